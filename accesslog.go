@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// accessLog records the proxied requests, nil when there is no access log
+var accessLog *accessLogger
+
+// accessLogger writes a line per proxied request in the format, json or
+// combined
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+// accessRecord is the line of a proxied request in the JSON format
+type accessRecord struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	RemoteAddr string  `json:"remote_addr"`
+	Caller     string  `json:"caller"`
+	Method     string  `json:"method"`
+	Target     string  `json:"target"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Session    string  `json:"session,omitempty"`
+	Proxy      string  `json:"proxy,omitempty"`
+	Code       string  `json:"code,omitempty"`
+}
+
+// proxiedRequest is what the access log records of a request that only the
+// handler knows, the target and the caller
+type proxiedRequest struct {
+	mu             sync.Mutex
+	target, caller string
+}
+
+type proxiedRequestKey struct{}
+
+// noteProxied records the target of the request for the access log, and the
+// caller its credentials identify
+func noteProxied(r *fhttp.Request, target string) {
+	if p, ok := r.Context().Value(proxiedRequestKey{}).(*proxiedRequest); ok {
+		p.mu.Lock()
+		p.target, p.caller = target, requestCaller(r)
+		p.mu.Unlock()
+	}
+}
+
+// withProxied returns the context the handler notes the target of the request
+// in for the access log
+func withProxied(ctx context.Context) context.Context {
+	return context.WithValue(ctx, proxiedRequestKey{}, &proxiedRequest{})
+}
+
+// openAccessLog opens the access log of the settings, nil when there is none
+func openAccessLog() (*accessLogger, error) {
+	path := getEnv("TLS_ACCESS_LOG", "")
+	if path == "" {
+		return nil, nil
+	}
+	file, err := openRotatingFile(
+		path,
+		int64(getEnvInt("TLS_ACCESS_LOG_MAX_SIZE", 100))<<20,
+		getEnvSeconds("TLS_ACCESS_LOG_ROTATE_INTERVAL", 0),
+		getEnvInt("TLS_ACCESS_LOG_KEEP", 7),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newAccessLogger(file, getEnv("TLS_ACCESS_LOG_FORMAT", "json"))
+}
+
+func newAccessLogger(out io.Writer, format string) (*accessLogger, error) {
+	switch format = strings.ToLower(format); format {
+	case "json", "combined":
+		return &accessLogger{out: out, format: format}, nil
+	}
+	return nil, fmt.Errorf("invalid TLS_ACCESS_LOG_FORMAT: '%s' is not json or combined", format)
+}
+
+// log writes the line of a request served from start, the ones not proxied
+// are left out
+func (l *accessLogger) log(r *fhttp.Request, header fhttp.Header, start time.Time, status int, bytes int64) {
+	p, ok := r.Context().Value(proxiedRequestKey{}).(*proxiedRequest)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	target, caller := p.target, p.caller
+	p.mu.Unlock()
+	if target == "" {
+		return
+	}
+
+	rec := accessRecord{
+		Time:       start.Format(time.RFC3339Nano),
+		RequestID:  header.Get(requestIDHeaderName),
+		RemoteAddr: r.RemoteAddr,
+		Caller:     caller,
+		Method:     r.Method,
+		Target:     target,
+		Status:     status,
+		Bytes:      bytes,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Session:    header.Get(sessionIDHeaderName),
+		Proxy:      header.Get(proxyUsedHeaderName),
+		Code:       header.Get(errorHeaderName),
+	}
+	var line []byte
+	if l.format == "json" {
+		line, _ = json.Marshal(rec)
+	} else {
+		line = combinedLine(r, start, rec)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// combinedLine formats the record in the combined log format, the caller as
+// the user, with the duration in seconds, the session and the request ID
+// appended
+func combinedLine(r *fhttp.Request, start time.Time, rec accessRecord) []byte {
+	host, _, err := net.SplitHostPort(rec.RemoteAddr)
+	if err != nil {
+		host = rec.RemoteAddr
+	}
+	return fmt.Appendf(nil, `%s - %s [%s] "%s %s %s" %d %d %q %q %.3f %q %q`,
+		orDash(host), orDash(rec.Caller), start.Format("02/Jan/2006:15:04:05 -0700"),
+		rec.Method, rec.Target, r.Proto, rec.Status, rec.Bytes,
+		orDash(r.Referer()), orDash(r.UserAgent()), rec.DurationMs/1000, orDash(rec.Session),
+		orDash(rec.RequestID),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// rotatingFile is a log file moved aside once it grows past a size, or gets
+// older than an interval, keeping a number of the files moved aside
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, keep int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	full := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	old := f.interval > 0 && time.Since(f.opened) >= f.interval
+	if full || old {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside with the time in its name, opens a new one and
+// removes the oldest of the ones moved aside beyond keep
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	rotated := f.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(f.path, rotated); err != nil {
+		// Keep writing to the file rather than losing the lines
+		slog.Warn("Error rotating the access log", "error", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	if f.keep <= 0 {
+		return nil
+	}
+	old, _ := filepath.Glob(f.path + ".*")
+	// The names sort by the time they were moved aside
+	sort.Strings(old)
+	for len(old) > f.keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
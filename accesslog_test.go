@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines go to a new file once the current one would grow past the size
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		f.Write([]byte(line))
+		time.Sleep(2 * time.Millisecond)
+	}
+	current, _ := os.ReadFile(path)
+	assert.Equal(t, "fourth\n", string(current))
+	rotated, _ := filepath.Glob(path + ".*")
+	if assert.Len(t, rotated, 2) {
+		second, _ := os.ReadFile(rotated[0])
+		assert.Equal(t, "second\n", string(second))
+	}
+
+	// And once it gets older than the interval
+	f, err = openRotatingFile(path, 0, 10*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	time.Sleep(20 * time.Millisecond)
+	f.Write([]byte("sixth\n"))
+	current, _ = os.ReadFile(path)
+	assert.Equal(t, "sixth\n", string(current))
+	rotated, _ = filepath.Glob(path + ".*")
+	assert.Len(t, rotated, 3)
+}
+
+func TestAccessLog(t *testing.T) {
+	defer func() { accessLog = nil }()
+	var out bytes.Buffer
+	accessLog, _ = newAccessLogger(&out, "json")
+
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	send := func(h http.Handler) {
+		r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "192.0.2.1:50000"
+		r.Header.Set("x-tls-url", url)
+		r.Header.Set("x-tls-buffer", "1")
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		observeRequests(h).ServeHTTP(w, r)
+	}
+	send(http.HandlerFunc(HandleReq))
+	// Requests that were not proxied are left out
+	send(http.HandlerFunc(HandleIsAlive))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 1) {
+		var rec accessRecord
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+		assert.Len(t, rec.RequestID, 16)
+		assert.Equal(t, "192.0.2.1:50000", rec.RemoteAddr)
+		assert.Equal(t, "ip:192.0.2.1", rec.Caller)
+		assert.Equal(t, http.MethodGet, rec.Method)
+		assert.Equal(t, url, rec.Target)
+		assert.Equal(t, http.StatusOK, rec.Status)
+		assert.Equal(t, int64(2), rec.Bytes)
+	}
+
+	out.Reset()
+	accessLog, _ = newAccessLogger(&out, "combined")
+	send(http.HandlerFunc(HandleReq))
+	assert.Regexp(t, `^192\.0\.2\.1 - ip:192\.0\.2\.1 \[[^]]+\] "GET `+url+` HTTP/1\.1" 200 2 "-" "-" \d+\.\d{3} "-" "[0-9a-f]{16}"\n$`, out.String())
+
+	_, err := newAccessLogger(&out, "common")
+	assert.Error(t, err)
+}
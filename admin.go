@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// adminAddr is the admin address the operator endpoints are served on, none
+// when empty. A bare port listens on localhost only. TLS_PPROF_ADDR, its name
+// from when it served the profiling endpoints only, is still read.
+var adminAddr = getEnv("TLS_ADMIN_ADDR", getEnv("TLS_PPROF_ADDR", ""))
+
+// adminAPIs are the APIs for operators by their path, which are served on the
+// admin address. On the addresses of the callers they refuse what is for
+// operators only, see adminOnly.
+var adminAPIs = map[string]fhttp.HandlerFunc{
+	"/metrics":           HandleMetrics,
+	"/api/profiles":      HandleProfiles,
+	"/api/proxies":       HandleProxies,
+	"/api/exits":         HandleExits,
+	"/api/config/reload": HandleReload,
+	"/api/sessions":      HandleSessions,
+	"/api/sessions/":     HandleSessions,
+}
+
+// adminKey is the context key marking the requests that came in on the admin
+// address
+type adminKey struct{}
+
+// adminOnly reports whether the request came in on the admin address, and
+// answers it with a 404 otherwise
+func adminOnly(w fhttp.ResponseWriter, r *fhttp.Request) bool {
+	if admin, _ := r.Context().Value(adminKey{}).(bool); admin {
+		return true
+	}
+	writeError(w, fhttp.StatusNotFound, fmt.Errorf("%s is served on the admin address (TLS_ADMIN_ADDR)", r.URL.Path))
+	return false
+}
+
+// adminHandler serves the operator endpoints: the admin APIs and the profiling
+// endpoints
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	for path, h := range adminAPIs {
+		mux.Handle(path, adminAPI(h))
+	}
+	handlePprof(mux)
+	return mux
+}
+
+// adminAPI serves an API of the server, written against fhttp like the rest of
+// it, on the net/http admin server
+func adminAPI(h fhttp.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &fhttp.Request{
+			Method:        r.Method,
+			URL:           r.URL,
+			Proto:         r.Proto,
+			ProtoMajor:    r.ProtoMajor,
+			ProtoMinor:    r.ProtoMinor,
+			Header:        fhttp.Header(r.Header),
+			Body:          r.Body,
+			ContentLength: r.ContentLength,
+			Host:          r.Host,
+			RemoteAddr:    r.RemoteAddr,
+			RequestURI:    r.RequestURI,
+		}
+		h(adminResponseWriter{w}, req.WithContext(context.WithValue(r.Context(), adminKey{}, true)))
+	})
+}
+
+// adminResponseWriter is a net/http response writer as an fhttp one, the
+// headers are the same map
+type adminResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w adminResponseWriter) Header() fhttp.Header {
+	return fhttp.Header(w.ResponseWriter.Header())
+}
+
+// listenAdmin listens on the admin address, apart from the callers, and
+// returns the function serving the operator endpoints on it. They are served
+// without the checks of the callers, so the address is best kept private.
+func listenAdmin(addr string) (net.Listener, func() error, error) {
+	if !strings.Contains(addr, ":") {
+		addr = "localhost:" + addr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// No write timeout, CPU profiles and traces take as long as asked for
+	server := &http.Server{Handler: adminHandler(), ReadHeaderTimeout: 10 * time.Second}
+	return l, func() error { return server.Serve(l) }, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	stdhttp "net/http"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// asAdmin returns the request as if it came in on the admin address
+func asAdmin(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminKey{}, true))
+}
+
+func TestAdminAPIs(t *testing.T) {
+	defer delete(adminAPIs, "/api/test")
+	adminAPIs["/api/test"] = func(w http.ResponseWriter, r *http.Request) {
+		if !adminOnly(w, r) {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("x-test", "admin")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + " " + string(body)))
+	}
+
+	l, serve, err := listenAdmin("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve()
+
+	// The APIs get the method and the body of the request
+	res, err := stdhttp.Post("http://"+l.Addr().String()+"/api/test", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, stdhttp.StatusCreated, res.StatusCode)
+	assert.Equal(t, "admin", res.Header.Get("x-test"))
+	assert.Equal(t, "POST body", string(body))
+
+	// Callers are refused what is for operators only
+	r, _ := http.NewRequest(http.MethodPost, "/api/test", strings.NewReader("body"))
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	adminAPIs["/api/test"](w, r)
+	assert.Equal(t, http.StatusNotFound, w.statusCode)
+	assert.Contains(t, w.body.String(), "admin address")
+}
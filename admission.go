@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// requestAdmission admits the requests served at once, nil for no limit
+var requestAdmission = newSetting[*admission](nil)
+
+var (
+	errQueueFull    = errors.New("too many requests waiting to be served")
+	errQueueTimeout = errors.New("timed out waiting to be served")
+)
+
+// admission serves up to a number of requests at once. The ones beyond it wait
+// in a bounded queue for a turn, up to a timeout, the ones beyond the queue are
+// turned away right away.
+type admission struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	queued   atomic.Int64
+}
+
+func newAdmission(maxInFlight, maxQueue int, timeout time.Duration) *admission {
+	return &admission{slots: make(chan struct{}, maxInFlight), maxQueue: int64(maxQueue), timeout: timeout}
+}
+
+// same reports whether the admission has the limits
+func (a *admission) same(maxInFlight, maxQueue int, timeout time.Duration) bool {
+	return cap(a.slots) == maxInFlight && a.maxQueue == int64(maxQueue) && a.timeout == timeout
+}
+
+// admit waits for the turn of a request, and returns the function ending it.
+// done is closed when the caller goes away.
+func (a *admission) admit(done <-chan struct{}) (func(), error) {
+	release := func() { <-a.slots }
+	select {
+	case a.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if a.queued.Add(1) > a.maxQueue {
+		a.queued.Add(-1)
+		return nil, errQueueFull
+	}
+	defer a.queued.Add(-1)
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errQueueTimeout
+	case <-done:
+		return nil, errQueueTimeout
+	}
+}
+
+// loadAdmission returns the admission of the limits, the current one when
+// they did not change so its requests are still counted
+func loadAdmission(maxInFlight, maxQueue int, timeout time.Duration) (*admission, error) {
+	switch {
+	case maxInFlight <= 0:
+		return nil, nil
+	case maxQueue < 0:
+		return nil, fmt.Errorf("TLS_MAX_QUEUE must not be negative")
+	case timeout <= 0 && maxQueue > 0:
+		return nil, fmt.Errorf("TLS_QUEUE_TIMEOUT must be at least a second")
+	}
+	if current := requestAdmission.get(); current != nil && current.same(maxInFlight, maxQueue, timeout) {
+		return current, nil
+	}
+	return newAdmission(maxInFlight, maxQueue, timeout), nil
+}
+
+// limitInFlight serves the handler to as many requests at once as the
+// admission lets through, answering the ones it turns away with 503
+func limitInFlight(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		a := requestAdmission.get()
+		if a == nil || openPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		release, err := a.admit(r.Context().Done())
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			w.Header().Set("Retry-After", "1")
+			writeFailure(w, r, fhttp.StatusServiceUnavailable, errOverloaded, err)
+			return
+		}
+		defer release()
+		h.ServeHTTP(w, r)
+	})
+}
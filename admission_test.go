@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(1, 1, 100*time.Millisecond)
+	release, err := a.admit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One request waits for the turn, the ones beyond the queue are turned away
+	admitted := make(chan error, 1)
+	go func() {
+		next, err := a.admit(nil)
+		if err == nil {
+			next()
+		}
+		admitted <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, err = a.admit(nil)
+	assert.ErrorIs(t, err, errQueueFull)
+	release()
+	assert.NoError(t, <-admitted)
+
+	// Waiting requests time out
+	release, _ = a.admit(nil)
+	start := time.Now()
+	_, err = a.admit(nil)
+	assert.ErrorIs(t, err, errQueueTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	release()
+	assert.Zero(t, a.queued.Load())
+}
+
+func TestLoadAdmission(t *testing.T) {
+	defer requestAdmission.set(nil)
+
+	a, err := loadAdmission(0, 100, 10*time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+
+	a, err = loadAdmission(10, 100, 10*time.Second)
+	assert.NoError(t, err)
+	requestAdmission.set(a)
+	// Unchanged limits keep counting the requests in flight
+	same, _ := loadAdmission(10, 100, 10*time.Second)
+	assert.Same(t, a, same)
+	other, _ := loadAdmission(20, 100, 10*time.Second)
+	assert.NotSame(t, a, other)
+
+	_, err = loadAdmission(10, -1, time.Second)
+	assert.Error(t, err)
+	_, err = loadAdmission(10, 1, 0)
+	assert.Error(t, err)
+}
+
+func TestLimitInFlight(t *testing.T) {
+	requestAdmission.set(newAdmission(2, 0, time.Second))
+	defer requestAdmission.set(nil)
+
+	started, finish := make(chan struct{}, 2), make(chan struct{})
+	handler := limitInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-finish
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(path string) *mockResponseWriter {
+		r, err := http.NewRequest(http.MethodGet, path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, send("/slow").statusCode)
+		}()
+	}
+	<-started
+	<-started
+
+	// Without a queue requests beyond the limit are shed right away
+	w := send("/")
+	assert.Equal(t, http.StatusServiceUnavailable, w.statusCode)
+	assert.Equal(t, string(errOverloaded), w.Header().Get(errorHeaderName))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("/isalive").statusCode)
+
+	close(finish)
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, send("/").statusCode)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+)
+
+// HandleProfiles serves the browser profile API. Callers list the profiles,
+// registering them is left to operators on the admin address.
+func HandleProfiles(w fhttp.ResponseWriter, r *fhttp.Request) {
+	switch r.Method {
+	case fhttp.MethodGet:
+		writeJSON(w, fhttp.StatusOK, browser.All())
+	case fhttp.MethodPost:
+		if !adminOnly(w, r) {
+			return
+		}
+		registerProfile(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// registerProfile registers a new profile or replaces an existing one with the
+// same name. Requests can start using it right away via the browser header.
+func registerProfile(w fhttp.ResponseWriter, r *fhttp.Request) {
+	var p browser.Profile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, fhttp.StatusBadRequest, fmt.Errorf("invalid profile: %w", err))
+		return
+	}
+
+	_, exists := browser.Get(p.Name)
+	if err := browser.Register(&p); err != nil {
+		writeError(w, fhttp.StatusBadRequest, err)
+		return
+	}
+
+	status := fhttp.StatusCreated
+	if exists {
+		status = fhttp.StatusOK
+	}
+	slog.Info("Registered browser profile", "profile", p.Name)
+	writeJSON(w, status, p)
+}
+
+func writeJSON(w fhttp.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing JSON response", "error", err)
+	}
+}
+
+func writeError(w fhttp.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
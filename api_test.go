@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProfile(t *testing.T) {
+	body := `{"name": "custom1", "navigator": "chrome", "headers": [["user-agent", "custom-agent"]]}`
+
+	r, err := http.NewRequest(http.MethodPost, "/api/profiles", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProfiles(w, r)
+	assert.Equal(t, http.StatusNotFound, w.statusCode)
+	_, ok := browser.Get("custom1")
+	assert.False(t, ok)
+
+	r, _ = http.NewRequest(http.MethodPost, "/api/profiles", strings.NewReader(body))
+	w = NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProfiles(w, asAdmin(r))
+	assert.Equal(t, http.StatusCreated, w.statusCode)
+
+	p, ok := browser.Get("custom1")
+	assert.True(t, ok)
+	assert.Equal(t, "custom-agent", p.Headers.Get("user-agent"))
+
+	// registering the same name again updates the profile
+	r, _ = http.NewRequest(http.MethodPost, "/api/profiles", strings.NewReader(body))
+	w = NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProfiles(w, asAdmin(r))
+	assert.Equal(t, http.StatusOK, w.statusCode)
+}
+
+func TestRegisterInvalidProfile(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "/api/profiles", strings.NewReader(`{"name": "empty"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProfiles(w, asAdmin(r))
+
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+	assert.Contains(t, w.body.String(), "has no headers")
+}
+
+func TestListProfiles(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "/api/profiles", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProfiles(w, r)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+
+	var profiles []browser.Profile
+	if err = json.Unmarshal(w.body.Bytes(), &profiles); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default is an alias of the latest profile
+	var names []string
+	for _, p := range profiles {
+		names = append(names, p.Name)
+		names = append(names, p.Aliases...)
+	}
+	assert.Contains(t, names, browser.DefaultProfile)
+}
+
+func TestFingerprint(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"http_version": "HTTP/1.1", "user_agent": "` + r.UserAgent() + `", "tls": {"ja4": "t13d1516h2"}}`))
+	}))
+	defer echo.Close()
+
+	defaultURL := fingerprintURL
+	fingerprintURL = echo.URL
+	defer func() { fingerprintURL = defaultURL }()
+
+	r, err := http.NewRequest(http.MethodGet, "/api/fingerprint?browser=chrome124", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleFingerprint(w, r)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+
+	var report fingerprintReport
+	if err = json.Unmarshal(w.body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "chrome124", report.Browser)
+	assert.Equal(t, "t13d1516h2", report.Ja4)
+	assert.Contains(t, report.UserAgent, "Chrome/124")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// apiKeyHeaderName is the header callers send their API key in, unless they
+// send it as a bearer token
+const apiKeyHeaderName = "x-api-key"
+
+var (
+	// apiKeys are the hashes of the keys callers authenticate with, none when
+	// the server serves anyone
+	apiKeys = newSetting[[][sha256.Size]byte](nil)
+	// basicCredentials are the hashes of the "user:pass" pairs callers
+	// authenticate with using Basic auth
+	basicCredentials = newSetting[[][sha256.Size]byte](nil)
+)
+
+// openPaths are the paths served to any caller, for health checks
+var openPaths = map[string]bool{"/isalive": true}
+
+// callerKey is the context key of the caller the credentials of a request
+// identify
+type callerKey struct{}
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+// parseAPIKeys parses comma separated keys into their hashes, which compare in
+// constant time whatever their length
+func parseAPIKeys(value string) [][sha256.Size]byte {
+	var keys [][sha256.Size]byte
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, sha256.Sum256([]byte(key)))
+		}
+	}
+	return keys
+}
+
+// parseBasicCredentials parses comma separated "user:pass" pairs into their
+// hashes
+func parseBasicCredentials(value string) ([][sha256.Size]byte, error) {
+	var credentials [][sha256.Size]byte
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		if user, _, ok := strings.Cut(pair, ":"); !ok || user == "" {
+			return nil, fmt.Errorf("invalid TLS_BASIC_AUTH: '%s' is not user:pass", strings.SplitN(pair, ":", 2)[0])
+		}
+		credentials = append(credentials, sha256.Sum256([]byte(pair)))
+	}
+	return credentials, nil
+}
+
+// loadAuth reads the credentials callers authenticate with, the rules for the
+// IPs they come from and the origins browsers may call from, and returns the
+// function applying them
+func loadAuth() (func(), error) {
+	keys := parseAPIKeys(getEnv("TLS_API_KEYS", ""))
+	credentials, err := parseBasicCredentials(getEnv("TLS_BASIC_AUTH", ""))
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseIPRules(getEnv("TLS_ALLOW_IPS", ""), getEnv("TLS_DENY_IPS", ""))
+	if err != nil {
+		return nil, err
+	}
+	cors, err := parseCORSPolicy(getEnv("TLS_CORS_ORIGINS", ""), getEnvInt("TLS_CORS_MAX_AGE", 600))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		apiKeys.set(keys)
+		basicCredentials.set(credentials)
+		callerIPRules.set(rules)
+		corsOrigins.set(cors)
+	}, nil
+}
+
+// requireAuth answers requests without valid credentials with 401 before they
+// reach the handler, which gets the caller they identify in the context
+func requireAuth(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		if openPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if caller, ok := authenticate(r); ok {
+			if caller != "" {
+				r = r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(apiKeys.get()) > 0 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="tls-impersonator"`)
+		}
+		if len(basicCredentials.get()) > 0 {
+			w.Header().Add("WWW-Authenticate", `Basic realm="tls-impersonator"`)
+		}
+		writeFailure(w, r, fhttp.StatusUnauthorized, errUnauthorized, errUnauthenticated)
+	})
+}
+
+// authenticate reports whether the request brings a valid API key, in the API
+// key header or as a bearer token, or valid Basic auth credentials, which
+// clients configured with a proxy URL send in Proxy-Authorization, and returns
+// the caller they identify: "key:" and the start of the hash of the key, or
+// "user:" and the user. The header the credentials came in is removed, so they
+// are not sent upstream; the others are left for the upstream.
+func authenticate(r *fhttp.Request) (string, bool) {
+	keys, credentials := apiKeys.get(), basicCredentials.get()
+	if len(keys) == 0 && len(credentials) == 0 {
+		return "", true
+	}
+
+	if key := r.Header.Get(apiKeyHeaderName); key != "" && validAPIKey(keys, key) {
+		r.Header.Del(apiKeyHeaderName)
+		return keyCaller(key), true
+	}
+	for _, header := range []string{"Authorization", "Proxy-Authorization"} {
+		scheme, value, _ := strings.Cut(r.Header.Get(header), " ")
+		value = strings.TrimSpace(value)
+		var caller string
+		switch {
+		case strings.EqualFold(scheme, "Bearer") && validAPIKey(keys, value):
+			caller = keyCaller(value)
+		case strings.EqualFold(scheme, "Basic") && validBasicCredentials(credentials, value):
+			pair, _ := base64.StdEncoding.DecodeString(value)
+			user, _, _ := strings.Cut(string(pair), ":")
+			caller = "user:" + user
+		default:
+			continue
+		}
+		r.Header.Del(header)
+		return caller, true
+	}
+	return "", false
+}
+
+// keyCaller is the caller an API key identifies, without telling the key
+func keyCaller(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:6])
+}
+
+// validBasicCredentials reports whether the base64 encoded "user:pass" pair
+// is one of credentials
+func validBasicCredentials(credentials [][sha256.Size]byte, encoded string) bool {
+	pair, err := base64.StdEncoding.DecodeString(encoded)
+	return err == nil && validAPIKey(credentials, string(pair))
+}
+
+// validAPIKey reports whether the key is one of keys, comparing it against all
+// of them so the time taken tells nothing. Basic auth credentials are checked
+// the same way.
+func validAPIKey(keys [][sha256.Size]byte, key string) bool {
+	sum := sha256.Sum256([]byte(key))
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare(k[:], sum[:])
+	}
+	return valid == 1
+}
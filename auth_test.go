@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// authenticatedRequest sends a request with the headers through requireAuth,
+// and returns the response and the headers the handler got, nil when it was
+// not reached
+func authenticatedRequest(t *testing.T, path string, headers map[string]string) (*mockResponseWriter, http.Header) {
+	var forwarded http.Header
+	handler := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	r, err := http.NewRequest(http.MethodGet, path, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	handler.ServeHTTP(w, r)
+	return w, forwarded
+}
+
+func TestRequireAuth(t *testing.T) {
+	apiKeys.set(parseAPIKeys("first-key, second-key"))
+	defer apiKeys.set(nil)
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		// kept is the header left for the upstream
+		kept string
+	}{
+		{name: "API key header", path: "/", headers: map[string]string{"x-api-key": "second-key"}, status: http.StatusOK},
+		{name: "bearer token", path: "/", headers: map[string]string{"Authorization": "Bearer first-key"}, status: http.StatusOK},
+		{
+			name:    "bearer token and the upstream's API key",
+			path:    "/",
+			headers: map[string]string{"Authorization": "Bearer first-key", "x-api-key": "upstream-key"},
+			status:  http.StatusOK,
+			kept:    "X-Api-Key",
+		},
+		{
+			name:    "API key and the upstream's authorization",
+			path:    "/",
+			headers: map[string]string{"x-api-key": "first-key", "Authorization": "Basic dXNlcjpwYXNz"},
+			status:  http.StatusOK,
+			kept:    "Authorization",
+		},
+		{name: "invalid key", path: "/", headers: map[string]string{"x-api-key": "first"}, status: http.StatusUnauthorized},
+		{name: "no key", path: "/api/sessions", status: http.StatusUnauthorized},
+		{name: "health check", path: "/isalive", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, forwarded := authenticatedRequest(t, tt.path, tt.headers)
+			assert.Equal(t, tt.status, w.statusCode)
+			if tt.status != http.StatusOK {
+				assert.Nil(t, forwarded)
+				assert.Equal(t, string(errUnauthorized), w.Header().Get(errorHeaderName))
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+				return
+			}
+			// Only the header the key came in is removed
+			for name := range tt.headers {
+				if http.CanonicalHeaderKey(name) == tt.kept {
+					assert.NotEmpty(t, forwarded.Get(name), name)
+				} else {
+					assert.Empty(t, forwarded.Get(name), name)
+				}
+			}
+		})
+	}
+
+	// Without keys anyone is served
+	apiKeys.set(nil)
+	w, _ := authenticatedRequest(t, "/", nil)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+}
+
+func TestBasicAuth(t *testing.T) {
+	credentials, err := parseBasicCredentials("scraper:s3cret:with:colons, other:pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	basicCredentials.set(credentials)
+	defer basicCredentials.set(nil)
+	basic := func(pair string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(pair))
+	}
+
+	// Credentials from a URL come in Authorization, or Proxy-Authorization from
+	// clients configured with the server as their proxy
+	w, forwarded := authenticatedRequest(t, "/", map[string]string{"Authorization": basic("scraper:s3cret:with:colons")})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Empty(t, forwarded.Get("Authorization"))
+	r, _ := http.NewRequest(http.MethodGet, "/", http.NoBody)
+	r.Header.Set("Authorization", basic("scraper:s3cret:with:colons"))
+	caller, ok := authenticate(r)
+	assert.True(t, ok)
+	assert.Equal(t, "user:scraper", caller)
+	w, _ = authenticatedRequest(t, "/", map[string]string{"Proxy-Authorization": basic("other:pass")})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+
+	w, forwarded = authenticatedRequest(t, "/", map[string]string{"Authorization": basic("other:wrong")})
+	assert.Equal(t, http.StatusUnauthorized, w.statusCode)
+	assert.Nil(t, forwarded)
+	assert.Equal(t, []string{`Basic realm="tls-impersonator"`}, w.Header().Values("WWW-Authenticate"))
+	w, _ = authenticatedRequest(t, "/", map[string]string{"Authorization": "Basic not base64"})
+	assert.Equal(t, http.StatusUnauthorized, w.statusCode)
+
+	// API keys are taken alongside
+	apiKeys.set(parseAPIKeys("key"))
+	defer apiKeys.set(nil)
+	w, _ = authenticatedRequest(t, "/", map[string]string{"x-api-key": "key"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	r, _ = http.NewRequest(http.MethodGet, "/", http.NoBody)
+	r.Header.Set("x-api-key", "key")
+	caller, _ = authenticate(r)
+	assert.Equal(t, keyCaller("key"), caller)
+	assert.NotContains(t, caller, "key:key")
+	w, _ = authenticatedRequest(t, "/", nil)
+	assert.Len(t, w.Header().Values("WWW-Authenticate"), 2)
+
+	_, err = parseBasicCredentials("scraper")
+	assert.Error(t, err)
+	_, err = parseBasicCredentials(":pass")
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// maxRequestBody is how many bytes a request body can have at most, 0 for no
+// limit
+var maxRequestBody = newSetting(int64(0))
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// bodyLimitKey is the context key of the limited body of a request
+type bodyLimitKey struct{}
+
+// requestBody cuts the body of a request at the limit, and records whether it
+// went over it
+type requestBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, errBodyTooLarge) {
+		b.exceeded.Store(true)
+		err = errRequestBodyTooLarge
+	}
+	return n, err
+}
+
+// limitRequestBody answers requests with a body over the limit with 413.
+// Bodies of an unknown length are cut once they go over it, failing the
+// request to the upstream, see requestBodyTooLarge.
+func limitRequestBody(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		limit := maxRequestBody.get()
+		if limit <= 0 || r.Body == nil || r.Body == fhttp.NoBody {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			// The rest of the body is not read, the connection cannot be reused
+			w.Header().Set("Connection", "close")
+			writeFailure(w, r, fhttp.StatusRequestEntityTooLarge, errRequestTooLarge,
+				fmt.Errorf("%w: %d bytes, at most %d", errRequestBodyTooLarge, r.ContentLength, limit))
+			return
+		}
+
+		body := &requestBody{ReadCloser: limitBody(r.Body, limit)}
+		r.Body = body
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), bodyLimitKey{}, body)))
+	})
+}
+
+// requestBodyTooLarge reports whether the body of the request went over the
+// limit, whatever error sending it upstream failed with
+func requestBodyTooLarge(r *fhttp.Request) bool {
+	body, ok := r.Context().Value(bodyLimitKey{}).(*requestBody)
+	return ok && body.exceeded.Load()
+}
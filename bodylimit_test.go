@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// bodyRequest proxies a POST with the body to url through the body limit.
+// Bodies of unknown length are sent without a Content-Length.
+func bodyRequest(t *testing.T, url string, body io.Reader, length int64) *mockResponseWriter {
+	r, err := http.NewRequest(http.MethodPost, "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ContentLength = length
+	r.Header.Set("x-tls-url", url)
+
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	limitRequestBody(http.HandlerFunc(HandleReq)).ServeHTTP(w, r)
+	return w
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	defer maxRequestBody.set(0)
+	maxRequestBody.set(10)
+
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+	}))
+	defer upstream.Close()
+
+	// Bodies within the limit are sent as they are
+	w := bodyRequest(t, upstream.URL, strings.NewReader("0123456789"), 10)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	w = bodyRequest(t, upstream.URL, strings.NewReader("0123456789"), -1)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, []string{"0123456789", "0123456789"}, received)
+
+	// Larger ones are turned away before reaching the upstream
+	w = bodyRequest(t, upstream.URL, strings.NewReader("0123456789a"), 11)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.statusCode)
+	assert.Equal(t, string(errRequestTooLarge), w.headers.Get(errorHeaderName))
+	assert.Len(t, received, 2)
+
+	// Ones of unknown length are cut once they go over
+	w = bodyRequest(t, upstream.URL, io.MultiReader(strings.NewReader("0123456789"), strings.NewReader("more")), -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.statusCode)
+	assert.Equal(t, string(errRequestTooLarge), w.headers.Get(errorHeaderName))
+}
+
+func TestRequestBodyLimitOff(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	limitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	})).ServeHTTP(w, r)
+	assert.Equal(t, "0123456789", string(body))
+}
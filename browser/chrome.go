@@ -4,8 +4,28 @@ import (
 	"github.com/Noooste/azuretls-client"
 )
 
+// ChromeHTTP2 is the HTTP/2 fingerprint of every Chrome build with a built-in
+// profile, the SETTINGS, WINDOW_UPDATE and pseudo header order have not changed
+// since Chrome 106
+const ChromeHTTP2 = "1:65536,2:0,4:6291456,6:262144|15663105|0|m,a,s,p"
+
 // TODO: update default browser headers
 var (
+	Chrome131 = azuretls.OrderedHeaders{
+		{"sec-ch-ua", `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`},
+		{"sec-ch-ua-mobile", "?0"},
+		{"sec-ch-ua-platform", `"Windows"`},
+		{"upgrade-insecure-requests", "1"},
+		{"user-agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"},
+		{"accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"},
+		{"sec-fetch-site", "none"},
+		{"sec-fetch-mode", "navigate"},
+		{"sec-fetch-user", "?1"},
+		{"sec-fetch-dest", "document"},
+		{"accept-encoding", "gzip, deflate, br, zstd"},
+		{"accept-language", "en-US,en;q=0.9"},
+		{"priority", "u=0, i"},
+	}
 	Chrome126 = azuretls.OrderedHeaders{
 		{"sec-ch-ua", `"Not/A)Brand";v="8", "Chromium";v="126", "Google Chrome";v="126"`},
 		{"sec-ch-ua-mobile", "?0"},
@@ -0,0 +1,199 @@
+package browser
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+)
+
+// ModifyClientHello makes every handshake of the session run fn over the
+// ClientHello spec the session would have used otherwise
+func ModifyClientHello(s *azuretls.Session, fn func(spec *tls.ClientHelloSpec)) {
+	getSpec := s.GetClientHelloSpec
+	s.GetClientHelloSpec = func() *tls.ClientHelloSpec {
+		spec := getSpec()
+		if spec != nil {
+			fn(spec)
+		}
+		return spec
+	}
+}
+
+// PostQuantum adds or removes the X25519Kyber768 hybrid key share and the
+// matching supported group. Modern Chrome sends it by default, while some
+// legacy middleboxes fail on the larger ClientHello.
+func PostQuantum(enabled bool) func(spec *tls.ClientHelloSpec) {
+	isKyber := func(c tls.CurveID) bool {
+		return c == tls.X25519Kyber768Draft00 || c == tls.X25519Kyber768Draft00Old
+	}
+
+	return func(spec *tls.ClientHelloSpec) {
+		for _, ext := range spec.Extensions {
+			switch e := ext.(type) {
+			case *tls.KeyShareExtension:
+				e.KeyShares = slices.DeleteFunc(e.KeyShares, func(k tls.KeyShare) bool {
+					return isKyber(k.Group)
+				})
+				if enabled {
+					e.KeyShares = slices.Insert(e.KeyShares, afterGrease(len(e.KeyShares), func(i int) bool {
+						return isGrease(uint16(e.KeyShares[i].Group))
+					}), tls.KeyShare{Group: tls.X25519Kyber768Draft00})
+				}
+
+			case *tls.SupportedCurvesExtension:
+				e.Curves = slices.DeleteFunc(e.Curves, isKyber)
+				if enabled {
+					e.Curves = slices.Insert(e.Curves, afterGrease(len(e.Curves), func(i int) bool {
+						return isGrease(uint16(e.Curves[i]))
+					}), tls.X25519Kyber768Draft00)
+				}
+			}
+		}
+	}
+}
+
+// GreaseECH adds or removes the GREASE Encrypted Client Hello extension Chrome
+// sends to origins it has no ECH config for. Real ECH needs support from the
+// TLS library and is not available.
+func GreaseECH(enabled bool) func(spec *tls.ClientHelloSpec) {
+	return func(spec *tls.ClientHelloSpec) {
+		spec.Extensions = slices.DeleteFunc(spec.Extensions, func(ext tls.TLSExtension) bool {
+			_, ok := ext.(tls.EncryptedClientHelloExtension)
+			return ok
+		})
+		if !enabled {
+			return
+		}
+
+		// Keep the trailing GREASE and padding extensions last
+		i := len(spec.Extensions)
+		for i > 0 {
+			switch spec.Extensions[i-1].(type) {
+			case *tls.UtlsGREASEExtension, *tls.UtlsPaddingExtension:
+				i--
+				continue
+			}
+			break
+		}
+		spec.Extensions = slices.Insert(spec.Extensions, i, tls.TLSExtension(tls.BoringGREASEECH()))
+	}
+}
+
+// ParseTLSVersion parses a TLS version like "1.2", "tls1.3" or "TLSv1.3"
+func ParseTLSVersion(version string) (uint16, error) {
+	v := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(version), "tls"), "v")
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version '%s'", version)
+	}
+}
+
+// TLSVersions limits the TLS versions offered in the ClientHello to the given
+// range. A zero bound keeps the one of the spec.
+func TLSVersions(min, max uint16) func(spec *tls.ClientHelloSpec) {
+	return func(spec *tls.ClientHelloSpec) {
+		vMin, vMax := spec.TLSVersMin, spec.TLSVersMax
+		for _, ext := range spec.Extensions {
+			if e, ok := ext.(*tls.SupportedVersionsExtension); ok {
+				e.Versions = slices.DeleteFunc(e.Versions, func(v uint16) bool {
+					return !isGrease(v) && ((min != 0 && v < min) || (max != 0 && v > max))
+				})
+
+				// uTLS needs both bounds once one of them is set
+				for _, v := range e.Versions {
+					if isGrease(v) {
+						continue
+					}
+					if vMin == 0 || v < vMin {
+						vMin = v
+					}
+					if v > vMax {
+						vMax = v
+					}
+				}
+			}
+		}
+
+		if min != 0 {
+			vMin = min
+		}
+		if max != 0 {
+			vMax = max
+		}
+		if vMin == 0 {
+			vMin = tls.VersionTLS10
+		}
+		if vMax == 0 {
+			vMax = tls.VersionTLS13
+		}
+		spec.TLSVersMin, spec.TLSVersMax = vMin, vMax
+	}
+}
+
+// ALPN replaces the protocols offered in the ALPN extension, so the upstream
+// protocol can be forced. ALPS is only kept for protocols that are still offered.
+func ALPN(protocols []string) func(spec *tls.ClientHelloSpec) {
+	return func(spec *tls.ClientHelloSpec) {
+		spec.Extensions = slices.DeleteFunc(spec.Extensions, func(ext tls.TLSExtension) bool {
+			switch e := ext.(type) {
+			case *tls.ALPNExtension:
+				e.AlpnProtocols = slices.Clone(protocols)
+			case *tls.ApplicationSettingsExtension:
+				e.SupportedProtocols = slices.DeleteFunc(e.SupportedProtocols, func(p string) bool {
+					return !slices.Contains(protocols, p)
+				})
+				return len(e.SupportedProtocols) == 0
+			}
+			return false
+		})
+	}
+}
+
+// ParseALPN parses a comma separated, ordered ALPN protocol list. Only the
+// protocols the upstream transports can speak are accepted.
+func ParseALPN(value string) ([]string, error) {
+	var protocols []string
+	for _, p := range strings.Split(value, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch p {
+		case "h2", "http/1.1":
+			if !slices.Contains(protocols, p) {
+				protocols = append(protocols, p)
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("unsupported ALPN protocol '%s'", p)
+		}
+	}
+
+	if len(protocols) == 0 {
+		return nil, errors.New("empty ALPN protocol list")
+	}
+
+	return protocols, nil
+}
+
+// afterGrease returns the index right after a leading GREASE value, which is
+// where Chrome places its preferred group
+func afterGrease(n int, grease func(i int) bool) int {
+	if n > 0 && grease(0) {
+		return 1
+	}
+	return 0
+}
+
+func isGrease(v uint16) bool {
+	return v == tls.GREASE_PLACEHOLDER || (v&0x0f0f == 0x0a0a && v>>8 == v&0xff)
+}
@@ -0,0 +1,237 @@
+package browser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Noooste/azuretls-client"
+)
+
+// DefaultProfile is used whenever a request does not ask for a specific browser
+const DefaultProfile = "chrome-latest"
+
+// Profile holds everything needed to impersonate a specific browser build: the
+// default header order, the TLS ClientHello (as a JA3 string) and the HTTP/2
+// fingerprint. Empty JA3/HTTP2 values fall back to the azuretls defaults of the
+// navigator.
+type Profile struct {
+	Name      string                  `json:"name"`
+	Aliases   []string                `json:"aliases,omitempty"`
+	Navigator string                  `json:"navigator"`
+	Headers   azuretls.OrderedHeaders `json:"headers"`
+	JA3       string                  `json:"ja3,omitempty"`
+	HTTP2     string                  `json:"http2,omitempty"`
+
+	// PostQuantum forces the hybrid post-quantum key share on or off; unset keeps
+	// whatever the ClientHello of the profile sends
+	PostQuantum *bool `json:"post_quantum,omitempty"`
+	// GreaseECH forces the GREASE ECH extension on or off
+	GreaseECH *bool `json:"grease_ech,omitempty"`
+}
+
+var (
+	mu       sync.RWMutex
+	profiles = map[string]*Profile{}
+	aliases  = map[string]string{}
+)
+
+// The built-in Chrome profiles each pin the TLS and HTTP/2 fingerprints of
+// their build, on top of the Chrome ClientHello azuretls ships with. Chrome 124
+// turned the X25519Kyber768 key share on by default, 120 still goes without it.
+// 131 moved on to X25519MLKEM768, which the TLS library does not support yet:
+// chrome131 sends the Kyber one of 124 to 130 instead, so its ClientHello is
+// not the one of Chrome 131 and chrome-latest stays on chrome126 until it is.
+func init() {
+	on, off := true, false
+	builtin := []*Profile{
+		{Name: "chrome131", Headers: Chrome131, PostQuantum: &on},
+		{Name: "chrome126", Aliases: []string{"chrome-latest"}, Headers: Chrome126, PostQuantum: &on},
+		{Name: "chrome124", Headers: Chrome124, PostQuantum: &on},
+		{Name: "chrome120", Headers: Chrome120, PostQuantum: &off},
+	}
+
+	for _, p := range builtin {
+		p.Navigator = azuretls.Chrome
+		p.HTTP2 = ChromeHTTP2
+		profiles[p.Name] = p
+		for _, alias := range p.Aliases {
+			aliases[alias] = p.Name
+		}
+	}
+}
+
+// Apply configures the session to use the profile's fingerprint
+func (p *Profile) Apply(s *azuretls.Session) error {
+	navigator := p.Navigator
+	if navigator == "" {
+		navigator = azuretls.Chrome
+	}
+	s.Browser = navigator
+
+	if p.JA3 != "" {
+		if err := s.ApplyJa3(p.JA3, navigator); err != nil {
+			return fmt.Errorf("profile '%s': invalid ja3: %w", p.Name, err)
+		}
+	}
+
+	if p.HTTP2 != "" {
+		if err := s.ApplyHTTP2(p.HTTP2); err != nil {
+			return fmt.Errorf("profile '%s': invalid http2 fingerprint: %w", p.Name, err)
+		}
+	}
+
+	if p.PostQuantum != nil {
+		ModifyClientHello(s, PostQuantum(*p.PostQuantum))
+	}
+
+	if p.GreaseECH != nil {
+		ModifyClientHello(s, GreaseECH(*p.GreaseECH))
+	}
+
+	if ua := p.Headers.Get("user-agent"); ua != "" {
+		s.UserAgent = ua
+	}
+
+	return nil
+}
+
+// Validate checks that the profile is complete and that its fingerprints can
+// be applied to a session
+func (p *Profile) Validate() error {
+	if p.Name == "" {
+		return errors.New("profile has no name")
+	}
+	if len(p.Headers) == 0 {
+		return fmt.Errorf("profile '%s' has no headers", p.Name)
+	}
+	for _, h := range p.Headers {
+		if len(h) < 2 {
+			return fmt.Errorf("profile '%s' has a header without a value", p.Name)
+		}
+	}
+	for _, alias := range p.Aliases {
+		if alias == "" || alias == p.Name {
+			return fmt.Errorf("profile '%s' has an invalid alias '%s'", p.Name, alias)
+		}
+	}
+
+	s := azuretls.NewSession()
+	defer s.Close()
+
+	return p.Apply(s)
+}
+
+// Register validates the profile and adds it to the available profiles,
+// replacing any existing profile with the same name. Aliases of the profile are
+// pointed at it, even if they belonged to another profile before.
+func Register(p *Profile) error {
+	p.Name = strings.ToLower(p.Name)
+	for i, alias := range p.Aliases {
+		p.Aliases[i] = strings.ToLower(alias)
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	profiles[p.Name] = p
+	for _, alias := range p.Aliases {
+		if previous, ok := profiles[aliases[alias]]; ok && previous != p {
+			// Profiles handed out by Get are never modified; replace it with a copy instead
+			updated := *previous
+			updated.Aliases = slices.DeleteFunc(slices.Clone(previous.Aliases), func(a string) bool {
+				return a == alias
+			})
+			profiles[updated.Name] = &updated
+		}
+		aliases[alias] = p.Name
+	}
+
+	return nil
+}
+
+// Get returns the profile registered under the given name or alias
+func Get(name string) (*Profile, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	name = strings.ToLower(name)
+	if p, ok := profiles[name]; ok {
+		return p, true
+	}
+
+	p, ok := profiles[aliases[name]]
+	return p, ok
+}
+
+// Names returns the names of all registered profiles, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// All returns all registered profiles, sorted by name
+func All() []*Profile {
+	names := Names()
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	all := make([]*Profile, 0, len(names))
+	for _, name := range names {
+		if p, ok := profiles[name]; ok {
+			all = append(all, p)
+		}
+	}
+
+	return all
+}
+
+// LoadDir registers every *.json profile definition found in dir and returns
+// the names of the loaded profiles
+func LoadDir(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return loaded, err
+		}
+
+		var p Profile
+		if err = json.Unmarshal(data, &p); err != nil {
+			return loaded, fmt.Errorf("%s: %w", f, err)
+		}
+		if p.Name == "" {
+			p.Name = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+
+		if err = Register(&p); err != nil {
+			return loaded, fmt.Errorf("%s: %w", f, err)
+		}
+		loaded = append(loaded, p.Name)
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,193 @@
+package browser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	profile := `{
+		"name": "Chrome999",
+		"navigator": "chrome",
+		"headers": [["user-agent", "test-agent"], ["accept", "*/*"]],
+		"http2": "1:65536,2:0,4:6291456,6:262144|15663105|0|m,a,s,p"
+	}`
+	if err := os.WriteFile(filepath.Join(dir, "chrome999.json"), []byte(profile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"chrome999"}, loaded)
+
+	p, ok := Get("CHROME999")
+	assert.True(t, ok)
+	assert.Equal(t, "test-agent", p.Headers.Get("user-agent"))
+}
+
+func TestLoadDirInvalidProfile(t *testing.T) {
+	dir := t.TempDir()
+	profile := `{"name": "broken", "headers": [["accept", "*/*"]], "ja3": "not-a-ja3"}`
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte(profile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadDir(dir)
+	assert.Error(t, err)
+
+	_, ok := Get("broken")
+	assert.False(t, ok)
+}
+
+func TestLatestAlias(t *testing.T) {
+	latest, ok := Get("chrome-latest")
+	assert.True(t, ok)
+	// chrome131 does not send the key share of Chrome 131
+	assert.Equal(t, "chrome126", latest.Name)
+
+	err := Register(&Profile{
+		Name:    "chrome132",
+		Aliases: []string{"Chrome-Latest"},
+		Headers: Chrome131,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Register(latest)
+
+	latest, _ = Get("chrome-latest")
+	assert.Equal(t, "chrome132", latest.Name)
+
+	previous, _ := Get("chrome126")
+	assert.Empty(t, previous.Aliases)
+}
+
+func hasKyber(spec *tls.ClientHelloSpec) bool {
+	for _, ext := range spec.Extensions {
+		if ks, ok := ext.(*tls.KeyShareExtension); ok {
+			for _, k := range ks.KeyShares {
+				if k.Group == tls.X25519Kyber768Draft00 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestBuiltinFingerprints(t *testing.T) {
+	for name, kyber := range map[string]bool{
+		"chrome131": true,
+		"chrome126": true,
+		"chrome124": true,
+		"chrome120": false,
+	} {
+		p, ok := Get(name)
+		if !assert.True(t, ok, name) {
+			continue
+		}
+		assert.Equal(t, ChromeHTTP2, p.HTTP2, name)
+
+		s := azuretls.NewSession()
+		if err := p.Apply(s); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, kyber, hasKyber(s.GetClientHelloSpec()), name)
+		s.Close()
+	}
+}
+
+func TestPostQuantum(t *testing.T) {
+	disabled := false
+	s := azuretls.NewSession()
+	defer s.Close()
+	if err := (&Profile{Name: "pq-off", Headers: Chrome131, PostQuantum: &disabled}).Apply(s); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hasKyber(s.GetClientHelloSpec()))
+
+	ModifyClientHello(s, PostQuantum(true))
+	spec := s.GetClientHelloSpec()
+	assert.True(t, hasKyber(spec))
+
+	for _, ext := range spec.Extensions {
+		if ks, ok := ext.(*tls.KeyShareExtension); ok {
+			assert.Equal(t, tls.X25519Kyber768Draft00, ks.KeyShares[1].Group)
+		}
+	}
+}
+
+func TestGreaseECH(t *testing.T) {
+	countECH := func(spec *tls.ClientHelloSpec) (n int) {
+		for _, ext := range spec.Extensions {
+			if _, ok := ext.(tls.EncryptedClientHelloExtension); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	s := azuretls.NewSession()
+	defer s.Close()
+
+	ModifyClientHello(s, GreaseECH(false))
+	assert.Equal(t, 0, countECH(s.GetClientHelloSpec()))
+
+	ModifyClientHello(s, GreaseECH(true))
+	spec := s.GetClientHelloSpec()
+	assert.Equal(t, 1, countECH(spec))
+	assert.IsType(t, &tls.UtlsPaddingExtension{}, spec.Extensions[len(spec.Extensions)-1])
+}
+
+func TestTLSVersions(t *testing.T) {
+	v, err := ParseTLSVersion("TLSv1.2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+
+	_, err = ParseTLSVersion("1.4")
+	assert.Error(t, err)
+
+	s := azuretls.NewSession()
+	defer s.Close()
+
+	ModifyClientHello(s, TLSVersions(tls.VersionTLS13, 0))
+	spec := s.GetClientHelloSpec()
+	assert.Equal(t, uint16(tls.VersionTLS13), spec.TLSVersMin)
+
+	for _, ext := range spec.Extensions {
+		if e, ok := ext.(*tls.SupportedVersionsExtension); ok {
+			assert.NotContains(t, e.Versions, uint16(tls.VersionTLS12))
+			assert.Contains(t, e.Versions, uint16(tls.VersionTLS13))
+		}
+	}
+}
+
+func TestALPN(t *testing.T) {
+	protocols, err := ParseALPN("http/1.1, h2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http/1.1", "h2"}, protocols)
+
+	_, err = ParseALPN("h3")
+	assert.Error(t, err)
+
+	s := azuretls.NewSession()
+	defer s.Close()
+
+	ModifyClientHello(s, ALPN([]string{"http/1.1"}))
+	for _, ext := range s.GetClientHelloSpec().Extensions {
+		switch e := ext.(type) {
+		case *tls.ALPNExtension:
+			assert.Equal(t, []string{"http/1.1"}, e.AlpnProtocols)
+		case *tls.ApplicationSettingsExtension:
+			t.Error("ALPS should be dropped without h2")
+		}
+	}
+}
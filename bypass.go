@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// proxyBypass are the targets requests go to directly, ignoring their proxy
+var proxyBypass = parseNoProxy(getEnv("TLS_NO_PROXY", getEnv("NO_PROXY", os.Getenv("no_proxy"))))
+
+// bypassRule matches targets by domain, IP or CIDR, and optionally port
+type bypassRule struct {
+	// domain matches the host and its subdomains, or only its subdomains when
+	// it starts with a dot
+	domain string
+	ipNet  *net.IPNet
+	ip     net.IP
+	port   string
+	all    bool
+}
+
+// parseNoProxy parses comma separated bypass rules with the usual NO_PROXY
+// semantics: '*', 'example.com' (and its subdomains), '.example.com' (only the
+// subdomains), IPs and CIDRs, each with an optional ':port'
+func parseNoProxy(value string) []bypassRule {
+	var rules []bypassRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return []bypassRule{{all: true}}
+		}
+
+		var rule bypassRule
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			rule.ipNet = ipNet
+			rules = append(rules, rule)
+			continue
+		}
+
+		host := entry
+		if h, port, err := net.SplitHostPort(entry); err == nil {
+			host, rule.port = h, port
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			rule.ip = ip
+		} else {
+			rule.domain = strings.TrimPrefix(host, "*")
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// bypassesProxy reports whether requests to the host "scheme://host:port" go
+// directly instead of through their proxy
+func bypassesProxy(target string) bool {
+	if len(proxyBypass) == 0 {
+		return false
+	}
+
+	_, hostport, _ := strings.Cut(target, "://")
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+
+	for _, rule := range proxyBypass {
+		switch {
+		case rule.all:
+			return true
+		case rule.port != "" && rule.port != port:
+			continue
+		case rule.ipNet != nil:
+			if ip != nil && rule.ipNet.Contains(ip) {
+				return true
+			}
+		case rule.ip != nil:
+			if rule.ip.Equal(ip) {
+				return true
+			}
+		case strings.HasPrefix(rule.domain, "."):
+			if strings.HasSuffix(host, rule.domain) {
+				return true
+			}
+		default:
+			if host == rule.domain || strings.HasSuffix(host, "."+rule.domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// parseProxyChain parses comma separated proxies that connections go through one
+// after the other, the last one being the exit. It returns nil for a single
+// proxy. Every hop has to be an HTTP or SOCKS5 proxy.
+func parseProxyChain(proxies string) ([]*url.URL, error) {
+	if !strings.Contains(proxies, ",") {
+		return nil, nil
+	}
+
+	var chain []*url.URL
+	for _, proxy := range strings.Split(proxies, ",") {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, errors.New("every proxy of a chain needs to be a URL")
+		}
+		switch u.Scheme {
+		case "http", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme '%s' in a chain", u.Scheme)
+		}
+		chain = append(chain, u)
+	}
+	return chain, nil
+}
+
+// dialChain connects to the first proxy of the chain and tunnels through each
+// of them to the next one, and from the last one to addr. The address the exit
+// bound for the connection is returned if it is a SOCKS5 proxy.
+func dialChain(ctx context.Context, dialer *net.Dialer, chain []*url.URL, addr, userAgent string, family ipFamily) (net.Conn, net.Addr, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(chain[0].String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Bound the handshakes with the proxies by the dial timeout as well
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var bound net.Addr
+	for i, hop := range chain {
+		target := addr
+		if i+1 < len(chain) {
+			target = proxyAddr(chain[i+1].String())
+		}
+
+		bound = nil
+		if hop.Scheme == "http" {
+			err = connectTunnel(conn, hop, target, userAgent)
+		} else {
+			bound, err = socksTunnel(ctx, conn, hop, target, family)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("proxy chain hop %d (%s): %w", i+1, hop.Redacted(), err)
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+// connectTunnel asks the HTTP proxy conn is connected to for a tunnel to addr
+func connectTunnel(conn net.Conn, proxyURL *url.URL, addr, userAgent string) error {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n", addr, addr, userAgent)
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return err
+	}
+
+	// The proxy sends nothing past its response until the tunnel is used
+	res, err := fhttp.ReadResponse(bufio.NewReader(conn), &fhttp.Request{Method: fhttp.MethodConnect})
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != fhttp.StatusOK {
+		return fmt.Errorf("proxy error : %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	// compressResponses gzips the decoded bodies sent back to callers accepting it
+	compressResponses = isTrue(getEnv("TLS_COMPRESS_RESPONSES", "1"))
+
+	compressBodyHeaderName = getEnv("TLS_COMPRESS_BODY", "x-tls-compress-body")
+)
+
+// acceptsGzip reports whether the Accept-Encoding of the caller takes gzip
+func acceptsGzip(value string) bool {
+	for _, part := range strings.Split(value, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		if name, v, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// gzipsResponse reports whether the body of the response is gzipped for the
+// caller, and sets the headers saying so. Bodies kept encoded as the upstream
+// sent them are not, nor are ranges of a body the Content-Range counts the
+// bytes of. 304 responses describe the body the caller has, gzipped by the
+// server, and get the same headers but the encoding.
+func gzipsResponse(w fhttp.ResponseWriter, r *fhttp.Request, req *azuretls.Request, res *azuretls.Response, raw bool) bool {
+	if raw || !compressResponses || isHead(r, req) || res.StatusCode == fhttp.StatusPartialContent {
+		return false
+	}
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return false
+	}
+	if res.StatusCode == fhttp.StatusNotModified {
+		varyOnEncoding(w.Header())
+		w.Header().Del("Content-Length")
+		return false
+	}
+	if !bodyAllowed(res.StatusCode) {
+		return false
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	varyOnEncoding(w.Header())
+	w.Header().Del("Content-Length")
+	return true
+}
+
+// varyOnEncoding adds Accept-Encoding to the Vary of the response unless the
+// upstream listed it already
+func varyOnEncoding(header fhttp.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// gzipBytes returns the body gzipped
+func gzipBytes(body []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	gz.Close()
+	return buf.Bytes()
+}
+
+// gzipStream gzips a stream, flushing every write so the data reaches the
+// caller as it comes from the upstream
+type gzipStream struct {
+	*gzip.Writer
+}
+
+func (s gzipStream) Write(p []byte) (int, error) {
+	n, err := s.Writer.Write(p)
+	if err == nil {
+		err = s.Writer.Flush()
+	}
+	return n, err
+}
+
+// compressesBody reports whether the body of the caller's request is gzipped
+// on its way to the upstream. Bodies the caller encoded already are sent as
+// they are.
+func compressesBody(r *fhttp.Request) bool {
+	if r.Body == nil || r.Body == fhttp.NoBody || r.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return isTrue(r.Header.Get(compressBodyHeaderName))
+}
+
+// gzipBody returns the body gzipped as the transport reads it, so it is never
+// held in memory. The transport closing it stops the compression.
+func gzipBody(body io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the path of the configuration file, taken from the arguments
+// rather than the flags as the settings are read before the flags are parsed
+var configFile = configPath(os.Args[1:])
+
+// fileConfig are the settings of the configuration file by the env var they
+// stand in for, errFileConfig is why it could not be loaded, if so
+var fileConfig, errFileConfig = loadConfig(configFile)
+
+// configPath returns the path given with --config, TLS_CONFIG otherwise
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("TLS_CONFIG")
+}
+
+// loadConfig reads the YAML configuration file at path, none when it is empty.
+// Every setting is the env var of the same name, nested keys joined with
+// underscores and without the TLS_ prefix, so
+//
+//	upstream:
+//	  max_body: 1048576
+//
+// is TLS_UPSTREAM_MAX_BODY. Lists are joined with commas.
+func loadConfig(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	config := make(map[string]string)
+	if err := flattenConfig(config, "TLS", settings); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// flattenConfig adds the settings to config under their env var names, prefixed
+// with prefix. Top level keys may have the TLS_ prefix already.
+func flattenConfig(config map[string]string, prefix string, settings map[string]any) error {
+	for key, value := range settings {
+		name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+		if prefix != "TLS" || !strings.HasPrefix(name, "TLS_") {
+			name = prefix + "_" + name
+		}
+		switch value := value.(type) {
+		case map[string]any:
+			if err := flattenConfig(config, name, value); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				if _, nested := item.(map[string]any); nested {
+					return fmt.Errorf("'%s' lists settings, only values can be listed", key)
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			config[name] = strings.Join(items, ",")
+		case nil:
+			config[name] = ""
+		default:
+			config[name] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
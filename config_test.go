@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigPath(t *testing.T) {
+	t.Setenv("TLS_CONFIG", "env.yaml")
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--config", "a.yaml"}, "a.yaml"},
+		{[]string{"-config=b.yaml", "-profiles-dir", "profiles"}, "b.yaml"},
+		{[]string{"-profiles-dir", "config"}, "env.yaml"},
+		{[]string{"--", "--config", "c.yaml"}, "env.yaml"},
+		{nil, "env.yaml"},
+	} {
+		assert.Equal(t, tc.want, configPath(tc.args), tc.args)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+listen_addr: 127.0.0.1:8082
+TLS_URL: x-target-url
+default-browser: chrome126
+log_upstream: false
+proxies:
+  - http://proxy-1:8080
+  - http://proxy-2:8080
+upstream:
+  timeout: 10
+  max_body: 1048576
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"TLS_LISTEN_ADDR":       "127.0.0.1:8082",
+		"TLS_URL":               "x-target-url",
+		"TLS_DEFAULT_BROWSER":   "chrome126",
+		"TLS_LOG_UPSTREAM":      "false",
+		"TLS_PROXIES":           "http://proxy-1:8080,http://proxy-2:8080",
+		"TLS_UPSTREAM_TIMEOUT":  "10",
+		"TLS_UPSTREAM_MAX_BODY": "1048576",
+	}, config)
+
+	// Env vars take precedence over the file
+	defaultConfig := fileConfig
+	fileConfig = config
+	defer func() { fileConfig = defaultConfig }()
+	t.Setenv("TLS_URL", "x-env-url")
+	assert.Equal(t, "x-env-url", getEnv("TLS_URL", "x-tls-url"))
+	assert.Equal(t, "127.0.0.1:8082", getEnv("TLS_LISTEN_ADDR", ""))
+	assert.Equal(t, "fallback", getEnv("TLS_PORT", "fallback"))
+
+	_, err = loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+	os.WriteFile(path, []byte("proxies: [{url: http://proxy:8080}]"), 0o644)
+	_, err = loadConfig(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/url"
+
+	fhttp "github.com/Noooste/fhttp"
+	tls "github.com/Noooste/utls"
+)
+
+var (
+	connALPNHeaderName    = getEnv("TLS_CONN_ALPN", "x-tls-conn-alpn")
+	connVersionHeaderName = getEnv("TLS_CONN_VERSION", "x-tls-conn-version")
+	connCipherHeaderName  = getEnv("TLS_CONN_CIPHER", "x-tls-conn-cipher")
+	connIPHeaderName      = getEnv("TLS_CONN_IP", "x-tls-conn-ip")
+)
+
+// setConnHeaders tells the caller what the connection the last request of the
+// session to rawURL went over negotiated with the upstream, and the IP it was
+// dialed to. Connections through a proxy are dialed to the proxy, their IP is
+// not sent; plain ones negotiate nothing.
+func (s *pooledSession) setConnHeaders(w fhttp.ResponseWriter, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+	conn := s.Connections.Get(u)
+	if conn == nil || conn.Conn == nil {
+		return
+	}
+
+	if s.ProxyDialer == nil {
+		if ip := addrIP(conn.Conn.RemoteAddr()); ip.IsValid() {
+			w.Header().Set(connIPHeaderName, ip.String())
+		}
+	}
+	if conn.TLS == nil {
+		return
+	}
+	state := conn.TLS.ConnectionState()
+	if state.NegotiatedProtocol != "" {
+		w.Header().Set(connALPNHeaderName, state.NegotiatedProtocol)
+	}
+	w.Header().Set(connVersionHeaderName, tls.VersionName(state.Version))
+	w.Header().Set(connCipherHeaderName, tls.CipherSuiteName(state.CipherSuite))
+}
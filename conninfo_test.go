@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnHeaders(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL})
+	assert.Equal(t, "http/1.1", w.sent.Get("x-tls-conn-alpn"))
+	assert.Equal(t, "TLS 1.3", w.sent.Get("x-tls-conn-version"))
+	assert.Contains(t, w.sent.Get("x-tls-conn-cipher"), "TLS_")
+	assert.Equal(t, "127.0.0.1", w.sent.Get("x-tls-conn-ip"))
+
+	// HTTP proxies are connected to instead of the upstream
+	proxy, _ := connectProxy(t)
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-proxy": proxy})
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, "TLS 1.3", w.sent.Get("x-tls-conn-version"))
+	assert.Empty(t, w.sent.Get("x-tls-conn-ip"))
+
+	// plain connections negotiate nothing
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	w = proxyRequest(t, map[string]string{"x-tls-url": plain.URL})
+	assert.Equal(t, "127.0.0.1", w.sent.Get("x-tls-conn-ip"))
+	assert.Empty(t, w.sent.Get("x-tls-conn-version"))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var cookiesHeaderName = getEnv("TLS_COOKIES", "x-tls-cookies")
+
+// savedCookie is a cookie of a session jar along with the URL that set it, so it
+// can be set again on a fresh jar with the same domain and path rules
+type savedCookie struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+// cookie converts the saved cookie back for the jar
+func (c savedCookie) cookie() *fhttp.Cookie {
+	return &fhttp.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+}
+
+// sameCookie reports whether both cookies would end up in the same jar entry
+func (c savedCookie) sameCookie(o savedCookie) bool {
+	host := func(c savedCookie) string {
+		if c.Domain != "" {
+			return strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		}
+		u, _ := url.Parse(c.URL)
+		return strings.ToLower(u.Hostname())
+	}
+	return c.Name == o.Name && c.Path == o.Path && host(c) == host(o)
+}
+
+// expired reports whether the jar would have dropped the cookie by now
+func (c savedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// newSavedCookie converts a cookie set by rawURL for saving it
+func newSavedCookie(rawURL string, c *fhttp.Cookie, now time.Time) savedCookie {
+	saved := savedCookie{
+		URL:      rawURL,
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		Expires:  c.Expires,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+	// Max-Age takes precedence and is relative to now, which is lost on reload
+	if c.MaxAge > 0 {
+		saved.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	} else if c.MaxAge < 0 {
+		saved.Expires = now
+	}
+	return saved
+}
+
+// recordCookies keeps track of the cookies set on the jar of a pinned session,
+// replacing older values of the same cookies, so the jar can be saved or
+// exported later
+func (s *pooledSession) recordCookies(rawURL string, cookies []*fhttp.Cookie) {
+	now := time.Now()
+	saved := make([]savedCookie, 0, len(cookies))
+	for _, c := range cookies {
+		saved = append(saved, newSavedCookie(rawURL, c, now))
+	}
+	s.recordSavedCookies(saved)
+}
+
+// recordSavedCookies is recordCookies for cookies converted already
+func (s *pooledSession) recordSavedCookies(cookies []savedCookie) {
+	if s.id == "" || len(cookies) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, saved := range cookies {
+		kept := s.cookies[:0]
+		for _, old := range s.cookies {
+			if !old.sameCookie(saved) {
+				kept = append(kept, old)
+			}
+		}
+		s.cookies = kept
+		if !saved.expired(now) {
+			s.cookies = append(s.cookies, saved)
+		}
+	}
+	s.dirty = true
+}
+
+// setCookiesHeader returns the cookies the responses to the request set, the
+// ones of the redirects followed included, as JSON in the cookies header. They
+// are listed like in session exports, in the order they were set.
+func setCookiesHeader(w fhttp.ResponseWriter, cookies []savedCookie) {
+	if cookies == nil {
+		cookies = []savedCookie{}
+	}
+	encoded, _ := json.Marshal(cookies)
+	w.Header().Set(cookiesHeaderName, string(encoded))
+}
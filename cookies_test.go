@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordCookiesReplacesValues(t *testing.T) {
+	defaultStore := savedSessions
+	savedSessions = &fileStore{dir: t.TempDir()}
+	defer func() { savedSessions = defaultStore }()
+
+	s := &pooledSession{id: "record"}
+	s.recordCookies("https://example.com/a", []*http.Cookie{{Name: "a", Value: "1", Path: "/"}})
+	s.recordCookies("https://EXAMPLE.com/b", []*http.Cookie{{Name: "a", Value: "2", Path: "/"}})
+	s.recordCookies("https://example.com/", []*http.Cookie{{Name: "b", Value: "1", Expires: time.Unix(1, 0)}})
+
+	assert.Len(t, s.cookies, 1)
+	assert.Equal(t, "2", s.cookies[0].Value)
+}
+
+func TestCookiesHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/", HttpOnly: true})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+			http.SetCookie(w, &http.Cookie{Name: "seen", Value: "yes"})
+		}
+	}))
+	defer upstream.Close()
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/login", "x-tls-allowredirect": "1", "x-tls-cookies": "1"})
+	var cookies []savedCookie
+	assert.NoError(t, json.Unmarshal([]byte(w.sent.Get("x-tls-cookies")), &cookies))
+	if assert.Len(t, cookies, 2) {
+		assert.Equal(t, savedCookie{URL: upstream.URL + "/login", Name: "session", Value: "1", Path: "/", HttpOnly: true}, cookies[0])
+		assert.Equal(t, savedCookie{URL: upstream.URL + "/home", Name: "seen", Value: "yes"}, cookies[1])
+	}
+	// only the final response is forwarded, with its own cookies
+	assert.Len(t, w.sent.Values("Set-Cookie"), 1)
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/home", "x-tls-cookies": "1"})
+	assert.NoError(t, json.Unmarshal([]byte(w.sent.Get("x-tls-cookies")), &cookies))
+	assert.Len(t, cookies, 1)
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/home"})
+	assert.Empty(t, w.sent.Get("x-tls-cookies"))
+}
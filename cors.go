@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// corsPolicy are the origins browsers may call the server from
+type corsPolicy struct {
+	// any allows every origin
+	any     bool
+	origins map[string]bool
+	maxAge  int
+}
+
+// corsOrigins is the CORS policy of the server, none serving no browser
+// origin
+var corsOrigins = newSetting(corsPolicy{})
+
+// parseCORSPolicy parses the comma separated origins like
+// "http://localhost:3000", "*" allowing any, and how many seconds browsers
+// keep the preflight responses
+func parseCORSPolicy(origins string, maxAge int) (corsPolicy, error) {
+	policy := corsPolicy{origins: make(map[string]bool), maxAge: maxAge}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin == "" {
+			continue
+		}
+		if origin == "*" {
+			policy.any = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			return corsPolicy{}, fmt.Errorf("invalid TLS_CORS_ORIGINS: '%s' is not an origin like https://example.com", origin)
+		}
+		policy.origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return policy, nil
+}
+
+// allows reports whether browsers may call the server from the origin
+func (p corsPolicy) allows(origin string) bool {
+	return origin != "" && (p.any || p.origins[strings.ToLower(origin)])
+}
+
+// corsExposedHeaders are the headers of the server browsers let callers read,
+// besides those of the upstream
+func corsExposedHeaders() string {
+	return strings.Join([]string{
+		"*",
+		"Retry-After",
+		"WWW-Authenticate",
+		requestIDHeaderName,
+		errorHeaderName,
+		upstreamWarningHeaderName,
+		sessionIDHeaderName,
+		sessionStatsHeaderName,
+		proxyUsedHeaderName,
+		exitIPHeaderName,
+		attemptsHeaderName,
+		hedgedHeaderName,
+		finalURLHeaderName,
+		redirectCountHeaderName,
+		timingHeaderName,
+		cookiesHeaderName,
+		connIPHeaderName,
+		connALPNHeaderName,
+		connVersionHeaderName,
+		connCipherHeaderName,
+	}, ", ")
+}
+
+// allowCORS lets browsers on the allowed origins call the server: preflight
+// requests are answered right away, allowing any method and headers as they
+// are forwarded upstream, and responses expose the x-tls headers. Requests of
+// other origins are served without CORS headers, which browsers refuse to
+// hand to the page.
+func allowCORS(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		policy := corsOrigins.get()
+		origin := r.Header.Get("Origin")
+		if !policy.any && len(policy.origins) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !policy.allows(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != fhttp.MethodOptions || method == "" {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders())
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", method)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		if policy.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+		}
+		w.WriteHeader(fhttp.StatusNoContent)
+	})
+}
+
+// ownCORSHeader reports whether name is a CORS header the server answers with
+// itself, which the one of the upstream would clash with
+func ownCORSHeader(w fhttp.ResponseWriter, name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "access-control-") && w.Header().Get("Access-Control-Allow-Origin") != ""
+}
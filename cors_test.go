@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCORSPolicy(t *testing.T) {
+	policy, err := parseCORSPolicy("http://localhost:3000, https://Dashboard.example/", 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, policy.allows("http://localhost:3000"))
+	assert.True(t, policy.allows("https://dashboard.example"))
+	assert.False(t, policy.allows("http://localhost:8080"))
+	assert.False(t, policy.allows(""))
+
+	policy, err = parseCORSPolicy("*", 0)
+	assert.NoError(t, err)
+	assert.True(t, policy.allows("https://anywhere.example"))
+
+	_, err = parseCORSPolicy("localhost:3000", 600)
+	assert.Error(t, err)
+	_, err = parseCORSPolicy("https://example.com/app", 600)
+	assert.Error(t, err)
+}
+
+func TestAllowCORS(t *testing.T) {
+	defer corsOrigins.set(corsPolicy{})
+	policy, _ := parseCORSPolicy("http://localhost:3000", 600)
+	corsOrigins.set(policy)
+
+	served := 0
+	send := func(method string, headers map[string]string) *mockResponseWriter {
+		r, err := http.NewRequest(method, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		allowCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served++
+			writeFailure(w, r, http.StatusUnauthorized, errUnauthorized, errUnauthenticated)
+		})).ServeHTTP(w, r)
+		return w
+	}
+
+	// Preflight requests are answered without reaching the handler
+	w := send(http.MethodOptions, map[string]string{
+		"Origin":                         "http://localhost:3000",
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "x-tls-url, x-api-key",
+	})
+	assert.Equal(t, http.StatusNoContent, w.statusCode)
+	assert.Equal(t, "http://localhost:3000", w.headers.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "PUT", w.headers.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "x-tls-url, x-api-key", w.headers.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.headers.Get("Access-Control-Max-Age"))
+	assert.Zero(t, served)
+
+	// Responses, failures included, expose the x-tls headers
+	w = send(http.MethodGet, map[string]string{"Origin": "http://localhost:3000"})
+	assert.Equal(t, http.StatusUnauthorized, w.statusCode)
+	assert.Equal(t, "http://localhost:3000", w.headers.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.headers.Get("Access-Control-Expose-Headers"), errorHeaderName)
+	assert.Contains(t, w.headers.Values("Vary"), "Origin")
+
+	// Other origins get no CORS headers
+	w = send(http.MethodOptions, map[string]string{
+		"Origin":                        "http://evil.example",
+		"Access-Control-Request-Method": "GET",
+	})
+	assert.Empty(t, w.headers.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, 2, served)
+}
+
+func TestUpstreamCORSHeaders(t *testing.T) {
+	defer corsOrigins.set(corsPolicy{})
+	policy, _ := parseCORSPolicy("*", 600)
+	corsOrigins.set(policy)
+
+	url := rawServer(t, "HTTP/1.1 200 OK\r\n"+
+		"Access-Control-Allow-Origin: https://target.example\r\n"+
+		"Content-Length: 2\r\n\r\nok")
+	r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Origin", "http://localhost:3000")
+	r.Header.Set("x-tls-url", url)
+	r.Header.Set("x-tls-buffer", "1")
+
+	// The upstream's own CORS headers would clash with the server's
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	allowCORS(http.HandlerFunc(HandleReq)).ServeHTTP(w, r)
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, []string{"*"}, w.headers.Values("Access-Control-Allow-Origin"))
+}
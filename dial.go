@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// ticketsPerKey bounds the TLS sessions remembered per session key, one per
+	// server name the sessions connected to
+	ticketsPerKey = 8
+	// maxTicketCaches bounds the session keys TLS sessions are remembered for
+	maxTicketCaches = 4096
+)
+
+// sessionResumption makes sessions resume TLS sessions on new connections like a
+// browser does, instead of doing a full handshake every time
+var sessionResumption = isTrue(getEnv("TLS_SESSION_RESUMPTION", "1"))
+
+// upstreamRootCAs verifies the certificates of the upstreams, nil uses the
+// system roots. Tests trust their own servers with it.
+var upstreamRootCAs *x509.CertPool
+
+// ticketCaches remembers the TLS session tickets per session key. They outlive
+// the sessions, so a fresh session for the same host, proxy and fingerprint
+// resumes where the previous one left off.
+var ticketCaches = struct {
+	sync.Mutex
+	caches map[sessionKey]tls.ClientSessionCache
+}{caches: map[sessionKey]tls.ClientSessionCache{}}
+
+// ticketCache returns the TLS session cache of the key
+func ticketCache(key sessionKey) tls.ClientSessionCache {
+	ticketCaches.Lock()
+	defer ticketCaches.Unlock()
+
+	cache, ok := ticketCaches.caches[key]
+	if !ok {
+		if len(ticketCaches.caches) >= maxTicketCaches {
+			// Make room by forgetting an arbitrary key, its sessions just do a full handshake again
+			for k := range ticketCaches.caches {
+				delete(ticketCaches.caches, k)
+				break
+			}
+		}
+		cache = tls.NewLRUClientSessionCache(ticketsPerKey)
+		ticketCaches.caches[key] = cache
+	}
+	return cache
+}
+
+// hookDialer makes the session open its TLS connections itself, with the ticket
+// cache of the key as azuretls does not keep session tickets, through the proxy
+// chain if it has one, and from the local address, with the IP family and to
+// the pinned IPs of the key. Exit IPs reported by SOCKS5 proxies are recorded in exits, the time
+// spent dialing in timing.
+func hookDialer(s *azuretls.Session, key sessionKey, chain []*url.URL, exits *connExits, timing *requestTiming) {
+	preHook := s.PreHookWithContext
+	s.PreHookWithContext = func(ctx *azuretls.Context) error {
+		var cache tls.ClientSessionCache
+		if sessionResumption {
+			// Pinned sessions can rotate their proxy, tickets are kept per proxy
+			if chain == nil {
+				key.proxy = s.Proxy
+			}
+			cache = ticketCache(key)
+		}
+
+		if err := dialTLS(s, ctx.Request, cache, key, chain, exits, timing); err != nil {
+			// azuretls would only go through the first proxy of the chain, or
+			// connect the way it likes, and dial timed out connections again
+			if chain != nil || key.localAddr != "" || key.ipFamily != ipFamilyAny || key.resolve != "" || isPhaseTimeout(err) {
+				return err
+			}
+			// azuretls dials the connection itself then, with a full handshake
+			slog.Warn("Error opening resumable TLS connection", "error", err)
+		}
+		if preHook != nil {
+			return preHook(ctx)
+		}
+		return nil
+	}
+}
+
+// dialTLS opens the connection for the request when azuretls would open a new one,
+// doing the handshake with the ClientHello of the session and the ticket cache
+func dialTLS(s *azuretls.Session, req *azuretls.Request, cache tls.ClientSessionCache, key sessionKey, chain []*url.URL, exits *connExits, timing *requestTiming) error {
+	local := key.localTCPAddr()
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return nil
+	}
+	if u.Scheme != "https" {
+		// azuretls dials plain connections itself, on every request
+		if chain != nil {
+			return fmt.Errorf("proxy chains only support https targets, not '%s'", req.Url)
+		}
+		// HTTP proxies are dialed with the bound dialer of the session
+		if local != nil && (s.ProxyDialer == nil || strings.HasPrefix(s.ProxyDialer.ProxyURL.Scheme, "socks")) {
+			return errLocalAddrUnbound
+		}
+		if key.ipFamily != ipFamilyAny && s.ProxyDialer == nil {
+			return errors.New("IP families only apply to https targets, or plain http ones through a proxy")
+		}
+		if key.pinnedAddr(u) != "" {
+			return errResolveUnpinned
+		}
+		return nil
+	}
+	// HTTPS proxies tunnel over HTTP/2 connections azuretls manages on its own
+	if s.ProxyDialer != nil && s.ProxyDialer.ProxyURL.Scheme == "https" {
+		if key.pinnedAddr(u) != "" {
+			return errResolveUnpinned
+		}
+		return nil
+	}
+
+	conn := s.Connections.Get(u)
+	if conn.Conn != nil && conn.TLS != nil && !connClosed(conn) {
+		return nil
+	}
+
+	timeout := req.TimeOut
+	if timeout == 0 {
+		timeout = s.TimeOut
+	}
+	parent := req.Context()
+	if parent == nil {
+		parent = s.Context()
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	ctx = httptrace.WithClientTrace(ctx, timing.dialTrace())
+
+	// The phases with a timeout of their own fail with it
+	phases := requestTimeouts(parent)
+	dialCtx, handshakeCtx := ctx, ctx
+	if phases.connect > 0 {
+		var cancelDial context.CancelFunc
+		dialCtx, cancelDial = context.WithTimeoutCause(ctx, phases.connect, errConnectTimeout)
+		defer cancelDial()
+	}
+	if phases.handshake > 0 {
+		var cancelHandshake context.CancelFunc
+		handshakeCtx, cancelHandshake = context.WithTimeoutCause(ctx, phases.handshake, errHandshakeTimeout)
+		defer cancelHandshake()
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	dialer := &net.Dialer{Timeout: timeout, LocalAddr: local}
+	// Pinned hosts are connected to at their IP, the server name stays the host
+	dialAddr := addr
+	if pinned := key.pinnedAddr(u); pinned != "" {
+		dialAddr = pinned
+	}
+
+	var raw net.Conn
+	var bound net.Addr
+	dns, dialStart := timing.dns, time.Now()
+	if chain != nil {
+		raw, bound, err = dialChain(dialCtx, dialer, chain, dialAddr, s.UserAgent, key.ipFamily)
+	} else if s.ProxyDialer != nil && strings.HasPrefix(s.ProxyDialer.ProxyURL.Scheme, "socks") {
+		raw, bound, err = dialSOCKS(dialCtx, dialer, s.ProxyDialer.ProxyURL, dialAddr, key.ipFamily)
+	} else if s.ProxyDialer != nil {
+		s.ProxyDialer.Dialer.Timeout = timeout
+		raw, err = s.ProxyDialer.DialContext(dialCtx, s.UserAgent, "tcp", dialAddr)
+	} else {
+		raw, err = key.ipFamily.dial(dialCtx, dialer, dialAddr)
+	}
+	if err != nil {
+		if context.Cause(dialCtx) == errConnectTimeout {
+			return fmt.Errorf("%w: %v", errConnectTimeout, err)
+		}
+		return err
+	}
+	timing.connect += time.Since(dialStart) - (timing.dns - dns)
+
+	uconn := tls.UClient(raw, &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		RootCAs:            upstreamRootCAs,
+		ClientSessionCache: cache,
+		OmitEmptyPsk:       true,
+	}, tls.HelloCustom)
+
+	spec := s.GetClientHelloSpec()
+	if spec == nil {
+		raw.Close()
+		return fmt.Errorf("no ClientHello spec for %s", addr)
+	}
+	if cache != nil {
+		spec = withPreSharedKey(spec)
+	}
+	if err = uconn.ApplyPreset(spec); err != nil {
+		raw.Close()
+		return fmt.Errorf("applying ClientHello spec: %w", err)
+	}
+	handshakeStart := time.Now()
+	if err = uconn.HandshakeContext(handshakeCtx); err != nil {
+		raw.Close()
+		if context.Cause(handshakeCtx) == errHandshakeTimeout {
+			return fmt.Errorf("%w: %v", errHandshakeTimeout, err)
+		}
+		return err
+	}
+	timing.tls += time.Since(handshakeStart)
+
+	// Replace the connection azuretls would otherwise dial again
+	conn.Close()
+	conn.Conn, conn.TLS = raw, uconn
+	exits.record(addr, raw, bound)
+
+	return nil
+}
+
+// socksDialer is the SOCKS5 dialer of x/net, which can tunnel over a connection
+// dialed already
+type socksDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
+
+// dialSOCKS tunnels to addr through a socks5:// or socks5h:// proxy. The
+// connection is returned as dialed, azuretls only reuses plain TCP connections,
+// along with the address the proxy bound for it.
+func dialSOCKS(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string, family ipFamily) (net.Conn, net.Addr, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxyURL.String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	bound, err := socksTunnel(ctx, conn, proxyURL, addr, family)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, bound, nil
+}
+
+// socksTunnel asks the SOCKS5 proxy conn is connected to for a tunnel to addr.
+// The hostname is resolved here for socks5, with an address of the family, and
+// by the proxy for socks5h. It returns the address the proxy bound the tunnel
+// to, which is the exit IP if the proxy tells.
+func socksTunnel(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string, family ipFamily) (net.Addr, error) {
+	if proxyURL.Scheme == "socks5" {
+		// Prefer IPv4 by default, the proxy might not reach IPv6 addresses
+		if family == ipFamilyAny {
+			family = ipFamilyPrefer4
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		ips, err := family.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ips[0].String(), port)
+	}
+
+	dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	socks, ok := dialer.(socksDialer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'", proxyURL.Scheme)
+	}
+	return socks.DialWithConn(ctx, conn, "tcp", addr)
+}
+
+// withPreSharedKey adds the TLS 1.3 pre_shared_key extension resumed sessions
+// are offered in. It has to be the last extension, and is left out of the hello
+// while there is no session to resume.
+func withPreSharedKey(spec *tls.ClientHelloSpec) *tls.ClientHelloSpec {
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(tls.PreSharedKeyExtension); ok {
+			return spec
+		}
+	}
+	spec.Extensions = append(spec.Extensions, &tls.UtlsPreSharedKeyExtension{})
+	return spec
+}
+
+// connClosed reports whether the connection was closed on our side, e.g. by the
+// HTTP/1.1 transport after a Connection: close response
+func connClosed(conn *azuretls.Conn) bool {
+	if conn.HTTP2 != nil {
+		return !conn.HTTP2.CanTakeNewRequest()
+	}
+	return conn.Conn.SetReadDeadline(time.Time{}) != nil
+}
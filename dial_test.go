@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// trustServer makes sessions verify the upstream against the certificate of
+// the test server
+func trustServer(t *testing.T, server *httptest.Server) {
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	defaultRoots := upstreamRootCAs
+	upstreamRootCAs = roots
+	t.Cleanup(func() { upstreamRootCAs = defaultRoots })
+}
+
+func TestResumeTLSSessions(t *testing.T) {
+	var resumed []bool
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resumed = append(resumed, r.TLS.DidResume)
+		// every request needs a new connection
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	headers := map[string]string{"x-tls-url": upstream.URL, "x-tls-alpn": "http/1.1"}
+	first := proxyRequest(t, headers)
+	second := proxyRequest(t, headers)
+
+	// a fresh session for the same key resumes as well
+	headers["x-tls-session-id"] = "resumed"
+	defer sessions.terminate("resumed")
+	third := proxyRequest(t, headers)
+
+	assert.Equal(t, "ok", first.body.String())
+	assert.Equal(t, "ok", second.body.String())
+	assert.Equal(t, "ok", third.body.String())
+	assert.Equal(t, []bool{false, true, true}, resumed)
+}
+
+// socksProxy starts a SOCKS5 proxy with username and password auth, which
+// tunnels every connection to target from 127.0.0.5 and records the addresses
+// asked for
+func socksProxy(t *testing.T, target string) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requested := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				read := func(n int) []byte {
+					buf := make([]byte, n)
+					io.ReadFull(r, buf)
+					return buf
+				}
+
+				// greeting, then RFC 1929 auth
+				read(int(read(2)[1]))
+				conn.Write([]byte{5, 2})
+				read(1)
+				user := string(read(int(read(1)[0])))
+				pass := string(read(int(read(1)[0])))
+				if user != "user" || pass != "pass" {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				var host string
+				switch header := read(4); header[3] {
+				case 1:
+					host = net.IP(read(4)).String()
+				case 3:
+					host = string(read(int(read(1)[0])))
+				case 4:
+					host = net.IP(read(16)).String()
+				}
+				port := read(2)
+				requested <- net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+				// the exit the proxy reports, as bound for the upstream connection
+				exit := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 5)}
+				upstream, err := (&net.Dialer{LocalAddr: exit}).Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				bound := upstream.LocalAddr().(*net.TCPAddr)
+				conn.Write(append([]byte{5, 0, 0, 1, 127, 0, 0, 5}, byte(bound.Port>>8), byte(bound.Port)))
+				go io.Copy(upstream, r)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), requested
+}
+
+func TestSOCKSProxy(t *testing.T) {
+	var connections atomic.Int32
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	addr, requested := socksProxy(t, upstream.Listener.Addr().String())
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	// socks5h leaves resolving the hostname to the proxy
+	headers := map[string]string{
+		"x-tls-url":   "https://example.com:" + port,
+		"x-tls-proxy": "socks5h://user:pass@" + addr,
+	}
+	assert.Equal(t, "ok", proxyRequest(t, headers).body.String())
+	assert.Equal(t, "ok", proxyRequest(t, headers).body.String())
+	assert.Equal(t, "example.com:"+port, <-requested)
+	assert.Equal(t, int32(1), connections.Load())
+
+	// socks5 resolves it before
+	proxyURL, _ := url.Parse("socks5://user:pass@" + addr)
+	conn, _, err := dialSOCKS(context.Background(), &net.Dialer{Timeout: time.Second}, proxyURL, "localhost:443", ipFamilyAny)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, "127.0.0.1:443", <-requested)
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+	_, _, err = dialSOCKS(context.Background(), &net.Dialer{Timeout: time.Second}, proxyURL, "localhost:443", ipFamilyAny)
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var downloadHeaderName = getEnv("TLS_DOWNLOAD", "x-tls-download")
+
+// downloadDir is the directory bodies are downloaded to, downloads are turned
+// off without one
+var downloadDir string
+
+// download is the body of the responses to requests which body was downloaded
+// to a file
+type download struct {
+	Status int    `json:"status"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Truncated tells the body was cut at the cap of x-tls-max-body
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// downloadPath returns where the body of the request is downloaded to, a path
+// relative to the download directory, or an empty string when it is forwarded
+func downloadPath(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if downloadDir == "" {
+		return "", errors.New("downloads are turned off, see -download-dir")
+	}
+	if !filepath.IsLocal(value) {
+		return "", fmt.Errorf("'%s' is not a path within the download directory", value)
+	}
+	return filepath.Join(downloadDir, value), nil
+}
+
+// fileWriter remembers the error writing to the file failed with, to tell it
+// from the ones reading the body
+type fileWriter struct {
+	file *os.File
+	err  error
+}
+
+func (f *fileWriter) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// saveDownload writes the body to the file at path and answers the caller with
+// where it went, its size and its SHA-256. The body is written next to the file
+// and renamed over it once complete, so the file is never left half written.
+// It returns how many bytes were read, and whether the body was read to its
+// end.
+func saveDownload(w fhttp.ResponseWriter, r *fhttp.Request, res *azuretls.Response, body io.ReadCloser, path string) (int64, bool) {
+	defer body.Close()
+
+	// A 304 tells the file downloaded before is still the one, it is kept
+	if !bodyAllowed(res.StatusCode) {
+		writeJSON(w, fhttp.StatusOK, download{Status: res.StatusCode, Path: path})
+		return 0, true
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		writeFailure(w, r, fhttp.StatusInternalServerError, errInternal, err)
+		return 0, true
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		writeFailure(w, r, fhttp.StatusInternalServerError, errInternal, err)
+		return 0, true
+	}
+	defer os.Remove(file.Name())
+
+	hash := sha256.New()
+	out := &fileWriter{file: file}
+	streamTimeout := parseStreamTimeout(r.Header.Get(streamTimeoutHeaderName))
+	idleTimeout := parseStreamTimeout(r.Header.Get(idleTimeoutHeaderName))
+	chunkSize := parseChunkSize(r.Header.Get(chunkSizeHeaderName))
+	size, err := copyStream(io.MultiWriter(out, hash), body, streamTimeout, idleTimeout, chunkSize)
+
+	// Bodies over the limit are cut at it and flagged, like forwarded ones
+	truncated := errors.Is(err, errBodyTooLarge)
+	if truncated {
+		slog.WarnContext(r.Context(), "Downloaded body cut", "size", size)
+		w.Header().Set(errorHeaderName, string(errBodyLimit))
+		err = nil
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		out.err, err = closeErr, closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+		out.err = err
+	}
+	if out.err != nil {
+		writeFailure(w, r, fhttp.StatusInternalServerError, errInternal, out.err)
+		return size, true
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "Caller went away, cancelled download", "path", path)
+			return size, true
+		}
+		setUpstreamWarning(w, err, false)
+		status, code := classifyFailure(err, false)
+		writeFailure(w, r, status, code, err)
+		return size, false
+	}
+
+	slog.InfoContext(r.Context(), "Downloaded response body", "path", path, "size", size)
+	writeJSON(w, fhttp.StatusOK, download{
+		Status:    res.StatusCode,
+		Path:      path,
+		Size:      size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		Truncated: truncated,
+	})
+	return size, true
+}
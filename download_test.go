@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	content := strings.Repeat("downloaded", 10000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-download": "file.bin"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode, "downloads are turned off by default")
+
+	defaultDir := downloadDir
+	downloadDir = t.TempDir()
+	defer func() { downloadDir = defaultDir }()
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-download": "files/file.bin"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "application/json", w.sent.Get("Content-Type"))
+
+	var got download
+	if err := json.Unmarshal(w.body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	path := filepath.Join(downloadDir, "files", "file.bin")
+	assert.Equal(t, download{Status: http.StatusOK, Path: path, Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}, got)
+	saved, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(saved))
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1, "no temporary file is left behind")
+
+	// Bodies over the cap are cut at it
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-download": "capped.bin", "x-tls-max-body": "100"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "ERR_BODY_LIMIT", w.sent.Get("x-tls-error"))
+	saved, _ = os.ReadFile(filepath.Join(downloadDir, "capped.bin"))
+	assert.Equal(t, content[:100], string(saved))
+
+	// Revalidated downloads keep the file
+	notModified := rawServer(t, "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\n")
+	w = proxyRequest(t, map[string]string{"x-tls-url": notModified, "x-tls-download": "files/file.bin", "If-None-Match": `"v1"`})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.JSONEq(t, `{"status":304,"path":"`+path+`","size":0}`, w.body.String())
+	saved, _ = os.ReadFile(path)
+	assert.Equal(t, content, string(saved))
+
+	for _, path := range []string{"../escape.bin", "/etc/escape.bin"} {
+		w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-download": path})
+		assert.Equal(t, http.StatusBadRequest, w.statusCode, path)
+	}
+}
+
+func TestDownloadBroken(t *testing.T) {
+	defaultDir := downloadDir
+	downloadDir = t.TempDir()
+	defer func() { downloadDir = defaultDir }()
+
+	body := strings.Repeat("resumable", 100)
+	url := brokenServer(t, body, make(chan string, 1))
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-download": "broken.bin"})
+	assert.Equal(t, http.StatusBadGateway, w.statusCode)
+	assert.Equal(t, "ERR_PREMATURE_CLOSE", w.sent.Get("x-tls-error"))
+	_, err := os.Stat(filepath.Join(downloadDir, "broken.bin"))
+	assert.True(t, os.IsNotExist(err), "half bodies are not kept")
+
+	// Resumed ones are complete
+	w = proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-download": "resumed.bin", "x-tls-resume": "1"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	saved, _ := os.ReadFile(filepath.Join(downloadDir, "resumed.bin"))
+	assert.Equal(t, body, string(saved))
+}
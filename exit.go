@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var exitIPHeaderName = getEnv("TLS_EXIT_IP", "x-tls-exit-ip")
+
+// connExits remembers the exit IPs SOCKS5 proxies reported for the connections
+// of a session, by the address they connect to. It is safe for concurrent use.
+type connExits struct {
+	mu     sync.Mutex
+	byAddr map[string]connExit
+}
+
+type connExit struct {
+	conn net.Conn
+	ip   string
+}
+
+// record keeps the address the proxy bound the connection to, unless the
+// proxy left it unspecified
+func (e *connExits) record(addr string, conn net.Conn, bound net.Addr) {
+	ip := addrIP(bound)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !ip.IsValid() || ip.IsUnspecified() {
+		delete(e.byAddr, addr)
+		return
+	}
+	if e.byAddr == nil {
+		e.byAddr = map[string]connExit{}
+	}
+	e.byAddr[addr] = connExit{conn: conn, ip: ip.String()}
+}
+
+// get returns the exit IP of the connection, if it was recorded
+func (e *connExits) get(addr string, conn net.Conn) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if exit, ok := e.byAddr[addr]; ok && exit.conn == conn {
+		return exit.ip
+	}
+	return ""
+}
+
+// exitIP returns the IP the last request of the session to rawURL left from,
+// when it can tell: the local address of direct connections, or what SOCKS5
+// proxies dialed by the session reported. HTTP proxies do not tell.
+func (s *pooledSession) exitIP(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	conn := s.Connections.Get(u)
+	if conn == nil || conn.Conn == nil {
+		return ""
+	}
+
+	if s.ProxyDialer == nil {
+		if ip := addrIP(conn.Conn.LocalAddr()); ip.IsValid() {
+			return ip.String()
+		}
+		return ""
+	}
+	if strings.HasPrefix(s.ProxyDialer.ProxyURL.Scheme, "socks") || strings.Contains(s.proxy(), ",") {
+		return s.exits.get(targetAddr(u), conn.Conn)
+	}
+	return ""
+}
+
+// targetAddr returns the host and port connections to u are dialed to
+func targetAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// addrIP returns the IP of a TCP address or of a SOCKS5 bound address, which
+// formats as one
+func addrIP(addr net.Addr) netip.Addr {
+	if addr == nil {
+		return netip.Addr{}
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap()
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitIP(t *testing.T) {
+	var remotes []string
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remotes = append(remotes, host)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	// direct connections leave from their local address
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-local-addr": "127.0.0.2"})
+	assert.Equal(t, "127.0.0.2", w.headers.Get("x-tls-exit-ip"))
+
+	// SOCKS5 proxies tell the address they bound
+	addr, _ := socksProxy(t, upstream.Listener.Addr().String())
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-proxy": "socks5://user:pass@" + addr})
+	assert.Equal(t, "127.0.0.5", w.headers.Get("x-tls-exit-ip"))
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.5"}, remotes)
+
+	// HTTP proxies do not
+	proxy, _ := connectProxy(t)
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-proxy": proxy})
+	assert.Equal(t, "ok", w.body.String())
+	assert.Empty(t, w.headers.Get("x-tls-exit-ip"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+
+	fhttp "github.com/Noooste/fhttp"
+	tls "github.com/Noooste/utls"
+)
+
+var errorHeaderName = getEnv("TLS_ERROR", "x-tls-error")
+
+// errorCode tells callers why a request failed, without parsing the message.
+// The codes are stable, new failures get new codes.
+type errorCode string
+
+const (
+	errBadRequest        errorCode = "ERR_BAD_REQUEST"
+	errTimeout           errorCode = "ERR_TIMEOUT"
+	errDNS               errorCode = "ERR_DNS"
+	errProxyAuth         errorCode = "ERR_PROXY_AUTH"
+	errProxyConnect      errorCode = "ERR_PROXY_CONNECT"
+	errTLSHandshake      errorCode = "ERR_TLS_HANDSHAKE"
+	errTLSCertificate    errorCode = "ERR_TLS_CERTIFICATE"
+	errConnect           errorCode = "ERR_CONNECT"
+	errConnection        errorCode = "ERR_CONNECTION"
+	errMalformedResponse errorCode = "ERR_MALFORMED_RESPONSE"
+	errPrematureClose    errorCode = "ERR_PREMATURE_CLOSE"
+	errRedirect          errorCode = "ERR_REDIRECT"
+	errBodyLimit         errorCode = "ERR_BODY_LIMIT"
+	errUnauthorized      errorCode = "ERR_UNAUTHORIZED"
+	errForbidden         errorCode = "ERR_FORBIDDEN"
+	errRateLimited       errorCode = "ERR_RATE_LIMITED"
+	errOverloaded        errorCode = "ERR_OVERLOADED"
+	errRequestTooLarge   errorCode = "ERR_REQUEST_TOO_LARGE"
+	errInternal          errorCode = "ERR_INTERNAL"
+)
+
+// failure is the JSON body of the responses to requests that failed
+type failure struct {
+	Error     string    `json:"error"`
+	Code      errorCode `json:"code"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// writeFailure answers the request r that failed with err, its code in the
+// error header and both in the body, along with the ID of the request
+func writeFailure(w fhttp.ResponseWriter, r *fhttp.Request, status int, code errorCode, err error) {
+	id := w.Header().Get(requestIDHeaderName)
+	slog.WarnContext(r.Context(), "Request failed", "code", code, "error", err)
+	w.Header().Set(errorHeaderName, string(code))
+	writeJSON(w, status, failure{Error: err.Error(), Code: code, RequestID: id})
+}
+
+// classifyFailure returns the status and the code to answer a request that got
+// no response from the upstream with: 504 when the upstream took too long, 502
+// when anything else on the way to it failed, 500 for failures of the server
+// itself. proxied tells whether the request went through a proxy.
+func classifyFailure(err error, proxied bool) (int, errorCode) {
+	if warning := upstreamWarning(err); warning != "" {
+		if warning == warningPrematureClose {
+			return fhttp.StatusBadGateway, errPrematureClose
+		}
+		return fhttp.StatusBadGateway, errMalformedResponse
+	}
+
+	msg := err.Error()
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	// azuretls reports its own deadlines as plain "timeout" errors
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout(),
+		strings.HasSuffix(msg, "timeout"), isPhaseTimeout(err), errors.Is(err, errHeaderTimeout):
+		return fhttp.StatusGatewayTimeout, errTimeout
+	case errors.As(err, &dnsErr):
+		return fhttp.StatusBadGateway, errDNS
+	case proxied && (strings.Contains(msg, "407") || strings.Contains(msg, "authentication")):
+		return fhttp.StatusBadGateway, errProxyAuth
+	case proxied && isProxyError(err):
+		return fhttp.StatusBadGateway, errProxyConnect
+	case isCertificateError(err):
+		return fhttp.StatusBadGateway, errTLSCertificate
+	case isTLSError(err):
+		return fhttp.StatusBadGateway, errTLSHandshake
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return fhttp.StatusBadGateway, errConnect
+	case errors.As(err, &opErr), errors.Is(err, io.EOF), errors.Is(err, syscall.ECONNRESET):
+		return fhttp.StatusBadGateway, errConnection
+	case strings.Contains(msg, "Redirects") || strings.Contains(msg, "Location header"):
+		return fhttp.StatusBadGateway, errRedirect
+	}
+	return fhttp.StatusInternalServerError, errInternal
+}
+
+// isCertificateError reports whether err comes from verifying the certificate
+// of the upstream. azuretls reports failed pin and expiry checks as plain errors.
+func isCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "pin verification failed") || strings.Contains(msg, "certificate is")
+}
+
+// isTLSError reports whether err comes from the TLS handshake. Alerts of the
+// upstream are not exported, they are told apart by their message.
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "tls: ") || strings.Contains(msg, "failed to apply preset")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamFailures(t *testing.T) {
+	// nothing listens on a port closed right after it was bound
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// an upstream that never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	tests := []struct {
+		url    string
+		status int
+		code   errorCode
+	}{
+		{"http://" + l.Addr().String(), http.StatusBadGateway, errConnect},
+		{"http://" + silent.Addr().String(), http.StatusGatewayTimeout, errTimeout},
+		{rawServer(t, "this is not http\r\n\r\n"), http.StatusBadGateway, errMalformedResponse},
+	}
+	for _, tt := range tests {
+		w := proxyRequest(t, map[string]string{"x-tls-url": tt.url, "x-tls-timeout": "1"})
+
+		assert.Equal(t, tt.status, w.statusCode, tt.code)
+		assert.Equal(t, "application/json", w.sent.Get("Content-Type"), tt.code)
+		assert.Equal(t, string(tt.code), w.sent.Get("x-tls-error"))
+		var body failure
+		assert.NoError(t, json.Unmarshal(w.body.Bytes(), &body), tt.code)
+		assert.Equal(t, tt.code, body.Code)
+		assert.NotEmpty(t, body.Error, tt.code)
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		err     error
+		proxied bool
+		status  int
+		code    errorCode
+	}{
+		{errors.New("timeout"), false, http.StatusGatewayTimeout, errTimeout},
+		{fmt.Errorf("dialing: %w", context.DeadlineExceeded), false, http.StatusGatewayTimeout, errTimeout},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}, false, http.StatusBadGateway, errDNS},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true, http.StatusBadGateway, errProxyConnect},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, false, http.StatusBadGateway, errConnect},
+		{errors.New("proxy error : 407 Proxy Authentication Required"), true, http.StatusBadGateway, errProxyAuth},
+		{errors.New("username/password authentication failed"), true, http.StatusBadGateway, errProxyAuth},
+		{x509.UnknownAuthorityError{}, false, http.StatusBadGateway, errTLSCertificate},
+		{errors.New("remote error: tls: handshake failure"), false, http.StatusBadGateway, errTLSHandshake},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, false, http.StatusBadGateway, errConnection},
+		{errors.New("too many Redirects"), false, http.StatusBadGateway, errRedirect},
+		{errLocalAddrUnbound, false, http.StatusInternalServerError, errInternal},
+	}
+	for _, tt := range tests {
+		status, code := classifyFailure(tt.err, tt.proxied)
+		assert.Equal(t, tt.status, status, tt.err.Error())
+		assert.Equal(t, tt.code, code, tt.err.Error())
+	}
+}
+
+func TestBadRequestFailure(t *testing.T) {
+	w := proxyRequest(t, map[string]string{"x-tls-max-redirects": "1"})
+
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+	assert.Equal(t, "ERR_BAD_REQUEST", w.sent.Get("x-tls-error"))
+	var body failure
+	assert.NoError(t, json.Unmarshal(w.body.Bytes(), &body))
+	assert.Contains(t, body.Error, "x-tls-url")
+}
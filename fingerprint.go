@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+)
+
+var fingerprintURL = getEnv("TLS_FINGERPRINT_URL", "https://tls.peet.ws/api/all")
+
+// fingerprintReport is the fingerprint observed by the echo service
+type fingerprintReport struct {
+	Browser     string `json:"browser"`
+	HttpVersion string `json:"http_version"`
+	UserAgent   string `json:"user_agent"`
+	Ja3         string `json:"ja3"`
+	Ja3Hash     string `json:"ja3_hash"`
+	Ja4         string `json:"ja4"`
+	Akamai      string `json:"akamai_fingerprint"`
+	AkamaiHash  string `json:"akamai_fingerprint_hash"`
+}
+
+// echoResponse is the subset of the tls.peet.ws response we report on
+type echoResponse struct {
+	HttpVersion string `json:"http_version"`
+	UserAgent   string `json:"user_agent"`
+	Tls         struct {
+		Ja3     string `json:"ja3"`
+		Ja3Hash string `json:"ja3_hash"`
+		Ja4     string `json:"ja4"`
+	} `json:"tls"`
+	Http2 struct {
+		Akamai     string `json:"akamai_fingerprint"`
+		AkamaiHash string `json:"akamai_fingerprint_hash"`
+	} `json:"http2"`
+}
+
+// HandleFingerprint requests the fingerprint echo service with the chosen browser
+// profile and reports the fingerprint it observed, so deployments can verify the
+// impersonation is still intact
+func HandleFingerprint(w fhttp.ResponseWriter, r *fhttp.Request) {
+	name := r.URL.Query().Get("browser")
+	if name == "" {
+		name = defaultBrowser.get()
+	}
+
+	profile, ok := browser.Get(name)
+	if !ok {
+		writeError(w, fhttp.StatusNotFound, fmt.Errorf("unknown browser profile '%s'", name))
+		return
+	}
+
+	session, err := NewSession(profile)
+	if err != nil {
+		writeError(w, fhttp.StatusInternalServerError, err)
+		return
+	}
+	defer session.Close()
+
+	res, err := session.Get(fingerprintURL)
+	if err != nil {
+		writeError(w, fhttp.StatusBadGateway, fmt.Errorf("fingerprint request failed: %w", err))
+		return
+	}
+
+	var echo echoResponse
+	if err = res.JSON(&echo); err != nil {
+		writeError(w, fhttp.StatusBadGateway, fmt.Errorf("invalid fingerprint response: %w", err))
+		return
+	}
+
+	writeJSON(w, fhttp.StatusOK, fingerprintReport{
+		Browser:     profile.Name,
+		HttpVersion: echo.HttpVersion,
+		UserAgent:   echo.UserAgent,
+		Ja3:         echo.Tls.Ja3,
+		Ja3Hash:     echo.Tls.Ja3Hash,
+		Ja4:         echo.Tls.Ja4,
+		Akamai:      echo.Http2.Akamai,
+		AkamaiHash:  echo.Http2.AkamaiHash,
+	})
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+const (
+	// maxRawHeads bounds the response heads a session remembers until their
+	// responses are forwarded
+	maxRawHeads = 16
+	// maxRawHeadBytes bounds a captured response head, larger ones are forwarded
+	// with canonical names
+	maxRawHeadBytes = 1 << 20
+)
+
+var (
+	preserveHeadersHeaderName = getEnv("TLS_PRESERVE_HEADERS", "x-tls-preserve-headers")
+	headerOrderHeaderName     = getEnv("TLS_HEADER_ORDER", "x-tls-header-order")
+	rawEncodingHeaderName     = getEnv("TLS_RAW_ENCODING", "x-tls-raw-encoding")
+)
+
+// encodingMarker is the name the Content-Encoding of HTTP/1.x responses which
+// body is kept encoded is renamed to, so the transport passes the body on as it
+// came. The encoding is forwarded as Content-Encoding again.
+const encodingMarker = "X-Tls-Kept-Content-Encoding"
+
+// framingHeaders are looked up by their canonical names by the server writing
+// the response, they keep those names so it does not add or frame them twice
+var framingHeaders = map[string]bool{
+	"Content-Length": true,
+	"Content-Type":   true,
+	"Date":           true,
+	"Trailer":        true,
+}
+
+// bodyHeaders describe the body of the caller's request, which is forwarded
+// untouched. They are taken from the caller over the profile and session ones.
+var bodyHeaders = map[string]bool{
+	"Content-Type":     true,
+	"Content-Encoding": true,
+}
+
+// hopByHop returns the canonical names of the headers that only apply to the
+// connection the header came over, and are not forwarded: the standard ones and
+// the ones its Connection header names. Proxy-* headers are too, see isHopByHop.
+// The transport drops the Connection header of responses it closes after, it
+// is looked up in their head as well.
+func hopByHop(header fhttp.Header, head []headerField) map[string]bool {
+	connection := header.Values("Connection")
+	for _, f := range head {
+		if strings.EqualFold(f.name, "Connection") {
+			connection = append(connection, f.value)
+		}
+	}
+
+	hop := map[string]bool{"Connection": true, "Keep-Alive": true, "Transfer-Encoding": true, "Upgrade": true}
+	for _, value := range connection {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hop[fhttp.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return hop
+}
+
+// isHopByHop reports whether the header is one of hop or a Proxy-* header
+func isHopByHop(hop map[string]bool, name string) bool {
+	key := fhttp.CanonicalHeaderKey(name)
+	return hop[key] || strings.HasPrefix(key, "Proxy-")
+}
+
+// headerField is a response header line as it came over the wire
+type headerField struct {
+	name, value string
+}
+
+// rawHeads remembers the heads of the HTTP/1.x responses a session read, as
+// the transport canonicalizes the header names it parses. It is safe for
+// concurrent use.
+type rawHeads struct {
+	mu    sync.Mutex
+	heads []rawHead
+	// keepEncoding hides the Content-Encoding of the responses from the
+	// transport, see encodingMarker. It is set for every request.
+	keepEncoding atomic.Bool
+}
+
+// rawHead is a captured response head, with how it was repaired
+type rawHead struct {
+	fields  []headerField
+	repairs []headRepair
+}
+
+// add remembers a head, forgetting the oldest one when full
+func (h *rawHeads) add(head rawHead) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.heads) >= maxRawHeads {
+		h.heads = h.heads[1:]
+	}
+	h.heads = append(h.heads, head)
+}
+
+// take returns and forgets the oldest head the parsed header was read from,
+// and how it was repaired, nil when it was not captured. Heads may have more
+// fields than the header, the transport drops some of them, e.g.
+// Transfer-Encoding.
+func (h *rawHeads) take(header fhttp.Header) ([]headerField, []headRepair) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, head := range h.heads {
+		if headMatches(head.fields, header) {
+			h.heads = slices.Delete(h.heads, i, i+1)
+			return head.fields, head.repairs
+		}
+	}
+	return nil, nil
+}
+
+func headMatches(head []headerField, header fhttp.Header) bool {
+	for key, values := range header {
+		var raw []string
+		for _, f := range head {
+			if fhttp.CanonicalHeaderKey(f.name) == key {
+				raw = append(raw, f.value)
+			}
+		}
+		if !slices.Equal(raw, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// headConn captures the heads of the responses read from an HTTP/1.x
+// connection. A response is expected after every request written to it, its
+// head is only passed on once it was read completely.
+type headConn struct {
+	net.Conn
+	heads *rawHeads
+
+	mu        sync.Mutex
+	capturing bool
+	// pending was read already and is yet to be returned, partial is the start
+	// of a head that is yet to be read on. They are only touched by the reading
+	// goroutine.
+	pending []byte
+	partial []byte
+}
+
+// recordHeads wraps the connection to capture its response heads, conn may be nil
+func recordHeads(conn net.Conn, heads *rawHeads) net.Conn {
+	if conn == nil || heads == nil {
+		return conn
+	}
+	return &headConn{Conn: conn, heads: heads}
+}
+
+func (c *headConn) Write(p []byte) (int, error) {
+	c.setCapturing(true)
+	return c.Conn.Write(p)
+}
+
+func (c *headConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.partial != nil {
+		partial := c.partial
+		c.partial = nil
+		c.pending = c.readHead(partial, nil)
+	} else if len(c.pending) == 0 {
+		// Idle connections are read from before the next request is written,
+		// whether to capture is known once the response arrived
+		n, err := c.Conn.Read(p)
+		if n == 0 || !c.isCapturing() {
+			return n, err
+		}
+		c.pending = c.readHead(append([]byte(nil), p[:n]...), err)
+	}
+	if len(c.pending) == 0 {
+		return c.Conn.Read(p)
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *headConn) isCapturing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capturing
+}
+
+func (c *headConn) setCapturing(capturing bool) {
+	c.mu.Lock()
+	c.capturing = capturing
+	c.mu.Unlock()
+}
+
+// readHead reads on from buf until the end of the next response head, and
+// returns what is to be passed on. Read errors are left to the next read of the
+// connection to return again.
+func (c *headConn) readHead(buf []byte, err error) []byte {
+	chunk := make([]byte, 4096)
+	end, rest := headEnd(buf)
+	for end < 0 {
+		if err != nil || len(buf) > maxRawHeadBytes {
+			c.setCapturing(false)
+			return buf
+		}
+		var n int
+		n, err = c.Conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		end, rest = headEnd(buf)
+	}
+
+	if status, _ := parseHead(buf[:end]); status >= 100 && status < 200 && status != fhttp.StatusSwitchingProtocols {
+		// Informational heads are passed on right away, the request body might
+		// wait for them, the final head comes next
+		c.partial = buf[rest:]
+		return buf[:rest]
+	}
+
+	// Heads the transport would refuse are repaired where they can be
+	head, repairs := repairHead(buf[:end:end])
+	if c.heads.keepEncoding.Load() {
+		// The transport decodes bodies it can tell the encoding of
+		head = renameHeader(head, "Content-Encoding", encodingMarker)
+	}
+	_, fields := parseHead(head)
+	c.heads.add(rawHead{fields: fields, repairs: repairs})
+	c.setCapturing(false)
+	return append(head, buf[end:]...)
+}
+
+// renameHeader renames the header in the head, under any casing of its name
+func renameHeader(head []byte, from, to string) []byte {
+	lines := bytes.Split(head, []byte("\n"))
+	for i, line := range lines[1:] {
+		if name, value, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(name), from) {
+			lines[i+1] = append([]byte(to+":"), value...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// headEnd returns where the head in buf ends and the body starts, -1 until it
+// was read completely. Lines may end with a bare LF, as the transport allows.
+func headEnd(buf []byte) (int, int) {
+	for i := bytes.IndexByte(buf, '\n'); i >= 0; {
+		next := buf[i+1:]
+		switch {
+		case len(next) > 0 && next[0] == '\n':
+			return i, i + 2
+		case len(next) > 1 && next[0] == '\r' && next[1] == '\n':
+			return i, i + 3
+		}
+		j := bytes.IndexByte(next, '\n')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return -1, -1
+}
+
+// parseHead returns the status code and the header fields of a response head.
+// Values are trimmed and continuation lines folded like the transport does.
+func parseHead(head []byte) (int, []headerField) {
+	lines := strings.Split(string(head), "\n")
+	var status int
+	if parts := strings.Fields(lines[0]); len(parts) > 1 {
+		status, _ = strconv.Atoi(parts[1])
+	}
+
+	var fields []headerField
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.value = strings.TrimSpace(last.value + " " + strings.TrimSpace(line))
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{name: name, value: strings.Trim(value, " \t")})
+	}
+	return status, fields
+}
+
+// forwardOriginalHeaders copies the headers of the upstream response to the
+// caller with the names they came with in its head, in their order, and lists
+// the names in that order in the header order header. HTTP/2 names are
+// lowercase on the wire and their order is not known. Responses which head was
+// not captured are forwarded as forwardHeaders does.
+func forwardOriginalHeaders(w fhttp.ResponseWriter, res *azuretls.Response, head []headerField) {
+	header := w.Header()
+	hop := hopByHop(res.Header, head)
+	if res.HttpResponse != nil && res.HttpResponse.ProtoMajor == 2 {
+		for h, v := range res.Header {
+			if h == "Content-Encoding" || h == encodingMarker || len(v) == 0 || isHopByHop(hop, h) || ownCORSHeader(w, h) {
+				continue
+			}
+			name := h
+			if !framingHeaders[h] {
+				name = strings.ToLower(h)
+			}
+			header[name] = append(header[name], v...)
+		}
+		return
+	}
+
+	if head == nil {
+		forwardHeaders(w, res, head)
+		return
+	}
+
+	var order []string
+	seen := map[string]bool{}
+	for _, f := range head {
+		key := fhttp.CanonicalHeaderKey(f.name)
+		if _, ok := res.Header[key]; !ok || key == "Content-Encoding" || key == encodingMarker || isHopByHop(hop, key) || ownCORSHeader(w, key) {
+			continue
+		}
+		name := f.name
+		if framingHeaders[key] {
+			name = key
+		}
+		header[name] = append(header[name], f.value)
+
+		if lower := strings.ToLower(f.name); !seen[lower] {
+			seen[lower] = true
+			order = append(order, f.name)
+			header[fhttp.HeaderOrderKey] = append(header[fhttp.HeaderOrderKey], lower)
+		}
+	}
+	// The server sorts the headers by the order key, the ones not in it go last
+	fhttp.EnableHeaderOrder(w)
+	header.Set(headerOrderHeaderName, strings.Join(order, ", "))
+}
+
+// bodyAllowed reports whether responses with the status can have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != fhttp.StatusNoContent && status != fhttp.StatusNotModified
+}
+
+// bodylessLength fixes up the Content-Length of a response forwarded without a
+// body. HEAD and 304 responses keep the one the upstream sent, of the body a GET
+// would get, unless that body is forwarded decoded and its length is not known.
+// 204 responses must not have one.
+func bodylessLength(w fhttp.ResponseWriter, res *azuretls.Response, raw bool) {
+	if res.StatusCode == fhttp.StatusNoContent || (!raw && res.Header.Get("Content-Encoding") != "") {
+		w.Header().Del("Content-Length")
+	}
+}
+
+// keepsEncoding reports whether the response body is forwarded as the upstream
+// encoded it, when the caller asks for it, for a range of the body or for it to
+// be resumed, as the offsets of ranges are the ones of the encoded body
+func keepsEncoding(r *fhttp.Request) bool {
+	resumes, _ := parseResumes(r.Header.Get(resumeHeaderName))
+	return isTrue(r.Header.Get(rawEncodingHeaderName)) || r.Header.Get("Range") != "" || resumes > 0
+}
+
+// keptEncodings returns the encodings of the response body when it is forwarded
+// as the upstream encoded it, nil when it was decoded. Without an HTTP/2
+// fingerprint the HTTP/2 transport of a session is set up by its first request,
+// which is decoded either way.
+func keptEncodings(r *fhttp.Request, res *azuretls.Response) []string {
+	if !keepsEncoding(r) || res.HttpResponse == nil {
+		return nil
+	}
+	if encodings := res.Header.Values(encodingMarker); len(encodings) > 0 {
+		return encodings
+	}
+	if res.HttpResponse.ProtoMajor == 2 && !res.HttpResponse.Uncompressed {
+		return res.Header.Values("Content-Encoding")
+	}
+	return nil
+}
+
+// headValue returns the first value of the header in the head
+func headValue(head []headerField, name string) string {
+	for _, f := range head {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	hedgeHeaderName  = getEnv("TLS_HEDGE", "x-tls-hedge")
+	hedgedHeaderName = getEnv("TLS_HEDGED", "x-tls-hedged")
+)
+
+// parseHedge parses how long a request waits for the response headers before
+// the same request is sent again on another session, 0 when it is not
+func parseHedge(value string) (time.Duration, error) {
+	d, err := parseTimeout(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid '%s': %w", hedgeHeaderName, err)
+	}
+	return d, nil
+}
+
+// headerWriter collects the headers sendRequest sets for an attempt, so the
+// ones of the attempt answering the caller are the only ones it gets
+type headerWriter struct {
+	header fhttp.Header
+}
+
+func (h *headerWriter) Header() fhttp.Header        { return h.header }
+func (h *headerWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (h *headerWriter) WriteHeader(int)             {}
+
+// attempt is a request sent on a session, and its outcome
+type attempt struct {
+	session *pooledSession
+	req     *azuretls.Request
+	headers *headerWriter
+	cancel  context.CancelFunc
+	hedged  bool
+
+	res *azuretls.Response
+	err error
+	// done is set once the outcome was received from the attempt
+	done bool
+}
+
+// sendHedged sends the request, and sends it once more on another session when
+// the upstream did not answer within delay. The first response is returned with
+// the session it came on, the other request is cancelled and its session
+// released. Pinned sessions serve a request at a time and are not hedged.
+func sendHedged(w fhttp.ResponseWriter, r *fhttp.Request, session *pooledSession, req *azuretls.Request, delay time.Duration) (*pooledSession, *azuretls.Request, *azuretls.Response, error) {
+	if delay <= 0 || session.id != "" {
+		res, err := sendRequest(w, r, session, req)
+		return session, req, res, err
+	}
+
+	done := make(chan *attempt, 2)
+	send := func(a *attempt, r *fhttp.Request) {
+		a.res, a.err = sendRequest(a.headers, r, a.session, a.req)
+		done <- a
+	}
+	start := func(session *pooledSession, req *azuretls.Request, r *fhttp.Request, hedged bool) *attempt {
+		ctx, cancel := context.WithCancel(req.Context())
+		req.SetContext(ctx)
+		a := &attempt{session: session, req: req, headers: &headerWriter{make(fhttp.Header)}, cancel: cancel, hedged: hedged}
+		go send(a, r.WithContext(ctx))
+		return a
+	}
+
+	attempts := []*attempt{start(session, req, r, false)}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var winner *attempt
+	for pending := 1; pending > 0 && winner == nil; {
+		select {
+		case <-timer.C:
+			hedge := r.WithContext(r.Context())
+			if r.GetBody != nil {
+				hedge.Body, _ = r.GetBody()
+			}
+			next, nextReq, err := NewRequest(hedge)
+			if err != nil {
+				slog.WarnContext(r.Context(), "Error hedging request", "url", req.Url, "error", err)
+				continue
+			}
+			slog.InfoContext(r.Context(), "Hedging request", "url", req.Url, "delay", delay.String())
+			attempts = append(attempts, start(next, nextReq, hedge, true))
+			pending++
+		case a := <-done:
+			a.done = true
+			pending--
+			// A failed attempt waits for the other one, if any
+			if a.err == nil || (pending == 0 && winner == nil) {
+				winner = a
+			}
+		}
+	}
+	if winner == nil {
+		winner = attempts[0]
+	}
+
+	for _, a := range attempts {
+		if a == winner {
+			continue
+		}
+		// The other attempt is cancelled and its session given back once it returned
+		a.cancel()
+		go func(a *attempt) {
+			// Only the other attempt can still be running
+			if !a.done {
+				<-done
+			}
+			if a.res != nil {
+				a.res.RawBody.Close()
+			}
+			sessions.release(a.session, false)
+		}(a)
+	}
+
+	for k, v := range winner.headers.header {
+		w.Header()[k] = v
+	}
+	if winner.hedged {
+		w.Header().Set(hedgedHeaderName, "1")
+	}
+	return winner.session, winner.req, winner.res, winner.err
+}
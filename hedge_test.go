@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedge(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every other request is stuck
+		if requests.Add(1)%2 == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.Write([]byte("slow"))
+			return
+		}
+		w.Write([]byte("fast"))
+	}))
+	defer upstream.Close()
+
+	start := time.Now()
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-hedge": "50ms"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "fast", w.body.String())
+	assert.Equal(t, "1", w.sent.Get("x-tls-hedged"))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// Requests answered in time are not hedged
+	requests.Store(1)
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-hedge": "500ms"})
+	assert.Equal(t, "fast", w.body.String())
+	assert.Empty(t, w.sent.Get("x-tls-hedged"))
+	assert.Equal(t, int32(2), requests.Load())
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-hedge": "later"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
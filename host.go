@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Noooste/azuretls-client"
+)
+
+var hostHeaderName = getEnv("TLS_HOST", "x-tls-host")
+
+// checkHost checks the Host the upstream is sent instead of the host of the
+// URL is a host with an optional port
+func checkHost(value string) error {
+	u, err := url.Parse("//" + value)
+	if err != nil || u.Host == "" || u.Host != value {
+		return fmt.Errorf("'%s' is not a host", value)
+	}
+	return nil
+}
+
+// overrideHost makes the session send the Host of the current request instead
+// of the one of its URL. Redirects keep it while they stay on the host of the
+// URL, the others go out with their own. Sessions serve a request at a time,
+// the override is set for every request, see sendRequest.
+func (s *pooledSession) overrideHost() {
+	preHook := s.PreHookWithContext
+	s.PreHookWithContext = func(ctx *azuretls.Context) error {
+		if s.host.value != "" {
+			req := ctx.Request
+			// Redirects are only filled with the headers of the session after the hook
+			if req.OrderedHeaders == nil {
+				req.OrderedHeaders = s.OrderedHeaders.Clone()
+			}
+			req.OrderedHeaders = req.OrderedHeaders.Del("Host")
+			if u, err := url.Parse(req.Url); err == nil && strings.EqualFold(u.Host, s.host.target) {
+				// Browsers send it first
+				req.OrderedHeaders = append(azuretls.OrderedHeaders{{"Host", s.host.value}}, req.OrderedHeaders...)
+			}
+		}
+		if preHook != nil {
+			return preHook(ctx)
+		}
+		return nil
+	}
+}
+
+// hostOverride is the Host a request is sent with instead of the host of its
+// URL, target
+type hostOverride struct {
+	value, target string
+}
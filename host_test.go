@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostOverride(t *testing.T) {
+	var hosts []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+	}))
+	defer other.Close()
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, other.URL, http.StatusFound)
+		default:
+			w.Write([]byte(r.Proto))
+		}
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	// HTTP/2 upstreams are spoken to over HTTP/1.1 to send the Host
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-host": "virtual.example:8443"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "HTTP/1.1", w.body.String())
+	assert.Equal(t, []string{"virtual.example:8443"}, hosts)
+
+	// Redirects on the same host keep it, the others get their own
+	hosts = nil
+	w = proxyRequest(t, map[string]string{
+		"x-tls-url": upstream.URL + "/same", "x-tls-host": "virtual.example", "x-tls-allowredirect": "1",
+	})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, []string{"virtual.example", "virtual.example", other.Listener.Addr().String()}, hosts)
+
+	// Without it the host of the URL is sent
+	hosts = nil
+	proxyRequest(t, map[string]string{"x-tls-url": upstream.URL})
+	assert.Equal(t, []string{upstream.Listener.Addr().String()}, hosts)
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, host := range []string{"example.com", "example.com:8080", "10.0.0.1", "[::1]:443"} {
+		assert.NoError(t, checkHost(host), host)
+	}
+	for _, host := range []string{"", "example.com/path", "user@example.com", "exa mple.com", "example.com\r\nX: y"} {
+		assert.Error(t, checkHost(host), host)
+	}
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": "http://example.com", "x-tls-host": "a/b"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
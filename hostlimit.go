@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLimits are the caps on the requests to upstream hosts, shared by all
+// callers
+var hostLimits = newSetting[[]*hostLimit](nil)
+
+// hostLimit caps the requests in flight to the hosts it matches, and the rate
+// they are sent at. Requests beyond either wait for their turn.
+type hostLimit struct {
+	// domain matches the host and its subdomains, or only its subdomains when
+	// it starts with a dot
+	domain      string
+	concurrency int
+	rate        float64
+
+	slots chan struct{}
+	mu    sync.Mutex
+	next  time.Time
+}
+
+// parseHostLimits parses comma separated limits like
+// "example.com concurrency=2 rate=1", "*.example.com" and ".example.com"
+// matching the subdomains only
+func parseHostLimits(value string) ([]*hostLimit, error) {
+	var limits []*hostLimit
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Fields(strings.ToLower(entry))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("invalid TLS_HOST_LIMITS: '%s' sets no limit", fields[0])
+		}
+
+		l := &hostLimit{domain: strings.TrimSuffix(strings.TrimPrefix(fields[0], "*"), ".")}
+		for _, field := range fields[1:] {
+			name, v, _ := strings.Cut(field, "=")
+			var err error
+			switch name {
+			case "concurrency":
+				if l.concurrency, err = strconv.Atoi(v); err == nil && l.concurrency < 1 {
+					err = fmt.Errorf("at least 1")
+				}
+			case "rate":
+				if l.rate, err = strconv.ParseFloat(v, 64); err == nil && (l.rate <= 0 || math.IsInf(l.rate, 0)) {
+					err = fmt.Errorf("above 0")
+				}
+			default:
+				err = fmt.Errorf("unknown limit")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid TLS_HOST_LIMITS: '%s' of %s: %w", field, fields[0], err)
+			}
+		}
+		if l.concurrency > 0 {
+			l.slots = make(chan struct{}, l.concurrency)
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// matches reports whether the limit applies to the host
+func (l *hostLimit) matches(host string) bool {
+	if strings.HasPrefix(l.domain, ".") {
+		return strings.HasSuffix(host, l.domain)
+	}
+	return host == l.domain || strings.HasSuffix(host, "."+l.domain)
+}
+
+// findHostLimit returns the limit of the host of rawURL, the one of the
+// longest domain when several match, nil when none does
+func findHostLimit(limits []*hostLimit, rawURL string) *hostLimit {
+	if len(limits) == 0 {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	var found *hostLimit
+	for _, l := range limits {
+		if l.matches(host) && (found == nil || len(l.domain) > len(found.domain)) {
+			found = l
+		}
+	}
+	return found
+}
+
+// turnContext bounds the wait of a request for its turn by its timeout
+func turnContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if total := requestTimeouts(ctx).total; total > 0 {
+		return context.WithTimeout(ctx, total)
+	}
+	return context.WithCancel(ctx)
+}
+
+// acquire waits until fewer requests than the concurrency are in flight to
+// the hosts, and returns the function ending the request
+func (l *hostLimit) acquire(ctx context.Context) (func(), error) {
+	if l == nil || l.slots == nil {
+		return func() {}, nil
+	}
+	ctx, cancel := turnContext(ctx)
+	defer cancel()
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pace waits for the turn of a request at the rate
+func (l *hostLimit) pace(ctx context.Context) error {
+	if l == nil || l.rate == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	turn := l.next
+	if turn.Before(now) {
+		turn = now
+	}
+	l.next = turn.Add(time.Duration(float64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	wait := time.Until(turn)
+	if wait <= 0 {
+		return nil
+	}
+	ctx, cancel := turnContext(ctx)
+	defer cancel()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostLimits(t *testing.T) {
+	limits, err := parseHostLimits("example.com concurrency=2 rate=1, *.shop.example rate=0.5, .api.example concurrency=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, limits, 3)
+	assert.Equal(t, "example.com", limits[0].domain)
+	assert.Equal(t, 2, limits[0].concurrency)
+	assert.Equal(t, 1.0, limits[0].rate)
+	assert.Equal(t, ".shop.example", limits[1].domain)
+	assert.Nil(t, limits[1].slots)
+	assert.Equal(t, ".api.example", limits[2].domain)
+
+	for _, value := range []string{
+		"example.com",
+		"example.com concurrency=0",
+		"example.com rate=-1",
+		"example.com rate=fast",
+		"example.com burst=2",
+	} {
+		_, err := parseHostLimits(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestFindHostLimit(t *testing.T) {
+	limits, err := parseHostLimits("example.com rate=1, www.example.com rate=2, .shop.test rate=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want float64
+	}{
+		{url: "https://example.com/", want: 1},
+		{url: "https://cdn.example.com/", want: 1},
+		{url: "https://WWW.example.com:8443/", want: 2},
+		{url: "https://eu.shop.test/", want: 3},
+		{url: "https://shop.test/", want: 0},
+		{url: "https://example.org/", want: 0},
+	}
+	for _, tt := range tests {
+		got := 0.0
+		if l := findHostLimit(limits, tt.url); l != nil {
+			got = l.rate
+		}
+		assert.Equal(t, tt.want, got, tt.url)
+	}
+}
+
+func TestHostLimitConcurrency(t *testing.T) {
+	limits, err := parseHostLimits("example.com concurrency=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := limits[0]
+	done, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request waits for the slot, up to its timeout
+	ctx := withTimeouts(context.Background(), timeouts{total: 50 * time.Millisecond})
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	acquired := make(chan struct{})
+	go func() {
+		next, err := l.acquire(context.Background())
+		if err == nil {
+			next()
+		}
+		close(acquired)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("the slot was not handed over")
+	}
+
+	// Hosts without a limit do not wait
+	var none *hostLimit
+	done, err = none.acquire(context.Background())
+	assert.NoError(t, err)
+	done()
+}
+
+func TestHostLimitRate(t *testing.T) {
+	limits, err := parseHostLimits("example.com rate=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := limits[0]
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, l.pace(context.Background()))
+	}
+	// The first goes at once, the others 50ms apart
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.pace(context.Background())
+	assert.ErrorIs(t, l.pace(ctx), context.Canceled)
+}
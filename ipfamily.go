@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var ipFamilyHeaderName = getEnv("TLS_IP_FAMILY", "x-tls-ip-family")
+
+// upstreamIPFamily is the IP family of requests that do not pick one, see
+// parseIPFamily. It is read as the header would be.
+var upstreamIPFamily = getEnv("TLS_UPSTREAM_IP_FAMILY", "")
+
+// ipFamily picks the IP version of the upstreams the server resolves itself:
+// the connections it dials directly and the targets of socks5:// proxies
+type ipFamily string
+
+const (
+	ipFamilyAny     ipFamily = ""
+	ipFamily4       ipFamily = "4"
+	ipFamily6       ipFamily = "6"
+	ipFamilyPrefer4 ipFamily = "prefer-4"
+	ipFamilyPrefer6 ipFamily = "prefer-6"
+)
+
+// parseIPFamily parses '4' or '6' to only use that IP version, and 'prefer-4'
+// or 'prefer-6' to try its addresses first and fall back to the others
+func parseIPFamily(value string) (ipFamily, error) {
+	family := ipFamily(strings.ToLower(strings.TrimSpace(value)))
+	switch family {
+	case ipFamilyAny, ipFamily4, ipFamily6, ipFamilyPrefer4, ipFamilyPrefer6:
+		return family, nil
+	case "ipv4", "v4":
+		return ipFamily4, nil
+	case "ipv6", "v6":
+		return ipFamily6, nil
+	}
+	return "", fmt.Errorf("unknown IP family '%s', expected 4, 6, prefer-4 or prefer-6", value)
+}
+
+// order returns the addresses of the family, the preferred ones first
+func (f ipFamily) order(ips []netip.Addr) []netip.Addr {
+	ordered := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if (f == ipFamily4 && !ip.Is4()) || (f == ipFamily6 && !ip.Is6()) {
+			continue
+		}
+		ordered = append(ordered, ip)
+	}
+
+	if f == ipFamilyPrefer4 || f == ipFamilyPrefer6 {
+		preferred := func(ip netip.Addr) bool { return ip.Is6() == (f == ipFamilyPrefer6) }
+		slices.SortStableFunc(ordered, func(a, b netip.Addr) int {
+			switch {
+			case preferred(a) && !preferred(b):
+				return -1
+			case !preferred(a) && preferred(b):
+				return 1
+			}
+			return 0
+		})
+	}
+	return ordered
+}
+
+// resolve returns the addresses of host to connect to, in order
+func (f ipFamily) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+
+	if ips = f.order(ips); len(ips) == 0 {
+		return nil, fmt.Errorf("%s has no IPv%s address", host, f)
+	}
+	return ips, nil
+}
+
+// dial connects to addr with the addresses of the family, trying them in order.
+// The dialer picks them itself when any family will do.
+func (f ipFamily) dial(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	if f == ipFamilyAny {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := f.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFamily(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	for family, ok := range map[string]bool{"4": true, "prefer-6": true, "6": false} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-ip-family": family})
+		assert.Equal(t, ok, w.statusCode == http.StatusOK, family)
+	}
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-ip-family": "5"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestIPFamilyOrder(t *testing.T) {
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	mapped := netip.MustParseAddr("::ffff:192.0.2.2")
+	ips := []netip.Addr{v6, v4, mapped}
+
+	assert.Equal(t, []netip.Addr{v6, v4, mapped.Unmap()}, ipFamilyAny.order(ips))
+	assert.Equal(t, []netip.Addr{v4, mapped.Unmap()}, ipFamily4.order(ips))
+	assert.Equal(t, []netip.Addr{v6}, ipFamily6.order(ips))
+	assert.Equal(t, []netip.Addr{v4, mapped.Unmap(), v6}, ipFamilyPrefer4.order(ips))
+	assert.Equal(t, []netip.Addr{v6, v4, mapped.Unmap()}, ipFamilyPrefer6.order([]netip.Addr{v4, mapped, v6}))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// ipRules are the IPs callers may come from, and the ones they may not
+type ipRules struct {
+	allow, deny []netip.Prefix
+}
+
+// callerIPRules are the rules callers are served by, none serving any caller
+var callerIPRules = newSetting(ipRules{})
+
+var errForbiddenIP = errors.New("caller IP not allowed")
+
+// parseIPRules parses the comma separated IPs and CIDRs of the allow and deny
+// lists
+func parseIPRules(allow, deny string) (ipRules, error) {
+	var rules ipRules
+	var err error
+	if rules.allow, err = parsePrefixes(allow); err != nil {
+		return ipRules{}, fmt.Errorf("invalid TLS_ALLOW_IPS: %w", err)
+	}
+	if rules.deny, err = parsePrefixes(deny); err != nil {
+		return ipRules{}, fmt.Errorf("invalid TLS_DENY_IPS: %w", err)
+	}
+	return rules, nil
+}
+
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		ip = ip.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// allows reports whether callers from ip are served: those in no deny rule
+// and, when there are allow rules, in one of them
+func (rules ipRules) allows(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range rules.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, prefix := range rules.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterIPs answers requests of callers the IP rules do not allow with 403
+// before they reach the handler. The caller is the one of the PROXY protocol
+// header when the listener takes one. Callers over unix sockets have no IP and
+// are served, any other caller whose address does not parse is not.
+func filterIPs(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		rules := callerIPRules.get()
+		if len(rules.allow) == 0 && len(rules.deny) == 0 || overUnixSocket(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			writeFailure(w, r, fhttp.StatusForbidden, errForbidden, fmt.Errorf("%w: unknown address '%s'", errForbiddenIP, r.RemoteAddr))
+			return
+		}
+		if !rules.allows(addrPort.Addr()) {
+			writeFailure(w, r, fhttp.StatusForbidden, errForbidden, fmt.Errorf("%w: %s", errForbiddenIP, addrPort.Addr()))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// overUnixSocket reports whether the request came in on a unix socket listener
+func overUnixSocket(r *fhttp.Request) bool {
+	addr, ok := r.Context().Value(fhttp.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPRules(t *testing.T) {
+	rules, err := parseIPRules("10.0.0.0/8, 192.0.2.7, 2001:db8::/32", "10.0.13.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.1.2.3", want: true},
+		{ip: "192.0.2.7", want: true},
+		{ip: "::ffff:192.0.2.7", want: true},
+		{ip: "2001:db8::1", want: true},
+		{ip: "10.0.13.5", want: false},
+		{ip: "192.0.2.8", want: false},
+		{ip: "198.51.100.1", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, rules.allows(netip.MustParseAddr(tt.ip)), tt.ip)
+	}
+
+	// Deny rules alone serve everyone else
+	rules, err = parseIPRules("", "198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, rules.allows(netip.MustParseAddr("192.0.2.1")))
+	assert.False(t, rules.allows(netip.MustParseAddr("198.51.100.1")))
+
+	_, err = parseIPRules("10.0.0.0/33", "")
+	assert.Error(t, err)
+	_, err = parseIPRules("", "example.com")
+	assert.Error(t, err)
+}
+
+func TestFilterIPs(t *testing.T) {
+	rules, err := parseIPRules("192.0.2.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callerIPRules.set(rules)
+	defer callerIPRules.set(ipRules{})
+
+	served := false
+	handler := filterIPs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(remoteAddr string, local net.Addr) int {
+		served = false
+		r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remoteAddr
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		handler.ServeHTTP(w, r)
+		return w.statusCode
+	}
+
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 8080}
+	assert.Equal(t, http.StatusOK, send("192.0.2.1:56324", tcp))
+	assert.Equal(t, http.StatusForbidden, send("198.51.100.1:56324", tcp))
+	assert.False(t, served)
+	// Addresses that do not parse are not served
+	assert.Equal(t, http.StatusForbidden, send("@", tcp))
+	assert.False(t, served)
+	// Callers over unix sockets have no IP
+	assert.Equal(t, http.StatusOK, send("@", &net.UnixAddr{Name: "/run/tls.sock", Net: "unix"}))
+}
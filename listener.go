@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/http2"
+	"github.com/Noooste/fhttp/http2/h2c"
+	tls "github.com/Noooste/utls"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// listenMaxStreams bounds the requests an HTTP/2 caller has in flight at once
+	// over a connection
+	listenMaxStreams = getEnvInt("TLS_LISTEN_MAX_STREAMS", 1000)
+	// listenH2C serves HTTP/2 over cleartext connections as well, to callers
+	// starting with it or upgrading to it
+	listenH2C = isTrue(getEnv("TLS_LISTEN_H2C", "1"))
+	// listenReusePort lets a new instance listen on the ports of the running one,
+	// so it can take over without refusing connections in between
+	listenReusePort = isTrue(getEnv("TLS_LISTEN_REUSE_PORT", "0"))
+)
+
+// listenAddress is an address the server listens on, serving HTTPS or plain
+// HTTP
+type listenAddress struct {
+	network, address string
+	tls              bool
+	// inherited is the socket listening on it already, one passed by systemd
+	inherited net.Listener
+}
+
+func (a listenAddress) String() string {
+	switch {
+	case a.network == "unix":
+		return "unix:" + a.address
+	case a.tls:
+		return "https://" + a.address
+	default:
+		return "http://" + a.address
+	}
+}
+
+// parseListenAddresses parses the comma separated addresses to listen on:
+// "https://host:port" and "http://host:port" ones, unix sockets as
+// "unix:/path", and addresses without a scheme, which serve HTTPS when a
+// certificate is configured
+func parseListenAddresses(value string, certificate bool) ([]listenAddress, error) {
+	var addrs []listenAddress
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		addr := listenAddress{network: "tcp", address: entry, tls: certificate}
+		switch {
+		case strings.HasPrefix(entry, "unix:"):
+			addr = listenAddress{network: "unix", address: strings.TrimPrefix(strings.TrimPrefix(entry, "unix:"), "//")}
+			if addr.address == "" {
+				return nil, fmt.Errorf("'%s' names no socket", entry)
+			}
+			addrs = append(addrs, addr)
+			continue
+		case strings.HasPrefix(entry, "https://"):
+			addr.address, addr.tls = strings.TrimPrefix(entry, "https://"), true
+		case strings.HasPrefix(entry, "http://"):
+			addr.address, addr.tls = strings.TrimPrefix(entry, "http://"), false
+		}
+		if _, err := strconv.Atoi(addr.address); err == nil {
+			// A port alone
+			addr.address = ":" + addr.address
+		}
+		if _, _, err := net.SplitHostPort(addr.address); err != nil {
+			return nil, fmt.Errorf("'%s' is not an address to listen on", entry)
+		}
+		if addr.tls && !certificate {
+			return nil, fmt.Errorf("'%s' takes --tls-cert or --acme-domains", entry)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+	return addrs, nil
+}
+
+// listen opens the listeners of the addresses, and returns the function
+// serving on all of them until the server is shut down or one of them fails
+func listen(server *fhttp.Server, addrs []listenAddress) (func() error, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, addr := range addrs {
+		if addr.inherited != nil {
+			listeners = append(listeners, wrapListener(addr, addr.inherited))
+			continue
+		}
+		if addr.network == "unix" {
+			// A socket left behind by an earlier run that did not exit cleanly, or the
+			// one of the instance this one takes over from
+			if info, err := os.Stat(addr.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(addr.address)
+			}
+		}
+		var config net.ListenConfig
+		if listenReusePort {
+			config.Control = reusePort
+		}
+		l, err := config.Listen(context.Background(), addr.network, addr.address)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if ul, ok := l.(*net.UnixListener); ok && listenReusePort {
+			// The socket file is the new instance's by the time this one stops
+			ul.SetUnlinkOnClose(false)
+		}
+		listeners = append(listeners, wrapListener(addr, l))
+	}
+
+	return func() error {
+		served := make(chan error, len(listeners))
+		for i, l := range listeners {
+			serve := server.Serve
+			if addrs[i].tls {
+				serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+			}
+			go func() { served <- serve(l) }()
+		}
+		err := <-served
+		if !errors.Is(err, fhttp.ErrServerClosed) {
+			// The others are stopped along with the one that failed
+			server.Close()
+		}
+		return err
+	}, nil
+}
+
+// wrapListener sets up the listener of the address for what the connections
+// it accepts start with
+func wrapListener(addr listenAddress, l net.Listener) net.Listener {
+	if addr.network == "tcp" && listenProxyProtocol {
+		return &proxyProtocolListener{Listener: l, timeout: proxyHeaderTimeout, trusted: proxyProtocolTrusted}
+	}
+	return l
+}
+
+// serverCert is the certificate the server serves TLS with, nil when it serves
+// plain HTTP
+var serverCert *certificate
+
+// clientCA verifies the certificates callers present, nil when the server does
+// not ask for any
+var clientCA *certificateAuthority
+
+// certificate is a certificate and key pair loaded from files, which can be
+// loaded again to pick up a renewed certificate without a restart
+type certificate struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// loadCertificate loads the PEM encoded certificate and key files
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("serving TLS takes both a certificate and a key file")
+	}
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	cert, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.cert.Store(cert)
+	return c, nil
+}
+
+// load reads the certificate files again
+func (c *certificate) load() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the certificate %s: %w", c.certFile, err)
+	}
+	return &cert, nil
+}
+
+// get hands out the certificate for TLS handshakes
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// tlsConfig is the TLS configuration the server serves the certificate with
+func (c *certificate) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// certificateAuthority verifies certificates against the CA certificates of a
+// file, which can be loaded again to trust other ones without a restart
+type certificateAuthority struct {
+	file string
+	pool atomic.Pointer[x509.CertPool]
+}
+
+// loadCertificateAuthority loads the PEM encoded CA certificates of the file
+func loadCertificateAuthority(file string) (*certificateAuthority, error) {
+	ca := &certificateAuthority{file: file}
+	pool, err := ca.load()
+	if err != nil {
+		return nil, err
+	}
+	ca.pool.Store(pool)
+	return ca, nil
+}
+
+// load reads the CA certificates file again
+func (ca *certificateAuthority) load() (*x509.CertPool, error) {
+	data, err := os.ReadFile(ca.file)
+	if err != nil {
+		return nil, fmt.Errorf("loading the client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("loading the client CA: no certificates in %s", ca.file)
+	}
+	return pool, nil
+}
+
+// require makes the server only complete handshakes with callers presenting a
+// certificate the CA issued for client authentication
+func (ca *certificateAuthority) require(config *tls.Config) {
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyPeerCertificate = ca.verify
+}
+
+// verify verifies the certificate chain a caller presented, the way crypto/tls
+// does for ClientCAs but against the CA certificates loaded last
+func (ca *certificateAuthority) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         ca.pool.Load(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("client certificate not trusted: %w", err)
+	}
+	return nil
+}
+
+// newACMEManager obtains the certificates of the domains from an ACME CA, Let's
+// Encrypt unless directoryURL is set, and renews them ahead of their expiry.
+// They are kept in cacheDir, or only in memory when it is empty.
+func newACMEManager(domains, cacheDir, email, directoryURL string) (*autocert.Manager, error) {
+	var hosts []string
+	for _, domain := range strings.Split(domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			hosts = append(hosts, domain)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no domains to obtain certificates for")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      email,
+	}
+	if cacheDir != "" {
+		m.Cache = autocert.DirCache(cacheDir)
+	} else {
+		slog.Warn("No ACME cache directory, certificates are obtained again on every start")
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m, nil
+}
+
+// acmeTLSConfig is the TLS configuration the server serves the certificates of
+// the manager with, answering the tls-alpn-01 challenges of the CA
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := m.GetCertificate(stdClientHello(hello))
+			if err != nil {
+				return nil, err
+			}
+			return utlsCertificate(cert), nil
+		},
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{acme.ALPNProto},
+	}
+}
+
+// stdClientHello converts the hello for autocert, which takes crypto/tls types
+func stdClientHello(hello *tls.ClientHelloInfo) *stdtls.ClientHelloInfo {
+	std := &stdtls.ClientHelloInfo{
+		CipherSuites:      hello.CipherSuites,
+		ServerName:        hello.ServerName,
+		SupportedPoints:   hello.SupportedPoints,
+		SupportedProtos:   hello.SupportedProtos,
+		SupportedVersions: hello.SupportedVersions,
+		Conn:              hello.Conn,
+	}
+	for _, curve := range hello.SupportedCurves {
+		std.SupportedCurves = append(std.SupportedCurves, stdtls.CurveID(curve))
+	}
+	for _, scheme := range hello.SignatureSchemes {
+		std.SignatureSchemes = append(std.SignatureSchemes, stdtls.SignatureScheme(scheme))
+	}
+	return std
+}
+
+// utlsCertificate converts a certificate of autocert for the server
+func utlsCertificate(cert *stdtls.Certificate) *tls.Certificate {
+	converted := &tls.Certificate{
+		Certificate:                 cert.Certificate,
+		PrivateKey:                  cert.PrivateKey,
+		OCSPStaple:                  cert.OCSPStaple,
+		SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+		Leaf:                        cert.Leaf,
+	}
+	for _, scheme := range cert.SupportedSignatureAlgorithms {
+		converted.SupportedSignatureAlgorithms = append(converted.SupportedSignatureAlgorithms, tls.SignatureScheme(scheme))
+	}
+	return converted
+}
+
+// serveHTTP2 sets the server up to serve the handler over HTTP/2 besides
+// HTTP/1.1, negotiated with ALPN over TLS or as h2c over cleartext connections,
+// so callers can multiplex their requests over a few connections
+func serveHTTP2(server *fhttp.Server, handler fhttp.Handler) error {
+	h2 := &http2.Server{MaxConcurrentStreams: uint32(listenMaxStreams)}
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return err
+	}
+	server.Handler = handler
+	if listenH2C {
+		// h2c connections are taken over from the server, which no longer tracks them
+		h2cHandler := h2c.NewHandler(handler, h2)
+		server.Handler = fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+			if r.TLS != nil {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			h2cHandler.ServeHTTP(w, r)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	stdhttp "net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	tls "github.com/Noooste/utls"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// writeCertificate writes a self-signed certificate for localhost and
+// proxy.test to dir, and returns the paths of the certificate and key files
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost", "proxy.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(100 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "first")
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(HandleIsAlive),
+		TLSConfig: cert.tlsConfig(),
+	}
+	go server.ServeTLS(l, "", "")
+	defer server.Close()
+
+	served := func() string {
+		conn, err := stdtls.Dial("tcp", l.Addr().String(), &stdtls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	// Renewed certificates are served once reloaded
+	writeCertificate(t, dir, "renewed")
+	renewed, err := cert.load()
+	assert.NoError(t, err)
+	cert.cert.Store(renewed)
+	assert.Equal(t, "renewed", served())
+
+	_, err = loadCertificate(certFile, "")
+	assert.Error(t, err)
+	_, err = loadCertificate(certFile, filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestACMEListener(t *testing.T) {
+	// The certificate of a domain is served from the cache without asking the CA
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "cached")
+	key, _ := os.ReadFile(keyFile)
+	cert, _ := os.ReadFile(certFile)
+	os.WriteFile(filepath.Join(dir, "proxy.test"), append(key, cert...), 0o600)
+
+	manager, err := newACMEManager("proxy.test, example.com", dir, "", "http://127.0.0.1:1/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(HandleIsAlive),
+		TLSConfig: acmeTLSConfig(manager),
+	}
+	go server.ServeTLS(l, "", "")
+	defer server.Close()
+
+	conn, err := stdtls.Dial("tcp", l.Addr().String(), &stdtls.Config{ServerName: "proxy.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "cached", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+
+	// Other domains are not asked for
+	_, err = stdtls.Dial("tcp", l.Addr().String(), &stdtls.Config{ServerName: "other.test", InsecureSkipVerify: true})
+	assert.Error(t, err)
+
+	_, err = newACMEManager(" , ", dir, "", "")
+	assert.Error(t, err)
+}
+
+// issueCertificate issues a certificate for client authentication, signed by
+// the parent or self-signed when it is nil
+func issueCertificate(t *testing.T, name string, ca bool, parent *stdtls.Certificate) stdtls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	issuer, signer := template, any(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return stdtls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCertificate(t, "ca", true, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o644)
+
+	cert, err := loadCertificate(writeCertificate(t, dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, err := loadCertificateAuthority(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := cert.tlsConfig()
+	clientCA.require(config)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(HandleIsAlive), TLSConfig: config}
+	go server.ServeTLS(l, "", "")
+	defer server.Close()
+
+	served := func(certs ...stdtls.Certificate) bool {
+		conn, err := stdtls.Dial("tcp", l.Addr().String(), &stdtls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		// TLS 1.3 servers reject client certificates after the handshake
+		conn.Write([]byte("GET /isalive HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		return err == nil && res.StatusCode == http.StatusOK
+	}
+	assert.True(t, served(issueCertificate(t, "service", false, &ca)))
+	assert.False(t, served(issueCertificate(t, "stranger", false, nil)))
+	assert.False(t, served())
+
+	// Reloaded CAs are trusted from then on
+	other := issueCertificate(t, "other ca", true, nil)
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Certificate[0]}), 0o644)
+	pool, err := clientCA.load()
+	assert.NoError(t, err)
+	clientCA.pool.Store(pool)
+	assert.True(t, served(issueCertificate(t, "service", false, &other)))
+	assert.False(t, served(issueCertificate(t, "service", false, &ca)))
+
+	os.WriteFile(caFile, []byte("not a certificate"), 0o644)
+	_, err = clientCA.load()
+	assert.Error(t, err)
+}
+
+func TestHTTP2Listener(t *testing.T) {
+	var mu sync.Mutex
+	remotes := map[string]bool{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes[r.RemoteAddr] = true
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(r.Proto))
+	})
+
+	serve := func(config *tls.Config) (*http.Server, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{TLSConfig: config}
+		if err := serveHTTP2(server, countInFlight(handler)); err != nil {
+			t.Fatal(err)
+		}
+		if config != nil {
+			go server.ServeTLS(l, "", "")
+			return server, "https://" + l.Addr().String()
+		}
+		go server.Serve(l)
+		return server, "http://" + l.Addr().String()
+	}
+	get := func(client *stdhttp.Client, url string) string {
+		res, err := client.Get(url)
+		if err != nil {
+			return err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// Cleartext callers with prior knowledge multiplex their requests over one connection
+	server, url := serve(nil)
+	h2c := &stdhttp.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *stdtls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "HTTP/2.0", get(h2c, url))
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, remotes, 1)
+	assert.Equal(t, "HTTP/1.1", get(&stdhttp.Client{}, url))
+
+	// Draining waits for the requests of h2c connections as well
+	slow := make(chan string, 1)
+	go func() { slow <- get(h2c, url+"/slow") }()
+	time.Sleep(50 * time.Millisecond)
+	drain(server, 5*time.Second)
+	assert.Equal(t, "HTTP/2.0", <-slow)
+
+	// TLS callers negotiate it
+	cert, err := loadCertificate(writeCertificate(t, t.TempDir(), "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, url = serve(cert.tlsConfig())
+	defer server.Close()
+	h2 := &stdhttp.Client{Transport: &http2.Transport{TLSClientConfig: &stdtls.Config{InsecureSkipVerify: true}}}
+	assert.Equal(t, "HTTP/2.0", get(h2, url))
+}
+
+func TestParseListenAddresses(t *testing.T) {
+	tests := []struct {
+		value       string
+		certificate bool
+		want        []string
+		wantErr     bool
+	}{
+		{value: ":8082", want: []string{"http://:8082"}},
+		{value: "8082", want: []string{"http://:8082"}},
+		{value: "8443", certificate: true, want: []string{"https://:8443"}},
+		{
+			value:       "http://127.0.0.1:8082, https://:8443,unix:/run/proxy.sock",
+			certificate: true,
+			want:        []string{"http://127.0.0.1:8082", "https://:8443", "unix:/run/proxy.sock"},
+		},
+		{value: "unix:///run/proxy.sock", want: []string{"unix:/run/proxy.sock"}},
+		{value: "https://:8443", wantErr: true},
+		{value: "localhost", wantErr: true},
+		{value: "unix:", wantErr: true},
+		{value: " , ", wantErr: true},
+	}
+	for _, tt := range tests {
+		addrs, err := parseListenAddresses(tt.value, tt.certificate)
+		if tt.wantErr {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	cert, err := loadCertificate(writeCertificate(t, t.TempDir(), "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	// A socket file left behind is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	// Ports are picked ahead, as the listeners do not tell theirs
+	ports := make([]string, 2)
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = l.Addr().String()
+		l.Close()
+	}
+	addrs, err := parseListenAddresses("http://"+ports[0]+",https://"+ports[1]+",unix:"+socket, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{TLSConfig: cert.tlsConfig()}
+	if err := serveHTTP2(server, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})); err != nil {
+		t.Fatal(err)
+	}
+	serve, err := listen(server, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- serve() }()
+
+	get := func(client *stdhttp.Client, url string) string {
+		res, err := client.Get(url)
+		if err != nil {
+			return err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// Each listener takes its own scheme
+	assert.Equal(t, "HTTP/1.1", get(&stdhttp.Client{}, "http://"+ports[0]))
+	h2 := &stdhttp.Client{Transport: &http2.Transport{TLSClientConfig: &stdtls.Config{InsecureSkipVerify: true}}}
+	assert.Equal(t, "HTTP/2.0", get(h2, "https://"+ports[1]))
+	assert.Contains(t, get(&stdhttp.Client{}, "http://"+ports[1]), "HTTPS")
+	local := &stdhttp.Client{Transport: &stdhttp.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	assert.Equal(t, "HTTP/1.1", get(local, "http://proxy/"))
+
+	// Shutting down stops all of them
+	drain(server, time.Second)
+	assert.ErrorIs(t, <-served, http.ErrServerClosed)
+	assert.Contains(t, get(local, "http://proxy/"), "connect")
+}
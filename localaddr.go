@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+)
+
+var localAddrHeaderName = getEnv("TLS_LOCAL_ADDR", "x-tls-local-addr")
+
+// errLocalAddrUnbound is returned for connections azuretls dials on its own,
+// which cannot be bound to a local address
+var errLocalAddrUnbound = errors.New("local addresses only bind https targets, or plain http ones through an HTTP proxy")
+
+// parseLocalAddr returns the local IP connections are dialed from, given as is
+// or as the name of a network interface, which binds its first IPv4 address
+func parseLocalAddr(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(strings.Trim(value, "[]")); ip != nil {
+		return ip.String(), nil
+	}
+
+	iface, err := net.InterfaceByName(value)
+	if err != nil {
+		return "", fmt.Errorf("'%s' is neither an IP nor a network interface", value)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var local net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if local == nil {
+			local = ipNet.IP
+		}
+	}
+	if local == nil {
+		return "", fmt.Errorf("network interface '%s' has no address", value)
+	}
+	return local.String(), nil
+}
+
+// localTCPAddr returns the address to dial the connections of the key from, nil
+// lets the system pick it
+func (k sessionKey) localTCPAddr() net.Addr {
+	if k.localAddr == "" {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.ParseIP(k.localAddr)}
+}
+
+// bindProxyDialer makes azuretls dial HTTP and HTTPS proxies from the local
+// address. It has to be done again whenever the proxy of the session is set.
+func bindProxyDialer(s *azuretls.Session, local net.Addr) {
+	if local == nil || s.ProxyDialer == nil {
+		return
+	}
+	s.ProxyDialer.Dialer.LocalAddr = local
+
+	proxyURL := s.ProxyDialer.ProxyURL
+	if proxyURL.Scheme != "https" {
+		return
+	}
+	// Same as azuretls does by default, see its InitProxyConn
+	s.ProxyDialer.DialTLS = func(network, addr string) (net.Conn, string, error) {
+		conn, err := tls.DialWithDialer(&s.ProxyDialer.Dialer, network, addr, &tls.Config{
+			NextProtos:         []string{"h2", "http/1.1"},
+			ServerName:         proxyURL.Hostname(),
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return conn, conn.ConnectionState().NegotiatedProtocol, nil
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalAddr(t *testing.T) {
+	var remotes []string
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remotes = append(remotes, host)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	// the whole of 127.0.0.0/8 is local
+	for _, local := range []string{"127.0.0.2", "127.0.0.3"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-local-addr": local})
+		assert.Equal(t, "ok", w.body.String())
+	}
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.3"}, remotes)
+
+	// azuretls dials plain http targets itself
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	w := proxyRequest(t, map[string]string{"x-tls-url": plain.URL, "x-tls-local-addr": "127.0.0.2"})
+	assert.NotEqual(t, http.StatusOK, w.statusCode)
+}
+
+func TestParseLocalAddr(t *testing.T) {
+	addr, err := parseLocalAddr("[::1]")
+	assert.NoError(t, err)
+	assert.Equal(t, "::1", addr)
+
+	loopback, err := net.InterfaceByName("lo")
+	if err == nil && loopback.Flags&net.FlagUp != 0 {
+		addr, err = parseLocalAddr("lo")
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.1", addr)
+	}
+
+	_, err = parseLocalAddr("not-an-interface")
+	assert.Error(t, err)
+}
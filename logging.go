@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// logLevel is the lowest level logged: debug, info, warn or error
+	logLevel = getEnv("TLS_LOG_LEVEL", "info")
+	// logFormat is how records are written: json or text
+	logFormat = getEnv("TLS_LOG_FORMAT", "json")
+)
+
+// logOutput is where the log goes, the event log for Windows services
+var logOutput io.Writer = os.Stderr
+
+// newLogger returns the logger writing records of the level and above to out
+// in the format
+func newLogger(level, format string, out io.Writer) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid TLS_LOG_LEVEL: '%s' is not debug, info, warn or error", level)
+	}
+	options := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(fieldsHandler{slog.NewJSONHandler(out, options)}), nil
+	case "text":
+		return slog.New(fieldsHandler{slog.NewTextHandler(out, options)}), nil
+	}
+	return nil, fmt.Errorf("invalid TLS_LOG_FORMAT: '%s' is not json or text", format)
+}
+
+// setupLogging makes the logger of the settings the default one, the log
+// package included
+func setupLogging() {
+	logger, err := newLogger(logLevel, logFormat, logOutput)
+	if err != nil {
+		log.Fatalln("Error setting up logging:", err)
+	}
+	slog.SetDefault(logger)
+}
+
+// fatal logs the message at the error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logFields are the fields of the records logged for a request, added to as
+// it is served
+type logFields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type logFieldsKey struct{}
+
+// withLogFields returns the context the records of a request are logged with,
+// along with the fields
+func withLogFields(ctx context.Context, attrs ...slog.Attr) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, &logFields{attrs: attrs})
+}
+
+// addLogFields adds the fields to the records logged for the request of the
+// context from now on
+func addLogFields(ctx context.Context, attrs ...slog.Attr) {
+	if f, ok := ctx.Value(logFieldsKey{}).(*logFields); ok {
+		f.mu.Lock()
+		f.attrs = append(f.attrs, attrs...)
+		f.mu.Unlock()
+	}
+}
+
+// fieldsHandler adds the fields of the request to the records logged with its
+// context
+type fieldsHandler struct {
+	slog.Handler
+}
+
+func (h fieldsHandler) Handle(ctx context.Context, r slog.Record) error {
+	if f, ok := ctx.Value(logFieldsKey{}).(*logFields); ok {
+		f.mu.Lock()
+		r.AddAttrs(f.attrs...)
+		f.mu.Unlock()
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h fieldsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return fieldsHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h fieldsHandler) WithGroup(name string) slog.Handler {
+	return fieldsHandler{h.Handler.WithGroup(name)}
+}
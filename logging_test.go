@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger("warn", "json", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "proxy", "http://proxy:8080")
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "shown", record["msg"])
+	assert.Equal(t, "http://proxy:8080", record["proxy"])
+
+	out.Reset()
+	logger, err = newLogger("DEBUG", "text", &out)
+	assert.NoError(t, err)
+	logger.Debug("shown")
+	assert.Contains(t, out.String(), "level=DEBUG msg=shown")
+
+	_, err = newLogger("verbose", "json", &out)
+	assert.Error(t, err)
+	_, err = newLogger("info", "xml", &out)
+	assert.Error(t, err)
+}
+
+func TestRequestLogFields(t *testing.T) {
+	var out bytes.Buffer
+	logger, _ := newLogger("info", "json", &out)
+	defer log.SetFlags(log.Flags())
+	defer log.SetOutput(log.Writer())
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	r, err := http.NewRequest(http.MethodPost, "/", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	observeRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addLogFields(r.Context(), slog.String("host", "example.com"))
+		slog.InfoContext(r.Context(), "Retrying request")
+		w.Header().Set(proxyUsedHeaderName, "http://proxy:8080")
+		writeFailure(w, r, http.StatusBadGateway, errConnect, errUnauthenticated)
+	})).ServeHTTP(w, r)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var records []map[string]any
+	for _, line := range lines {
+		var record map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	if assert.Len(t, records, 3) {
+		// Records logged with the request carry its fields
+		assert.Equal(t, "Retrying request", records[0]["msg"])
+		assert.Equal(t, "POST", records[0]["method"])
+		assert.NotEmpty(t, records[0]["request_id"])
+		assert.Equal(t, "example.com", records[0]["host"])
+		assert.Equal(t, "Request failed", records[1]["msg"])
+		assert.Equal(t, "POST", records[1]["method"])
+		assert.Equal(t, records[0]["request_id"], records[1]["request_id"])
+		assert.Equal(t, "example.com", records[1]["host"])
+
+		served := records[2]
+		assert.Equal(t, "Served request", served["msg"])
+		assert.Equal(t, "WARN", served["level"])
+		assert.Equal(t, "example.com", served["host"])
+		assert.Equal(t, float64(http.StatusBadGateway), served["status"])
+		assert.Equal(t, "http://proxy:8080", served["proxy"])
+		assert.Equal(t, string(errConnect), served["code"])
+		assert.Contains(t, served, "duration_ms")
+	}
+}
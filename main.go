@@ -1,9 +1,13 @@
 package main
 
 import (
+	"compress/gzip"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/netip"
 	"net/url"
 	"os"
 	"strconv"
@@ -12,6 +16,7 @@ import (
 
 	fhttp "github.com/Noooste/fhttp"
 	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
 	"github.com/stanislav-milchev/tls-impersonator/browser"
 )
 
@@ -22,17 +27,259 @@ var (
 	bufferingHeaderName = getEnv("TLS_BUFFER", "x-tls-buffer")
 	redirectHeaderName  = getEnv("TLS_REDIRECT", "x-tls-allowredirect")
 	timeoutHeaderName   = getEnv("TLS_TIMEOUT", "x-tls-timeout")
+	browserHeaderName   = getEnv("TLS_BROWSER", "x-tls-browser")
+
+	streamTimeoutHeaderName = getEnv("TLS_STREAM_TIMEOUT", "x-tls-stream-timeout")
+	idleTimeoutHeaderName   = getEnv("TLS_IDLE_TIMEOUT", "x-tls-idle-timeout")
+	postQuantumHeaderName   = getEnv("TLS_POST_QUANTUM", "x-tls-post-quantum")
+	greaseECHHeaderName     = getEnv("TLS_GREASE_ECH", "x-tls-grease-ech")
+	minVersionHeaderName    = getEnv("TLS_MIN_VERSION", "x-tls-min-version")
+	maxVersionHeaderName    = getEnv("TLS_MAX_VERSION", "x-tls-max-version")
+	alpnHeaderName          = getEnv("TLS_ALPN", "x-tls-alpn")
+	sessionIDHeaderName     = getEnv("TLS_SESSION_ID", "x-tls-session-id")
+	clientKeyHeaderName     = getEnv("TLS_CLIENT_KEY", "x-tls-client-key")
+	methodHeaderName        = getEnv("TLS_METHOD", "x-tls-method")
+
+	// listenAddr are the comma separated addresses the server listens on, any
+	// address on the port unless set
+	listenAddr = getEnv("TLS_LISTEN_ADDR", "")
+	// defaultBrowser is the browser profile of requests that do not ask for one
+	defaultBrowser = newSetting(getEnv("TLS_DEFAULT_BROWSER", browser.DefaultProfile))
+	// logUpstream turns the azuretls log of the upstream requests on or off
+	logUpstream = isTrue(getEnv("TLS_LOG_UPSTREAM", "true"))
 )
 
 func main() {
-    port := fmt.Sprintf(":%s", serverPort)
-	log.Printf("Listening on localhost%s", port)
+	flag.String("config", configFile, "YAML file with the settings, env vars take precedence over it")
+	profilesDir := flag.String(
+		"profiles-dir", getEnv("TLS_PROFILES_DIR", ""), "directory with JSON browser profile definitions",
+	)
+	ipDB := flag.String(
+		"ip-db", getEnv("TLS_IP_DB", ""), "comma separated MaxMind DB files to annotate the exits of proxies from",
+	)
+	cookiesDir := flag.String(
+		"cookies-dir", getEnv("TLS_COOKIES_DIR", ""), "directory to persist pinned sessions and their cookies in",
+	)
+	redisURL := flag.String(
+		"redis-url", getEnv("TLS_REDIS_URL", ""), "redis to share pinned sessions and their cookies with other instances",
+	)
+	proxyFile := flag.String(
+		"proxy-file", getEnv("TLS_PROXY_FILE", ""), "file with a proxy per line to rotate through when requests bring none",
+	)
+	pacFile := flag.String(
+		"pac-file", getEnv("TLS_PAC_FILE", ""), "path or URL of a PAC file picking the proxy of requests that bring none",
+	)
+	flag.StringVar(
+		&downloadDir, "download-dir", getEnv("TLS_DOWNLOAD_DIR", ""), "directory response bodies can be downloaded to",
+	)
+	certFile := flag.String(
+		"tls-cert", getEnv("TLS_CERT_FILE", ""), "PEM certificate file to serve HTTPS with, along with --tls-key",
+	)
+	keyFile := flag.String(
+		"tls-key", getEnv("TLS_KEY_FILE", ""), "PEM key file of the --tls-cert certificate",
+	)
+	clientCAFile := flag.String(
+		"tls-client-ca", getEnv("TLS_CLIENT_CA_FILE", ""), "PEM file with the CAs callers need a client certificate of to be served",
+	)
+	acmeDomains := flag.String(
+		"acme-domains", getEnv("TLS_ACME_DOMAINS", ""), "comma separated domains to serve HTTPS for with certificates from Let's Encrypt",
+	)
+	acmeCacheDir := flag.String(
+		"acme-cache-dir", getEnv("TLS_ACME_CACHE_DIR", ""), "directory to keep the --acme-domains certificates in",
+	)
+	command, args := serviceCommand(os.Args[1:])
+	flag.CommandLine.Parse(args)
+	if command != "" {
+		if err := controlService(command, args); err != nil {
+			fatal("Error controlling the service", "command", command, "error", err)
+		}
+		return
+	}
+
+	setupLogging()
+	if errFileConfig != nil {
+		fatal("Error loading the configuration file", "file", configFile, "error", errFileConfig)
+	}
+	if configFile != "" {
+		slog.Info("Loaded the configuration file", "file", configFile, "settings", len(fileConfig))
+	}
+
+	pool, err := newUpstreamProxies(*proxyFile)
+	if err != nil {
+		fatal("Error setting up the proxy pool", "error", err)
+	}
+	if pool != nil {
+		setUpstreamProxies(pool)
+		slog.Info("Rotating through the proxy pool", "proxies", len(pool.proxies), "strategy", pool.strategy)
+	}
+
+	if *pacFile != "" {
+		pac, err := loadPAC(*pacFile)
+		if err != nil {
+			fatal("Error loading the PAC file", "error", err)
+		}
+		upstreamPAC.Store(pac)
+		slog.Info("Picking proxies with the PAC file", "file", *pacFile)
+	}
+
+	switch {
+	case *redisURL != "":
+		store, err := newRedisStore(*redisURL, getEnvSeconds("TLS_REDIS_TTL", 86400), getEnvInt("TLS_REDIS_POOL_SIZE", 8))
+		if err != nil {
+			fatal("Error parsing the redis URL", "error", err)
+		}
+		savedSessions = store
+	case *cookiesDir != "":
+		store, err := newFileStore(*cookiesDir)
+		if err != nil {
+			fatal("Error creating the cookies directory", "error", err)
+		}
+		savedSessions = store
+	}
+
+	if *profilesDir != "" {
+		loaded, err := browser.LoadDir(*profilesDir)
+		if err != nil {
+			fatal("Error loading browser profiles", "error", err)
+		}
+		slog.Info("Loaded browser profiles", "dir", *profilesDir, "profiles", len(loaded))
+	}
+	limits, err := loadLimits()
+	if err != nil {
+		fatal("Error parsing the limits", "error", err)
+	}
+	limits()
+	if rate := clientRate.get(); rate > 0 {
+		slog.Info("Limiting the rate of callers", "rate", rate, "burst", clientBurst.get())
+	}
+	if hosts := len(hostLimits.get()); hosts > 0 {
+		slog.Info("Throttling the requests to hosts", "hosts", hosts)
+	}
+	if admission := requestAdmission.get(); admission != nil {
+		slog.Info(
+			"Limiting the requests served at once",
+			"in_flight", cap(admission.slots), "queue", admission.maxQueue, "queue_timeout", admission.timeout.String(),
+		)
+	}
+	auth, err := loadAuth()
+	if err != nil {
+		fatal("Error parsing the credentials", "error", err)
+	}
+	auth()
+	if keys := len(apiKeys.get()); keys > 0 {
+		slog.Info("Requiring API keys from callers", "keys", keys)
+	}
+	if credentials := len(basicCredentials.get()); credentials > 0 {
+		slog.Info("Taking Basic auth from callers", "credentials", credentials)
+	}
+	if rules := callerIPRules.get(); len(rules.allow) > 0 || len(rules.deny) > 0 {
+		slog.Info("Serving callers by IP rules", "allow", len(rules.allow), "deny", len(rules.deny))
+	}
+
+	if *ipDB != "" {
+		db, err := loadIPDatabase(*ipDB)
+		if err != nil {
+			fatal("Error loading the IP databases", "error", err)
+		}
+		ipDatabases.Store(db)
+		slog.Info("Annotating proxy exits with the IP databases", "files", *ipDB)
+	}
+
+	if accessLog, err = openAccessLog(); err != nil {
+		fatal("Error opening the access log", "error", err)
+	}
+	if accessLog != nil {
+		slog.Info("Writing the access log", "file", getEnv("TLS_ACCESS_LOG", ""), "format", accessLog.format)
+	}
+
+	var tlsConfig *tls.Config
+	switch {
+	case *acmeDomains != "" && (*certFile != "" || *keyFile != ""):
+		fatal("Serve HTTPS with either --acme-domains or --tls-cert, not both")
+	case *acmeDomains != "":
+		manager, err := newACMEManager(
+			*acmeDomains, *acmeCacheDir, getEnv("TLS_ACME_EMAIL", ""), getEnv("TLS_ACME_DIRECTORY_URL", ""),
+		)
+		if err != nil {
+			fatal("Error setting up ACME", "error", err)
+		}
+		tlsConfig = acmeTLSConfig(manager)
+	case *certFile != "" || *keyFile != "":
+		if serverCert, err = loadCertificate(*certFile, *keyFile); err != nil {
+			fatal("Error loading the TLS certificate", "error", err)
+		}
+		tlsConfig = serverCert.tlsConfig()
+	}
+	if *clientCAFile != "" {
+		if tlsConfig == nil {
+			fatal("Requiring client certificates takes --tls-cert or --acme-domains")
+		}
+		if clientCA, err = loadCertificateAuthority(*clientCAFile); err != nil {
+			fatal("Error loading the client CA", "error", err)
+		}
+		clientCA.require(tlsConfig)
+	}
+
+	go sessions.runReaper()
+	go reloadOnSignal()
+
+	if proxyProtocolTrusted, err = parsePrefixes(getEnv("TLS_LISTEN_PROXY_PROTOCOL_TRUSTED", "")); err != nil {
+		fatal("Error parsing TLS_LISTEN_PROXY_PROTOCOL_TRUSTED", "error", err)
+	}
+	listeners, err := systemdListeners(tlsConfig != nil)
+	if err != nil {
+		fatal("Error taking over the sockets from systemd", "error", err)
+	}
+	if listeners != nil {
+		slog.Info("Taking over the sockets from systemd", "sockets", len(listeners))
+	} else {
+		addrs := listenAddr
+		if addrs == "" {
+			addrs = fmt.Sprintf(":%s", serverPort)
+		}
+		if listeners, err = parseListenAddresses(addrs, tlsConfig != nil); err != nil {
+			fatal("Error parsing TLS_LISTEN_ADDR", "error", err)
+		}
+	}
+	server := &fhttp.Server{TLSConfig: tlsConfig}
+	// Callers are checked before any work is done for them, with CORS headers
+	// so browsers hand the failures to the page
+	handler := allowCORS(filterIPs(requireAuth(limitClients(limitRequestBody(limitInFlight(fhttp.DefaultServeMux))))))
+	if err := serveHTTP2(server, countInFlight(observeRequests(recoverPanics(handler)))); err != nil {
+		fatal("Error setting up HTTP/2", "error", err)
+	}
+	serve, err := listen(server, listeners)
+	if err != nil {
+		fatal("Error starting the HTTP server", "error", err)
+	}
+	for _, addr := range listeners {
+		slog.Info("Listening", "address", addr.String())
+	}
+	if listenProxyProtocol {
+		slog.Info("Taking the callers of TCP connections from their PROXY protocol header", "trusted", getEnv("TLS_LISTEN_PROXY_PROTOCOL_TRUSTED", ""))
+	}
 	fhttp.HandleFunc("/", HandleReq)
 	fhttp.HandleFunc("/isalive", HandleIsAlive)
+	fhttp.HandleFunc("/api/profiles", HandleProfiles)
+	fhttp.HandleFunc("/api/exits", HandleExits)
+	fhttp.HandleFunc("/api/fingerprint", HandleFingerprint)
+	fhttp.HandleFunc("/api/sessions", HandleSessions)
+	fhttp.HandleFunc("/api/sessions/", HandleSessions)
+	fhttp.HandleFunc("/api/proxies", HandleProxies)
+	fhttp.HandleFunc("/api/config/reload", HandleReload)
+	fhttp.HandleFunc("/metrics", HandleMetrics)
+
+	if adminAddr != "" {
+		l, serveAdmin, err := listenAdmin(adminAddr)
+		if err != nil {
+			fatal("Error starting the admin server", "error", err)
+		}
+		slog.Info("Serving the admin endpoints", "address", l.Addr().String())
+		go func() { slog.Error("The admin server stopped", "error", serveAdmin()) }()
+	}
 
-	err := fhttp.ListenAndServe(port, nil)
-	if err != nil {
-		log.Fatalln("Error starting the HTTP server:", err)
+	if err := runService(func() error { return runServer(server, serve) }); err != nil {
+		fatal("Error starting the HTTP server", "error", err)
 	}
 }
 
@@ -44,150 +291,659 @@ func HandleIsAlive(w fhttp.ResponseWriter, r *fhttp.Request) {
 
 // HandleReq takes the incoming request, parses it, sends it towards the target host
 func HandleReq(w fhttp.ResponseWriter, r *fhttp.Request) {
-	session, req, err := NewRequest(r)
+	maxBody, err := parseMaxBody(r.Header.Get(maxBodyHeaderName))
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(fhttp.StatusBadRequest)
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, fmt.Errorf("invalid '%s': %w", maxBodyHeaderName, err))
 		return
 	}
 
-	defer session.Close()
+	resumes, err := parseResumes(r.Header.Get(resumeHeaderName))
+	if err != nil {
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, fmt.Errorf("invalid '%s': %w", resumeHeaderName, err))
+		return
+	}
 
-	SetHeaders(session, r.Header)
-	SetCookies(req.Url, session, r.Cookies())
+	maxRate, err := parseMaxRate(r.Header.Get(maxRateHeaderName))
+	if err != nil {
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, fmt.Errorf("invalid '%s': %w", maxRateHeaderName, err))
+		return
+	}
 
-	res, err := session.Do(req)
+	downloadTo, err := downloadPath(r.Header.Get(downloadHeaderName))
+	if err != nil {
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, fmt.Errorf("invalid '%s': %w", downloadHeaderName, err))
+		return
+	}
 
+	policy, err := parseRetryPolicy(r.Header)
+	if err != nil {
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, err)
+		return
+	}
+	hedge, err := parseHedge(r.Header.Get(hedgeHeaderName))
 	if err != nil {
-		if strings.Contains(err.Error(), "timeout") {
-			fmt.Print("timeout\n", err)
-			w.WriteHeader(fhttp.StatusRequestTimeout)
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, err)
+		return
+	}
+	if policy.retries > 0 || hedge > 0 {
+		replayable, err := replayBody(r)
+		if err != nil {
+			writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, fmt.Errorf("reading the request body: %w", err))
 			return
-		} else {
-			fmt.Print("other error:\n", err)
-			w.WriteHeader(fhttp.StatusInternalServerError)
+		}
+		if !replayable {
+			slog.InfoContext(r.Context(), "Not retrying or hedging the request, its body is too large to send again")
+			policy.retries, hedge = 0, 0
+		}
+	}
+
+	session, req, err := NewRequest(r)
+	if err != nil {
+		writeFailure(w, r, fhttp.StatusBadRequest, errBadRequest, err)
+		return
+	}
+	if u, err := url.Parse(req.Url); err == nil {
+		addLogFields(r.Context(), slog.String("host", u.Hostname()))
+	}
+	noteProxied(r, req.Url)
+
+	healthy := false
+	defer func() { sessions.release(session, healthy) }()
+
+	// Requests to hosts with a concurrency cap wait for a free slot, held until
+	// the response is forwarded
+	done, err := findHostLimit(hostLimits.get(), req.Url).acquire(req.Context())
+	if err != nil {
+		healthy = true
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "Caller went away waiting for a turn to send", "url", req.Url)
 			return
 		}
+		writeFailure(w, r, fhttp.StatusGatewayTimeout, errTimeout, fmt.Errorf("waiting for a turn to send to %s: %w", req.Url, err))
+		return
+	}
+	defer done()
+
+	var res *azuretls.Response
+	for attempt := 1; ; attempt++ {
+		session, req, res, err = sendHedged(w, r, session, req, hedge)
+
+		// Requests going through the proxy pool fail over to the next proxy that is
+		// up when theirs cannot be reached
+		for tries := 1; err != nil && failsOver(r, session, err) && tries < proxyFailoverTries; tries++ {
+			slog.WarnContext(r.Context(), "Failing over from proxy", "proxy", redactProxy(session.proxy()), "error", err)
+			upstreamProxies.Load().markDown(session.proxy())
+
+			next, nextReq, nextErr := NewRequest(r)
+			if nextErr != nil {
+				break
+			}
+			sessions.release(session, false)
+			session, req = next, nextReq
+			res, err = sendRequest(w, r, session, req)
+		}
+
+		if policy.retries > 0 {
+			w.Header().Set(attemptsHeaderName, strconv.Itoa(attempt))
+		}
+		status := 0
+		if err == nil {
+			status = res.StatusCode
+		}
+		if attempt > policy.retries || r.Context().Err() != nil || !policy.retry(err, status, session.proxy() != "") {
+			break
+		}
+
+		// Transient failures are tried again on a fresh request, after a backoff
+		if !waitRetry(r.Context(), policy.delay(attempt)) {
+			err = r.Context().Err()
+			break
+		}
+		if r.GetBody != nil {
+			r.Body, _ = r.GetBody()
+		}
+		next, nextReq, nextErr := NewRequest(r)
+		if nextErr != nil {
+			break
+		}
+		if err == nil {
+			slog.InfoContext(r.Context(), "Retrying request", "url", req.Url, "upstream_status", status)
+			recordResponse(session, status)
+			res.RawBody.Close()
+		} else {
+			slog.InfoContext(r.Context(), "Retrying request", "url", req.Url, "error", err)
+		}
+		sessions.release(session, err == nil)
+		session, req = next, nextReq
+	}
+
+	stats := &session.stats
+	if err != nil && r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "Caller went away, cancelled request", "url", req.Url)
+		healthy = true
+		return
+	}
+	if err != nil && requestBodyTooLarge(r) {
+		writeFailure(w, r, fhttp.StatusRequestEntityTooLarge, errRequestTooLarge, errRequestBodyTooLarge)
+		return
+	}
+	if err != nil {
+		setUpstreamWarning(w, err, false)
+		status, code := classifyFailure(err, session.proxy() != "")
+		writeFailure(w, r, status, code, err)
+		return
+	}
+
+	// The session jar took the cookies already, keep them for persisting it
+	session.recordSavedCookies(session.responseCookies)
+	if isTrue(r.Header.Get(cookiesHeaderName)) {
+		setCookiesHeader(w, session.responseCookies)
+	}
+
+	recordResponse(session, res.StatusCode)
+	if isTrue(r.Header.Get(sessionStatsHeaderName)) {
+		w.Header().Set(sessionStatsHeaderName, stats.String())
+	}
+
+	head, repairs := session.heads.take(res.Header)
+	warnRepairs(w, r, repairs)
+	res.RawBody = throttleBody(r.Context(), resumeBody(session, req, res, resumes), maxRate)
+
+	// Downloaded bodies stay on the server, the caller only gets where they went
+	if downloadTo != "" {
+		written, ok := saveDownload(w, r, res, limitBody(res.RawBody, maxBody), downloadTo)
+		stats.Bytes.Add(written)
+		healthy = ok
+		return
+	}
+
+	if isTrue(r.Header.Get(preserveHeadersHeaderName)) {
+		forwardOriginalHeaders(w, res, head)
+	} else {
+		forwardHeaders(w, res, head)
+	}
+	encodings := keptEncodings(r, res)
+	for _, v := range encodings {
+		w.Header().Add("Content-Encoding", v)
+	}
+	raw := len(encodings) > 0
+	// The HTTP/1.1 transport drops the length of bodies it would have decoded
+	if length := headValue(head, "Content-Length"); raw && length != "" && res.Header.Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", length)
+	}
+
+	buffering := isTrue(r.Header.Get(bufferingHeaderName))
+	timed := isTrue(r.Header.Get(timingHeaderName))
+	gzipped := gzipsResponse(w, r, req, res, raw)
+	limited := limitBody(res.RawBody, maxBody)
+
+	// Either return no body, a buffered response or a stream
+	if isHead(r, req) || !bodyAllowed(res.StatusCode) {
+		bodylessLength(w, res, raw)
+		if timed {
+			session.timing.set(w, true, false)
+		}
+		w.WriteHeader(res.StatusCode)
+		healthy = true
+
+		res.RawBody.Close()
+	} else if buffering {
+		readBody, readErr := io.ReadAll(limited)
+		limited.Close()
+		// Bodies over the limit are cut at it and flagged instead of failing
+		truncated := errors.Is(readErr, errBodyTooLarge)
+		if truncated {
+			slog.WarnContext(r.Context(), "Response body cut", "max_body", maxBody)
+			w.Header().Set(errorHeaderName, string(errBodyLimit))
+		} else if readErr != nil {
+			slog.ErrorContext(r.Context(), "Error buffering response", "error", readErr)
+
+			// Forward whatever the upstream managed to send, flagged as incomplete
+			if !setUpstreamWarning(w, readErr, false) {
+				readBody = nil
+			}
+			w.Header().Del("Content-Length")
+		}
+		body := readBody
+		if gzipped {
+			body = gzipBytes(readBody)
+		}
+		if readErr == nil || truncated {
+			// Unless kept encoded, the upstream length is the one of the encoded body
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if timed {
+			session.timing.set(w, true, false)
+		}
+
+		w.WriteHeader(res.StatusCode)
+		w.Write(body)
+		stats.Bytes.Add(int64(len(readBody)))
+		if !truncated {
+			forwardTrailers(w, res)
+		}
+		healthy = readErr == nil || truncated
+	} else {
+		streamTimeout := parseStreamTimeout(r.Header.Get(streamTimeoutHeaderName))
+		idleTimeout := parseStreamTimeout(r.Header.Get(idleTimeoutHeaderName))
+		flushInterval := parseFlushInterval(r.Header.Get(flushIntervalHeaderName))
+		chunkSize := parseChunkSize(r.Header.Get(chunkSizeHeaderName))
+
+		// The length of an encoded body is not the one of the decoded stream
+		if !raw && res.Header.Get("Content-Encoding") != "" {
+			w.Header().Del("Content-Length")
+		}
+		// Nor is it the one of a body cut at the limit
+		if maxBody > 0 && res.ContentLength > maxBody {
+			w.Header().Del("Content-Length")
+		}
+		if timed {
+			session.timing.set(w, false, false)
+		}
+		w.WriteHeader(res.StatusCode)
+		flushed := newFlushWriter(w, flushInterval)
+		defer flushed.stop()
+		var out io.Writer = flushed
+		if gzipped {
+			gz := gzipStream{gzip.NewWriter(flushed)}
+			defer gz.Close()
+			out = gz
+		}
+		written, err := copyStream(out, limited, streamTimeout, idleTimeout, chunkSize)
+		stats.Bytes.Add(written)
+		if err != nil && r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "Caller went away, cancelled stream", "url", req.Url)
+			err = nil
+		} else if errors.Is(err, errBodyTooLarge) {
+			slog.WarnContext(r.Context(), "Response stream cut", "max_body", maxBody)
+			w.Header().Set(fhttp.TrailerPrefix+errorHeaderName, string(errBodyLimit))
+			err = nil
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Error streaming response", "error", err)
+			setUpstreamWarning(w, err, true)
+		} else {
+			forwardTrailers(w, res)
+		}
+		if timed {
+			session.timing.set(w, true, true)
+		}
+		healthy = err == nil
+
+		res.RawBody.Close()
 	}
+}
 
-	// Forward the headers received
+// forwardHeaders copies the headers of the upstream response to the caller,
+// head is the response as captured if it was. It has to run before the status
+// is written, the server drops headers set later.
+func forwardHeaders(w fhttp.ResponseWriter, res *azuretls.Response, head []headerField) {
+	hop := hopByHop(res.Header, head)
 	for h, v := range res.Header {
 		// Response we get is already decoded so this header will only cause issues with the
 		// client used for the request
-		if "content-encoding" == strings.ToLower(h) {
+		if "content-encoding" == strings.ToLower(h) || h == encodingMarker {
 			continue
 		}
-		if len(v) > 0 {
-			w.Header().Set(h, v[0])
-		} else {
-			fmt.Printf("Skipping \"%s\" header with invalid value", h)
+		// The caller gets its own connection to the server, see hopByHop
+		if isHopByHop(hop, h) || ownCORSHeader(w, h) {
 			continue
 		}
-
+		if len(v) == 0 {
+			slog.Debug("Skipping header with invalid value", "header", h)
+			continue
+		}
+		// Every value is surfaced to the caller, e.g. all the cookies; the session
+		// jar keeps its own copy of them
+		for _, value := range v {
+			w.Header().Add(h, value)
+		}
 	}
+}
 
-	var buffering bool
-	switch b := r.Header.Get(bufferingHeaderName); b {
-	case "true", "True", "1":
-		buffering = true
-	default:
-		buffering = false
+// forwardTrailers copies the trailers of the upstream response to the caller,
+// once the body was read and they are known
+func forwardTrailers(w fhttp.ResponseWriter, res *azuretls.Response) {
+	if res.HttpResponse == nil {
+		return
+	}
+	for h, v := range res.HttpResponse.Trailer {
+		for _, value := range v {
+			w.Header().Add(fhttp.TrailerPrefix+h, value)
+		}
+	}
+}
 
+// sendRequest sends the request with the headers and cookies of the caller,
+// and sets the response headers telling the caller which session, proxy and
+// exit IP it went through
+func sendRequest(w fhttp.ResponseWriter, r *fhttp.Request, session *pooledSession, req *azuretls.Request) (*azuretls.Response, error) {
+	if session.id != "" {
+		w.Header().Set(sessionIDHeaderName, session.id)
+	}
+	if proxy := redactProxy(session.proxy()); proxy != "" {
+		w.Header().Set(proxyUsedHeaderName, proxy)
 	}
 
-	w.WriteHeader(res.StatusCode)
-	// Either return buffered response or a stream
-	if buffering {
-		if readBody, readErr := res.ReadBody(); readErr == nil {
-			w.Write(readBody)
-		} else {
-			log.Printf("Error buffering response: %v", readErr)
+	SetHeaders(session.Session, r.Header)
+	if compressesBody(r) {
+		session.OrderedHeaders.Set("Content-Encoding", "gzip")
+	}
+	SetCookies(req.Url, session.Session, r.Cookies())
+	session.recordCookies(req.Url, r.Cookies())
+	raw := keepsEncoding(r)
+	session.heads.keepEncoding.Store(raw)
+	setDecompression(session.Session, !raw)
+	setLogging(session.Session, req.Method)
+
+	session.hops, session.lastResponse, session.responseCookies = 0, nil, nil
+	session.host = hostOverride{}
+	if host := r.Header.Get(hostHeaderName); host != "" {
+		u, _ := url.Parse(req.Url)
+		session.host = hostOverride{host, u.Host}
+	}
+	// Requests to hosts with a rate cap are sent at it
+	if err := findHostLimit(hostLimits.get(), req.Url).pace(req.Context()); err != nil {
+		if r.Context().Err() != nil {
+			return nil, r.Context().Err()
 		}
-	} else {
-		_, err = io.Copy(w, res.RawBody)
-		if err != nil {
-			log.Printf("Error streaming response: %v", err)
+		return nil, fmt.Errorf("waiting for a turn to send to %s: %w", req.Url, err)
+	}
+
+	session.timing.reset()
+	res, err := session.Do(req)
+	if err != nil {
+		res, err = session.cappedRedirect(req, timeoutCause(req.Context(), err))
+	}
+	if err != nil {
+		// Requests the caller gave up on tell nothing about the upstream or proxy
+		if r.Context().Err() != nil {
+			return nil, r.Context().Err()
 		}
+		session.stats.recordError()
+		upstreamErrors.Add(1)
+		session.countProxyUse(0)
+		upstreamProxies.Load().record(session.proxy(), 0)
+		return nil, err
+	}
 
-		res.RawBody.Close()
+	session.timing.ttfb = time.Since(session.timing.start)
+	upstreamDuration.observe(session.timing.ttfb.Seconds())
+
+	if exit := session.exitIP(res.Url); exit != "" {
+		w.Header().Set(exitIPHeaderName, exit)
+		if ip, err := netip.ParseAddr(exit); err == nil {
+			proxyExits.recordExit(session.proxy(), ip)
+		}
 	}
+	session.setConnHeaders(w, res.Url)
+	setRedirectHeaders(w, req, res, session.hops)
+	return res, nil
 }
 
-// NewRequest opens a new azuretls session and a request, and sets it up with url,
-// proxy, headers, cookies, redirects and timeouts
-func NewRequest(r *fhttp.Request) (*azuretls.Session, *azuretls.Request, error) {
-	// Open and set-up session
-	session := azuretls.NewSession()
-	session.EnableLog()
+// recordResponse counts a response the session got in its stats and the ones
+// of its proxy
+func recordResponse(session *pooledSession, status int) {
+	session.stats.recordResponse(status)
+	session.countProxyUse(status)
+	upstreamProxies.Load().record(session.proxy(), status)
+}
 
+// failsOver reports whether the request can be tried again through another
+// proxy of the pool. Pinned sessions and proxies of the caller are kept, the
+// pool is not used with a PAC file.
+func failsOver(r *fhttp.Request, session *pooledSession, err error) bool {
+	return upstreamProxies.Load() != nil && upstreamPAC.Load() == nil && session.id == "" &&
+		r.Header.Get(proxyHeaderName) == "" && isProxyError(err)
+}
+
+// NewRequest takes a session from the pool and opens a request, and sets it up with
+// url, proxy, headers, cookies, redirects and timeouts
+func NewRequest(r *fhttp.Request) (*pooledSession, *azuretls.Request, error) {
 	// Parse URL
-	urlHeader := r.Header.Get(urlHeaderName)
+	urlHeader, err := targetURL(r)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if urlHeader == "" {
-		return nil, nil, fmt.Errorf(
-			"no valid request URL supplied via '%s'; skipping request", urlHeaderName,
-		)
+	key, err := parseSessionKey(r, urlHeader)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Parse redirects
-	var allowRedirects bool
-	switch rH := r.Header.Get(redirectHeaderName); rH {
-	case "true", "True", "1":
-		allowRedirects = true
-	default:
-		allowRedirects = false
+	// Use the session pinned by the caller or its client key, or take a warm
+	// session for the host, proxy and fingerprint
+	id := r.Header.Get(sessionIDHeaderName)
+	if clientKey := r.Header.Get(clientKeyHeaderName); id == "" && clientKey != "" {
+		id = clientSessionID(clientKey)
+	}
 
+	// Proxies to rotate between are given like a single one, comma separated.
+	// Targets bypassing proxies have none left to rotate between.
+	var rotation *proxyRotation
+	if policy := r.Header.Get(proxyRotationHeaderName); policy != "" && !bypassesProxy(key.host) {
+		if id == "" {
+			return nil, nil, fmt.Errorf("'%s' needs a pinned session; skipping request", proxyRotationHeaderName)
+		}
+		if rotation, err = parseProxyRotation(policy, key.proxy); err != nil {
+			return nil, nil, fmt.Errorf("invalid '%s': %w", proxyRotationHeaderName, err)
+		}
+		key.proxy = rotation.Proxies[0]
 	}
 
-	// Parse timeout
-	timeoutHeader := r.Header.Get(timeoutHeaderName)
-	t, err := strconv.Atoi(timeoutHeader)
-	if err != nil || t <= 0 {
-		t = 30
+	// Callers limited to some methods have the upstream one given separately
+	method := r.Method
+	if override := r.Header.Get(methodHeaderName); override != "" {
+		if !validMethod(override) {
+			return nil, nil, fmt.Errorf("invalid '%s': '%s' is not a method", methodHeaderName, override)
+		}
+		method = strings.ToUpper(override)
 	}
-	timeout := time.Duration(t) * time.Second
-	session.SetTimeout(timeout)
 
-	// Parse proxy
-	proxy := r.Header.Get(proxyHeaderName)
-	session.SetProxy(proxy)
+	if host := r.Header.Get(hostHeaderName); host != "" {
+		if err := checkHost(host); err != nil {
+			return nil, nil, fmt.Errorf("invalid '%s': %w", hostHeaderName, err)
+		}
+	}
+
+	phases, err := parseTimeouts(r.Header)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	maxRedirects, err := parseMaxRedirects(r.Header.Get(maxRedirectsHeaderName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid '%s': %w", maxRedirectsHeaderName, err)
+	}
+
+	var session *pooledSession
+	if id != "" {
+		session, err = sessions.acquirePinned(id, key, rotation)
+	} else {
+		session, err = sessions.acquire(key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	session.visit(key.host)
+
+	// Parse redirects
+	allowRedirects := isTrue(r.Header.Get(redirectHeaderName))
+
+	session.SetTimeout(phases.total)
+
+	// Bodies are streamed to the upstream as they come from the caller, gzipped
+	// ones with a length known only once they are done
 	var body any
-	if r.Method == fhttp.MethodPost {
+	length := r.ContentLength
+	if compressesBody(r) {
+		body, length = gzipBody(r.Body), -1
+	} else if r.Body != nil && r.Body != fhttp.NoBody {
 		body = r.Body
-	} else {
-		body = nil
 	}
 
 	req := &azuretls.Request{
-		Method:           r.Method,
+		Method:           method,
 		Url:              urlHeader,
 		DisableRedirects: !allowRedirects,
 		IgnoreBody:       true,
 		Body:             body,
 	}
+	// Callers going away cancel the request, its redirects and reading the body
+	req.SetContext(withTimeouts(withBodyLength(r.Context(), length), phases))
+	// A cap on the redirects follows them up to it, azuretls counts the requests
+	if maxRedirects >= 0 {
+		req.DisableRedirects = maxRedirects == 0
+		req.MaxRedirects = uint(maxRedirects) + 1
+	}
 
 	return session, req, nil
 }
 
-// SetHeaders sets the custom headers received in the server to the session
+// parseTLSVersions parses the TLS version range headers, leaving unset bounds zero
+func parseTLSVersions(headers fhttp.Header) (min uint16, max uint16, err error) {
+	if v := headers.Get(minVersionHeaderName); v != "" {
+		if min, err = browser.ParseTLSVersion(v); err != nil {
+			return 0, 0, fmt.Errorf("invalid '%s': %w", minVersionHeaderName, err)
+		}
+	}
+	if v := headers.Get(maxVersionHeaderName); v != "" {
+		if max, err = browser.ParseTLSVersion(v); err != nil {
+			return 0, 0, fmt.Errorf("invalid '%s': %w", maxVersionHeaderName, err)
+		}
+	}
+	if min != 0 && max != 0 && min > max {
+		return 0, 0, fmt.Errorf("'%s' is above '%s'", minVersionHeaderName, maxVersionHeaderName)
+	}
+
+	return min, max, nil
+}
+
+// validMethod reports whether the method is an HTTP token
+func validMethod(method string) bool {
+	return method != "" && strings.IndexFunc(method, func(c rune) bool {
+		return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+	}) < 0
+}
+
+// isHead reports whether the caller or the upstream request is a HEAD one,
+// either way the response has no body to forward
+func isHead(r *fhttp.Request, req *azuretls.Request) bool {
+	return r.Method == fhttp.MethodHead || req.Method == fhttp.MethodHead
+}
+
+// loggedMethods are the methods azuretls can log the requests of, it panics on
+// the others, e.g. HEAD
+var loggedMethods = map[string]bool{
+	fhttp.MethodGet:     true,
+	fhttp.MethodPost:    true,
+	fhttp.MethodPut:     true,
+	fhttp.MethodPatch:   true,
+	fhttp.MethodDelete:  true,
+	fhttp.MethodOptions: true,
+	fhttp.MethodConnect: true,
+}
+
+// setLogging makes the session log the request unless azuretls cannot or the
+// log is turned off. Sessions serve a request at a time, it is set for every
+// request.
+func setLogging(s *azuretls.Session, method string) {
+	if logUpstream && loggedMethods[method] {
+		s.EnableLog()
+	} else {
+		s.DisableLog()
+	}
+}
+
+// NewSession opens a new azuretls session impersonating the given browser profile
+func NewSession(profile *browser.Profile) (*azuretls.Session, error) {
+	session := azuretls.NewSession()
+	session.EnableLog()
+
+	if err := profile.Apply(session); err != nil {
+		session.Close()
+		return nil, err
+	}
+	session.OrderedHeaders = profile.Headers.Clone()
+
+	return session, nil
+}
+
+// SetHeaders merges the custom headers received in the server into the browser
+// headers of the session
 func SetHeaders(s *azuretls.Session, headers fhttp.Header) {
-	browserHeaders := browser.Chrome126
+	browserHeaders := s.OrderedHeaders
+	hop := hopByHop(headers, nil)
 	customHeaderNames := []string{
 		urlHeaderName,
 		proxyHeaderName,
 		redirectHeaderName,
 		timeoutHeaderName,
+		connectTimeoutHeaderName,
+		handshakeTimeoutHeaderName,
+		headerTimeoutHeaderName,
 		bufferingHeaderName,
+		browserHeaderName,
+		streamTimeoutHeaderName,
+		idleTimeoutHeaderName,
+		flushIntervalHeaderName,
+		chunkSizeHeaderName,
+		sessionStatsHeaderName,
+		postQuantumHeaderName,
+		greaseECHHeaderName,
+		minVersionHeaderName,
+		maxVersionHeaderName,
+		alpnHeaderName,
+		sessionIDHeaderName,
+		clientKeyHeaderName,
+		proxyRotationHeaderName,
+		proxyUserHeaderName,
+		proxyPassHeaderName,
+		localAddrHeaderName,
+		ipFamilyHeaderName,
+		preserveHeadersHeaderName,
+		rawEncodingHeaderName,
+		maxRedirectsHeaderName,
+		timingHeaderName,
+		cookiesHeaderName,
+		maxBodyHeaderName,
+		compressBodyHeaderName,
+		methodHeaderName,
+		hostHeaderName,
+		resolveHeaderName,
+		urlBaseHeaderName,
+		resumeHeaderName,
+		downloadHeaderName,
+		maxRateHeaderName,
+		retriesHeaderName,
+		retryBackoffHeaderName,
+		retryStatusHeaderName,
+		hedgeHeaderName,
 	}
 Outer:
 	for k, v := range headers {
+		// Cookies of the caller go through the session cookie jar, see SetCookies
+		if strings.ToLower(k) == "cookie" {
+			continue
+		}
+		// Those of the connection to the server are not the upstream's, the
+		// profile brings its own
+		if isHopByHop(hop, k) {
+			continue
+		}
 		for _, header := range customHeaderNames {
 			if strings.ToLower(header) == strings.ToLower(k) {
 				continue Outer
 			}
 		}
 
+		// The body goes out as the caller sent it, so do the headers describing it,
+		// e.g. the boundary of a multipart body, over those of the session
+		if bodyHeaders[fhttp.CanonicalHeaderKey(k)] {
+			browserHeaders.Set(k, v[0])
+			continue
+		}
+
 		exist := browserHeaders.Get(strings.ToLower(k)) != ""
 		if !exist {
 			browserHeaders = append(browserHeaders, []string{k, v[0]})
@@ -197,6 +953,8 @@ Outer:
 	s.OrderedHeaders = browserHeaders
 }
 
+// SetCookies stores the cookies of the caller in the session jar, which attaches
+// them along with the ones set by the upstream
 func SetCookies(url_ string, s *azuretls.Session, c []*fhttp.Cookie) {
     parsed, err := url.Parse(url_)
     if err != nil {
@@ -206,10 +964,57 @@ func SetCookies(url_ string, s *azuretls.Session, c []*fhttp.Cookie) {
     s.CookieJar.SetCookies(parsed, c)
 }
 
+// isTrue reports whether a boolean dev header is switched on
+func isTrue(value string) bool {
+	switch value {
+	case "true", "True", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseToggle parses a header that switches a feature on or off
+func parseToggle(value string) toggle {
+	switch value {
+	case "true", "True", "1":
+		return toggleOn
+	case "false", "False", "0":
+		return toggleOff
+	default:
+		return toggleUnset
+	}
+}
+
+// getEnvInt reads a non-negative number from the environment
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil || value < 0 {
+		slog.Warn("Invalid setting, using the default", "setting", key, "default", fallback)
+		value = fallback
+	}
+	return value
+}
+
+// getEnvSeconds reads a duration in seconds from the environment
+func getEnvSeconds(key string, fallback int) time.Duration {
+	seconds, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil || seconds < 0 {
+		slog.Warn("Invalid setting, using the default", "setting", key, "default", fmt.Sprintf("%ds", fallback))
+		seconds = fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getEnv returns the env var, or the setting of the configuration file when it
+// is not set
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
 
 	}
+	if value, ok := fileConfig[key]; ok {
+		return value
+	}
 	return fallback
 }
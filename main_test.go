@@ -22,6 +22,9 @@ type mockResponseWriter struct {
 	statusCode int
 	headers    http.Header
 	body       *bytes.Buffer
+	// sent are the headers as they were when the status got written, the
+	// ones set later are dropped by the server unless they are trailers
+	sent http.Header
 }
 
 func NewMockResponseWriter(header http.Header, body *bytes.Buffer, statusCode int) *mockResponseWriter {
@@ -38,6 +41,7 @@ func (m *mockResponseWriter) Header() http.Header {
 
 func (m *mockResponseWriter) WriteHeader(statusCode int) {
 	m.statusCode = statusCode
+	m.sent = m.headers.Clone()
 }
 
 func (m *mockResponseWriter) Write(data []byte) (int, error) {
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// counterVec counts by a label value
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]int64)}
+}
+
+func (c *counterVec) add(label string, n int64) {
+	c.mu.Lock()
+	c.values[label] += n
+	c.mu.Unlock()
+}
+
+// snapshot returns the label values in order with their counts
+func (c *counterVec) snapshot() ([]string, map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]int64, len(c.values))
+	labels := make([]string, 0, len(c.values))
+	for label, n := range c.values {
+		values[label] = n
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels, values
+}
+
+// histogram counts observations in cumulative buckets of upper bounds
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the buckets, the sum and the count of the histogram as the
+// metric name
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+var (
+	// requestsServed counts the requests served by status code
+	requestsServed = newCounterVec()
+	// upstreamDuration is how long upstreams took to answer, up to the
+	// response head
+	upstreamDuration = newHistogram(0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60)
+	// upstreamErrors counts the requests that got no response from the upstream
+	upstreamErrors atomic.Int64
+	// bytesReceived and bytesSent count the bytes of the request and response
+	// bodies of callers
+	bytesReceived, bytesSent atomic.Int64
+)
+
+// metricsWriter records the status of a response and counts its bytes
+type metricsWriter struct {
+	fhttp.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = fhttp.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	bytesSent.Add(int64(n))
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(fhttp.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	bytesReceived.Add(int64(n))
+	return n, err
+}
+
+// observeRequests counts the requests of the handler by status in the
+// metrics, and the bytes of their bodies, and logs them once served along with
+// the fields of the request, in the access log too when proxied. Requests are
+// given an ID, or keep the one of the caller.
+func observeRequests(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		start := time.Now()
+		// The ID goes back to the caller. Only the one of the caller goes upstream
+		// with the request, browsers send none of their own.
+		id := requestID(r)
+		w.Header().Set(requestIDHeaderName, id)
+		ctx := withLogFields(
+			r.Context(), slog.String("request_id", id), slog.String("method", r.Method), slog.String("path", r.URL.Path),
+		)
+		if accessLog != nil {
+			ctx = withProxied(ctx)
+		}
+		r = r.WithContext(ctx)
+		if r.Body != nil && r.Body != fhttp.NoBody {
+			r.Body = countingBody{r.Body}
+		}
+		mw := &metricsWriter{ResponseWriter: w}
+		h.ServeHTTP(mw, r)
+		if mw.status == 0 {
+			mw.status = fhttp.StatusOK
+		}
+		requestsServed.add(strconv.Itoa(mw.status), 1)
+
+		// Health checks would drown the rest
+		level := slog.LevelInfo
+		if openPaths[r.URL.Path] {
+			level = slog.LevelDebug
+		} else if mw.status >= fhttp.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.Int("status", mw.status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		}
+		if proxy := w.Header().Get(proxyUsedHeaderName); proxy != "" {
+			attrs = append(attrs, slog.String("proxy", proxy))
+		}
+		if code := w.Header().Get(errorHeaderName); code != "" {
+			attrs = append(attrs, slog.String("code", code))
+		}
+		slog.LogAttrs(r.Context(), level, "Served request", attrs...)
+		if accessLog != nil {
+			accessLog.log(r, w.Header(), start, mw.status, mw.written)
+		}
+	})
+}
+
+// HandleMetrics serves the metrics in the Prometheus text format, on the admin
+// address only
+func HandleMetrics(w fhttp.ResponseWriter, r *fhttp.Request) {
+	if !adminOnly(w, r) {
+		return
+	}
+	if r.Method != fhttp.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+func writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("tls_impersonator_requests_total", "counter", "Requests served, by status code.")
+	codes, counts := requestsServed.snapshot()
+	for _, code := range codes {
+		fmt.Fprintf(w, "tls_impersonator_requests_total{code=%q} %d\n", code, counts[code])
+	}
+	metric("tls_impersonator_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(w, "tls_impersonator_requests_in_flight %d\n", inFlight.Load())
+
+	metric("tls_impersonator_upstream_duration_seconds", "histogram", "Time upstreams took to answer, up to the response head.")
+	upstreamDuration.write(w, "tls_impersonator_upstream_duration_seconds")
+	metric("tls_impersonator_upstream_errors_total", "counter", "Requests that got no response from the upstream.")
+	fmt.Fprintf(w, "tls_impersonator_upstream_errors_total %d\n", upstreamErrors.Load())
+
+	metric("tls_impersonator_sessions", "gauge", "Sessions open, in use or idle in the pool.")
+	sessions.mu.Lock()
+	open := sessions.open
+	sessions.mu.Unlock()
+	fmt.Fprintf(w, "tls_impersonator_sessions %d\n", open)
+
+	metric("tls_impersonator_received_bytes_total", "counter", "Bytes of the request bodies of callers.")
+	fmt.Fprintf(w, "tls_impersonator_received_bytes_total %d\n", bytesReceived.Load())
+	metric("tls_impersonator_sent_bytes_total", "counter", "Bytes of the responses sent to callers.")
+	fmt.Fprintf(w, "tls_impersonator_sent_bytes_total %d\n", bytesSent.Load())
+
+	pool := upstreamProxies.Load()
+	if pool == nil {
+		return
+	}
+	proxies := make([]string, len(pool.proxies))
+	for i, proxy := range pool.proxies {
+		// Do not hand out proxy credentials
+		proxies[i] = redactProxy(proxy)
+	}
+	for _, m := range []struct {
+		name, help string
+		value      func(i int) int64
+	}{
+		{"tls_impersonator_proxy_requests_total", "Requests through the proxy that got a response.", func(i int) int64 { return pool.stats[i].Requests.Load() }},
+		{"tls_impersonator_proxy_errors_total", "Requests through the proxy that got no response.", func(i int) int64 { return pool.stats[i].Errors.Load() }},
+		{"tls_impersonator_proxy_bans_total", "403 and 429 responses through the proxy.", func(i int) int64 { return pool.stats[i].Bans.Load() }},
+	} {
+		metric(m.name, "counter", m.help)
+		for i := range proxies {
+			fmt.Fprintf(w, "%s{proxy=%q} %d\n", m.name, proxies[i], m.value(i))
+		}
+	}
+	metric("tls_impersonator_proxy_down", "gauge", "Whether the proxy failed its health check.")
+	for i := range proxies {
+		down := 0
+		if pool.down[i].Load() {
+			down = 1
+		}
+		fmt.Fprintf(w, "tls_impersonator_proxy_down{proxy=%q} %d\n", proxies[i], down)
+	}
+}
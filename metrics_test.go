@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.1, 1)
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(2)
+
+	var out bytes.Buffer
+	h.write(&out, "latency_seconds")
+	assert.Equal(t, `latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+`, out.String())
+}
+
+func TestMetrics(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+
+	send := func(h http.HandlerFunc, r *http.Request) *mockResponseWriter {
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		observeRequests(h).ServeHTTP(w, r)
+		return w
+	}
+	r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("x-tls-url", url)
+	r.Header.Set("x-tls-buffer", "1")
+	sent, received := bytesSent.Load(), bytesReceived.Load()
+	assert.Equal(t, "ok", send(HandleReq, r).body.String())
+	assert.Equal(t, int64(2), bytesSent.Load()-sent)
+	assert.Equal(t, int64(4), bytesReceived.Load()-received)
+
+	r, err = http.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, send(HandleMetrics, r).statusCode)
+	w := send(HandleMetrics, asAdmin(r))
+	metrics := w.body.String()
+	assert.Contains(t, metrics, "# TYPE tls_impersonator_requests_total counter\n")
+	assert.Regexp(t, `(?m)^tls_impersonator_requests_total\{code="200"\} [1-9]`, metrics)
+	assert.Regexp(t, `(?m)^tls_impersonator_upstream_duration_seconds_count [1-9]`, metrics)
+	assert.Regexp(t, `(?m)^tls_impersonator_sessions \d+$`, metrics)
+	assert.Contains(t, metrics, "tls_impersonator_sent_bytes_total ")
+}
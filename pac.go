@@ -0,0 +1,968 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+const (
+	// pacTimeout bounds fetching a PAC file, the DNS lookups of its rules, and
+	// running it for a request
+	pacTimeout = 10 * time.Second
+	// pacMaxDepth bounds how deep calls of the PAC file nest, so a recursive one
+	// fails rather than overflowing the stack
+	pacMaxDepth = 64
+	// pacMaxCalls bounds the calls of a run of the PAC file
+	pacMaxCalls = 10000
+)
+
+// pacAllowHTTP lets PAC files be fetched over plain http://. The file picks
+// where all traffic goes, it is refused unless fetched over https:// otherwise.
+var pacAllowHTTP = isTrue(getEnv("TLS_PAC_ALLOW_HTTP", "0"))
+
+// upstreamPAC picks the proxy of requests that bring none, it is nil when no
+// PAC file is configured
+var upstreamPAC atomic.Pointer[pacScript]
+
+// pacScript is a proxy auto-config file. Without a JavaScript engine at hand it
+// is interpreted here, which covers what PAC files are made of: functions,
+// variables, if/else, returns, the boolean, comparison and + operators, string
+// methods, and the PAC helpers but the time based ones. Anything else, loops
+// and regular expressions included, fails to load rather than being guessed
+// at.
+type pacScript struct {
+	globals   map[string]any
+	functions map[string]*pacFunction
+}
+
+type pacFunction struct {
+	params []string
+	// locals are the variables the function declares with var, wherever in
+	// its body
+	locals []string
+	body   []pacStmt
+}
+
+// pacScope holds the variables of a function call, over the global ones
+type pacScope struct {
+	script *pacScript
+	run    *pacRun
+	vars   map[string]any
+}
+
+// pacRun is a run of the PAC file, with what it spent of its budget
+type pacRun struct {
+	depth, calls int
+	deadline     time.Time
+	// globals are the global variables once the run assigned one, the ones of
+	// the script are shared by concurrent runs and left as they were loaded
+	globals map[string]any
+}
+
+func newPACRun() *pacRun {
+	return &pacRun{deadline: time.Now().Add(pacTimeout)}
+}
+
+type (
+	pacExpr func(*pacScope) (any, error)
+	// pacStmt reports whether it returned, with the value
+	pacStmt func(*pacScope) (any, bool, error)
+)
+
+// loadPAC reads the PAC file at path, or fetches it when it is an http(s) URL
+func loadPAC(path string) (*pacScript, error) {
+	read := os.ReadFile
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		read = fetchPAC
+	}
+	if strings.HasPrefix(path, "http://") && !pacAllowHTTP {
+		return nil, errPACOverHTTP
+	}
+	src, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePAC(string(src))
+}
+
+var errPACOverHTTP = errors.New("PAC file over plain http:// refused, fetch it over https:// or set TLS_PAC_ALLOW_HTTP=1")
+
+func fetchPAC(u string) ([]byte, error) {
+	client := &fhttp.Client{
+		Timeout: pacTimeout,
+		CheckRedirect: func(r *fhttp.Request, via []*fhttp.Request) error {
+			if r.URL.Scheme != "https" && !pacAllowHTTP {
+				return errPACOverHTTP
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != fhttp.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// parsePAC parses a PAC file, which has to define FindProxyForURL(url, host)
+func parsePAC(src string) (*pacScript, error) {
+	tokens, err := tokenizePAC(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &pacParser{tokens: tokens}
+	script := &pacScript{globals: map[string]any{}, functions: map[string]*pacFunction{}}
+
+	// Top level variables are set right away, in order
+	run := newPACRun()
+	run.globals = script.globals
+	scope := &pacScope{script: script, run: run, vars: script.globals}
+	for !p.done() {
+		if p.accept("function") {
+			name := p.ident()
+			fn := &pacFunction{}
+			p.expect("(")
+			for !p.accept(")") && p.err == nil {
+				fn.params = append(fn.params, p.ident())
+				if !p.peek(")") {
+					p.expect(",")
+				}
+			}
+			p.locals = nil
+			fn.body = p.block()
+			fn.locals, p.locals = p.locals, nil
+			script.functions[name] = fn
+			continue
+		}
+		stmt := p.statement()
+		if p.err != nil {
+			break
+		}
+		if _, _, err := stmt(scope); err != nil {
+			return nil, err
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if fn := script.functions["FindProxyForURL"]; fn == nil || len(fn.params) != 2 {
+		return nil, errors.New("PAC file defines no FindProxyForURL(url, host) function")
+	}
+	return script, nil
+}
+
+// find returns what the PAC file says for the target, e.g. 'PROXY p:8080; DIRECT'
+func (s *pacScript) find(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	result, err := s.call(newPACRun(), "FindProxyForURL", []any{target, u.Hostname()})
+	if err != nil {
+		return "", err
+	}
+	str, ok := result.(string)
+	if !ok {
+		return "", errors.New("FindProxyForURL returned no string")
+	}
+	return str, nil
+}
+
+// proxy returns the proxy the PAC file picks for the target, nothing for
+// DIRECT. The first usable of its choices is taken.
+func (s *pacScript) proxy(target string) (string, error) {
+	result, err := s.find(target)
+	if err != nil {
+		return "", err
+	}
+
+	for _, choice := range strings.Split(result, ";") {
+		fields := strings.Fields(choice)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return "", nil
+		case "PROXY", "HTTP":
+			if len(fields) > 1 {
+				return "http://" + fields[1], nil
+			}
+		case "HTTPS":
+			if len(fields) > 1 {
+				return "https://" + fields[1], nil
+			}
+		case "SOCKS", "SOCKS5":
+			if len(fields) > 1 {
+				return "socks5://" + fields[1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no usable proxy in '%s'", result)
+}
+
+// call calls the function of the PAC file or the helper as a part of the run,
+// which fails once it goes over its budget
+func (s *pacScript) call(run *pacRun, name string, args []any) (any, error) {
+	run.calls++
+	switch {
+	case run.depth >= pacMaxDepth:
+		return nil, fmt.Errorf("PAC file: calls nested deeper than %d in %s", pacMaxDepth, name)
+	case run.calls > pacMaxCalls:
+		return nil, fmt.Errorf("PAC file: more than %d calls", pacMaxCalls)
+	case time.Now().After(run.deadline):
+		return nil, fmt.Errorf("PAC file: ran longer than %s", pacTimeout)
+	}
+	run.depth++
+	defer func() { run.depth-- }()
+
+	fn, ok := s.functions[name]
+	if !ok {
+		builtin, ok := pacBuiltins[name]
+		if !ok {
+			return nil, fmt.Errorf("undefined function %s", name)
+		}
+		return builtin(args)
+	}
+
+	scope := &pacScope{script: s, run: run, vars: map[string]any{}}
+	for _, local := range fn.locals {
+		scope.vars[local] = nil
+	}
+	for i, param := range fn.params {
+		if i < len(args) {
+			scope.vars[param] = args[i]
+		} else {
+			scope.vars[param] = nil
+		}
+	}
+	for _, stmt := range fn.body {
+		if result, returned, err := stmt(scope); err != nil || returned {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *pacScope) get(name string) (any, error) {
+	if v, ok := s.vars[name]; ok {
+		return v, nil
+	}
+	globals := s.run.globals
+	if globals == nil {
+		globals = s.script.globals
+	}
+	if v, ok := globals[name]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("undefined variable %s", name)
+}
+
+// set assigns a variable: a parameter or a variable the function declared, or
+// else a global one. Global variables are assigned for the rest of the run
+// only, the script is run by concurrent requests.
+func (s *pacScope) set(name string, v any) {
+	if _, local := s.vars[name]; local {
+		s.vars[name] = v
+		return
+	}
+	if s.run.globals == nil {
+		s.run.globals = maps.Clone(s.script.globals)
+	}
+	s.run.globals[name] = v
+}
+
+// pacToken is an identifier, a number, a punctuator, or a string literal with
+// its quotes left on
+type pacToken string
+
+func (t pacToken) isString() bool { return len(t) > 0 && (t[0] == '"' || t[0] == '\'') }
+
+func tokenizePAC(src string) ([]pacToken, error) {
+	var tokens []pacToken
+	punctuators := []string{"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "(", ")", "{", "}", ";", ",", ".", "!", "=", "+", "-", "<", ">"}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment in PAC file")
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, errors.New("unterminated string in PAC file")
+			}
+			tokens = append(tokens, pacToken(src[i:j+1]))
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := pacNumberEnd(src, i)
+			tokens = append(tokens, pacToken(src[i:j]))
+			i = j
+		case c == '/':
+			// Comments are taken above, anything else is a regular expression or a
+			// division
+			return nil, errors.New("regular expressions and division are not supported in PAC files")
+		case c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '$' || src[j] >= 'a' && src[j] <= 'z' ||
+				src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, pacToken(src[i:j]))
+			i = j
+		default:
+			matched := false
+			for _, punctuator := range punctuators {
+				if strings.HasPrefix(src[i:], punctuator) {
+					tokens = append(tokens, pacToken(punctuator))
+					i += len(punctuator)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unsupported character '%c' in PAC file", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// pacNumberEnd returns where the number literal starting at i ends: decimal
+// ones with a fraction and an exponent, or hexadecimal ones
+func pacNumberEnd(src string, i int) int {
+	digits := func(j int, hex bool) int {
+		for j < len(src) && (src[j] >= '0' && src[j] <= '9' ||
+			hex && (src[j] >= 'a' && src[j] <= 'f' || src[j] >= 'A' && src[j] <= 'F')) {
+			j++
+		}
+		return j
+	}
+	if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+		return digits(i+2, true)
+	}
+	j := digits(i, false)
+	if j < len(src) && src[j] == '.' {
+		j = digits(j+1, false)
+	}
+	if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+		k := j + 1
+		if k < len(src) && (src[k] == '+' || src[k] == '-') {
+			k++
+		}
+		if end := digits(k, false); end > k {
+			j = end
+		}
+	}
+	return j
+}
+
+// pacParser compiles the tokens into closures. It stops at the first error,
+// returning placeholders from then on.
+type pacParser struct {
+	tokens []pacToken
+	pos    int
+	err    error
+	// locals are the variables declared with var in the function being parsed
+	locals []string
+}
+
+// pacUnsupported are the keywords of what PAC files cannot use here, loops
+// among them, which would otherwise parse as calls of undefined functions
+var pacUnsupported = map[pacToken]bool{
+	"for": true, "while": true, "do": true, "break": true, "continue": true, "switch": true, "case": true,
+	"default": true, "function": true, "new": true, "this": true, "typeof": true, "instanceof": true,
+	"in": true, "delete": true, "void": true, "with": true, "try": true, "catch": true, "finally": true,
+	"throw": true, "let": true, "const": true, "class": true,
+}
+
+func (p *pacParser) done() bool { return p.err != nil || p.pos >= len(p.tokens) }
+
+func (p *pacParser) peek(t pacToken) bool { return p.pos < len(p.tokens) && p.tokens[p.pos] == t }
+
+func (p *pacParser) accept(t pacToken) bool {
+	if p.err == nil && p.peek(t) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) fail(format string, args ...any) {
+	if p.err == nil {
+		at := "the end"
+		if p.pos < len(p.tokens) {
+			at = "'" + string(p.tokens[p.pos]) + "'"
+		}
+		p.err = fmt.Errorf("PAC file: "+format+" at %s", append(args, at)...)
+	}
+}
+
+func (p *pacParser) expect(t pacToken) {
+	if !p.accept(t) {
+		p.fail("expected '%s'", t)
+	}
+}
+
+func (p *pacParser) ident() string {
+	if p.done() {
+		p.fail("expected a name")
+		return ""
+	}
+	t := p.tokens[p.pos]
+	if pacUnsupported[t] {
+		p.fail("unsupported '%s'", t)
+		return ""
+	}
+	if t.isString() || !(t[0] == '_' || t[0] == '$' || t[0] >= 'a' && t[0] <= 'z' || t[0] >= 'A' && t[0] <= 'Z') {
+		p.fail("expected a name")
+		return ""
+	}
+	p.pos++
+	return string(t)
+}
+
+func (p *pacParser) block() []pacStmt {
+	p.expect("{")
+	var stmts []pacStmt
+	for !p.accept("}") {
+		if p.done() {
+			p.fail("expected '}'")
+			return nil
+		}
+		stmts = append(stmts, p.statement())
+	}
+	return stmts
+}
+
+func (p *pacParser) statement() pacStmt {
+	switch {
+	case p.peek("{"):
+		stmts := p.block()
+		return func(s *pacScope) (any, bool, error) {
+			for _, stmt := range stmts {
+				if result, returned, err := stmt(s); err != nil || returned {
+					return result, returned, err
+				}
+			}
+			return nil, false, nil
+		}
+
+	case p.accept(";"):
+		return func(*pacScope) (any, bool, error) { return nil, false, nil }
+
+	case p.accept("if"):
+		p.expect("(")
+		cond := p.expression()
+		p.expect(")")
+		then := p.statement()
+		otherwise := func(*pacScope) (any, bool, error) { return nil, false, nil }
+		if p.accept("else") {
+			otherwise = p.statement()
+		}
+		return func(s *pacScope) (any, bool, error) {
+			v, err := cond(s)
+			if err != nil {
+				return nil, false, err
+			}
+			if pacTruthy(v) {
+				return then(s)
+			}
+			return otherwise(s)
+		}
+
+	case p.accept("return"):
+		var value pacExpr = func(*pacScope) (any, error) { return nil, nil }
+		if !p.peek(";") && !p.peek("}") {
+			value = p.expression()
+		}
+		p.accept(";")
+		return func(s *pacScope) (any, bool, error) {
+			v, err := value(s)
+			return v, true, err
+		}
+
+	case p.accept("var"):
+		var stmts []pacStmt
+		for {
+			name := p.ident()
+			p.locals = append(p.locals, name)
+			var value pacExpr = func(*pacScope) (any, error) { return nil, nil }
+			if p.accept("=") {
+				value = p.expression()
+			}
+			stmts = append(stmts, func(s *pacScope) (any, bool, error) {
+				v, err := value(s)
+				s.vars[name] = v
+				return nil, false, err
+			})
+			if !p.accept(",") {
+				break
+			}
+		}
+		p.accept(";")
+		return func(s *pacScope) (any, bool, error) {
+			for _, stmt := range stmts {
+				if _, _, err := stmt(s); err != nil {
+					return nil, false, err
+				}
+			}
+			return nil, false, nil
+		}
+	}
+
+	// An assignment, or an expression evaluated for nothing
+	if p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "=" {
+		name := p.ident()
+		p.expect("=")
+		value := p.expression()
+		p.accept(";")
+		return func(s *pacScope) (any, bool, error) {
+			v, err := value(s)
+			s.set(name, v)
+			return nil, false, err
+		}
+	}
+	value := p.expression()
+	p.accept(";")
+	return func(s *pacScope) (any, bool, error) {
+		_, err := value(s)
+		return nil, false, err
+	}
+}
+
+func (p *pacParser) expression() pacExpr { return p.or() }
+
+func (p *pacParser) or() pacExpr {
+	left := p.and()
+	for p.accept("||") {
+		l, r := left, p.and()
+		left = func(s *pacScope) (any, error) {
+			v, err := l(s)
+			if err != nil || pacTruthy(v) {
+				return v, err
+			}
+			return r(s)
+		}
+	}
+	return left
+}
+
+func (p *pacParser) and() pacExpr {
+	left := p.comparison()
+	for p.accept("&&") {
+		l, r := left, p.comparison()
+		left = func(s *pacScope) (any, error) {
+			v, err := l(s)
+			if err != nil || !pacTruthy(v) {
+				return v, err
+			}
+			return r(s)
+		}
+	}
+	return left
+}
+
+func (p *pacParser) comparison() pacExpr {
+	left := p.sum()
+	for _, op := range []pacToken{"===", "!==", "==", "!=", "<=", ">=", "<", ">"} {
+		if !p.accept(op) {
+			continue
+		}
+		l, r := left, p.sum()
+		return func(s *pacScope) (any, error) {
+			a, err := l(s)
+			if err != nil {
+				return nil, err
+			}
+			b, err := r(s)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "===":
+				return a == b, nil
+			case "!==":
+				return a != b, nil
+			case "==":
+				return pacLooseEqual(a, b), nil
+			case "!=":
+				return !pacLooseEqual(a, b), nil
+			}
+			x, y := pacNumber(a), pacNumber(b)
+			sa, saOK := a.(string)
+			sb, sbOK := b.(string)
+			if saOK && sbOK {
+				// Strings are compared in order rather than as numbers
+				x, y = float64(strings.Compare(sa, sb)), 0
+			}
+			switch op {
+			case "<=":
+				return x <= y, nil
+			case ">=":
+				return x >= y, nil
+			case "<":
+				return x < y, nil
+			}
+			return x > y, nil
+		}
+	}
+	return left
+}
+
+func (p *pacParser) sum() pacExpr {
+	left := p.unary()
+	for p.accept("+") {
+		l, r := left, p.unary()
+		left = func(s *pacScope) (any, error) {
+			a, err := l(s)
+			if err != nil {
+				return nil, err
+			}
+			b, err := r(s)
+			if err != nil {
+				return nil, err
+			}
+			x, xOK := a.(float64)
+			y, yOK := b.(float64)
+			if xOK && yOK {
+				return x + y, nil
+			}
+			return pacString(a) + pacString(b), nil
+		}
+	}
+	return left
+}
+
+func (p *pacParser) unary() pacExpr {
+	switch {
+	case p.accept("!"):
+		operand := p.unary()
+		return func(s *pacScope) (any, error) {
+			v, err := operand(s)
+			return !pacTruthy(v), err
+		}
+	case p.accept("-"):
+		operand := p.unary()
+		return func(s *pacScope) (any, error) {
+			v, err := operand(s)
+			n, _ := v.(float64)
+			return -n, err
+		}
+	}
+	return p.postfix()
+}
+
+func (p *pacParser) postfix() pacExpr {
+	expr := p.primary()
+	for p.accept(".") {
+		name := p.ident()
+		object := expr
+		if name == "length" {
+			expr = func(s *pacScope) (any, error) {
+				v, err := object(s)
+				return float64(len(pacString(v))), err
+			}
+			continue
+		}
+		method, ok := pacStringMethods[name]
+		if !ok {
+			p.fail("unsupported method %s", name)
+			return expr
+		}
+		args := p.arguments()
+		expr = func(s *pacScope) (any, error) {
+			v, err := object(s)
+			if err != nil {
+				return nil, err
+			}
+			values, err := evalAll(s, args)
+			if err != nil {
+				return nil, err
+			}
+			return method(pacString(v), values), nil
+		}
+	}
+	return expr
+}
+
+func (p *pacParser) arguments() []pacExpr {
+	p.expect("(")
+	var args []pacExpr
+	for !p.accept(")") {
+		if p.done() {
+			p.fail("expected ')'")
+			return nil
+		}
+		args = append(args, p.expression())
+		if !p.peek(")") {
+			p.expect(",")
+		}
+	}
+	return args
+}
+
+func (p *pacParser) primary() pacExpr {
+	nothing := func(*pacScope) (any, error) { return nil, nil }
+	if p.done() {
+		p.fail("expected an expression")
+		return nothing
+	}
+
+	t := p.tokens[p.pos]
+	switch {
+	case p.accept("("):
+		expr := p.expression()
+		p.expect(")")
+		return expr
+	case t.isString():
+		p.pos++
+		str := unquotePAC(string(t))
+		return func(*pacScope) (any, error) { return str, nil }
+	case t[0] >= '0' && t[0] <= '9' || t[0] == '.':
+		n, ok := pacParseNumber(string(t))
+		if !ok {
+			p.fail("invalid number")
+		}
+		p.pos++
+		return func(*pacScope) (any, error) { return n, nil }
+	case t == "true" || t == "false":
+		p.pos++
+		return func(*pacScope) (any, error) { return t == "true", nil }
+	case t == "null" || t == "undefined":
+		p.pos++
+		return nothing
+	}
+
+	name := p.ident()
+	if !p.peek("(") {
+		return func(s *pacScope) (any, error) { return s.get(name) }
+	}
+	args := p.arguments()
+	return func(s *pacScope) (any, error) {
+		values, err := evalAll(s, args)
+		if err != nil {
+			return nil, err
+		}
+		return s.script.call(s.run, name, values)
+	}
+}
+
+func evalAll(s *pacScope, exprs []pacExpr) ([]any, error) {
+	values := make([]any, len(exprs))
+	for i, expr := range exprs {
+		v, err := expr(s)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func unquotePAC(literal string) string {
+	replacer := strings.NewReplacer(`\\`, `\`, `\'`, `'`, `\"`, `"`, `\n`, "\n", `\t`, "\t", `\.`, `.`)
+	return replacer.Replace(literal[1 : len(literal)-1])
+}
+
+func pacTruthy(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	}
+	return false
+}
+
+// pacNumber converts v to a number like JavaScript does, NaN when it is not one
+func pacNumber(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return 0
+		}
+		if n, ok := pacParseNumber(v); ok && pacNumberEnd(v, 0) == len(v) {
+			return n
+		}
+	}
+	return math.NaN()
+}
+
+// pacParseNumber parses a decimal or hexadecimal number literal
+func pacParseNumber(literal string) (float64, bool) {
+	if hex, ok := strings.CutPrefix(strings.ToLower(literal), "0x"); ok {
+		n, err := strconv.ParseUint(hex, 16, 64)
+		return float64(n), err == nil
+	}
+	if literal == "" || literal[0] != '.' && (literal[0] < '0' || literal[0] > '9') {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(literal, 64)
+	return n, err == nil
+}
+
+// pacLooseEqual compares like == does in JavaScript: null equals undefined
+// only, and a string or a boolean compared with a number is converted to one
+func pacLooseEqual(a, b any) bool {
+	if a == nil || b == nil || a == b {
+		return a == b
+	}
+	_, aString := a.(string)
+	_, bString := b.(string)
+	if aString && bString {
+		return false
+	}
+	return pacNumber(a) == pacNumber(b)
+}
+
+func pacString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return "null"
+}
+
+func pacArg(args []any, i int) string {
+	if i < len(args) {
+		return pacString(args[i])
+	}
+	return ""
+}
+
+var pacStringMethods = map[string]func(string, []any) any{
+	"toLowerCase": func(s string, _ []any) any { return strings.ToLower(s) },
+	"toUpperCase": func(s string, _ []any) any { return strings.ToUpper(s) },
+	"indexOf":     func(s string, args []any) any { return float64(strings.Index(s, pacArg(args, 0))) },
+	"substring": func(s string, args []any) any {
+		start, end := 0, len(s)
+		if len(args) > 0 {
+			n, _ := args[0].(float64)
+			start = max(0, min(int(n), len(s)))
+		}
+		if len(args) > 1 {
+			n, _ := args[1].(float64)
+			end = max(0, min(int(n), len(s)))
+		}
+		if start > end {
+			start, end = end, start
+		}
+		return s[start:end]
+	},
+}
+
+// pacBuiltins are the helpers PAC files are given, see
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+var pacBuiltins = map[string]func([]any) (any, error){
+	"isPlainHostName": func(args []any) (any, error) {
+		return !strings.Contains(pacArg(args, 0), "."), nil
+	},
+	"dnsDomainIs": func(args []any) (any, error) {
+		return strings.HasSuffix(strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))), nil
+	},
+	"localHostOrDomainIs": func(args []any) (any, error) {
+		host, hostdom := strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))
+		return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+	},
+	"isResolvable": func(args []any) (any, error) {
+		return pacResolve(pacArg(args, 0)) != nil, nil
+	},
+	"dnsResolve": func(args []any) (any, error) {
+		if ip := pacResolve(pacArg(args, 0)); ip != nil {
+			return ip.String(), nil
+		}
+		return nil, nil
+	},
+	"isInNet": func(args []any) (any, error) {
+		ip := pacResolve(pacArg(args, 0))
+		pattern, mask := net.ParseIP(pacArg(args, 1)).To4(), net.ParseIP(pacArg(args, 2)).To4()
+		if ip == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		return ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+	},
+	"myIpAddress": func([]any) (any, error) {
+		addrs, _ := net.InterfaceAddrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String(), nil
+			}
+		}
+		return "127.0.0.1", nil
+	},
+	"dnsDomainLevels": func(args []any) (any, error) {
+		return float64(strings.Count(pacArg(args, 0), ".")), nil
+	},
+	"shExpMatch": func(args []any) (any, error) {
+		pattern := regexp.QuoteMeta(pacArg(args, 1))
+		pattern = strings.NewReplacer(`\*`, `.*`, `\?`, `.`).Replace(pattern)
+		return regexp.MatchString("^(?s:"+pattern+")$", pacArg(args, 0))
+	},
+	"alert": func([]any) (any, error) { return nil, nil },
+}
+
+// pacResolve returns the IPv4 address of host, which PAC helpers work with
+func pacResolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	return ips[0].To4()
+}
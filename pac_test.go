@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPAC = `
+// Corporate routing rules
+var corpProxy = "PROXY corp-proxy:3128";
+
+function isInternal(host) {
+	return isPlainHostName(host) || dnsDomainIs(host, ".corp.example") || isInNet(host, "10.0.0.0", "255.0.0.0");
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isInternal(host))
+		return "DIRECT";
+	/* regional exits */
+	if (shExpMatch(host, "*.eu.example") && url.substring(0, 6) == "https:") {
+		return "SOCKS5 eu-exit:1080; " + corpProxy;
+	} else if (host.indexOf("cdn") != -1) {
+		return 'HTTPS cdn-proxy:443';
+	}
+	return corpProxy + "; DIRECT";
+}
+`
+
+func TestParsePAC(t *testing.T) {
+	pac, err := parsePAC(testPAC)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for target, proxy := range map[string]string{
+		"https://intranet/":              "",
+		"https://git.CORP.example/repo":  "",
+		"http://10.1.2.3:8080/":          "",
+		"https://shop.eu.example/":       "socks5://eu-exit:1080",
+		"http://shop.eu.example/":        "http://corp-proxy:3128",
+		"https://static.cdn.example/app": "https://cdn-proxy:443",
+		"https://example.com/":           "http://corp-proxy:3128",
+	} {
+		got, err := pac.proxy(target)
+		assert.NoError(t, err, target)
+		assert.Equal(t, proxy, got, target)
+	}
+
+	result, err := pac.find("https://shop.eu.example/")
+	assert.NoError(t, err)
+	assert.Equal(t, "SOCKS5 eu-exit:1080; PROXY corp-proxy:3128", result)
+}
+
+func TestPACSemantics(t *testing.T) {
+	pac, err := parsePAC(`
+var ratio = 1.5, hex = 0x10, calls = 0, hoisted = "global";
+
+function count() {
+	calls = calls + 1;
+	return calls;
+}
+
+function shadow(calls) {
+	calls = 100;
+	hoisted = "local";
+	var hoisted;
+	return calls;
+}
+
+function FindProxyForURL(url, host) {
+	count();
+	shadow(0);
+	if (count() !== 2 || hoisted !== "global")
+		return "PROXY globals:1";
+	if (ratio + .5 !== 2 || hex !== 16 || 1e3 !== 1000)
+		return "PROXY numbers:1";
+	if (!("1" == 1 && "1.50" == ratio && true == 1 && "" == 0 && null == undefined && "10" < "9") ||
+		"1" === 1 || null == 0 || "a" == 0 || "a" != "a")
+		return "PROXY equality:1";
+	return "DIRECT";
+}
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	result, err := pac.find("https://example.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, "DIRECT", result)
+	// Global variables are assigned for the run only
+	result, err = pac.find("https://example.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, "DIRECT", result)
+	assert.Equal(t, 0.0, pac.globals["calls"])
+}
+
+func TestParsePACErrors(t *testing.T) {
+	for src, msg := range map[string]string{
+		`function FindProxy(url, host) { return "DIRECT"; }`:                            "FindProxyForURL",
+		`function FindProxyForURL(url, host) { return "DIRECT"`:                         "",
+		`function FindProxyForURL(url, host) { return /regex/.test(host); }`:            "regular expressions",
+		`function FindProxyForURL(url, host) { return host.replace("a", "b"); }`:        "",
+		`function FindProxyForURL(url, host) { for (;;) {} return "DIRECT"; }`:          "unsupported 'for'",
+		`function FindProxyForURL(url, host) { while (true) {} return "DIRECT"; }`:      "unsupported 'while'",
+		`function FindProxyForURL(url, host) { do {} while (true); return "DIRECT"; }`:  "unsupported 'do'",
+		`function FindProxyForURL(url, host) { return host.length / 2 > 1 ? "" : ""; }`: "division",
+	} {
+		_, err := parsePAC(src)
+		assert.ErrorContains(t, err, msg, src)
+	}
+
+	pac, err := parsePAC(`function FindProxyForURL(url, host) { return weekdayRange("MON", "FRI") ? "DIRECT" : "PROXY p:1"; }`)
+	if err == nil {
+		_, err = pac.find("https://example.com/")
+	}
+	assert.Error(t, err)
+}
+
+func TestPACBudget(t *testing.T) {
+	for _, src := range []string{
+		// Endless recursion fails instead of overflowing the stack
+		`function FindProxyForURL(url, host) { return FindProxyForURL(url, host); }`,
+		// So does recursion that would take forever
+		`function spin(n) { return spin(n + 1) + spin(n + 1); }
+		function FindProxyForURL(url, host) { return spin(0); }`,
+	} {
+		pac, err := parsePAC(src)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, err = pac.find("https://example.com/")
+		assert.ErrorContains(t, err, "PAC file:")
+	}
+}
+
+func TestLoadPACOverHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`))
+	}))
+	defer server.Close()
+
+	_, err := loadPAC(server.URL)
+	assert.ErrorIs(t, err, errPACOverHTTP)
+
+	defer func(allow bool) { pacAllowHTTP = allow }(pacAllowHTTP)
+	pacAllowHTTP = true
+	_, err = loadPAC(server.URL)
+	assert.NoError(t, err)
+}
+
+func TestPACProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	proxy, connects := connectProxy(t)
+	pac, err := parsePAC(fmt.Sprintf(`function FindProxyForURL(url, host) {
+		if (url.indexOf("/direct") != -1) return "DIRECT";
+		return "PROXY %s";
+	}`, proxy[len("http://"):]))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer upstreamPAC.Store(nil)
+	upstreamPAC.Store(pac)
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/proxied"})
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, proxy, w.headers.Get("x-tls-proxy-used"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/direct"})
+	assert.Equal(t, "ok", w.body.String())
+	assert.Empty(t, w.headers.Get("x-tls-proxy-used"))
+	assert.Equal(t, int32(1), connects.Load())
+}
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/cookiejar"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+)
+
+const (
+	// maxIdleSessionsPerKey bounds how many warm sessions are kept around for the
+	// same key once the requests using them are done
+	maxIdleSessionsPerKey = 8
+	// sessionReapInterval is how often expired sessions are looked for
+	sessionReapInterval = 10 * time.Second
+)
+
+var (
+	// Sessions unused for this long are closed
+	sessionIdleTimeout = newSetting(getEnvSeconds("TLS_SESSION_IDLE_TIMEOUT", 300))
+	// Sessions are closed once they are this old, even if they are still used
+	sessionMaxLifetime = newSetting(getEnvSeconds("TLS_SESSION_MAX_LIFETIME", 1800))
+	// At most this many sessions are held at once, idle and pinned ones included
+	sessionMaxSessions = newSetting(getEnvInt("TLS_MAX_SESSIONS", 1000))
+)
+
+// toggle is a tri-state header value that can switch a feature on or off, or
+// leave the default of the profile
+type toggle int8
+
+const (
+	toggleUnset toggle = iota
+	toggleOn
+	toggleOff
+)
+
+// sessionKey identifies which sessions can serve a request: the same target
+// host, reached through the same proxy from the same local address and at the
+// same pinned IPs, with the same fingerprint
+type sessionKey struct {
+	host        string
+	proxy       string
+	localAddr   string
+	ipFamily    ipFamily
+	resolve     string
+	profile     *browser.Profile
+	postQuantum toggle
+	greaseECH   toggle
+	minVersion  uint16
+	maxVersion  uint16
+	alpn        string
+}
+
+// pooledSession is an azuretls session that is kept warm between requests, so
+// its connections (and TLS state) are reused the way a browser reuses them
+type pooledSession struct {
+	*azuretls.Session
+	key      sessionKey
+	stats    sessionStats
+	created  time.Time
+	lastUsed time.Time
+
+	// id is set for sessions pinned by the caller, which keep their cookies and
+	// are shared by every request carrying the same session ID
+	id string
+	// inUse serializes the requests of a pinned session
+	inUse sync.Mutex
+	// closed is set once a pinned session got closed or terminated, requests
+	// waiting for it open a fresh one instead
+	closed atomic.Bool
+	// cancel aborts the requests in flight on the session
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	// infoMu guards what the session API reads while requests run: the target
+	// hosts the session sent requests to, and the proxy of its key
+	infoMu sync.Mutex
+	hosts  map[string]bool
+	// headers are the default headers of a pinned session, set over the ones of
+	// the profile
+	headers azuretls.OrderedHeaders
+	// cookies are the cookies of a pinned session jar, kept for persisting it
+	cookies []savedCookie
+	// dirty is set when the pinned session changed since it was last saved
+	dirty bool
+	// revision is the revision of the saved copy the pinned session is in step
+	// with, see refresh
+	revision string
+	// rotation is the proxy rotation policy of a pinned session, counting the
+	// requests and bans through the current proxy
+	rotation      *proxyRotation
+	proxyRequests int
+	proxyBans     int
+	// exits are the exit IPs proxies reported for the connections
+	exits *connExits
+	// heads are the response heads read by the session, as they came
+	heads *rawHeads
+	// hops counts the requests sent for the current one, lastResponse is the
+	// response to the last of them and responseCookies the cookies all of them
+	// set, see trackHops
+	hops            int
+	lastResponse    *azuretls.Response
+	responseCookies []savedCookie
+	// timing breaks down the time of the current request
+	timing *requestTiming
+	// host is the Host the current request is sent with, see overrideHost
+	host hostOverride
+}
+
+// sessionPool hands out sessions by key, or by ID for pinned sessions. A session
+// is used by a single request at a time; azuretls sessions are not safe for
+// concurrent HTTP/1.1 requests.
+type sessionPool struct {
+	mu     sync.Mutex
+	idle   map[sessionKey][]*pooledSession
+	pinned map[string]*pooledSession
+	// open counts the sessions handed out or held by the pool
+	open int
+}
+
+var sessions = &sessionPool{
+	idle:   map[sessionKey][]*pooledSession{},
+	pinned: map[string]*pooledSession{},
+}
+
+// parseSessionKey extracts the session key from the dev headers of the request
+func parseSessionKey(r *fhttp.Request, target string) (sessionKey, error) {
+	var key sessionKey
+	var err error
+
+	if key.host, err = targetHost(target); err != nil {
+		return key, fmt.Errorf("%w supplied via '%s'", err, urlHeaderName)
+	}
+
+	// Parse browser profile
+	profileName := r.Header.Get(browserHeaderName)
+	if profileName == "" {
+		profileName = defaultBrowser.get()
+	}
+	profile, ok := browser.Get(profileName)
+	if !ok {
+		return key, fmt.Errorf(
+			"unknown browser profile '%s' supplied via '%s'; skipping request", profileName, browserHeaderName,
+		)
+	}
+	key.profile = profile
+
+	// Parse fingerprint overrides of the profile
+	key.postQuantum = parseToggle(r.Header.Get(postQuantumHeaderName))
+	key.greaseECH = parseToggle(r.Header.Get(greaseECHHeaderName))
+
+	if key.minVersion, key.maxVersion, err = parseTLSVersions(r.Header); err != nil {
+		return key, err
+	}
+
+	if alpnHeader := r.Header.Get(alpnHeaderName); alpnHeader != "" {
+		protocols, err := browser.ParseALPN(alpnHeader)
+		if err != nil {
+			return key, fmt.Errorf("invalid '%s': %w", alpnHeaderName, err)
+		}
+		key.alpn = strings.Join(protocols, ",")
+	} else if r.Header.Get(hostHeaderName) != "" {
+		// HTTP/2 takes the :authority from the URL, only HTTP/1.1 can send another Host
+		key.alpn = "http/1.1"
+	}
+
+	// Parse proxy, or the proxies to rotate between
+	user, pass := r.Header.Get(proxyUserHeaderName), r.Header.Get(proxyPassHeaderName)
+	proxies := strings.Split(r.Header.Get(proxyHeaderName), ",")
+	for i, proxy := range proxies {
+		proxies[i] = normalizeProxy(proxy, user, pass)
+	}
+	key.proxy = strings.Join(proxies, ",")
+	pac, pool := upstreamPAC.Load(), upstreamProxies.Load()
+	switch {
+	case bypassesProxy(key.host):
+		key.proxy = ""
+	case key.proxy != "":
+	case pac != nil:
+		if key.proxy, err = pac.proxy(target); err != nil {
+			return key, fmt.Errorf("proxy auto-config: %w", err)
+		}
+	case pool != nil:
+		u, _ := url.Parse(target)
+		key.proxy = pool.pickFor(strings.ToLower(u.Hostname()), prefersResidential(target))
+	}
+
+	if key.localAddr, err = parseLocalAddr(r.Header.Get(localAddrHeaderName)); err != nil {
+		return key, fmt.Errorf("invalid '%s': %w", localAddrHeaderName, err)
+	}
+
+	family := r.Header.Get(ipFamilyHeaderName)
+	if family == "" {
+		family = upstreamIPFamily
+	}
+	if key.ipFamily, err = parseIPFamily(family); err != nil {
+		return key, fmt.Errorf("invalid '%s': %w", ipFamilyHeaderName, err)
+	}
+
+	if key.resolve, err = parseResolve(r.Header.Get(resolveHeaderName)); err != nil {
+		return key, fmt.Errorf("invalid '%s': %w", resolveHeaderName, err)
+	}
+
+	return key, nil
+}
+
+// targetHost returns the scheme and host sessions to target are keyed by
+func targetHost(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid request URL '%s'", target)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// newSession opens a session with the fingerprint and proxy of the key, which
+// records the exit IPs of its connections in exits, the heads of its HTTP/1.x
+// responses in heads and the time spent dialing in timing
+func (k sessionKey) newSession(exits *connExits, heads *rawHeads, timing *requestTiming) (*azuretls.Session, error) {
+	session, err := NewSession(k.profile)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.postQuantum != toggleUnset {
+		browser.ModifyClientHello(session, browser.PostQuantum(k.postQuantum == toggleOn))
+	}
+	if k.greaseECH != toggleUnset {
+		browser.ModifyClientHello(session, browser.GreaseECH(k.greaseECH == toggleOn))
+	}
+	if k.minVersion != 0 || k.maxVersion != 0 {
+		browser.ModifyClientHello(session, browser.TLSVersions(k.minVersion, k.maxVersion))
+	}
+	if k.alpn != "" {
+		browser.ModifyClientHello(session, browser.ALPN(strings.Split(k.alpn, ",")))
+	}
+
+	chain, err := parseProxyChain(k.proxy)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("invalid proxy chain supplied via '%s': %w", proxyHeaderName, err)
+	}
+	if k.proxy != "" {
+		// Connections of a chain are dialed by the session, anything azuretls dials
+		// itself at least goes through the first proxy
+		proxy := k.proxy
+		if chain != nil {
+			proxy = chain[0].String()
+		}
+		if err = session.SetProxy(proxy); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("invalid proxy '%s' supplied via '%s': %w", k.proxy, proxyHeaderName, err)
+		}
+		proxyExits.use(k.proxy)
+		bindProxyDialer(session, k.localTCPAddr())
+	}
+
+	tuneTransport(session, heads)
+	hookTimeouts(session)
+	if sessionResumption || chain != nil || k.localAddr != "" || k.ipFamily != ipFamilyAny || k.resolve != "" {
+		hookDialer(session, k, chain, exits, timing)
+	}
+
+	return session, nil
+}
+
+// acquire returns an idle session for the key, or opens a new one
+func (p *sessionPool) acquire(key sessionKey) (*pooledSession, error) {
+	p.mu.Lock()
+	for idle := p.idle[key]; len(idle) > 0; idle = p.idle[key] {
+		s := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		if s.expired(time.Now()) {
+			p.discard(s)
+			continue
+		}
+		p.mu.Unlock()
+
+		// Headers are merged into the session per request; start from the profile again
+		s.OrderedHeaders = key.profile.Headers.Clone()
+		return s, nil
+	}
+	p.evictLRU()
+	p.open++
+	p.mu.Unlock()
+
+	s, err := newPooledSession(key)
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newPooledSession(key sessionKey) (*pooledSession, error) {
+	exits, heads, timing := &connExits{}, &rawHeads{}, &requestTiming{}
+	session, err := key.newSession(exits, heads, timing)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session.SetContext(ctx)
+
+	now := time.Now()
+	pooled := &pooledSession{Session: session, key: key, created: now, lastUsed: now, cancel: cancel, exits: exits, heads: heads, timing: timing}
+	pooled.trackHops()
+	pooled.overrideHost()
+	return pooled, nil
+}
+
+// shutdown aborts the requests of the session and closes it, only once
+func (s *pooledSession) shutdown() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.Close()
+	})
+}
+
+// visit records a target host the session sent a request to
+func (s *pooledSession) visit(host string) {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+
+	if s.hosts == nil {
+		s.hosts = map[string]bool{}
+	}
+	s.hosts[host] = true
+}
+
+// visited returns the target hosts the session sent requests to, sorted
+func (s *pooledSession) visited() []string {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// expired reports whether the session was idle or alive for too long. Zero
+// timeouts never expire.
+func (s *pooledSession) expired(now time.Time) bool {
+	if idle := sessionIdleTimeout.get(); idle > 0 && now.Sub(s.lastUsed) > idle {
+		return true
+	}
+	lifetime := sessionMaxLifetime.get()
+	return lifetime > 0 && now.Sub(s.created) > lifetime
+}
+
+// clientSessionID returns the ID of the session pinned for a client key, so a
+// logical client sticks to one session without managing session IDs
+func clientSessionID(clientKey string) string {
+	return "client:" + clientKey
+}
+
+// acquirePinned returns the session pinned under id, opening it with the key
+// and proxy rotation on first use. The fingerprint and proxy of a pinned session
+// are the ones of the request that opened it.
+func (p *sessionPool) acquirePinned(id string, key sessionKey, rotation *proxyRotation) (*pooledSession, error) {
+	for {
+		p.mu.Lock()
+		s, ok := p.pinned[id]
+		p.mu.Unlock()
+		// loaded is set when the store was just read for the session
+		loaded := !ok
+		if !ok {
+			// The store may be a network round trip away, it is not waited on with the
+			// pool locked. The session may be opened by another request meanwhile.
+			saved, savedKey := loadSaved(id)
+			openKey := key
+			if saved != nil {
+				openKey = savedKey
+			}
+			p.mu.Lock()
+			if s, ok = p.pinned[id]; !ok {
+				var err error
+				if s, err = p.openPinned(id, openKey, rotation, saved); err != nil {
+					p.mu.Unlock()
+					return nil, err
+				}
+			}
+			p.mu.Unlock()
+		}
+
+		s.inUse.Lock()
+		if s.closed.Load() {
+			// Closed while we were waiting for it, open a fresh one under the same ID
+			s.inUse.Unlock()
+			continue
+		}
+		if !loaded && !p.refresh(s) {
+			continue
+		}
+		s.OrderedHeaders = s.defaultHeaders()
+
+		return s, nil
+	}
+}
+
+// refresh catches the locked pinned session up with its saved copy when another
+// instance sharing the store saved it since, so the cookies the session got
+// there are sent from here too. When the copy has another fingerprint or proxy,
+// or is gone as the session was terminated or expired, the session is closed
+// and false returned, for the caller to open it again.
+func (p *sessionPool) refresh(s *pooledSession) bool {
+	if !sharedStore() {
+		return true
+	}
+	saved, err := savedSessions.load(s.id)
+	if err != nil {
+		// Go on with the copy at hand
+		slog.Error("Error loading session", "session", s.id, "error", err)
+		return true
+	}
+	if saved == nil && s.revision == "" || saved != nil && saved.Revision == s.revision {
+		return true
+	}
+	if saved != nil {
+		if key, err := saved.key(); err == nil && key == s.key {
+			s.CookieJar, _ = cookiejar.New(nil)
+			s.cookies = nil
+			s.restore(saved)
+			return true
+		}
+	}
+
+	p.mu.Lock()
+	if p.pinned[s.id] == s {
+		p.discardPinned(s)
+	} else {
+		// Terminated meanwhile
+		s.shutdown()
+		s.inUse.Unlock()
+	}
+	p.mu.Unlock()
+	return false
+}
+
+// defaultHeaders returns the headers requests of the session start from: the
+// profile headers, with the default headers of the session set over them
+func (s *pooledSession) defaultHeaders() azuretls.OrderedHeaders {
+	headers := s.key.profile.Headers.Clone()
+
+Outer:
+	for _, h := range s.headers.Clone() {
+		for i, ph := range headers {
+			if strings.EqualFold(ph[0], h[0]) {
+				headers[i] = h
+				continue Outer
+			}
+		}
+		headers = append(headers, h)
+	}
+
+	return headers
+}
+
+// loadSaved returns the session saved under id and the key it was opened with,
+// or nil if none was persisted
+func loadSaved(id string) (*savedSession, sessionKey) {
+	if savedSessions == nil {
+		return nil, sessionKey{}
+	}
+	saved, err := savedSessions.load(id)
+	if err != nil {
+		slog.Error("Error loading session", "session", id, "error", err)
+	}
+	if saved == nil {
+		return nil, sessionKey{}
+	}
+	key, err := saved.key()
+	if err != nil {
+		slog.Error("Error restoring session", "session", id, "error", err)
+		return nil, sessionKey{}
+	}
+	return saved, key
+}
+
+// openPinned opens the session pinned under id, restored from saved if it was
+// persisted before, see loadSaved, with the proxy rotation otherwise. It must be
+// called with p.mu held.
+func (p *sessionPool) openPinned(id string, key sessionKey, rotation *proxyRotation, saved *savedSession) (*pooledSession, error) {
+	p.evictLRU()
+	s, err := newPooledSession(key)
+	if err != nil {
+		return nil, err
+	}
+	s.id = id
+	if saved != nil {
+		s.restore(saved)
+	} else {
+		s.rotation = rotation
+		s.dirty = savedSessions != nil
+	}
+	p.pinned[id] = s
+	p.open++
+
+	return s, nil
+}
+
+// lockPinned waits for the session pinned under id to be done with its request
+// and returns it locked, or nil if there is no such session
+func (p *sessionPool) lockPinned(id string) *pooledSession {
+	for {
+		p.mu.Lock()
+		s, ok := p.pinned[id]
+		p.mu.Unlock()
+		if !ok {
+			return nil
+		}
+
+		s.inUse.Lock()
+		if !s.closed.Load() {
+			return s
+		}
+		s.inUse.Unlock()
+	}
+}
+
+// importPinned pins a session restored from saved under id, replacing the
+// session pinned under the same ID once its request is done. It returns what
+// got imported, without the cookies that expired already.
+func (p *sessionPool) importPinned(id string, saved *savedSession) (*savedSession, error) {
+	key, err := saved.key()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		old := p.lockPinned(id)
+
+		p.mu.Lock()
+		if p.pinned[id] != old {
+			// Opened by a request meanwhile, replace that one instead
+			p.mu.Unlock()
+			if old != nil {
+				old.inUse.Unlock()
+			}
+			continue
+		}
+		if old != nil {
+			p.discardPinned(old)
+		}
+
+		p.evictLRU()
+		s, err := newPooledSession(key)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		s.id = id
+		s.restore(saved)
+		s.revision = randomID()
+		p.pinned[id] = s
+		p.open++
+		imported := s.save()
+		p.mu.Unlock()
+
+		if savedSessions != nil {
+			if err = savedSessions.save(id, imported); err != nil {
+				slog.Error("Error saving session", "session", id, "error", err)
+			}
+		}
+
+		return imported, nil
+	}
+}
+
+// setHeaders replaces the default headers of the session pinned under id once
+// its request is done, or of its saved copy when it is not open here. It
+// reports whether there is such a session.
+func (p *sessionPool) setHeaders(id string, headers azuretls.OrderedHeaders) (bool, error) {
+	// A session closed by refresh is behind its saved copy, which is set instead
+	if s := p.lockPinned(id); s != nil && p.refresh(s) {
+		s.headers = headers.Clone()
+		s.dirty = savedSessions != nil
+		p.release(s, true)
+		return true, nil
+	}
+
+	if savedSessions == nil {
+		return false, nil
+	}
+	saved, err := savedSessions.load(id)
+	if err != nil || saved == nil {
+		return false, err
+	}
+	saved.Headers = headers
+	saved.Revision = randomID()
+	return true, savedSessions.save(id, saved)
+}
+
+// release hands the session back to the pool once its request is done. Sessions
+// that failed are closed instead, their connections might be broken.
+func (p *sessionPool) release(s *pooledSession, healthy bool) {
+	s.lastUsed = time.Now()
+
+	// Pinned sessions are kept with their cookies; azuretls redials broken connections
+	if s.id != "" {
+		if s.closed.Load() {
+			// Terminated while serving the request
+			s.shutdown()
+			s.inUse.Unlock()
+			return
+		}
+
+		s.rotateProxy()
+		if s.dirty && savedSessions != nil {
+			if err := s.persist(); err != nil {
+				slog.Error("Error saving session", "session", s.id, "error", err)
+			} else {
+				s.dirty = false
+			}
+		}
+		s.inUse.Unlock()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !healthy {
+		p.discard(s)
+		return
+	}
+
+	// Cookies belong to the caller of the request, do not leak them to the next one
+	s.CookieJar, _ = cookiejar.New(nil)
+
+	if len(p.idle[s.key]) >= maxIdleSessionsPerKey {
+		p.discard(s)
+		return
+	}
+	p.idle[s.key] = append(p.idle[s.key], s)
+}
+
+// discard closes a session that is no longer held by the pool. It must be
+// called with p.mu held.
+func (p *sessionPool) discard(s *pooledSession) {
+	s.shutdown()
+	p.open--
+}
+
+// terminate closes the session pinned under id and forgets it, including the
+// saved copy. Requests in flight on the session are aborted.
+func (p *sessionPool) terminate(id string) bool {
+	p.mu.Lock()
+	s, ok := p.pinned[id]
+	if ok {
+		delete(p.pinned, id)
+		p.open--
+		s.closed.Store(true)
+		if s.inUse.TryLock() {
+			s.shutdown()
+			s.inUse.Unlock()
+		} else {
+			// The request is aborted and shuts the session down once it is released
+			s.cancel()
+		}
+	}
+	p.mu.Unlock()
+
+	if savedSessions != nil {
+		if err := savedSessions.remove(id); err != nil {
+			slog.Error("Error removing saved session", "session", id, "error", err)
+		}
+	}
+
+	return ok
+}
+
+// pinnedSessions returns the sessions pinned right now
+func (p *sessionPool) pinnedSessions() []*pooledSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pinned := make([]*pooledSession, 0, len(p.pinned))
+	for _, s := range p.pinned {
+		pinned = append(pinned, s)
+	}
+	return pinned
+}
+
+// discardPinned closes a pinned session whose inUse lock is held by the caller,
+// so waiting requests open a fresh one. It must be called with p.mu held.
+func (p *sessionPool) discardPinned(s *pooledSession) {
+	delete(p.pinned, s.id)
+	s.closed.Store(true)
+	p.discard(s)
+	s.inUse.Unlock()
+}
+
+// evictLRU closes the least recently used sessions until a new one fits under
+// sessionMaxSessions. Sessions serving a request are never evicted, so the cap
+// can be exceeded while all of them are busy. It must be called with p.mu held.
+func (p *sessionPool) evictLRU() {
+	for limit := sessionMaxSessions.get(); limit > 0 && p.open >= limit; {
+		var oldest *pooledSession
+
+		// Idle lists are in release order, their first session was used the longest ago
+		for _, idle := range p.idle {
+			if len(idle) > 0 && (oldest == nil || idle[0].lastUsed.Before(oldest.lastUsed)) {
+				oldest = idle[0]
+			}
+		}
+		for _, s := range p.pinned {
+			if !s.inUse.TryLock() {
+				continue
+			}
+			if oldest != nil && !s.lastUsed.Before(oldest.lastUsed) {
+				s.inUse.Unlock()
+				continue
+			}
+			if oldest != nil && oldest.id != "" {
+				oldest.inUse.Unlock()
+			}
+			oldest = s
+		}
+
+		if oldest == nil {
+			return
+		}
+		if oldest.id != "" {
+			p.discardPinned(oldest)
+			continue
+		}
+
+		if idle := p.idle[oldest.key]; len(idle) == 1 {
+			delete(p.idle, oldest.key)
+		} else {
+			p.idle[oldest.key] = idle[1:]
+		}
+		p.discard(oldest)
+	}
+}
+
+// reap closes the expired sessions that are not serving a request right now
+// and returns how many were closed
+func (p *sessionPool) reap(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	closed := 0
+	for key, idle := range p.idle {
+		kept := idle[:0]
+		for _, s := range idle {
+			if s.expired(now) {
+				p.discard(s)
+				closed++
+			} else {
+				kept = append(kept, s)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+
+	for _, s := range p.pinned {
+		if !s.inUse.TryLock() {
+			continue
+		}
+		if !s.expired(now) {
+			s.inUse.Unlock()
+			continue
+		}
+		p.discardPinned(s)
+		closed++
+	}
+
+	return closed
+}
+
+// runReaper periodically closes expired sessions, so long running deployments
+// do not keep stale connections to upstreams around
+func (p *sessionPool) runReaper() {
+	for range time.Tick(sessionReapInterval) {
+		if n := p.reap(time.Now()); n > 0 {
+			slog.Info("Closed expired sessions", "sessions", n)
+		}
+	}
+}
+
+// closeAll closes every session, aborting the requests still running on them,
+// and returns how many were closed
+func (p *sessionPool) closeAll() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	closed := 0
+	for key, idle := range p.idle {
+		for _, s := range idle {
+			p.discard(s)
+			closed++
+		}
+		delete(p.idle, key)
+	}
+
+	for id, s := range p.pinned {
+		if s.inUse.TryLock() {
+			p.discardPinned(s)
+		} else {
+			// The request is aborted and shuts the session down once it is released
+			delete(p.pinned, id)
+			p.open--
+			s.closed.Store(true)
+			s.cancel()
+		}
+		closed++
+	}
+
+	return closed
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionPoolReusesSessions(t *testing.T) {
+	var cookies []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	headers := map[string]string{"x-tls-url": upstream.URL, "x-tls-session-stats": "1"}
+	first := proxyRequest(t, headers)
+	second := proxyRequest(t, headers)
+
+	assert.Equal(t, "ok", first.body.String())
+	assert.Equal(t, "ok", second.body.String())
+	assert.Equal(t, "requests=2;bytes=2;errors=0;bans=0", second.headers.Get("x-tls-session-stats"))
+
+	// cookies set for the first caller are not sent on behalf of the second one
+	assert.Equal(t, []string{"", ""}, cookies)
+}
+
+func TestSessionKeySeparatesFingerprints(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := parseSessionKey(r, "https://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("x-tls-alpn", "http/1.1")
+	forced, err := parseSessionKey(r, "https://EXAMPLE.com/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, plain.host, forced.host)
+	assert.NotEqual(t, plain, forced)
+}
+
+func TestPinnedSessionKeepsCookies(t *testing.T) {
+	var cookies []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		http.SetCookie(w, &http.Cookie{Name: "login", Value: "token", Path: "/"})
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	defer sessions.terminate("flow-1")
+	headers := map[string]string{"x-tls-url": upstream.URL + "/login", "x-tls-session-id": "flow-1"}
+	first := proxyRequest(t, headers)
+	headers["x-tls-url"] = upstream.URL + "/account"
+	second := proxyRequest(t, headers)
+
+	assert.Equal(t, "flow-1", first.headers.Get("x-tls-session-id"))
+	assert.Equal(t, "flow-1", second.headers.Get("x-tls-session-id"))
+	assert.Equal(t, []string{"", "login=token"}, cookies)
+}
+
+func TestPinnedSessionRoundTripsCookies(t *testing.T) {
+	var cookies []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2", Path: "/"})
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	defer sessions.terminate("flow-2")
+	headers := map[string]string{"x-tls-url": upstream.URL + "/login", "x-tls-session-id": "flow-2"}
+	first := proxyRequest(t, headers)
+	headers["x-tls-url"] = upstream.URL + "/account"
+	headers["Cookie"] = "pref=dark"
+	proxyRequest(t, headers)
+
+	// every cookie set by the upstream is surfaced to the caller
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Path=/"}, first.headers.Values("Set-Cookie"))
+
+	// and sent along with the caller's own ones, once each
+	assert.Equal(t, "", cookies[0])
+	assert.ElementsMatch(t, []string{"a=1", "b=2", "pref=dark"}, strings.Split(cookies[1], "; "))
+}
+
+func TestClientKeySticksToSession(t *testing.T) {
+	var cookies []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		http.SetCookie(w, &http.Cookie{Name: "client", Value: r.URL.Query().Get("c"), Path: "/"})
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	defer sessions.terminate(clientSessionID("alice"))
+	defer sessions.terminate(clientSessionID("bob"))
+	proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "?c=alice", "x-tls-client-key": "alice"})
+	proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "?c=bob", "x-tls-client-key": "bob"})
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "?c=alice", "x-tls-client-key": "alice"})
+
+	// the client got its own session back, and nobody else's cookies
+	assert.Equal(t, []string{"", "", "client=alice"}, cookies)
+	assert.Equal(t, clientSessionID("alice"), w.headers.Get("x-tls-session-id"))
+}
+
+func TestUpstreamConnectionTuning(t *testing.T) {
+	var connections atomic.Int32
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	headers := map[string]string{"x-tls-url": upstream.URL, "x-tls-session-id": "tuned"}
+	requests := func() int32 {
+		defer sessions.terminate("tuned")
+		connections.Store(0)
+		proxyRequest(t, headers)
+		time.Sleep(50 * time.Millisecond)
+		proxyRequest(t, headers)
+		return connections.Load()
+	}
+
+	// the connection is kept alive by default
+	assert.Equal(t, int32(1), requests())
+
+	defer func(keepAlive bool, timeout time.Duration) {
+		upstreamKeepAlive, upstreamIdleConnTimeout = keepAlive, timeout
+	}(upstreamKeepAlive, upstreamIdleConnTimeout)
+
+	upstreamKeepAlive = false
+	assert.Equal(t, int32(2), requests())
+
+	upstreamKeepAlive, upstreamIdleConnTimeout = true, 10*time.Millisecond
+	assert.Equal(t, int32(2), requests())
+}
+
+func TestReapExpiredSessions(t *testing.T) {
+	pool := &sessionPool{idle: map[sessionKey][]*pooledSession{}, pinned: map[string]*pooledSession{}}
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	key, err := parseSessionKey(r, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idle, _ := pool.acquire(key)
+	pool.release(idle, true)
+	pinned, _ := pool.acquirePinned("busy", key, nil)
+
+	// nothing expired yet
+	assert.Equal(t, 0, pool.reap(time.Now()))
+
+	// the busy pinned session is only closed once its request is done
+	later := time.Now().Add(sessionIdleTimeout.get() + time.Second)
+	assert.Equal(t, 1, pool.reap(later))
+	assert.Empty(t, pool.idle)
+
+	pool.release(pinned, true)
+	assert.Equal(t, 1, pool.reap(later))
+	assert.Empty(t, pool.pinned)
+}
+
+func TestEvictLeastRecentlyUsedSessions(t *testing.T) {
+	pool := &sessionPool{idle: map[sessionKey][]*pooledSession{}, pinned: map[string]*pooledSession{}}
+
+	max := sessionMaxSessions.get()
+	sessionMaxSessions.set(2)
+	defer sessionMaxSessions.set(max)
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	key, err := parseSessionKey(r, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned, _ := pool.acquirePinned("old", key, nil)
+	pool.release(pinned, true)
+	idle, _ := pool.acquire(key)
+	pool.release(idle, true)
+
+	// the pinned session was used the longest ago and makes room for the new one
+	busy, _ := pool.acquirePinned("new", key, nil)
+	assert.Equal(t, 2, pool.open)
+	assert.NotContains(t, pool.pinned, "old")
+	assert.Len(t, pool.idle[key], 1)
+
+	// sessions serving a request are kept, even over the cap
+	other, _ := pool.acquirePinned("other", key, nil)
+	assert.Equal(t, 2, pool.open)
+	assert.Empty(t, pool.idle)
+	_, err = pool.acquire(key)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pool.open)
+
+	pool.release(busy, true)
+	pool.release(other, true)
+}
+
+func TestCloseAllSessions(t *testing.T) {
+	pool := &sessionPool{idle: map[sessionKey][]*pooledSession{}, pinned: map[string]*pooledSession{}}
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	key, err := parseSessionKey(r, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idle, _ := pool.acquire(key)
+	pool.release(idle, true)
+	pinned, _ := pool.acquirePinned("idle", key, nil)
+	pool.release(pinned, true)
+	busy, _ := pool.acquirePinned("busy", key, nil)
+
+	assert.Equal(t, 3, pool.closeAll())
+	assert.Empty(t, pool.idle)
+	assert.Empty(t, pool.pinned)
+	assert.Equal(t, 0, pool.open)
+
+	// the busy session is shut down once its aborted request releases it
+	assert.True(t, busy.closed.Load())
+	pool.release(busy, true)
+}
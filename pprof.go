@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// handlePprof serves the net/http/pprof endpoints under /debug/pprof/ on mux
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
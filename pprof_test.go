@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"net"
+	stdhttp "net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprof(t *testing.T) {
+	l, serve, err := listenAdmin("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve()
+
+	// Bare ports are kept to localhost
+	assert.True(t, l.Addr().(*net.TCPAddr).IP.IsLoopback())
+
+	res, err := stdhttp.Get("http://" + l.Addr().String() + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, stdhttp.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), "goroutine profile")
+}
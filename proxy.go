@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// proxyFailoverTries bounds the proxies of the pool a request is tried with
+	proxyFailoverTries = 3
+	// proxyCheckTimeout bounds how long a health check waits for a proxy
+	proxyCheckTimeout = 5 * time.Second
+	// maxStickyHosts bounds the target hosts proxies of the pool are pinned to
+	maxStickyHosts = 4096
+)
+
+var (
+	// Proxies of the pool are health checked this often, 0 disables the checks
+	proxyCheckInterval = getEnvSeconds("TLS_PROXY_CHECK_INTERVAL", 30)
+	// A target host keeps the proxy of the pool it was sent through until it goes
+	// unused this long, 0 picks a proxy for every request
+	proxyStickiness = getEnvSeconds("TLS_PROXY_STICKY", 0)
+)
+
+var (
+	proxyUserHeaderName = getEnv("TLS_PROXY_USER", "x-tls-proxy-user")
+	proxyPassHeaderName = getEnv("TLS_PROXY_PASS", "x-tls-proxy-pass")
+	proxyUsedHeaderName = getEnv("TLS_PROXY_USED", "x-tls-proxy-used")
+)
+
+// upstreamProxies are rotated through by requests that bring no proxy, it is
+// nil when no proxies are configured
+var upstreamProxies atomic.Pointer[proxyPool]
+
+// proxyPool hands out its proxies by its strategy, skipping the ones that are
+// down. It is safe for concurrent use.
+type proxyPool struct {
+	proxies []string
+	weights []int
+	// down flags the proxies that failed, until a health check finds them up
+	down     []atomic.Bool
+	next     atomic.Uint64
+	strategy proxyStrategy
+	// stats counts the requests through every proxy, and how they went
+	stats []sessionStats
+
+	stickyMu sync.Mutex
+	sticky   map[string]stickyProxy
+}
+
+// stickyProxy is the proxy index a target host is pinned to
+type stickyProxy struct {
+	proxy    int
+	lastUsed time.Time
+}
+
+// newProxyPool rotates round robin through the proxies, each of them optionally
+// followed by its 'weight=N' for the weighted strategy
+func newProxyPool(proxies []string) *proxyPool {
+	pool := &proxyPool{sticky: map[string]stickyProxy{}}
+	for _, entry := range proxies {
+		proxy, weight, err := parseWeightedProxy(entry)
+		if err != nil {
+			slog.Warn("Skipping proxy", "proxy", redactProxy(proxy), "error", err)
+			continue
+		}
+		if proxy = normalizeProxy(proxy, "", ""); proxy != "" {
+			pool.proxies = append(pool.proxies, proxy)
+			pool.weights = append(pool.weights, weight)
+		}
+	}
+	pool.down = make([]atomic.Bool, len(pool.proxies))
+	pool.stats = make([]sessionStats, len(pool.proxies))
+	return pool
+}
+
+// newUpstreamProxies builds the proxy pool of TLS_PROXIES and the proxy file,
+// nil when neither has a proxy
+func newUpstreamProxies(proxyFile string) (*proxyPool, error) {
+	proxies := strings.Split(getEnv("TLS_PROXIES", ""), ",")
+	if proxyFile != "" {
+		loaded, err := loadProxyFile(proxyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading the proxy file: %w", err)
+		}
+		proxies = append(proxies, loaded...)
+	}
+	pool := newProxyPool(proxies)
+	if len(pool.proxies) == 0 {
+		return nil, nil
+	}
+	strategy, err := parseProxyStrategy(getEnv("TLS_PROXY_STRATEGY", ""))
+	if err != nil {
+		return nil, fmt.Errorf("parsing TLS_PROXY_STRATEGY: %w", err)
+	}
+	pool.strategy = strategy
+	return pool, nil
+}
+
+// setUpstreamProxies makes requests rotate through the pool, and starts its
+// health checks. Requests in flight keep the proxy they were given.
+func setUpstreamProxies(pool *proxyPool) {
+	upstreamProxies.Store(pool)
+	if pool != nil && proxyCheckInterval > 0 {
+		go pool.runHealthChecks(proxyCheckInterval)
+	}
+}
+
+// loadProxyFile reads a proxy per line, skipping blank lines and # comments
+func loadProxyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var proxies []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			proxies = append(proxies, line)
+		}
+	}
+	return proxies, scanner.Err()
+}
+
+// pick returns the next proxy of the pool that is up, of the ones with a
+// residential exit when asked for and there are any. When all of them are down
+// it goes on round robin, one of them might be back already.
+func (p *proxyPool) pick(residential bool) string {
+	if len(p.proxies) == 0 {
+		return ""
+	}
+
+	return p.proxies[p.pickIndex(residential)]
+}
+
+// pickIndex picks among the residential proxies that are up when asked to and
+// there are any, and among all the ones that are up otherwise
+func (p *proxyPool) pickIndex(residential bool) int {
+	up := make([]int, 0, len(p.proxies))
+	for i := range p.proxies {
+		if !p.down[i].Load() {
+			up = append(up, i)
+		}
+	}
+	if residential {
+		if preferred := slices.DeleteFunc(slices.Clone(up), func(i int) bool {
+			return !isResidential(p.proxies[i])
+		}); len(preferred) > 0 {
+			up = preferred
+		}
+	}
+	start := p.next.Add(1) - 1
+	if len(up) == 0 {
+		return int(start % uint64(len(p.proxies)))
+	}
+	return p.strategy.pick(p, up, start)
+}
+
+// record accounts for a request through the proxy, statusCode is 0 when it got
+// no response. Proxies that are not part of the pool are not counted.
+func (p *proxyPool) record(proxy string, statusCode int) {
+	if p == nil {
+		return
+	}
+	for i, candidate := range p.proxies {
+		if candidate != proxy {
+			continue
+		}
+		if statusCode == 0 {
+			p.stats[i].recordError()
+		} else {
+			p.stats[i].recordResponse(statusCode)
+		}
+		return
+	}
+}
+
+// pickFor returns the proxy the target host is pinned to when proxies stick to
+// hosts, so a flow keeps its exit IP. Hosts are pinned to another proxy once
+// theirs is down. Residential exits are picked when asked for and known.
+func (p *proxyPool) pickFor(host string, residential bool) string {
+	if proxyStickiness <= 0 || len(p.proxies) == 0 {
+		return p.pick(residential)
+	}
+
+	p.stickyMu.Lock()
+	defer p.stickyMu.Unlock()
+
+	now := time.Now()
+	pinned, ok := p.sticky[host]
+	if !ok || now.Sub(pinned.lastUsed) > proxyStickiness || p.down[pinned.proxy].Load() {
+		if !ok && len(p.sticky) >= maxStickyHosts {
+			p.forgetStickyHosts(now)
+		}
+		pinned.proxy = p.pickIndex(residential)
+	}
+	pinned.lastUsed = now
+	p.sticky[host] = pinned
+	return p.proxies[pinned.proxy]
+}
+
+// forgetStickyHosts drops the hosts that went unused, or an arbitrary one when
+// they are all in use
+func (p *proxyPool) forgetStickyHosts(now time.Time) {
+	for host, pinned := range p.sticky {
+		if now.Sub(pinned.lastUsed) > proxyStickiness {
+			delete(p.sticky, host)
+		}
+	}
+	for host := range p.sticky {
+		if len(p.sticky) < maxStickyHosts {
+			break
+		}
+		delete(p.sticky, host)
+	}
+}
+
+// markDown takes the proxy out of the rotation until it is found up again
+func (p *proxyPool) markDown(proxy string) {
+	if p == nil {
+		return
+	}
+	for i, candidate := range p.proxies {
+		if candidate == proxy && !p.down[i].Swap(true) {
+			slog.Warn("Proxy is down", "proxy", redactProxy(proxy))
+		}
+	}
+}
+
+// check connects to every proxy of the pool, taking the ones that cannot be
+// reached out of the rotation and putting the others back
+func (p *proxyPool) check() {
+	var wg sync.WaitGroup
+	for i, proxy := range p.proxies {
+		addr := proxyAddr(proxy)
+		if addr == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", addr, proxyCheckTimeout)
+			if err != nil {
+				p.markDown(proxy)
+				return
+			}
+			proxyExits.recordAddr(proxy, addrIP(conn.RemoteAddr()))
+			conn.Close()
+			if p.down[i].Swap(false) {
+				slog.Info("Proxy is up again", "proxy", redactProxy(proxy))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runHealthChecks checks the proxies of the pool every interval, until the
+// pool is replaced
+func (p *proxyPool) runHealthChecks(interval time.Duration) {
+	for ; upstreamProxies.Load() == p; time.Sleep(interval) {
+		p.check()
+	}
+}
+
+// proxyAddr returns the address to connect to the proxy at, with the default
+// port of its scheme, or nothing for shorthands it cannot parse
+func proxyAddr(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	port := "80"
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// isProxyError reports whether the request failed to go through the proxy of the
+// session, as opposed to the upstream failing. Every connection of a session
+// with a proxy is dialed to the proxy.
+func isProxyError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "dial tcp") || strings.Contains(msg, "proxy") || strings.Contains(msg, "socks")
+}
+
+// redactProxy returns the proxy without its password, or nothing if it cannot
+// tell the credentials apart
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// normalizeProxy escapes the credentials of a proxy URL, so passwords with '@'
+// or ':' can be given as they are, and sets the user and password given apart
+// from it. Shorthands without a scheme and credentials are left to azuretls.
+func normalizeProxy(proxy, user, pass string) string {
+	proxy = strings.TrimSpace(proxy)
+	if proxy == "" {
+		return ""
+	}
+
+	scheme, rest, ok := strings.Cut(proxy, "://")
+	if !ok {
+		if user == "" && pass == "" {
+			return proxy
+		}
+		scheme, rest = "http", proxy
+	}
+
+	// The host comes after the last '@', anything before it is the user info
+	host := rest
+	var info *url.Userinfo
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		host = rest[i+1:]
+		username, password, hasPassword := strings.Cut(rest[:i], ":")
+		if hasPassword {
+			info = url.UserPassword(unescape(username), unescape(password))
+		} else {
+			info = url.User(unescape(username))
+		}
+	}
+	if user != "" || pass != "" {
+		info = url.UserPassword(user, pass)
+	}
+
+	if info == nil {
+		return scheme + "://" + host
+	}
+	return scheme + "://" + info.String() + "@" + host
+}
+
+// unescape decodes credentials that were URL-escaped already, and returns the
+// others as they are
+func unescape(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
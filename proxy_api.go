@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// proxyPoolInfo describes the proxy pool for operators
+type proxyPoolInfo struct {
+	Strategy proxyStrategy `json:"strategy,omitempty"`
+	Proxies  []proxyInfo   `json:"proxies"`
+}
+
+// proxyInfo is a proxy of the pool with the outcome of the requests through it
+type proxyInfo struct {
+	Proxy    string `json:"proxy"`
+	Weight   int    `json:"weight"`
+	Down     bool   `json:"down"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	Bans     int64  `json:"bans"`
+	// ExitIP is the IP the proxy is known to leave from, and Reputation what
+	// the IP databases know about it
+	ExitIP     string        `json:"exit_ip,omitempty"`
+	Reputation *ipReputation `json:"reputation,omitempty"`
+}
+
+// HandleProxies serves the proxy pool API, on the admin address only
+func HandleProxies(w fhttp.ResponseWriter, r *fhttp.Request) {
+	if !adminOnly(w, r) {
+		return
+	}
+	if r.Method != fhttp.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	info := proxyPoolInfo{Proxies: []proxyInfo{}}
+	if pool := upstreamProxies.Load(); pool != nil {
+		info.Strategy = pool.strategy
+		for i, proxy := range pool.proxies {
+			proxyInfo := proxyInfo{
+				// Do not hand out proxy credentials
+				Proxy:    redactProxy(proxy),
+				Weight:   pool.weights[i],
+				Down:     pool.down[i].Load(),
+				Requests: pool.stats[i].Requests.Load(),
+				Errors:   pool.stats[i].Errors.Load(),
+				Bans:     pool.stats[i].Bans.Load(),
+			}
+			exit, reputation := proxyExits.lookup(proxy)
+			if exit.IsValid() {
+				proxyInfo.ExitIP, proxyInfo.Reputation = exit.String(), reputation
+			}
+			info.Proxies = append(info.Proxies, proxyInfo)
+		}
+	}
+	writeJSON(w, fhttp.StatusOK, info)
+}
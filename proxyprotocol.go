@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// listenProxyProtocol takes a PROXY protocol header, v1 or v2, ahead of every
+	// connection of the TCP listeners, from a load balancer in front of them
+	listenProxyProtocol = isTrue(getEnv("TLS_LISTEN_PROXY_PROTOCOL", "0"))
+	// proxyHeaderTimeout is how long a connection gets to send its header
+	proxyHeaderTimeout = getEnvSeconds("TLS_LISTEN_PROXY_PROTOCOL_TIMEOUT", 5)
+	// proxyProtocolTrusted are the IPs and CIDRs of the load balancers headers
+	// are taken from, any peer when empty
+	proxyProtocolTrusted []netip.Prefix
+)
+
+// proxyProtocolSignature starts the headers of v2, binary ones
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections starting with a PROXY protocol
+// header, whose remote address is the caller the header names
+type proxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+	// trusted are the peers headers are taken from, any when empty. Other
+	// peers are the callers themselves, a header they send is not read and
+	// fails their request.
+	trusted []netip.Prefix
+}
+
+// Accept does not read the header, so a slow caller does not hold up the
+// others; it is read along with the first read or lookup of the remote address
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if peer, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !(ipRules{allow: l.trusted}).allows(peer.AddrPort().Addr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// readHeader reads the header once. Connections without a valid one are closed.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr is the caller named in the header, the load balancer when the
+// header names none (health checks of the balancer itself)
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header, and returns the source address it
+// names, nil for LOCAL and UNKNOWN ones
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyProtocolSignature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// Headers are up to 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if line = append(line, b); b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header '%s'", line[:len(line)-2])
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 source '%s %s'", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header, skipping its TLVs
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command := header[12] & 0x0f; command {
+	case 0x0:
+		// LOCAL, sent by the balancer on its own behalf
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+	// Only the sources of TCP over IPv4 and IPv6 are kept
+	switch header[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
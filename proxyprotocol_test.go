@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	stdtls "crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyHeaderV2 builds a v2 header with the command, family and addresses
+func proxyHeaderV2(command, family byte, addrs []byte) string {
+	header := append([]byte{}, proxyProtocolSignature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	// A TLV after the addresses
+	ipv6 = append(ipv6, 0x04, 0x00, 0x01, 0xff)
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 mismatched family", header: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", wantErr: true},
+		{name: "v1 invalid port", header: "PROXY TCP4 192.0.2.1 192.0.2.2 70000 443\r\n", wantErr: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "v2 IPv4", header: proxyHeaderV2(0x1, 0x11, ipv4), want: "192.0.2.1:56324"},
+		{name: "v2 IPv6", header: proxyHeaderV2(0x1, 0x21, ipv6), want: "[2001:db8::1]:56324"},
+		{name: "v2 LOCAL", header: proxyHeaderV2(0x0, 0x00, nil)},
+		{name: "v2 short addresses", header: proxyHeaderV2(0x1, 0x11, ipv4[:8]), wantErr: true},
+		{name: "missing", header: "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "GET"))
+			addr, err := readProxyHeader(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, tt.want, addr.String())
+			}
+			// What follows the header is left to read
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, "GET", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cert, err := loadCertificate(writeCertificate(t, t.TempDir(), "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	serve := func(tls bool, trusted ...netip.Prefix) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: handler, TLSConfig: cert.tlsConfig()}
+		proxied := &proxyProtocolListener{Listener: l, timeout: 200 * time.Millisecond, trusted: trusted}
+		if tls {
+			go server.ServeTLS(proxied, "", "")
+		} else {
+			go server.Serve(proxied)
+		}
+		t.Cleanup(func() { server.Close() })
+		return l.Addr().String()
+	}
+	// remote sends the header ahead of a request, and returns the remote
+	// address the server saw
+	remote := func(addr, header string, tls bool) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+		if tls {
+			conn = stdtls.Client(conn, &stdtls.Config{InsecureSkipVerify: true})
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	plain := serve(false)
+	assert.Equal(t, "192.0.2.1:56324", remote(plain, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", false))
+	// Health checks of the balancer itself come from it
+	assert.Contains(t, remote(plain, "PROXY UNKNOWN\r\n", false), "127.0.0.1:")
+	// Connections without a header are closed
+	assert.Empty(t, remote(plain, "", false))
+
+	// The header comes ahead of the TLS handshake
+	secure := serve(true)
+	assert.Equal(t, "[2001:db8::1]:56324", remote(secure, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", true))
+
+	// Callers sending nothing do not hold up the others
+	idle, err := net.Dial("tcp", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	assert.Equal(t, "192.0.2.1:56324", remote(plain, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", false))
+
+	// Headers are only taken from the trusted balancers, other peers are the callers
+	balanced := serve(false, netip.MustParsePrefix("127.0.0.0/8"))
+	assert.Equal(t, "192.0.2.1:56324", remote(balanced, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", false))
+	direct := serve(false, netip.MustParsePrefix("198.51.100.0/24"))
+	assert.Contains(t, remote(direct, "", false), "127.0.0.1:")
+	assert.NotContains(t, remote(direct, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", false), "192.0.2.1")
+}
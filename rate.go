@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var maxRateHeaderName = getEnv("TLS_MAX_RATE", "x-tls-max-rate")
+
+// upstreamMaxRate is how many bytes per second the response bodies of requests
+// that do not set a rate are read at most, 0 for no limit
+var upstreamMaxRate = newSetting(int64(getEnvInt("TLS_UPSTREAM_MAX_RATE", 0)))
+
+// rateSlices is how many reads a second of a throttled body is split into at
+// least, so it is read evenly rather than in bursts
+const rateSlices = 10
+
+// parseMaxRate parses a rate limit header value in bytes per second, "0"
+// disables the limit. Requests without one get the default.
+func parseMaxRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return upstreamMaxRate.get(), nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a number of bytes per second", value)
+	}
+	return n, nil
+}
+
+// throttledBody reads the body at rate bytes per second at most. Reading the
+// upstream connection slower makes the upstream send slower in turn.
+type throttledBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	rate int64
+
+	start time.Time
+	read  int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// throttleBody limits the rate the body is read at, 0 leaves it as it is. The
+// waits between reads end when ctx is done or the body is closed.
+func throttleBody(ctx context.Context, body io.ReadCloser, rate int64) io.ReadCloser {
+	if rate <= 0 {
+		return body
+	}
+	return &throttledBody{ReadCloser: body, ctx: ctx, rate: rate, closed: make(chan struct{})}
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+	if slice := max(b.rate/rateSlices, 1); int64(len(p)) > slice {
+		p = p[:slice]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	// Wait until the bytes read so far are within the rate
+	due := b.start.Add(time.Duration(float64(b.read) / float64(b.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 && err == nil {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-b.closed:
+		case <-b.ctx.Done():
+		}
+	}
+	return n, err
+}
+
+func (b *throttledBody) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return b.ReadCloser.Close()
+}
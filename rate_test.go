@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxRate(t *testing.T) {
+	content := strings.Repeat("paced", 4000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+
+	for _, buffer := range []string{"0", "1"} {
+		start := time.Now()
+		w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-buffer": buffer, "x-tls-max-rate": "40000"})
+		elapsed := time.Since(start)
+
+		assert.Equal(t, http.StatusOK, w.statusCode, buffer)
+		assert.Equal(t, content, w.body.String(), buffer)
+		// 20000 bytes at 40000 bytes per second
+		assert.GreaterOrEqual(t, elapsed, 400*time.Millisecond, buffer)
+		assert.Less(t, elapsed, 2*time.Second, buffer)
+	}
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-max-rate": "fast"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestThrottleBodyClose(t *testing.T) {
+	body := throttleBody(context.Background(), io.NopCloser(strings.NewReader(strings.Repeat("x", 100))), 1)
+
+	// The wait for the next byte ends once the body is closed
+	time.AfterFunc(100*time.Millisecond, func() { body.Close() })
+	start := time.Now()
+	buf := make([]byte, 10)
+	n, err := body.Read(buf)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestParseMaxRate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"", upstreamMaxRate.get(), true},
+		{"0", 0, true},
+		{" 1048576 ", 1048576, true},
+		{"-1", 0, false},
+		{"1MB", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMaxRate(tt.value)
+		assert.Equal(t, tt.ok, err == nil, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	// clientRate is how many requests a second a caller is served on average, 0
+	// for no limit
+	clientRate = newSetting(0.0)
+	// clientBurst is how many requests a caller is served at once after being
+	// idle
+	clientBurst = newSetting(0)
+)
+
+var errRateLimit = errors.New("too many requests from the caller")
+
+// clientBuckets are the token buckets of the callers
+var clientBuckets = newRateLimiter()
+
+// tokenBucket holds the requests a caller can still be served at once
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per caller, refilled at the rate up to the
+// burst
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes a token from the bucket of the caller, and returns how long until
+// there is one when it is empty
+func (l *rateLimiter) take(caller string, now time.Time, rate float64, burst int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now, rate, burst)
+
+	b, ok := l.buckets[caller]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[caller] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// sweep drops the buckets refilled since, about once a minute, so callers
+// that went away are not kept
+func (l *rateLimiter) sweep(now time.Time, rate float64, burst int) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for caller, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, caller)
+		}
+	}
+}
+
+// parseClientRate parses the rate and the burst of TLS_CLIENT_RATE and
+// TLS_CLIENT_BURST, the burst defaulting to the rate
+func parseClientRate(rate, burst string) (float64, int, error) {
+	if rate == "" {
+		return 0, 0, nil
+	}
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r < 0 || math.IsInf(r, 0) {
+		return 0, 0, fmt.Errorf("invalid TLS_CLIENT_RATE: '%s' is not a number of requests per second", rate)
+	}
+	b := int(math.Ceil(r))
+	if burst != "" {
+		if b, err = strconv.Atoi(burst); err != nil || b < 1 {
+			return 0, 0, fmt.Errorf("invalid TLS_CLIENT_BURST: '%s' is not a number of requests", burst)
+		}
+	}
+	return r, b, nil
+}
+
+// limitClients answers the requests of callers beyond their rate with 429 and
+// when to come back. Callers are told apart by their credentials, by their IP
+// when the server takes none.
+func limitClients(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		rate := clientRate.get()
+		if rate <= 0 || openPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		caller := requestCaller(r)
+		ok, wait := clientBuckets.take(caller, time.Now(), rate, clientBurst.get())
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeFailure(w, r, fhttp.StatusTooManyRequests, errRateLimited, fmt.Errorf("%w %s", errRateLimit, caller))
+	})
+}
+
+// requestCaller is the caller the credentials of the request identify, or its
+// IP
+func requestCaller(r *fhttp.Request) string {
+	if caller, ok := r.Context().Value(callerKey{}).(string); ok {
+		return caller
+	}
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return "ip:" + addrPort.Addr().Unmap().String()
+	}
+	return "local"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Now()
+
+	// The burst is served at once, then a request every half second
+	for i := 0; i < 3; i++ {
+		ok, _ := l.take("ip:192.0.2.1", now, 2, 3)
+		assert.True(t, ok)
+	}
+	ok, wait := l.take("ip:192.0.2.1", now, 2, 3)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = l.take("ip:192.0.2.1", now.Add(500*time.Millisecond), 2, 3)
+	assert.True(t, ok)
+
+	// Callers have buckets of their own
+	ok, _ = l.take("ip:192.0.2.2", now, 2, 3)
+	assert.True(t, ok)
+
+	// Refilled buckets are dropped
+	l.take("ip:192.0.2.3", now.Add(2*time.Minute), 2, 3)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestParseClientRate(t *testing.T) {
+	tests := []struct {
+		rate, burst string
+		wantRate    float64
+		wantBurst   int
+		wantErr     bool
+	}{
+		{rate: "", wantRate: 0, wantBurst: 0},
+		{rate: "10", wantRate: 10, wantBurst: 10},
+		{rate: "0.5", wantRate: 0.5, wantBurst: 1},
+		{rate: "2", burst: "20", wantRate: 2, wantBurst: 20},
+		{rate: "fast", wantErr: true},
+		{rate: "-1", wantErr: true},
+		{rate: "2", burst: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		rate, burst, err := parseClientRate(tt.rate, tt.burst)
+		if tt.wantErr {
+			assert.Error(t, err, tt.rate)
+			continue
+		}
+		assert.NoError(t, err, tt.rate)
+		assert.Equal(t, tt.wantRate, rate, tt.rate)
+		assert.Equal(t, tt.wantBurst, burst, tt.rate)
+	}
+}
+
+func TestLimitClients(t *testing.T) {
+	clientRate.set(0.001)
+	clientBurst.set(1)
+	clientBuckets = newRateLimiter()
+	defer func() {
+		clientRate.set(0)
+		clientBurst.set(0)
+		clientBuckets = newRateLimiter()
+	}()
+
+	handler := limitClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(path, remoteAddr, caller string) *mockResponseWriter {
+		r, err := http.NewRequest(http.MethodGet, path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remoteAddr
+		if caller != "" {
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send("/", "192.0.2.1:1000", "").statusCode)
+	w := send("/", "192.0.2.1:1001", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.statusCode)
+	assert.Equal(t, string(errRateLimited), w.Header().Get(errorHeaderName))
+	assert.Equal(t, "1000", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("/isalive", "192.0.2.1:1002", "").statusCode)
+
+	// Callers with credentials are told apart by them, wherever they come from
+	assert.Equal(t, http.StatusOK, send("/", "192.0.2.1:1003", "key:1234").statusCode)
+	assert.Equal(t, http.StatusTooManyRequests, send("/", "192.0.2.2:1000", "key:1234").statusCode)
+	assert.Equal(t, http.StatusOK, send("/", "192.0.2.1:1004", "user:scraper").statusCode)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// recoveryWriter records whether the response was started, so a panic after
+// it aborts the connection instead of writing a failure into the response
+type recoveryWriter struct {
+	fhttp.ResponseWriter
+	started bool
+}
+
+func (w *recoveryWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoveryWriter) Write(data []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recoveryWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(fhttp.Flusher); ok {
+		w.started = true
+		flusher.Flush()
+	}
+}
+
+// recoverPanics answers requests whose handler panics with 500 and an error ID
+// the stack is logged with, instead of the panic taking the connection or the
+// process down with it. Responses already started are cut off.
+func recoverPanics(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		rw := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == fhttp.ErrAbortHandler {
+				panic(p)
+			}
+
+			id := randomID()
+			slog.ErrorContext(r.Context(), "Panic serving request", "error_id", id, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			if rw.started {
+				panic(fhttp.ErrAbortHandler)
+			}
+			writeFailure(w, r, fhttp.StatusInternalServerError, errInternal, fmt.Errorf("internal error %s", id))
+		}()
+		h.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	serve := func(h http.HandlerFunc) *mockResponseWriter {
+		r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		recoverPanics(h).ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(func(w http.ResponseWriter, r *http.Request) {
+		var headers map[string]string
+		headers["x-tls-url"] = "https://example.com"
+	})
+	assert.Equal(t, http.StatusInternalServerError, w.statusCode)
+	assert.Equal(t, string(errInternal), w.headers.Get(errorHeaderName))
+	var got failure
+	assert.NoError(t, json.Unmarshal(w.body.Bytes(), &got))
+	assert.Regexp(t, `^internal error [0-9a-f]{16}$`, got.Error)
+
+	// Responses already started are aborted
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		serve(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			panic("broken")
+		})
+	})
+
+	w = serve(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	assert.Equal(t, "ok", w.body.String())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	maxRedirectsHeaderName  = getEnv("TLS_MAX_REDIRECTS", "x-tls-max-redirects")
+	finalURLHeaderName      = getEnv("TLS_FINAL_URL", "x-tls-final-url")
+	redirectCountHeaderName = getEnv("TLS_REDIRECT_COUNT", "x-tls-redirect-count")
+)
+
+// parseMaxRedirects parses the number of redirects to follow at most, -1 when
+// the request does not cap them
+func parseMaxRedirects(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a number of redirects", value)
+	}
+	return n, nil
+}
+
+// trackHops makes the session count the requests it sends in hops, the ones
+// following redirects included, and keep the response of the last one and the
+// cookies all of them set, as azuretls keeps none of it. Sessions serve a
+// request at a time, they are reset for every request.
+func (s *pooledSession) trackHops() {
+	preHook := s.PreHookWithContext
+	s.PreHookWithContext = func(ctx *azuretls.Context) error {
+		s.hops++
+		if preHook != nil {
+			return preHook(ctx)
+		}
+		return nil
+	}
+
+	callback := s.CallbackWithContext
+	s.CallbackWithContext = func(ctx *azuretls.Context) {
+		s.lastResponse = nil
+		if ctx.Err == nil && ctx.Response != nil {
+			s.lastResponse = ctx.Response
+			now := time.Now()
+			for _, c := range azuretls.ReadSetCookies(ctx.Response.Header) {
+				s.responseCookies = append(s.responseCookies, newSavedCookie(ctx.Response.Url, c, now))
+			}
+		}
+		if callback != nil {
+			callback(ctx)
+		}
+	}
+}
+
+// cappedRedirect returns the last response of a request that stopped following
+// redirects at its cap, azuretls fails those with the response left unread
+func (s *pooledSession) cappedRedirect(req *azuretls.Request, err error) (*azuretls.Response, error) {
+	if err == nil || req.DisableRedirects || s.lastResponse == nil || s.hops != int(req.MaxRedirects) {
+		return nil, err
+	}
+	return s.lastResponse, nil
+}
+
+// setRedirectHeaders tells the caller the URL the redirects of the request
+// ended up at, and how many of them were followed. Requests that do not follow
+// redirects get neither.
+func setRedirectHeaders(w fhttp.ResponseWriter, req *azuretls.Request, res *azuretls.Response, hops int) {
+	if req.DisableRedirects {
+		return
+	}
+	w.Header().Set(finalURLHeaderName, res.Url)
+	w.Header().Set(redirectCountHeaderName, strconv.Itoa(max(hops-1, 0)))
+}
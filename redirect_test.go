@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/one", http.StatusFound)
+		case "/one":
+			http.Redirect(w, r, "/two", http.StatusMovedPermanently)
+		}
+	}))
+	defer upstream.Close()
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-allowredirect": "1"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, upstream.URL+"/two", w.sent.Get("x-tls-final-url"))
+	assert.Equal(t, "2", w.sent.Get("x-tls-redirect-count"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/two", "x-tls-allowredirect": "1"})
+	assert.Equal(t, upstream.URL+"/two", w.sent.Get("x-tls-final-url"))
+	assert.Equal(t, "0", w.sent.Get("x-tls-redirect-count"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL})
+	assert.Equal(t, http.StatusFound, w.statusCode)
+	assert.Empty(t, w.sent.Get("x-tls-final-url"))
+	assert.Empty(t, w.sent.Get("x-tls-redirect-count"))
+}
+
+func TestMaxRedirects(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, _ := strconv.Atoi(r.URL.Path[1:]); n < 5 {
+			http.Redirect(w, r, "/"+strconv.Itoa(n+1), http.StatusFound)
+		}
+	}))
+	defer upstream.Close()
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/0", "x-tls-max-redirects": "2"})
+	assert.Equal(t, http.StatusFound, w.statusCode)
+	assert.Equal(t, "/3", w.sent.Get("Location"))
+	assert.Equal(t, upstream.URL+"/2", w.sent.Get("x-tls-final-url"))
+	assert.Equal(t, "2", w.sent.Get("x-tls-redirect-count"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/0", "x-tls-max-redirects": "9"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, upstream.URL+"/5", w.sent.Get("x-tls-final-url"))
+	assert.Equal(t, "5", w.sent.Get("x-tls-redirect-count"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/0", "x-tls-max-redirects": "0", "x-tls-allowredirect": "1"})
+	assert.Equal(t, http.StatusFound, w.statusCode)
+	assert.Equal(t, "/1", w.sent.Get("Location"))
+	assert.Empty(t, w.sent.Get("x-tls-redirect-count"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL + "/0", "x-tls-max-redirects": "two"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestParseMaxRedirects(t *testing.T) {
+	for value, want := range map[string]int{"": -1, "0": 0, " 3 ": 3} {
+		n, err := parseMaxRedirects(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, n, value)
+	}
+	for _, value := range []string{"-1", "many"} {
+		_, err := parseMaxRedirects(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisKeyPrefix   = "tls-impersonator:session:"
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 5 * time.Second
+)
+
+// redisStore saves pinned sessions in Redis, so every instance behind a load
+// balancer can pick up a session opened by another one. It speaks just enough
+// of the Redis protocol for GET, SET and DEL, over a pool of connections that
+// serve a command each at a time.
+type redisStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	// ttl expires sessions that were not saved for this long, zero keeps them
+	ttl time.Duration
+	// tls is the config of rediss:// connections, nil for plain ones
+	tls *tls.Config
+
+	// conns has a slot per connection open or being dialed, up to the size of
+	// the pool, commands wait for one when all are taken
+	conns chan struct{}
+	mu    sync.Mutex
+	idle  []*redisConn
+}
+
+// redisConn is a connection to Redis along with the reader of its replies
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisStore parses a redis://[user:password@]host[:port][/db] URL, or a
+// rediss:// one for TLS, and keeps up to poolSize connections to it
+func newRedisStore(rawURL string, ttl time.Duration, poolSize int) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	s := &redisStore{addr: u.Host, ttl: ttl, conns: make(chan struct{}, poolSize)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		s.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unsupported redis URL scheme '%s'", u.Scheme)
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+		if s.password == "" {
+			// redis://password@host
+			s.password = u.User.Username()
+		} else {
+			s.username = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database '%s'", db)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *redisStore) load(id string) (*savedSession, error) {
+	reply, err := s.do("GET", redisKeyPrefix+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	var saved savedSession
+	if err = json.Unmarshal([]byte(reply.(string)), &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+func (s *redisStore) save(id string, saved *savedSession) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"SET", redisKeyPrefix + id, string(data)}
+	if s.ttl > 0 {
+		args = append(args, "EX", strconv.Itoa(int(s.ttl.Seconds())))
+	}
+	_, err = s.do(args...)
+	return err
+}
+
+func (s *redisStore) remove(id string) error {
+	_, err := s.do("DEL", redisKeyPrefix+id)
+	return err
+}
+
+// do sends a command on a connection of the pool and returns its reply, which
+// is nil, a string or an int64. Broken connections are dropped, and new ones
+// dialed in their place by the next commands.
+func (s *redisStore) do(args ...string) (any, error) {
+	s.conns <- struct{}{}
+	defer func() { <-s.conns }()
+
+	conn := s.takeIdle()
+	if conn == nil {
+		var err error
+		if conn, err = s.connect(); err != nil {
+			return nil, fmt.Errorf("connecting to redis at %s: %w", s.addr, err)
+		}
+	}
+
+	reply, err := conn.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return reply, err
+	}
+	s.mu.Lock()
+	s.idle = append(s.idle, conn)
+	s.mu.Unlock()
+	return reply, err
+}
+
+func (s *redisStore) takeIdle() *redisConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) == 0 {
+		return nil
+	}
+	conn := s.idle[len(s.idle)-1]
+	s.idle = s.idle[:len(s.idle)-1]
+	return conn
+}
+
+func (s *redisStore) connect() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	setup := [][]string{}
+	if s.username != "" {
+		setup = append(setup, []string{"AUTH", s.username, s.password})
+	} else if s.password != "" {
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	for _, args := range setup {
+		if _, err = c.roundTrip(args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisConn) roundTrip(args []string) (any, error) {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	c.SetDeadline(time.Now().Add(redisIOTimeout))
+	if _, err := io.WriteString(c, cmd.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.r)
+}
+
+// redisError is an error reply of the server, the connection is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply '%s'", line)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	fhttp "github.com/Noooste/fhttp"
+	tls "github.com/Noooste/utls"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+)
+
+// setting is a value of the configuration that can be reloaded while requests
+// read it
+type setting[T any] struct {
+	v atomic.Pointer[T]
+}
+
+func newSetting[T any](v T) *setting[T] {
+	s := &setting[T]{}
+	s.set(v)
+	return s
+}
+
+func (s *setting[T]) get() T  { return *s.v.Load() }
+func (s *setting[T]) set(v T) { s.v.Store(&v) }
+
+// reloadMu serializes reloads
+var reloadMu sync.Mutex
+
+// reloaded is what a reload changed
+type reloaded struct {
+	Settings int      `json:"settings"`
+	Proxies  int      `json:"proxies"`
+	Profiles []string `json:"profiles"`
+}
+
+// reloadConfig reads the configuration file, the proxy file, the PAC file, the
+// IP databases, the browser profiles, the TLS certificate and the client CA
+// again and applies them along with the limits, the credentials and the IP
+// rules, without a restart. Requests in flight finish with the settings they
+// started with. When any of them fails to load nothing changes but the profiles
+// loaded so far.
+func reloadConfig() (reloaded, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return reloaded{}, fmt.Errorf("loading the configuration file: %w", err)
+	}
+	previous := fileConfig
+	fileConfig = config
+	applied := false
+	defer func() {
+		if !applied {
+			fileConfig = previous
+		}
+	}()
+
+	pool, err := newUpstreamProxies(flagOrEnv("proxy-file", "TLS_PROXY_FILE"))
+	if err != nil {
+		return reloaded{}, err
+	}
+	var pac *pacScript
+	if path := flagOrEnv("pac-file", "TLS_PAC_FILE"); path != "" {
+		if pac, err = loadPAC(path); err != nil {
+			return reloaded{}, fmt.Errorf("loading the PAC file: %w", err)
+		}
+	}
+	var db *ipDatabase
+	if paths := flagOrEnv("ip-db", "TLS_IP_DB"); paths != "" {
+		if db, err = loadIPDatabase(paths); err != nil {
+			return reloaded{}, fmt.Errorf("loading the IP databases: %w", err)
+		}
+	}
+	var profiles []string
+	if dir := flagOrEnv("profiles-dir", "TLS_PROFILES_DIR"); dir != "" {
+		if profiles, err = browser.LoadDir(dir); err != nil {
+			return reloaded{}, fmt.Errorf("loading browser profiles: %w", err)
+		}
+	}
+	limits, err := loadLimits()
+	if err != nil {
+		return reloaded{}, err
+	}
+	auth, err := loadAuth()
+	if err != nil {
+		return reloaded{}, err
+	}
+	var cert *tls.Certificate
+	if serverCert != nil {
+		if cert, err = serverCert.load(); err != nil {
+			return reloaded{}, err
+		}
+	}
+	var clientCAs *x509.CertPool
+	if clientCA != nil {
+		if clientCAs, err = clientCA.load(); err != nil {
+			return reloaded{}, err
+		}
+	}
+
+	applied = true
+	setUpstreamProxies(pool)
+	upstreamPAC.Store(pac)
+	ipDatabases.Store(db)
+	limits()
+	auth()
+	if cert != nil {
+		serverCert.cert.Store(cert)
+	}
+	if clientCAs != nil {
+		clientCA.pool.Store(clientCAs)
+	}
+
+	r := reloaded{Settings: len(config), Profiles: profiles}
+	if r.Profiles == nil {
+		r.Profiles = []string{}
+	}
+	if pool != nil {
+		r.Proxies = len(pool.proxies)
+	}
+	return r, nil
+}
+
+// loadLimits reads the limits and the default browser profile, and returns the
+// function applying them
+func loadLimits() (func(), error) {
+	timeout := getEnvSeconds("TLS_UPSTREAM_TIMEOUT", 30)
+	if timeout <= 0 {
+		return nil, errors.New("TLS_UPSTREAM_TIMEOUT must be at least a second")
+	}
+	profile := getEnv("TLS_DEFAULT_BROWSER", browser.DefaultProfile)
+	if _, ok := browser.Get(profile); !ok {
+		return nil, fmt.Errorf("unknown browser profile '%s' in TLS_DEFAULT_BROWSER", profile)
+	}
+
+	maxBody := int64(getEnvInt("TLS_UPSTREAM_MAX_BODY", 0))
+	maxRate := int64(getEnvInt("TLS_UPSTREAM_MAX_RATE", 0))
+	maxRequest := int64(getEnvInt("TLS_MAX_REQUEST_BODY", 0))
+	idleTimeout := getEnvSeconds("TLS_SESSION_IDLE_TIMEOUT", 300)
+	maxLifetime := getEnvSeconds("TLS_SESSION_MAX_LIFETIME", 1800)
+	maxSessions := getEnvInt("TLS_MAX_SESSIONS", 1000)
+	rate, burst, err := parseClientRate(getEnv("TLS_CLIENT_RATE", ""), getEnv("TLS_CLIENT_BURST", ""))
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseHostLimits(getEnv("TLS_HOST_LIMITS", ""))
+	if err != nil {
+		return nil, err
+	}
+	admission, err := loadAdmission(
+		getEnvInt("TLS_MAX_IN_FLIGHT", 0), getEnvInt("TLS_MAX_QUEUE", 100), getEnvSeconds("TLS_QUEUE_TIMEOUT", 10),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		defaultTimeout.set(timeout)
+		defaultBrowser.set(profile)
+		upstreamMaxBody.set(maxBody)
+		upstreamMaxRate.set(maxRate)
+		maxRequestBody.set(maxRequest)
+		sessionIdleTimeout.set(idleTimeout)
+		sessionMaxLifetime.set(maxLifetime)
+		sessionMaxSessions.set(maxSessions)
+		clientRate.set(rate)
+		clientBurst.set(burst)
+		hostLimits.set(hosts)
+		requestAdmission.set(admission)
+	}, nil
+}
+
+// flagOrEnv returns the value of the flag when it was passed, the setting it
+// defaults to otherwise
+func flagOrEnv(name, key string) string {
+	value, passed := "", false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			value, passed = f.Value.String(), true
+		}
+	})
+	if passed {
+		return value
+	}
+	return getEnv(key, "")
+}
+
+// reloadOnSignal reloads the configuration whenever the process gets SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		logReload(reloadConfig())
+	}
+}
+
+func logReload(r reloaded, err error) {
+	if err != nil {
+		slog.Error("Error reloading the configuration, keeping the current one", "error", err)
+		return
+	}
+	slog.Info("Reloaded the configuration", "settings", r.Settings, "proxies", r.Proxies, "profiles", r.Profiles)
+}
+
+// HandleReload serves the configuration reload API, on the admin address only
+func HandleReload(w fhttp.ResponseWriter, r *fhttp.Request) {
+	if !adminOnly(w, r) {
+		return
+	}
+	if r.Method != fhttp.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	reloaded, err := reloadConfig()
+	logReload(reloaded, err)
+	if err != nil {
+		writeError(w, fhttp.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, fhttp.StatusOK, reloaded)
+}
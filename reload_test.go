@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defaultFile, defaultConfig := configFile, fileConfig
+	configFile = path
+	defer func() {
+		configFile, fileConfig = defaultFile, defaultConfig
+		upstreamProxies.Store(nil)
+		if limits, err := loadLimits(); err == nil {
+			limits()
+		}
+	}()
+
+	write(`
+proxies: [http://proxy-1:8080, http://proxy-2:8080]
+proxy_strategy: random
+default_browser: chrome126
+upstream:
+  max_body: 1024
+  timeout: 5
+`)
+	send := func(method string) *mockResponseWriter {
+		r, err := http.NewRequest(method, "/api/config/reload", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReload(w, asAdmin(r))
+		return w
+	}
+	// callers cannot reload, only operators on the admin address
+	r, _ := http.NewRequest(http.MethodPost, "/api/config/reload", http.NoBody)
+	caller := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleReload(caller, r)
+	assert.Equal(t, http.StatusNotFound, caller.statusCode)
+
+	w := send(http.MethodPost)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	var got reloaded
+	assert.NoError(t, json.Unmarshal(w.body.Bytes(), &got))
+	assert.Equal(t, reloaded{Settings: 5, Proxies: 2, Profiles: []string{}}, got)
+
+	pool := upstreamProxies.Load()
+	if assert.NotNil(t, pool) {
+		assert.Equal(t, []string{"http://proxy-1:8080", "http://proxy-2:8080"}, pool.proxies)
+		assert.Equal(t, strategyRandom, pool.strategy)
+	}
+	assert.Equal(t, "chrome126", defaultBrowser.get())
+	assert.Equal(t, int64(1024), upstreamMaxBody.get())
+	assert.Equal(t, 5*time.Second, defaultTimeout.get())
+
+	// Nothing changes when the configuration does not load
+	write("default_browser: netscape")
+	w = send(http.MethodPost)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.statusCode)
+	assert.Same(t, pool, upstreamProxies.Load())
+	assert.Equal(t, "chrome126", defaultBrowser.get())
+	assert.Equal(t, "random", fileConfig["TLS_PROXY_STRATEGY"])
+
+	// Settings taken out of the file go back to their defaults
+	write("{}")
+	_, err := reloadConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, upstreamProxies.Load())
+	assert.Equal(t, int64(0), upstreamMaxBody.get())
+	assert.Equal(t, 30*time.Second, defaultTimeout.get())
+
+	w = send(http.MethodGet)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.statusCode)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxProxyExits bounds the proxies exit IPs are remembered for
+const maxProxyExits = 4096
+
+const (
+	classResidential = "residential"
+	classDatacenter  = "datacenter"
+)
+
+// residentialHosts are the target domains, subdomains included, requests
+// through the proxy pool go over its residential exits to
+var residentialHosts = parseDomains(getEnv("TLS_RESIDENTIAL_HOSTS", ""))
+
+// ipDatabases annotate the exits of the proxies, nil when none are configured
+var ipDatabases atomic.Pointer[ipDatabase]
+
+// ipDatabase looks IPs up in MaxMind DB files, like GeoLite2-ASN,
+// GeoLite2-City and GeoIP2-Connection-Type. Each field of an annotation comes
+// from the first file that has it.
+type ipDatabase struct {
+	readers []*maxminddb.Reader
+}
+
+// ipReputation is what the databases know about an IP
+type ipReputation struct {
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	// Class is residential or datacenter, empty when the databases do not tell
+	Class string `json:"class,omitempty"`
+}
+
+// ipRecord holds the fields of the ASN, City, Country, Connection-Type,
+// Enterprise and Anonymous-IP databases annotations are made of
+type ipRecord struct {
+	ASN               uint      `maxminddb:"autonomous_system_number"`
+	ASOrg             string    `maxminddb:"autonomous_system_organization"`
+	ConnectionType    string    `maxminddb:"connection_type"`
+	Country           ipCountry `maxminddb:"country"`
+	RegisteredCountry ipCountry `maxminddb:"registered_country"`
+	City              struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Traits struct {
+		ASN            uint   `maxminddb:"autonomous_system_number"`
+		ASOrg          string `maxminddb:"autonomous_system_organization"`
+		ConnectionType string `maxminddb:"connection_type"`
+		UserType       string `maxminddb:"user_type"`
+	} `maxminddb:"traits"`
+	IsResidentialProxy bool `maxminddb:"is_residential_proxy"`
+	IsHostingProvider  bool `maxminddb:"is_hosting_provider"`
+}
+
+type ipCountry struct {
+	ISOCode string `maxminddb:"iso_code"`
+}
+
+// loadIPDatabase reads the comma separated MaxMind DB files into memory, nil
+// when there are none
+func loadIPDatabase(paths string) (*ipDatabase, error) {
+	db := &ipDatabase{}
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := maxminddb.FromBytes(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		db.readers = append(db.readers, r)
+	}
+	if len(db.readers) == 0 {
+		return nil, nil
+	}
+	return db, nil
+}
+
+// lookup annotates the IP, nil when none of the files has it
+func (db *ipDatabase) lookup(ip netip.Addr) *ipReputation {
+	var rep ipReputation
+	found := false
+	for _, r := range db.readers {
+		var record ipRecord
+		_, ok, err := r.LookupNetwork(ip.Unmap().AsSlice(), &record)
+		if err != nil {
+			slog.Warn("Error looking up IP", "database", r.Metadata.DatabaseType, "ip", ip, "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		found = true
+
+		if rep.ASN == 0 {
+			rep.ASN = cmp.Or(record.ASN, record.Traits.ASN)
+		}
+		if rep.ASOrg == "" {
+			rep.ASOrg = cmp.Or(record.ASOrg, record.Traits.ASOrg)
+		}
+		if rep.Country == "" {
+			rep.Country = cmp.Or(record.Country.ISOCode, record.RegisteredCountry.ISOCode)
+		}
+		if rep.City == "" {
+			rep.City = record.City.Names["en"]
+		}
+		if rep.Class == "" {
+			rep.Class = record.class()
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &rep
+}
+
+// class tells residential and datacenter IPs apart by the connection type,
+// user type and anonymous IP fields of the record
+func (record *ipRecord) class() string {
+	switch cmp.Or(record.ConnectionType, record.Traits.ConnectionType) {
+	case "Cable/DSL", "Cellular":
+		return classResidential
+	}
+	switch record.Traits.UserType {
+	case "residential", "cellular":
+		return classResidential
+	case "hosting", "content_delivery_network":
+		return classDatacenter
+	}
+	switch {
+	case record.IsResidentialProxy:
+		return classResidential
+	case record.IsHostingProvider:
+		return classDatacenter
+	}
+	return ""
+}
+
+// proxyExits remembers where the proxies requests went through are, to
+// annotate them
+var proxyExits = &exitsByProxy{byProxy: map[string]*proxyExit{}}
+
+// exitsByProxy is safe for concurrent use
+type exitsByProxy struct {
+	mu      sync.Mutex
+	byProxy map[string]*proxyExit
+}
+
+type proxyExit struct {
+	// exit is the IP the proxy last reported it connected from
+	exit netip.Addr
+	// addr is the IP the proxy was last found at, HTTP proxies do not report
+	// their exits and most leave from where they are
+	addr netip.Addr
+
+	// rep annotates the IP of the exit for db
+	db  *ipDatabase
+	ip  netip.Addr
+	rep *ipReputation
+}
+
+// use records a request through the proxy. A proxy given by its host name is
+// resolved the first time, in the background.
+func (e *exitsByProxy) use(proxy string) {
+	if proxy == "" {
+		return
+	}
+	e.mu.Lock()
+	_, known := e.byProxy[proxy]
+	e.entry(proxy)
+	e.mu.Unlock()
+
+	u, err := url.Parse(proxy)
+	if known || err != nil || u.Hostname() == "" {
+		return
+	}
+	if _, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+		if err != nil || len(ips) == 0 {
+			return
+		}
+		e.recordAddr(proxy, ips[0])
+	}()
+}
+
+// recordExit keeps the exit IP a request through the proxy left from
+func (e *exitsByProxy) recordExit(proxy string, ip netip.Addr) {
+	if proxy == "" || !ip.IsValid() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.entry(proxy).exit = ip
+}
+
+// recordAddr keeps the IP the proxy was found at
+func (e *exitsByProxy) recordAddr(proxy string, ip netip.Addr) {
+	if !ip.IsValid() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.entry(proxy).addr = ip
+}
+
+// entry returns the entry of the proxy, making room for it when there are too
+// many. The lock must be held.
+func (e *exitsByProxy) entry(proxy string) *proxyExit {
+	exit, ok := e.byProxy[proxy]
+	if !ok {
+		for other := range e.byProxy {
+			if len(e.byProxy) < maxProxyExits {
+				break
+			}
+			delete(e.byProxy, other)
+		}
+		exit = &proxyExit{}
+		e.byProxy[proxy] = exit
+	}
+	return exit
+}
+
+// proxies returns the proxies requests went through, sorted
+func (e *exitsByProxy) proxies() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	proxies := make([]string, 0, len(e.byProxy))
+	for proxy := range e.byProxy {
+		proxies = append(proxies, proxy)
+	}
+	slices.Sort(proxies)
+	return proxies
+}
+
+// lookup returns the IP the proxy is known to leave from and its annotation,
+// which is nil without databases or when they do not have the IP
+func (e *exitsByProxy) lookup(proxy string) (netip.Addr, *ipReputation) {
+	db := ipDatabases.Load()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exit := e.entry(proxy)
+	ip := exit.exit
+	if !ip.IsValid() {
+		ip = exit.addr
+	}
+	if !ip.IsValid() {
+		// Proxies given by their IP are where they are
+		if u, err := url.Parse(proxy); err == nil {
+			ip, _ = netip.ParseAddr(u.Hostname())
+		}
+	}
+	if !ip.IsValid() || db == nil {
+		return ip, nil
+	}
+
+	if exit.db != db || exit.ip != ip {
+		exit.db, exit.ip, exit.rep = db, ip, db.lookup(ip)
+	}
+	return ip, exit.rep
+}
+
+// isResidential reports whether the proxy is known to leave from a residential
+// IP
+func isResidential(proxy string) bool {
+	_, rep := proxyExits.lookup(proxy)
+	return rep != nil && rep.Class == classResidential
+}
+
+// prefersResidential reports whether requests to the target URL go over the
+// residential exits of the proxy pool
+func prefersResidential(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range residentialHosts {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDomains splits comma separated domains, a leading dot is left out
+func parseDomains(domains string) []string {
+	var parsed []string
+	for _, domain := range strings.Split(domains, ",") {
+		if domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "."); domain != "" {
+			parsed = append(parsed, domain)
+		}
+	}
+	return parsed
+}
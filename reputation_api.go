@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// exitInfo is a proxy requests went through, with where it leaves from
+type exitInfo struct {
+	Proxy string `json:"proxy"`
+	// ExitIP is the IP the proxy is known to leave from, and Reputation what the
+	// IP databases know about it
+	ExitIP     string        `json:"exit_ip,omitempty"`
+	Reputation *ipReputation `json:"reputation,omitempty"`
+}
+
+// HandleExits serves the annotated exits of the proxies requests went through,
+// on the admin address
+func HandleExits(w fhttp.ResponseWriter, r *fhttp.Request) {
+	if !adminOnly(w, r) {
+		return
+	}
+	if r.Method != fhttp.MethodGet {
+		w.Header().Set("Allow", fhttp.MethodGet)
+		writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	exits := []exitInfo{}
+	for _, proxy := range proxyExits.proxies() {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			continue
+		}
+		// Do not hand out proxy credentials
+		info := exitInfo{Proxy: u.Redacted()}
+		exit, reputation := proxyExits.lookup(proxy)
+		if exit.IsValid() {
+			info.ExitIP, info.Reputation = exit.String(), reputation
+		}
+		exits = append(exits, info)
+	}
+	writeJSON(w, fhttp.StatusOK, exits)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// requestIDHeaderName is the header of the ID a request is traced by in the
+// logs of the caller, the server and the upstream
+var requestIDHeaderName = getEnv("TLS_REQUEST_ID", "x-request-id")
+
+// maxRequestIDLength is how long the request IDs of callers can be
+const maxRequestIDLength = 128
+
+// requestID returns the ID the caller gave the request, or a new one when it
+// gave none, or one too long or with characters that do not belong in logs
+func requestID(r *fhttp.Request) string {
+	if id := r.Header.Get(requestIDHeaderName); validRequestID(id) {
+		return id
+	}
+	return randomID()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// randomID returns a random ID to find the logs of a request or a failure by
+func randomID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
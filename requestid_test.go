@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	var upstreamIDs []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamIDs = append(upstreamIDs, r.Header.Get("x-request-id"))
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	send := func(h http.HandlerFunc, id string) *mockResponseWriter {
+		r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("x-tls-url", upstream.URL)
+		if id != "" {
+			r.Header.Set("x-request-id", id)
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		observeRequests(h).ServeHTTP(w, r)
+		return w
+	}
+
+	// The ID of the caller goes upstream and back
+	w := send(HandleReq, "trace-42")
+	assert.Equal(t, "trace-42", w.headers.Get("x-request-id"))
+
+	// Requests without one are given one, not sent upstream
+	w = send(HandleReq, "")
+	assert.Regexp(t, `^[0-9a-f]{16}$`, w.headers.Get("x-request-id"))
+	assert.Equal(t, []string{"trace-42", ""}, upstreamIDs)
+
+	// IDs that do not belong in logs are replaced
+	w = send(HandleReq, strings.Repeat("a", maxRequestIDLength+1))
+	assert.Len(t, w.headers.Get("x-request-id"), 16)
+	w = send(HandleReq, "two words")
+	assert.Len(t, w.headers.Get("x-request-id"), 16)
+
+	// Failures carry the ID in the body
+	w = send(func(w http.ResponseWriter, r *http.Request) {
+		writeFailure(w, r, http.StatusBadRequest, errBadRequest, errUnauthenticated)
+	}, "trace-43")
+	var got failure
+	assert.NoError(t, json.Unmarshal(w.body.Bytes(), &got))
+	assert.Equal(t, "trace-43", got.RequestID)
+}
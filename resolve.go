@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var resolveHeaderName = getEnv("TLS_RESOLVE", "x-tls-resolve")
+
+// errResolveUnpinned is returned for connections to pinned hosts azuretls dials
+// on its own, which resolve the host themselves
+var errResolveUnpinned = errors.New("resolve pins only apply to https targets not going through an HTTPS proxy")
+
+// parseResolve parses pins of hosts to an IP as 'host:port:addr', like curl's
+// --resolve, comma separated. IPv6 addresses can be given in brackets. The pins
+// are returned normalized, as they are part of the session key.
+func parseResolve(value string) (string, error) {
+	var pins []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, rest, _ := strings.Cut(entry, ":")
+		port, addr, _ := strings.Cut(rest, ":")
+		if host == "" {
+			return "", fmt.Errorf("'%s' has no host, expected host:port:addr", entry)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("'%s' has no valid port, expected host:port:addr", entry)
+		}
+		ip, err := netip.ParseAddr(strings.Trim(addr, "[]"))
+		if err != nil {
+			return "", fmt.Errorf("'%s' has no valid IP, expected host:port:addr", entry)
+		}
+		pins = append(pins, strings.ToLower(host)+":"+port+":"+ip.Unmap().String())
+	}
+	return strings.Join(pins, ","), nil
+}
+
+// pinnedAddr returns the address to dial for the URL in place of its host when
+// the key pins the host and port of the URL, or an empty string
+func (k sessionKey) pinnedAddr(u *url.URL) string {
+	if k.resolve == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" || u.Scheme == "ws" {
+			port = "80"
+		}
+	}
+	for _, pin := range strings.Split(k.resolve, ",") {
+		host, rest, _ := strings.Cut(pin, ":")
+		pinPort, ip, _ := strings.Cut(rest, ":")
+		if strings.EqualFold(host, u.Hostname()) && pinPort == port {
+			return net.JoinHostPort(ip, port)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve(t *testing.T) {
+	var host, serverName string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, serverName = r.Host, r.TLS.ServerName
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	// The test certificate is valid for example.com, which resolves elsewhere
+	u, _ := url.Parse(upstream.URL)
+	target := "https://example.com:" + u.Port()
+
+	w := proxyRequest(t, map[string]string{
+		"x-tls-url": target, "x-tls-resolve": "other.example:443:10.0.0.1, EXAMPLE.com:" + u.Port() + ":127.0.0.1",
+	})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, "example.com:"+u.Port(), host)
+	assert.Equal(t, "example.com", serverName)
+
+	// azuretls dials plain connections itself
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	u, _ = url.Parse(plain.URL)
+	w = proxyRequest(t, map[string]string{
+		"x-tls-url": "http://example.com:" + u.Port(), "x-tls-resolve": "example.com:" + u.Port() + ":127.0.0.1",
+	})
+	assert.Equal(t, http.StatusInternalServerError, w.statusCode)
+	assert.Contains(t, w.body.String(), errResolveUnpinned.Error())
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": target, "x-tls-resolve": "example.com:443"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestParseResolve(t *testing.T) {
+	tests := map[string]string{
+		"":                                       "",
+		"Example.com:443:1.2.3.4":                "example.com:443:1.2.3.4",
+		"a.test:80:[2001:db8::1], b.test:443:::1": "a.test:80:2001:db8::1,b.test:443:::1",
+		"a.test:443:::ffff:10.0.0.1":             "a.test:443:10.0.0.1",
+	}
+	for value, want := range tests {
+		got, err := parseResolve(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+
+	for _, value := range []string{"example.com", "example.com:443", ":443:1.2.3.4", "example.com:http:1.2.3.4", "example.com:0:1.2.3.4", "example.com:443:host"} {
+		_, err := parseResolve(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPinnedAddr(t *testing.T) {
+	key := sessionKey{resolve: "example.com:443:1.2.3.4,example.com:8080:2001:db8::1,plain.test:80:10.0.0.1"}
+	tests := map[string]string{
+		"https://EXAMPLE.com/path":   "1.2.3.4:443",
+		"https://example.com:8080/":  "[2001:db8::1]:8080",
+		"http://plain.test/":         "10.0.0.1:80",
+		"https://plain.test/":        "",
+		"https://other.example.com/": "",
+	}
+	for target, want := range tests {
+		u, _ := url.Parse(target)
+		assert.Equal(t, want, key.pinnedAddr(u), target)
+	}
+}
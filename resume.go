@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var resumeHeaderName = getEnv("TLS_RESUME", "x-tls-resume")
+
+// maxResumes bounds how many times a response body is resumed
+const maxResumes = 100
+
+// parseResumes parses how many times the body of the response is resumed at
+// most when the upstream connection breaks, 0 when the request does not say
+func parseResumes(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > maxResumes {
+		return 0, fmt.Errorf("'%s' is not a number of resumes up to %d", value, maxResumes)
+	}
+	return n, nil
+}
+
+// parseContentRange parses the Content-Range of a 206 response, the size is -1
+// when the upstream does not know it
+func parseContentRange(value string) (first, last, size int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, total, found := strings.Cut(spec, "/")
+	from, to, found2 := strings.Cut(span, "-")
+	if !found || !found2 {
+		return 0, 0, 0, false
+	}
+	first, err1 := strconv.ParseInt(from, 10, 64)
+	last, err2 := strconv.ParseInt(to, 10, 64)
+	size, err3 := int64(-1), error(nil)
+	if total != "*" {
+		size, err3 = strconv.ParseInt(total, 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || first < 0 || last < first || (size >= 0 && last >= size) {
+		return 0, 0, 0, false
+	}
+	return first, last, size, true
+}
+
+// decodedBody reports whether the transport decoded the body of the response
+// although it was to be kept encoded, see keptEncodings
+func decodedBody(res *azuretls.Response) bool {
+	return res.HttpResponse == nil || (res.HttpResponse.ProtoMajor == 2 && res.HttpResponse.Uncompressed)
+}
+
+// resumingBody is the body of a response that asks the upstream for the rest
+// of it with a Range request when the connection breaks, and reads on from the
+// partial response
+type resumingBody struct {
+	session *pooledSession
+	req     *azuretls.Request
+	url     string
+	// validator is the ETag or Last-Modified the rest is asked for If-Range of
+	validator string
+	// next is the offset of the next byte, last the one of the last byte of the
+	// body or -1 when its length is not known, size the size of the whole
+	// representation or -1
+	next, last, size int64
+	left             int
+
+	mu     sync.Mutex
+	body   io.ReadCloser
+	closed bool
+}
+
+// resumeBody returns the body of the response, resumed up to resumes times.
+// Only bodies of GET requests forwarded as the upstream sent them can be, the
+// offsets of decoded bodies are not the ones of the upstream, see keepsEncoding.
+func resumeBody(session *pooledSession, req *azuretls.Request, res *azuretls.Response, resumes int) io.ReadCloser {
+	if resumes == 0 || req.Method != fhttp.MethodGet || decodedBody(res) {
+		return res.RawBody
+	}
+
+	b := &resumingBody{session: session, req: req, url: res.Url, left: resumes, body: res.RawBody}
+	switch res.StatusCode {
+	case fhttp.StatusOK:
+		b.last, b.size = res.ContentLength-1, res.ContentLength
+		if res.ContentLength < 0 {
+			b.last = -1
+		}
+	case fhttp.StatusPartialContent:
+		first, last, size, ok := parseContentRange(res.Header.Get("Content-Range"))
+		if !ok {
+			return res.RawBody
+		}
+		b.next, b.last, b.size = first, last, size
+	default:
+		return res.RawBody
+	}
+
+	// Weak ETags cannot be used for ranges
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		b.validator = etag
+	} else {
+		b.validator = res.Header.Get("Last-Modified")
+	}
+	return b
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	body := b.body
+	b.mu.Unlock()
+
+	n, err := body.Read(p)
+	b.next += int64(n)
+	if err == nil || err == io.EOF || b.left == 0 || (b.last >= 0 && b.next > b.last) {
+		return n, err
+	}
+	if resumeErr := b.resume(); resumeErr != nil {
+		slog.Warn("Error resuming response body", "url", b.url, "offset", b.next, "error", resumeErr)
+		return n, err
+	}
+	slog.Info("Resumed response body", "url", b.url, "offset", b.next, "error", err)
+	return n, nil
+}
+
+// resume asks the upstream for the rest of the body and reads on from it
+func (b *resumingBody) resume() error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed || b.req.Context().Err() != nil {
+		return fmt.Errorf("response body closed")
+	}
+	b.left--
+
+	span := fmt.Sprintf("bytes=%d-", b.next)
+	if b.last >= 0 {
+		span += strconv.FormatInt(b.last, 10)
+	}
+	headers := b.session.OrderedHeaders.Clone()
+	headers.Set("Range", span)
+	if b.validator != "" {
+		headers.Set("If-Range", b.validator)
+	}
+	req := &azuretls.Request{
+		Method:           fhttp.MethodGet,
+		Url:              b.url,
+		OrderedHeaders:   headers,
+		DisableRedirects: true,
+		IgnoreBody:       true,
+	}
+	req.SetContext(b.req.Context())
+
+	res, err := b.session.Do(req)
+	if err != nil {
+		return err
+	}
+	// The rest has to be the one of the same representation
+	first, _, size, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if res.StatusCode != fhttp.StatusPartialContent || !ok || first != b.next || (b.size >= 0 && size != b.size) || decodedBody(res) {
+		res.RawBody.Close()
+		return fmt.Errorf("upstream answered with %d %s", res.StatusCode, res.Header.Get("Content-Range"))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.body.Close()
+	b.body = res.RawBody
+	if b.closed {
+		b.body.Close()
+	}
+	return nil
+}
+
+// Close closes the body being read, and stops resuming it. Stream timeouts
+// close it while it is read.
+func (b *resumingBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.body.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeRequest(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.txt", time.Unix(0, 0), strings.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	for _, buffer := range []string{"0", "1"} {
+		r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("x-tls-url", upstream.URL)
+		r.Header.Set("x-tls-buffer", buffer)
+		r.Header.Set("Range", "bytes=10-19")
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+
+		assert.Equal(t, http.StatusPartialContent, w.statusCode)
+		assert.Equal(t, "bytes 10-19/1000", w.sent.Get("Content-Range"))
+		assert.Empty(t, w.sent.Get("Content-Encoding"))
+		assert.Equal(t, content[10:20], w.body.String())
+	}
+}
+
+// brokenServer answers the first request for the body with its first half and
+// closes the connection, and requests for the rest with a partial response,
+// recording their Range and If-Range
+func brokenServer(t *testing.T, body string, ranges chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	half := len(body) / 2
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Range") == "" {
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nETag: \"v1\"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body[:half]))
+					return
+				}
+				ranges <- req.Header.Get("Range") + " " + req.Header.Get("If-Range")
+				conn.Write([]byte("HTTP/1.1 206 Partial Content\r\nContent-Range: bytes " + strconv.Itoa(half) + "-" + strconv.Itoa(len(body)-1) +
+					"/" + strconv.Itoa(len(body)) + "\r\nContent-Length: " + strconv.Itoa(len(body)-half) + "\r\n\r\n" + body[half:]))
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestResumeBody(t *testing.T) {
+	body := strings.Repeat("resumable", 100)
+	ranges := make(chan string, 1)
+	url := brokenServer(t, body, ranges)
+
+	for _, buffer := range []string{"0", "1"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": buffer, "x-tls-resume": "2"})
+
+		assert.Equal(t, http.StatusOK, w.statusCode, buffer)
+		assert.Equal(t, body, w.body.String(), buffer)
+		assert.Empty(t, w.sent.Get("x-tls-upstream-warning"), buffer)
+		select {
+		case got := <-ranges:
+			assert.Equal(t, "bytes=450- \"v1\"", got, buffer)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the body was not resumed", buffer)
+		}
+	}
+
+	// Without resuming the body is cut short
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1"})
+	assert.Equal(t, body[:450], w.body.String())
+	assert.Contains(t, w.sent.Get("x-tls-upstream-warning"), "premature-close")
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-resume": "many"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestParseContentRange(t *testing.T) {
+	first, last, size, ok := parseContentRange("bytes 10-19/1000")
+	assert.True(t, ok)
+	assert.Equal(t, []int64{10, 19, 1000}, []int64{first, last, size})
+
+	_, _, size, ok = parseContentRange("bytes 0-99/*")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1), size)
+
+	for _, value := range []string{"", "bytes */1000", "bytes 20-10/1000", "bytes 0-1000/1000", "items 0-1/2"} {
+		_, _, _, ok = parseContentRange(value)
+		assert.False(t, ok, value)
+	}
+}
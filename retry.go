@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	retriesHeaderName      = getEnv("TLS_RETRIES", "x-tls-retries")
+	retryBackoffHeaderName = getEnv("TLS_RETRY_BACKOFF", "x-tls-retry-backoff")
+	retryStatusHeaderName  = getEnv("TLS_RETRY_STATUS", "x-tls-retry-status")
+	attemptsHeaderName     = getEnv("TLS_ATTEMPTS", "x-tls-attempts")
+)
+
+const (
+	// maxRetries bounds how many times a request is retried
+	maxRetries = 10
+	// defaultRetryBackoff is the wait before the first retry of requests that
+	// do not set one, it doubles for every retry up to maxRetryBackoff
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 10 * time.Second
+	// maxRetryBody is the size of the largest request body kept to be sent
+	// again, requests with larger ones or ones of unknown length are not retried
+	maxRetryBody = 1 << 20
+)
+
+// retriedFailures are the failures worth trying again, those of the
+// connection to the upstream or the proxy rather than of the request
+var retriedFailures = map[errorCode]bool{
+	errTimeout:        true,
+	errConnect:        true,
+	errConnection:     true,
+	errProxyConnect:   true,
+	errPrematureClose: true,
+}
+
+// retryPolicy says how many times and when a request is retried
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	// statuses are the statuses of the responses retried as failures
+	statuses map[int]bool
+}
+
+// parseRetryPolicy parses the retry headers of the request
+func parseRetryPolicy(headers fhttp.Header) (p retryPolicy, err error) {
+	if value := strings.TrimSpace(headers.Get(retriesHeaderName)); value != "" {
+		if p.retries, err = strconv.Atoi(value); err != nil || p.retries < 0 || p.retries > maxRetries {
+			return retryPolicy{}, fmt.Errorf("invalid '%s': '%s' is not a number of retries up to %d", retriesHeaderName, value, maxRetries)
+		}
+	}
+	if p.backoff, err = parseTimeout(headers.Get(retryBackoffHeaderName)); err != nil {
+		return retryPolicy{}, fmt.Errorf("invalid '%s': %w", retryBackoffHeaderName, err)
+	}
+	if headers.Get(retryBackoffHeaderName) == "" {
+		p.backoff = defaultRetryBackoff
+	}
+	for _, value := range strings.Split(headers.Get(retryStatusHeaderName), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 100 || status > 599 {
+			return retryPolicy{}, fmt.Errorf("invalid '%s': '%s' is not a status", retryStatusHeaderName, value)
+		}
+		if p.statuses == nil {
+			p.statuses = make(map[int]bool)
+		}
+		p.statuses[status] = true
+	}
+	return p, nil
+}
+
+// retry reports whether an attempt that failed with err, or got a response
+// with the status, is tried again
+func (p retryPolicy) retry(err error, status int, proxied bool) bool {
+	if err != nil {
+		_, code := classifyFailure(err, proxied)
+		return retriedFailures[code]
+	}
+	return p.statuses[status]
+}
+
+// delay returns how long to wait before the retry, the backoff doubled for
+// every retry before it, with jitter so retries of many callers spread out
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := min(p.backoff<<(retry-1), maxRetryBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// replayBody makes the body of the request readable again for every attempt,
+// keeping it in memory. It reports whether the request can be sent again,
+// which requests with large bodies or ones of unknown length cannot.
+func replayBody(r *fhttp.Request) (bool, error) {
+	if r.Body == nil || r.Body == fhttp.NoBody {
+		return true, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > maxRetryBody {
+		return false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil {
+		return false, err
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
+
+// waitRetry waits for the delay, and reports whether the caller is still there
+// once it passed
+func waitRetry(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer drops the connections of the first failures requests without an
+// answer, and answers the next ones
+func flakyServer(t *testing.T, failures int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var requests atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				if requests.Add(1) > failures {
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestRetries(t *testing.T) {
+	url := flakyServer(t, 2)
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-retries": "3", "x-tls-retry-backoff": "10ms"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, "3", w.sent.Get("x-tls-attempts"))
+
+	// Running out of retries fails like a single attempt
+	url = flakyServer(t, 5)
+	w = proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-retries": "1", "x-tls-retry-backoff": "10ms"})
+	assert.Equal(t, http.StatusBadGateway, w.statusCode)
+	assert.Equal(t, "2", w.sent.Get("x-tls-attempts"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-retries": "many"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestRetryStatus(t *testing.T) {
+	var requests atomic.Int32
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if requests.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	send := func(headers map[string]string) *mockResponseWriter {
+		r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+		return w
+	}
+
+	w := send(map[string]string{"x-tls-url": upstream.URL, "x-tls-retries": "2", "x-tls-retry-status": "502, 503"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "2", w.sent.Get("x-tls-attempts"))
+	// The body goes out with every attempt
+	assert.Equal(t, []string{"payload", "payload"}, bodies)
+
+	// Statuses are only retried when asked for
+	w = send(map[string]string{"x-tls-url": upstream.URL, "x-tls-retries": "2"})
+	assert.Equal(t, http.StatusServiceUnavailable, w.statusCode)
+	assert.Equal(t, "1", w.sent.Get("x-tls-attempts"))
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{backoff: 100 * time.Millisecond}
+	for retry, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		d := p.delay(retry + 1)
+		assert.GreaterOrEqual(t, d, want/2)
+		assert.LessOrEqual(t, d, want)
+	}
+	assert.LessOrEqual(t, p.delay(maxRetries), maxRetryBackoff)
+}
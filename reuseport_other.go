@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails, the system has no SO_REUSEPORT
+func reusePort(string, string, syscall.RawConn) error {
+	return errors.New("TLS_LISTEN_REUSE_PORT is not supported on this system")
+}
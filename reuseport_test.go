@@ -0,0 +1,53 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReusePort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	addrs := []listenAddress{{network: "tcp", address: addr}}
+
+	listenReusePort = true
+	defer func() { listenReusePort = false }()
+	old := &http.Server{Handler: http.HandlerFunc(HandleIsAlive)}
+	serveOld, err := listen(old, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldServed := make(chan error, 1)
+	go func() { oldServed <- serveOld() }()
+
+	// A new instance listens on the port alongside the old one, which then drains
+	next := &http.Server{Handler: http.HandlerFunc(HandleIsAlive)}
+	serveNew, err := listen(next, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveNew()
+	defer next.Close()
+	old.Close()
+	assert.ErrorIs(t, <-oldServed, http.ErrServerClosed)
+
+	res, err := http.Get("http://" + addr + "/isalive")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	// Without it the port is taken
+	listenReusePort = false
+	_, err = listen(&http.Server{}, addrs)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var proxyRotationHeaderName = getEnv("TLS_PROXY_ROTATION", "x-tls-proxy-rotation")
+
+// proxyRotation switches a pinned session to the next of its proxies after a
+// number of requests or bans through the current one. Cookies and fingerprint
+// stay the same, only the egress IP changes.
+type proxyRotation struct {
+	Proxies []string `json:"proxies"`
+	// Requests rotates after this many requests through a proxy, 0 never does
+	Requests int `json:"requests,omitempty"`
+	// Bans rotates after this many ban responses through a proxy, 0 never does
+	Bans int `json:"bans,omitempty"`
+	// Residential rotates to the next proxy known to leave from a residential
+	// IP, skipping the others as long as there is one
+	Residential bool `json:"residential,omitempty"`
+}
+
+// parseProxyRotation parses a 'requests=50;bans=1;residential=1' policy for
+// the comma separated proxies
+func parseProxyRotation(policy, proxies string) (*proxyRotation, error) {
+	rotation := &proxyRotation{}
+	for _, p := range strings.Split(proxies, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			rotation.Proxies = append(rotation.Proxies, p)
+		}
+	}
+
+	for _, field := range strings.Split(policy, ";") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid '%s' value '%s'", name, value)
+		}
+		switch name {
+		case "requests":
+			rotation.Requests = n
+		case "bans":
+			rotation.Bans = n
+		case "residential":
+			rotation.Residential = n > 0
+		default:
+			return nil, fmt.Errorf("unknown proxy rotation setting '%s'", name)
+		}
+	}
+
+	return rotation, rotation.check()
+}
+
+// check makes sure the rotation has proxies to rotate between
+func (r *proxyRotation) check() error {
+	if len(r.Proxies) < 2 {
+		return errors.New("proxy rotation needs at least two proxies")
+	}
+	return nil
+}
+
+// countProxyUse accounts for a request of the session through its current
+// proxy, statusCode is 0 when it got no response
+func (s *pooledSession) countProxyUse(statusCode int) {
+	if s.rotation == nil {
+		return
+	}
+	s.proxyRequests++
+	if isBan(statusCode) {
+		s.proxyBans++
+	}
+}
+
+// rotateProxy switches the session to its next proxy once the rotation policy
+// says so. It must be called between requests, it drops the connections.
+func (s *pooledSession) rotateProxy() {
+	r := s.rotation
+	if r == nil {
+		return
+	}
+	if (r.Requests == 0 || s.proxyRequests < r.Requests) && (r.Bans == 0 || s.proxyBans < r.Bans) {
+		return
+	}
+
+	next := r.next(s.proxy())
+	if err := s.SetProxy(next); err != nil {
+		slog.Error("Error rotating proxy of session", "session", s.id, "error", err)
+		return
+	}
+	bindProxyDialer(s.Session, s.key.localTCPAddr())
+
+	s.infoMu.Lock()
+	s.key.proxy = next
+	s.infoMu.Unlock()
+	s.proxyRequests, s.proxyBans = 0, 0
+	s.dirty = savedSessions != nil
+}
+
+// next returns the proxy to rotate to from current
+func (r *proxyRotation) next(current string) string {
+	i := slices.Index(r.Proxies, current)
+	if r.Residential {
+		for n := 1; n <= len(r.Proxies); n++ {
+			if proxy := r.Proxies[(i+n)%len(r.Proxies)]; isResidential(proxy) {
+				return proxy
+			}
+		}
+	}
+	return r.Proxies[(i+1)%len(r.Proxies)]
+}
+
+// proxy returns the proxy the session goes through right now
+func (s *pooledSession) proxy() string {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	return s.key.proxy
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// connectProxy starts an HTTP proxy tunneling CONNECT requests, counting them
+func connectProxy(t *testing.T) (string, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	connects := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				connects.Add(1)
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return "http://" + ln.Addr().String(), connects
+}
+
+func TestRotateProxyAfterRequests(t *testing.T) {
+	var cookies []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Path: "/"})
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	first, firstConnects := connectProxy(t)
+	second, secondConnects := connectProxy(t)
+
+	defer sessions.terminate("rotating")
+	headers := map[string]string{
+		"x-tls-url":            upstream.URL,
+		"x-tls-session-id":     "rotating",
+		"x-tls-proxy":          first + "," + second,
+		"x-tls-proxy-rotation": "requests=2",
+	}
+	for range 3 {
+		w := proxyRequest(t, headers)
+		assert.Equal(t, "ok", w.body.String())
+	}
+
+	// the third request went through the next proxy, with the cookies of the session
+	assert.Equal(t, int32(2), firstConnects.Load())
+	assert.Equal(t, int32(1), secondConnects.Load())
+	assert.Equal(t, []string{"", "sid=1", "sid=1"}, cookies)
+}
+
+func TestRotateProxyOnBan(t *testing.T) {
+	banned := true
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if banned {
+			banned = false
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	first, firstConnects := connectProxy(t)
+	second, secondConnects := connectProxy(t)
+
+	defer sessions.terminate("banned")
+	headers := map[string]string{
+		"x-tls-url":            upstream.URL,
+		"x-tls-session-id":     "banned",
+		"x-tls-proxy":          first + "," + second,
+		"x-tls-proxy-rotation": "bans=1",
+	}
+	assert.Equal(t, http.StatusForbidden, proxyRequest(t, headers).statusCode)
+	assert.Equal(t, "ok", proxyRequest(t, headers).body.String())
+
+	assert.Equal(t, int32(1), firstConnects.Load())
+	assert.Equal(t, int32(1), secondConnects.Load())
+}
+
+func TestParseProxyRotation(t *testing.T) {
+	rotation, err := parseProxyRotation("requests=50; bans=1", "http://a:8080, http://b:8080")
+	assert.NoError(t, err)
+	assert.Equal(t, &proxyRotation{Proxies: []string{"http://a:8080", "http://b:8080"}, Requests: 50, Bans: 1}, rotation)
+
+	_, err = parseProxyRotation("requests=50", "http://a:8080")
+	assert.Error(t, err)
+	_, err = parseProxyRotation("after=50", "http://a:8080,http://b:8080")
+	assert.Error(t, err)
+	_, err = parseProxyRotation("requests=-1", "http://a:8080,http://b:8080")
+	assert.Error(t, err)
+}
+
+func TestRotateToResidential(t *testing.T) {
+	defer ipDatabases.Store(nil)
+	ipDatabases.Store(testIPDatabase(t))
+
+	rotation, err := parseProxyRotation(
+		"requests=10;residential=1", "http://198.51.100.1:8080, http://203.0.113.1:8080, http://198.51.100.2:8080",
+	)
+	assert.NoError(t, err)
+	assert.True(t, rotation.Residential)
+
+	// Datacenter exits are skipped, as long as there is a residential one
+	assert.Equal(t, "http://198.51.100.2:8080", rotation.next("http://198.51.100.1:8080"))
+	assert.Equal(t, "http://198.51.100.1:8080", rotation.next("http://198.51.100.2:8080"))
+	assert.Equal(t, "http://198.51.100.2:8080", rotation.next("http://203.0.113.1:8080"))
+
+	rotation.Residential = false
+	assert.Equal(t, "http://203.0.113.1:8080", rotation.next("http://198.51.100.1:8080"))
+
+	ipDatabases.Store(nil)
+	rotation.Residential = true
+	assert.Equal(t, "http://203.0.113.1:8080", rotation.next("http://198.51.100.1:8080"))
+}
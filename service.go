@@ -0,0 +1,16 @@
+package main
+
+// serviceName is the name the proxy is installed as a Windows service under
+const serviceName = "tls-impersonator"
+
+// serviceCommand splits the subcommand managing the Windows service, if any,
+// off the arguments
+func serviceCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "install", "uninstall", "start", "stop":
+			return args[0], args[1:]
+		}
+	}
+	return "", args
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// controlService manages the Windows service, which only exists on Windows
+func controlService(command string, _ []string) error {
+	return fmt.Errorf("%s: running as a service is only supported on Windows", command)
+}
+
+// runService runs the server in the foreground
+func runService(run func() error) error {
+	return run()
+}
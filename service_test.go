@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceCommand(t *testing.T) {
+	command, args := serviceCommand([]string{"install", "--config", `C:\tls-impersonator\config.yaml`})
+	assert.Equal(t, "install", command)
+	assert.Equal(t, []string{"--config", `C:\tls-impersonator\config.yaml`}, args)
+
+	command, args = serviceCommand([]string{"--config", "install"})
+	assert.Empty(t, command)
+	assert.Equal(t, []string{"--config", "install"}, args)
+
+	command, args = serviceCommand(nil)
+	assert.Empty(t, command)
+	assert.Empty(t, args)
+}
@@ -0,0 +1,152 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func init() {
+	// Services have no console, their log goes to the event log
+	if isService, _ := svc.IsWindowsService(); isService {
+		if elog, err := eventlog.Open(serviceName); err == nil {
+			log.SetOutput(eventLogWriter{elog})
+			logOutput = eventLogWriter{elog}
+		}
+	}
+}
+
+// eventLogWriter writes log lines to the event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	return len(p), w.elog.Info(1, string(p))
+}
+
+// controlService installs, uninstalls, starts or stops the service. Installed,
+// it starts with the machine and runs with the arguments given to install.
+func controlService(command string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if command == "install" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "TLS impersonator",
+			Description: "Proxies requests with the TLS and HTTP/2 fingerprints of browsers",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return fmt.Errorf("installing the service: %w", err)
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("registering the event log source: %w", err)
+		}
+		slog.Info("Installed the service", "service", serviceName)
+		return nil
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("opening the %s service: %w", serviceName, err)
+	}
+	defer s.Close()
+	switch command {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("uninstalling the service: %w", err)
+		}
+		eventlog.Remove(serviceName)
+		slog.Info("Uninstalled the service", "service", serviceName)
+	case "start":
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("starting the service: %w", err)
+		}
+		slog.Info("Started the service", "service", serviceName)
+	case "stop":
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return fmt.Errorf("stopping the service: %w", err)
+		}
+		// It drains the requests in flight before it stops
+		deadline := time.Now().Add(drainTimeout + 10*time.Second)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return errors.New("the service did not stop in time")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return fmt.Errorf("querying the service: %w", err)
+			}
+		}
+		slog.Info("Stopped the service", "service", serviceName)
+	}
+	return nil
+}
+
+// runService runs the server as the service when the service manager started
+// the process, in the foreground otherwise
+func runService(run func() error) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return run()
+	}
+	service := &windowsService{run: run}
+	if err := svc.Run(serviceName, service); err != nil {
+		return err
+	}
+	return service.err
+}
+
+// windowsService runs the server until the service manager stops it, draining
+// the requests in flight the way SIGTERM does
+type windowsService struct {
+	run func() error
+	err error
+}
+
+func (s *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() { done <- s.run() }()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case s.err = <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			if s.err != nil {
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((drainTimeout + 5*time.Second).Milliseconds())}
+				stopSignals <- syscall.SIGTERM
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var sessionStatsHeaderName = getEnv("TLS_SESSION_STATS", "x-tls-session-stats")
+
+// sessionStats counts what went through a session. It is safe for concurrent use.
+type sessionStats struct {
+	Requests atomic.Int64
+	Bytes    atomic.Int64
+	Errors   atomic.Int64
+	Bans     atomic.Int64
+}
+
+// isBan reports whether the upstream status code suggests the session got blocked
+func isBan(statusCode int) bool {
+	return statusCode == fhttp.StatusForbidden || statusCode == fhttp.StatusTooManyRequests
+}
+
+// recordResponse accounts for a request that got a response from the upstream
+func (s *sessionStats) recordResponse(statusCode int) {
+	s.Requests.Add(1)
+	if isBan(statusCode) {
+		s.Bans.Add(1)
+	}
+}
+
+// recordError accounts for a request that failed before getting a response
+func (s *sessionStats) recordError() {
+	s.Requests.Add(1)
+	s.Errors.Add(1)
+}
+
+// String formats the counters for the session stats response header. As it is
+// sent ahead of the body, bytes only cover the previous responses.
+func (s *sessionStats) String() string {
+	return fmt.Sprintf(
+		"requests=%d;bytes=%d;errors=%d;bans=%d",
+		s.Requests.Load(), s.Bytes.Load(), s.Errors.Load(), s.Bans.Load(),
+	)
+}
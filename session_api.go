@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+)
+
+// exportedSession is a pinned session as served by the session API
+type exportedSession struct {
+	ID string `json:"id"`
+	savedSession
+	// ProfileDefinition is the browser profile of the session, registered on
+	// import by instances that do not have one by its name
+	ProfileDefinition *browser.Profile `json:"profile_definition,omitempty"`
+}
+
+// sessionHeaders are the default headers of a pinned session, in order
+type sessionHeaders struct {
+	Headers azuretls.OrderedHeaders `json:"headers"`
+}
+
+// warmRequest asks for sessions to open their connection to url ahead of the
+// requests. The fingerprint and proxy are given like for an import.
+type warmRequest struct {
+	URL string `json:"url"`
+	// ID warms the session pinned under it, Sessions warms that many pooled ones
+	ID       string `json:"id,omitempty"`
+	Sessions int    `json:"sessions,omitempty"`
+	savedSession
+}
+
+// warmResult reports how many sessions got connected and how long it took
+type warmResult struct {
+	Warmed       int   `json:"warmed"`
+	Milliseconds int64 `json:"milliseconds"`
+}
+
+// sessionInfo describes a pinned session for operators
+type sessionInfo struct {
+	ID         string   `json:"id"`
+	Profile    string   `json:"profile"`
+	Hosts      []string `json:"hosts"`
+	Proxy      string   `json:"proxy,omitempty"`
+	AgeSeconds int64    `json:"age_seconds"`
+	Requests   int64    `json:"requests"`
+	Errors     int64    `json:"errors"`
+	Bans       int64    `json:"bans"`
+}
+
+// HandleSessions serves the pinned session API. Listing, terminating,
+// exporting and importing sessions, which go over the sessions of every caller
+// and hand out their cookies, are left to operators on the admin address.
+func HandleSessions(w fhttp.ResponseWriter, r *fhttp.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+
+	switch {
+	case path == "":
+		if !adminOnly(w, r) {
+			return
+		}
+		if r.Method != fhttp.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		listSessions(w)
+	case path == "import":
+		if !adminOnly(w, r) {
+			return
+		}
+		if r.Method != fhttp.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		importSession(w, r)
+	case path == "warm":
+		if r.Method != fhttp.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		warmSessions(w, r)
+	case strings.HasSuffix(path, "/export"):
+		if !adminOnly(w, r) {
+			return
+		}
+		if r.Method != fhttp.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		exportSession(w, strings.TrimSuffix(path, "/export"), isTrue(r.URL.Query().Get("secrets")))
+	case strings.HasSuffix(path, "/headers"):
+		id := strings.TrimSuffix(path, "/headers")
+		switch r.Method {
+		case fhttp.MethodGet:
+			getSessionHeaders(w, id)
+		case fhttp.MethodPut:
+			setSessionHeaders(w, r, id)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	case !strings.Contains(path, "/"):
+		if !adminOnly(w, r) {
+			return
+		}
+		if r.Method != fhttp.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			writeError(w, fhttp.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		terminateSession(w, path)
+	default:
+		writeError(w, fhttp.StatusNotFound, fmt.Errorf("unknown session API path '%s'", r.URL.Path))
+	}
+}
+
+// listSessions returns the pinned sessions, oldest first
+func listSessions(w fhttp.ResponseWriter) {
+	now := time.Now()
+	pinned := sessions.pinnedSessions()
+	slices.SortFunc(pinned, func(a, b *pooledSession) int {
+		return a.created.Compare(b.created)
+	})
+
+	infos := make([]sessionInfo, 0, len(pinned))
+	for _, s := range pinned {
+		info := sessionInfo{
+			ID:         s.id,
+			Profile:    s.key.profile.Name,
+			Hosts:      s.visited(),
+			AgeSeconds: int64(now.Sub(s.created).Seconds()),
+			Requests:   s.stats.Requests.Load(),
+			Errors:     s.stats.Errors.Load(),
+			Bans:       s.stats.Bans.Load(),
+		}
+		// Do not hand out proxy credentials
+		info.Proxy = redactProxy(s.proxy())
+		infos = append(infos, info)
+	}
+
+	writeJSON(w, fhttp.StatusOK, infos)
+}
+
+// terminateSession force-closes a pinned session, aborting its request in
+// flight, and forgets its cookies
+func terminateSession(w fhttp.ResponseWriter, id string) {
+	if !sessions.terminate(id) {
+		writeError(w, fhttp.StatusNotFound, fmt.Errorf("unknown session '%s'", id))
+		return
+	}
+
+	slog.Info("Terminated session", "session", id)
+	w.WriteHeader(fhttp.StatusNoContent)
+}
+
+// exportSession returns the pinned session with its cookies and the definition
+// of its profile, so it can be imported on another instance. The proxy
+// credentials are left out unless secrets are asked for.
+func exportSession(w fhttp.ResponseWriter, id string, secrets bool) {
+	export := func(saved *savedSession) {
+		if !secrets {
+			saved = saved.redacted()
+		}
+		exported := exportedSession{ID: id, savedSession: *saved}
+		exported.ProfileDefinition, _ = browser.Get(saved.Profile)
+		writeJSON(w, fhttp.StatusOK, exported)
+	}
+
+	if s := sessions.lockPinned(id); s != nil {
+		saved := s.save()
+		s.inUse.Unlock()
+		export(saved)
+		return
+	}
+
+	if savedSessions != nil {
+		saved, err := savedSessions.load(id)
+		if err != nil {
+			writeError(w, fhttp.StatusBadGateway, fmt.Errorf("loading session '%s': %w", id, err))
+			return
+		}
+		if saved != nil {
+			export(saved)
+			return
+		}
+	}
+
+	writeError(w, fhttp.StatusNotFound, fmt.Errorf("unknown session '%s'", id))
+}
+
+// getSessionHeaders returns the default headers of a pinned session
+func getSessionHeaders(w fhttp.ResponseWriter, id string) {
+	if s := sessions.lockPinned(id); s != nil {
+		headers := s.headers.Clone()
+		s.inUse.Unlock()
+		writeJSON(w, fhttp.StatusOK, sessionHeaders{Headers: headers})
+		return
+	}
+
+	if savedSessions != nil {
+		saved, err := savedSessions.load(id)
+		if err != nil {
+			writeError(w, fhttp.StatusBadGateway, fmt.Errorf("loading session '%s': %w", id, err))
+			return
+		}
+		if saved != nil {
+			writeJSON(w, fhttp.StatusOK, sessionHeaders{Headers: saved.Headers})
+			return
+		}
+	}
+
+	writeError(w, fhttp.StatusNotFound, fmt.Errorf("unknown session '%s'", id))
+}
+
+// setSessionHeaders replaces the default headers of a pinned session, which
+// every following request of the session is sent with
+func setSessionHeaders(w fhttp.ResponseWriter, r *fhttp.Request, id string) {
+	var req sessionHeaders
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fhttp.StatusBadRequest, fmt.Errorf("invalid headers: %w", err))
+		return
+	}
+	if err := checkHeaders(req.Headers); err != nil {
+		writeError(w, fhttp.StatusBadRequest, err)
+		return
+	}
+
+	found, err := sessions.setHeaders(id, req.Headers)
+	if err != nil {
+		writeError(w, fhttp.StatusBadGateway, fmt.Errorf("saving session '%s': %w", id, err))
+		return
+	}
+	if !found {
+		writeError(w, fhttp.StatusNotFound, fmt.Errorf("unknown session '%s'", id))
+		return
+	}
+
+	writeJSON(w, fhttp.StatusOK, req)
+}
+
+// importSession pins a session from an export, or from cookies and headers of a
+// login done elsewhere. Requests can use it right away via the session ID header.
+func importSession(w fhttp.ResponseWriter, r *fhttp.Request) {
+	var imported exportedSession
+	if err := json.NewDecoder(r.Body).Decode(&imported); err != nil {
+		writeError(w, fhttp.StatusBadRequest, fmt.Errorf("invalid session: %w", err))
+		return
+	}
+	if imported.ID == "" {
+		writeError(w, fhttp.StatusBadRequest, errors.New("session has no id"))
+		return
+	}
+	if imported.hasRedactedProxy() {
+		writeError(w, fhttp.StatusBadRequest, errors.New("the proxy credentials of the session are redacted, export it with ?secrets=1"))
+		return
+	}
+
+	if err := importProfile(&imported); err != nil {
+		writeError(w, fhttp.StatusBadRequest, err)
+		return
+	}
+
+	saved, err := sessions.importPinned(imported.ID, &imported.savedSession)
+	if err != nil {
+		writeError(w, fhttp.StatusBadRequest, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Imported session", "session", imported.ID)
+	writeJSON(w, fhttp.StatusCreated, exportedSession{ID: imported.ID, savedSession: *saved})
+}
+
+// importProfile registers the profile definition of an export when there is no
+// profile by its name yet, so sessions of profiles registered at runtime can be
+// moved between instances. Profiles already there are kept as they are.
+func importProfile(imported *exportedSession) error {
+	def := imported.ProfileDefinition
+	if def == nil || imported.Profile == "" {
+		return nil
+	}
+	if _, ok := browser.Get(imported.Profile); ok {
+		return nil
+	}
+	if !strings.EqualFold(def.Name, imported.Profile) {
+		return fmt.Errorf("profile_definition is of '%s', not of the profile '%s'", def.Name, imported.Profile)
+	}
+
+	// Aliases would take names over from the profiles of this instance
+	p := *def
+	p.Aliases = nil
+	if err := browser.Register(&p); err != nil {
+		return err
+	}
+	slog.Info("Registered browser profile", "profile", p.Name, "session", imported.ID)
+	return nil
+}
+
+// warmSessions opens the TCP and TLS connections of sessions to the target, so
+// the first real requests do not pay for the handshakes
+func warmSessions(w fhttp.ResponseWriter, r *fhttp.Request) {
+	var req warmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fhttp.StatusBadRequest, fmt.Errorf("invalid warm request: %w", err))
+		return
+	}
+
+	key, err := req.key()
+	if err != nil {
+		writeError(w, fhttp.StatusBadRequest, err)
+		return
+	}
+	if key.host, err = targetHost(req.URL); err != nil {
+		writeError(w, fhttp.StatusBadRequest, err)
+		return
+	}
+	if req.Sessions <= 0 || req.ID != "" {
+		req.Sessions = 1
+	}
+	req.Sessions = min(req.Sessions, maxIdleSessionsPerKey)
+
+	start := time.Now()
+	errs := make([]error, req.Sessions)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = warmSession(req.ID, key, req.ProxyRotation, req.URL)
+		}()
+	}
+	wg.Wait()
+
+	if err = errors.Join(errs...); err != nil {
+		writeError(w, fhttp.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, fhttp.StatusOK, warmResult{Warmed: req.Sessions, Milliseconds: time.Since(start).Milliseconds()})
+}
+
+// warmSession connects a session for the key, or the one pinned under id, to
+// the target and hands it back to the pool
+func warmSession(id string, key sessionKey, rotation *proxyRotation, target string) error {
+	var s *pooledSession
+	var err error
+	if id != "" {
+		s, err = sessions.acquirePinned(id, key, rotation)
+	} else {
+		s, err = sessions.acquire(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.SetTimeout(30 * time.Second)
+	err = s.Connect(target)
+	sessions.release(s, err == nil)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", key.host, err)
+	}
+	return nil
+}
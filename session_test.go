@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStatsHeader(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 403 Forbidden\r\nContent-Length: 7\r\n\r\nblocked")
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-session-stats": "1"})
+
+	assert.Equal(t, http.StatusForbidden, w.statusCode)
+	assert.Equal(t, "requests=1;bytes=0;errors=0;bans=1", w.headers.Get("x-tls-session-stats"))
+	assert.Equal(t, "blocked", w.body.String())
+}
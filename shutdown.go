@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// inFlight counts the requests being served, h2c ones included, which the
+// server stops tracking once their connection is taken over for HTTP/2
+var inFlight atomic.Int64
+
+// countInFlight counts the requests of the handler in inFlight
+func countInFlight(h fhttp.Handler) fhttp.Handler {
+	return fhttp.HandlerFunc(func(w fhttp.ResponseWriter, r *fhttp.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drainTimeout is how long requests in flight get to finish once the server is
+// told to stop, before their connections are closed
+var drainTimeout = getEnvSeconds("TLS_DRAIN_TIMEOUT", 30)
+
+// stopSignals stops the server the way SIGINT and SIGTERM do, for the Windows
+// service manager
+var stopSignals = make(chan os.Signal, 1)
+
+// runServer serves with serve until the process gets SIGINT or SIGTERM, then
+// drains the server and closes the sessions
+func runServer(server *fhttp.Server, serve func() error) error {
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stopSignals)
+
+	served := make(chan error, 1)
+	go func() { served <- serve() }()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stopSignals:
+		slog.Info("Draining requests", "signal", sig.String(), "timeout", drainTimeout.String())
+	}
+	drain(server, drainTimeout)
+	if err := <-served; !errors.Is(err, fhttp.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// drain stops the server from taking new requests and waits up to timeout for
+// the ones in flight, streamed bodies included. Connections still busy after
+// it are closed. The sessions are closed last, aborting whatever still runs
+// on them.
+func drain(server *fhttp.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = waitInFlight(ctx)
+	}
+	if err != nil {
+		slog.Warn("Requests still running, closing their connections", "timeout", timeout.String())
+		server.Close()
+	}
+	slog.Info("Closed the sessions", "sessions", sessions.closeAll())
+}
+
+// waitInFlight waits until no request is in flight anymore, or ctx is done
+func waitInFlight(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// drainedServer serves handler until it is drained, and returns its URL
+func drainedServer(t *testing.T, handler http.HandlerFunc) (*http.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return server, "http://" + l.Addr().String()
+}
+
+func TestDrain(t *testing.T) {
+	started := make(chan struct{})
+	server, url := drainedServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	// The request in flight finishes, new ones are refused
+	drain(server, 5*time.Second)
+	assert.Equal(t, "finished", <-body)
+	_, err := http.Get(url)
+	assert.Error(t, err)
+}
+
+func TestDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	server, url := drainedServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get(url)
+		failed <- err
+	}()
+	<-started
+
+	start := time.Now()
+	drain(server, 50*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Error(t, <-failed)
+}
+
+func TestRunServerStop(t *testing.T) {
+	server := &http.Server{Handler: http.HandlerFunc(HandleIsAlive)}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Windows service manager stops the server the way SIGTERM does
+	stopped := make(chan error, 1)
+	go func() { stopped <- runServer(server, func() error { return server.Serve(l) }) }()
+	stopSignals <- syscall.SIGTERM
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not stop")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/stanislav-milchev/tls-impersonator/browser"
+)
+
+// savedSession is what is kept of a pinned session outside the process: its
+// fingerprint and proxy, and the cookies of its jar
+type savedSession struct {
+	Profile     string        `json:"profile"`
+	Host        string        `json:"host"`
+	Proxy       string        `json:"proxy,omitempty"`
+	LocalAddr   string        `json:"local_addr,omitempty"`
+	IPFamily    string        `json:"ip_family,omitempty"`
+	Resolve     string        `json:"resolve,omitempty"`
+	PostQuantum *bool         `json:"post_quantum,omitempty"`
+	GreaseECH   *bool         `json:"grease_ech,omitempty"`
+	MinVersion  uint16        `json:"min_version,omitempty"`
+	MaxVersion  uint16        `json:"max_version,omitempty"`
+	ALPN        string        `json:"alpn,omitempty"`
+	Cookies     []savedCookie `json:"cookies"`
+	// Headers are the default headers of the session, set over the profile ones
+	Headers       azuretls.OrderedHeaders `json:"headers,omitempty"`
+	ProxyRotation *proxyRotation          `json:"proxy_rotation,omitempty"`
+	// Revision changes with every save, so instances sharing the store can tell
+	// when their copy of the session fell behind
+	Revision string `json:"revision,omitempty"`
+}
+
+// redacted returns the saved session without the credentials of its proxies
+func (saved *savedSession) redacted() *savedSession {
+	redacted := *saved
+	redacted.Proxy = redactProxy(saved.Proxy)
+	if saved.ProxyRotation != nil {
+		rotation := *saved.ProxyRotation
+		rotation.Proxies = make([]string, len(saved.ProxyRotation.Proxies))
+		for i, proxy := range saved.ProxyRotation.Proxies {
+			rotation.Proxies[i] = redactProxy(proxy)
+		}
+		redacted.ProxyRotation = &rotation
+	}
+	return &redacted
+}
+
+// hasRedactedProxy reports whether a proxy of the saved session has its
+// password redacted, as exports leave it without secrets
+func (saved *savedSession) hasRedactedProxy() bool {
+	proxies := []string{saved.Proxy}
+	if saved.ProxyRotation != nil {
+		proxies = append(proxies, saved.ProxyRotation.Proxies...)
+	}
+	for _, proxy := range proxies {
+		if u, err := url.Parse(proxy); err == nil && u.User != nil {
+			if password, _ := u.User.Password(); password == "xxxxx" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sessionStore keeps pinned sessions across restarts, and across instances when
+// it is shared
+type sessionStore interface {
+	// load returns the session saved under id, or nil if there is none
+	load(id string) (*savedSession, error)
+	save(id string, s *savedSession) error
+	remove(id string) error
+}
+
+// savedSessions persists pinned sessions, it is nil when persistence is disabled
+var savedSessions sessionStore
+
+// sharedStore reports whether other instances save to the session store too,
+// so pinned sessions are checked against it before every request
+func sharedStore() bool {
+	_, ok := savedSessions.(*redisStore)
+	return ok
+}
+
+// persist saves the pinned session under a new revision
+func (s *pooledSession) persist() error {
+	saved := s.save()
+	saved.Revision = randomID()
+	if err := savedSessions.save(s.id, saved); err != nil {
+		return err
+	}
+	s.revision = saved.Revision
+	return nil
+}
+
+func toggleBool(t toggle) *bool {
+	if t == toggleUnset {
+		return nil
+	}
+	enabled := t == toggleOn
+	return &enabled
+}
+
+func boolToggle(b *bool) toggle {
+	switch {
+	case b == nil:
+		return toggleUnset
+	case *b:
+		return toggleOn
+	default:
+		return toggleOff
+	}
+}
+
+// save returns what is kept of the pinned session
+func (s *pooledSession) save() *savedSession {
+	return &savedSession{
+		Profile:       s.key.profile.Name,
+		Host:          s.key.host,
+		Proxy:         s.key.proxy,
+		LocalAddr:     s.key.localAddr,
+		IPFamily:      string(s.key.ipFamily),
+		Resolve:       s.key.resolve,
+		PostQuantum:   toggleBool(s.key.postQuantum),
+		GreaseECH:     toggleBool(s.key.greaseECH),
+		MinVersion:    s.key.minVersion,
+		MaxVersion:    s.key.maxVersion,
+		ALPN:          s.key.alpn,
+		Cookies:       s.cookies,
+		Headers:       s.headers,
+		ProxyRotation: s.rotation,
+		Revision:      s.revision,
+	}
+}
+
+// key returns the key to open the saved session with again
+func (saved *savedSession) key() (sessionKey, error) {
+	name := saved.Profile
+	if name == "" {
+		name = defaultBrowser.get()
+	}
+	profile, ok := browser.Get(name)
+	if !ok {
+		return sessionKey{}, fmt.Errorf("unknown browser profile '%s'", name)
+	}
+
+	if saved.ALPN != "" {
+		if _, err := browser.ParseALPN(saved.ALPN); err != nil {
+			return sessionKey{}, err
+		}
+	}
+	if saved.MinVersion != 0 && saved.MaxVersion != 0 && saved.MinVersion > saved.MaxVersion {
+		return sessionKey{}, errors.New("min_version is above max_version")
+	}
+	if saved.LocalAddr != "" && net.ParseIP(saved.LocalAddr) == nil {
+		return sessionKey{}, fmt.Errorf("invalid local_addr '%s'", saved.LocalAddr)
+	}
+	family, err := parseIPFamily(saved.IPFamily)
+	if err != nil {
+		return sessionKey{}, err
+	}
+	resolve, err := parseResolve(saved.Resolve)
+	if err != nil {
+		return sessionKey{}, err
+	}
+	if err := checkHeaders(saved.Headers); err != nil {
+		return sessionKey{}, err
+	}
+	if saved.ProxyRotation != nil {
+		if err := saved.ProxyRotation.check(); err != nil {
+			return sessionKey{}, err
+		}
+	}
+
+	proxy := saved.Proxy
+	if proxy == "" && saved.ProxyRotation != nil {
+		proxy = saved.ProxyRotation.Proxies[0]
+	}
+
+	return sessionKey{
+		host:        saved.Host,
+		proxy:       proxy,
+		localAddr:   saved.LocalAddr,
+		ipFamily:    family,
+		resolve:     resolve,
+		profile:     profile,
+		postQuantum: boolToggle(saved.PostQuantum),
+		greaseECH:   boolToggle(saved.GreaseECH),
+		minVersion:  saved.MinVersion,
+		maxVersion:  saved.MaxVersion,
+		alpn:        saved.ALPN,
+	}, nil
+}
+
+// checkHeaders makes sure every default header has a name and a value
+func checkHeaders(headers azuretls.OrderedHeaders) error {
+	for _, h := range headers {
+		if len(h) < 2 || h[0] == "" {
+			return fmt.Errorf("header %q has no value", h)
+		}
+	}
+	return nil
+}
+
+// restore sets the saved cookies on the jar of the session, skipping the ones
+// that expired since, its default headers and proxy rotation
+func (s *pooledSession) restore(saved *savedSession) {
+	s.headers = saved.Headers.Clone()
+	s.rotation = saved.ProxyRotation
+	s.revision = saved.Revision
+	for _, c := range saved.Cookies {
+		if c.expired(s.lastUsed) {
+			continue
+		}
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			continue
+		}
+		s.CookieJar.SetCookies(u, []*fhttp.Cookie{c.cookie()})
+		s.cookies = append(s.cookies, c)
+	}
+}
+
+// fileStore saves every pinned session to a JSON file in dir
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// path returns the file the session id is saved to
+func (f *fileStore) path(id string) string {
+	return filepath.Join(f.dir, url.PathEscape(id)+".json")
+}
+
+func (f *fileStore) load(id string) (*savedSession, error) {
+	data, err := os.ReadFile(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved savedSession
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+func (f *fileStore) save(id string, s *savedSession) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write next to the file and rename it over, so a crash never leaves a truncated session
+	path := f.path(id)
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *fileStore) remove(id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
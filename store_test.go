@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// restartPinned drops the pinned session id from the pool, as a restart would
+func restartPinned(id string) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	s := sessions.pinned[id]
+	s.inUse.Lock()
+	sessions.discardPinned(s)
+}
+
+func TestSavedSessionSurvivesRestart(t *testing.T) {
+	var cookies, agents []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		agents = append(agents, r.UserAgent())
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "login", Value: "token", Path: "/", MaxAge: 3600})
+			http.SetCookie(w, &http.Cookie{Name: "gone", Value: "1", Path: "/", MaxAge: -1})
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	store := &fileStore{dir: t.TempDir()}
+	defaultStore := savedSessions
+	savedSessions = store
+	defer func() { savedSessions = defaultStore }()
+
+	defer sessions.terminate("persisted")
+	headers := map[string]string{
+		"x-tls-url": upstream.URL + "/login", "x-tls-session-id": "persisted", "x-tls-browser": "chrome120",
+	}
+	proxyRequest(t, headers)
+	_, err := os.Stat(store.path("persisted"))
+	assert.NoError(t, err)
+
+	restartPinned("persisted")
+
+	// the restored session keeps its cookies and the profile it was opened with
+	headers["x-tls-url"] = upstream.URL + "/account"
+	delete(headers, "x-tls-browser")
+	proxyRequest(t, headers)
+
+	assert.Equal(t, []string{"", "login=token"}, cookies)
+	assert.Equal(t, agents[0], agents[1])
+	assert.Contains(t, agents[1], "Chrome/120")
+}
+
+// slowStore holds loads until they are let through
+type slowStore struct {
+	loading, release chan struct{}
+}
+
+func (s *slowStore) load(string) (*savedSession, error) {
+	s.loading <- struct{}{}
+	<-s.release
+	return nil, nil
+}
+
+func (s *slowStore) save(string, *savedSession) error { return nil }
+
+func (s *slowStore) remove(string) error { return nil }
+
+func TestLoadSavedSessionUnlocked(t *testing.T) {
+	store := &slowStore{loading: make(chan struct{}), release: make(chan struct{})}
+	defaultStore := savedSessions
+	savedSessions = store
+	defer func() { savedSessions = defaultStore }()
+
+	pool := &sessionPool{idle: map[sessionKey][]*pooledSession{}, pinned: map[string]*pooledSession{}}
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	key, err := parseSessionKey(r, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *pooledSession)
+	for range 2 {
+		go func() {
+			s, _ := pool.acquirePinned("slow", key, nil)
+			acquired <- s
+		}()
+		<-store.loading
+	}
+
+	// the pool is not held up while the store is
+	assert.True(t, pool.mu.TryLock())
+	pool.mu.Unlock()
+
+	// both requests get the session opened by the one loaded first
+	store.release <- struct{}{}
+	first := <-acquired
+	pool.release(first, true)
+	store.release <- struct{}{}
+	second := <-acquired
+	assert.Same(t, first, second)
+	assert.Equal(t, 1, pool.open)
+	pool.release(second, true)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// proxyStrategy picks which of the proxies of the pool that are up a request
+// goes through
+type proxyStrategy string
+
+const (
+	strategyRoundRobin  proxyStrategy = "round-robin"
+	strategyRandom      proxyStrategy = "random"
+	strategyLeastErrors proxyStrategy = "least-errors"
+	strategyWeighted    proxyStrategy = "weighted"
+)
+
+func parseProxyStrategy(value string) (proxyStrategy, error) {
+	switch strategy := proxyStrategy(strings.ToLower(strings.TrimSpace(value))); strategy {
+	case "", "round_robin", "roundrobin":
+		return strategyRoundRobin, nil
+	case strategyRoundRobin, strategyRandom, strategyLeastErrors, strategyWeighted:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown proxy strategy '%s', expected round-robin, random, least-errors or weighted", value)
+}
+
+// pick returns one of the up proxy indexes, start is the round robin counter
+func (s proxyStrategy) pick(p *proxyPool, up []int, start uint64) int {
+	switch s {
+	case strategyRandom:
+		return up[rand.IntN(len(up))]
+
+	case strategyLeastErrors:
+		// Ties go round robin, so proxies without errors share the load
+		best := -1
+		for i := range up {
+			n := up[(start+uint64(i))%uint64(len(up))]
+			if best < 0 || p.stats[n].Errors.Load() < p.stats[best].Errors.Load() {
+				best = n
+			}
+		}
+		return best
+
+	case strategyWeighted:
+		total := 0
+		for _, n := range up {
+			total += p.weights[n]
+		}
+		r := rand.IntN(total)
+		for _, n := range up {
+			if r -= p.weights[n]; r < 0 {
+				return n
+			}
+		}
+	}
+	return up[start%uint64(len(up))]
+}
+
+// parseWeightedProxy splits a 'proxy weight=N' pool entry, the weight defaults
+// to 1
+func parseWeightedProxy(entry string) (string, int, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return "", 1, nil
+	}
+	if len(fields) == 1 {
+		return fields[0], 1, nil
+	}
+
+	value, ok := strings.CutPrefix(fields[1], "weight=")
+	weight, err := strconv.Atoi(value)
+	if len(fields) > 2 || !ok || err != nil || weight < 1 {
+		return fields[0], 0, fmt.Errorf("invalid weight '%s', expected weight=N with N above 0", strings.Join(fields[1:], " "))
+	}
+	return fields[0], weight, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyStrategies(t *testing.T) {
+	pool := newProxyPool([]string{"http://a:8080 weight=3", "http://b:8080", "http://c:8080 weight=0", "http://d:8080"})
+	assert.Equal(t, []string{"http://a:8080", "http://b:8080", "http://d:8080"}, pool.proxies)
+	assert.Equal(t, []int{3, 1, 1}, pool.weights)
+
+	picks := func(strategy proxyStrategy) map[string]int {
+		pool.strategy = strategy
+		counts := map[string]int{}
+		for range 1000 {
+			counts[pool.pick(false)]++
+		}
+		return counts
+	}
+
+	pool.markDown("http://d:8080")
+	assert.Equal(t, map[string]int{"http://a:8080": 500, "http://b:8080": 500}, picks(strategyRoundRobin))
+
+	random := picks(strategyRandom)
+	assert.Len(t, random, 2)
+	assert.Greater(t, random["http://b:8080"], 300)
+
+	weighted := picks(strategyWeighted)
+	assert.Greater(t, weighted["http://a:8080"], 2*weighted["http://b:8080"])
+
+	// proxies with fewer errors are picked first, ties share the load
+	pool.record("http://a:8080", 0)
+	pool.record("http://b:8080", http.StatusOK)
+	assert.Equal(t, map[string]int{"http://b:8080": 1000}, picks(strategyLeastErrors))
+	pool.record("http://b:8080", 0)
+	assert.Len(t, picks(strategyLeastErrors), 2)
+
+	_, err := parseProxyStrategy("fastest")
+	assert.Error(t, err)
+}
+
+func TestProxyAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+
+	proxy, _ := connectProxy(t)
+	defer upstreamProxies.Store(nil)
+	upstreamProxies.Store(newProxyPool([]string{"http://user:pass@" + proxy[len("http://"):] + " weight=2"}))
+
+	proxyRequest(t, map[string]string{"x-tls-url": upstream.URL})
+
+	r, _ := http.NewRequest(http.MethodGet, "/api/proxies", nil)
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProxies(w, r)
+	assert.Equal(t, http.StatusNotFound, w.statusCode)
+	w = NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleProxies(w, asAdmin(r))
+
+	var info proxyPoolInfo
+	assert.NoError(t, json.Unmarshal(w.body.Bytes(), &info))
+	// Proxies given by their IP are taken to leave from it
+	assert.Equal(t, []proxyInfo{{
+		Proxy: "http://user:xxxxx@" + proxy[len("http://"):], Weight: 2, Requests: 1, Bans: 1, ExitIP: "127.0.0.1",
+	}}, info.Proxies)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	errStreamTimeout = errors.New("stream timeout")
+	errBodyTooLarge  = errors.New("response body exceeds the size limit")
+)
+
+var (
+	maxBodyHeaderName       = getEnv("TLS_MAX_BODY", "x-tls-max-body")
+	flushIntervalHeaderName = getEnv("TLS_FLUSH_INTERVAL", "x-tls-flush-interval")
+	chunkSizeHeaderName     = getEnv("TLS_CHUNK_SIZE", "x-tls-chunk-size")
+)
+
+// upstreamMaxBody is the size limit in bytes of the response bodies of requests
+// that do not set one, 0 for no limit
+var upstreamMaxBody = newSetting(int64(getEnvInt("TLS_UPSTREAM_MAX_BODY", 0)))
+
+// upstreamFlushInterval is how long streamed data waits at most before being
+// flushed to the caller, 0 flushes every chunk as it is read
+var upstreamFlushInterval = time.Duration(getEnvInt("TLS_UPSTREAM_FLUSH_INTERVAL", 0)) * time.Millisecond
+
+// upstreamChunkSize is the size of the reads of streamed bodies, capped at
+// maxChunkSize
+var upstreamChunkSize = min(getEnvInt("TLS_UPSTREAM_CHUNK_SIZE", 32*1024), maxChunkSize)
+
+const maxChunkSize = 16 << 20
+
+// parseMaxBody parses a body size limit header value in bytes, "0" disables the
+// limit. Requests without one get the default.
+func parseMaxBody(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return upstreamMaxBody.get(), nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a number of bytes", value)
+	}
+	return n, nil
+}
+
+// limitedBody passes on up to max bytes of the body, and fails with
+// errBodyTooLarge once there would be more
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+// limitBody limits the body to max bytes, 0 leaves it as it is
+func limitBody(body io.ReadCloser, max int64) io.ReadCloser {
+	if max <= 0 {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, left: max}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		// Only fail when the body goes on past the limit
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+// parseStreamTimeout parses a stream timeout header value like parseTimeout.
+// Empty, invalid, "0" and "unlimited" values disable the timeout.
+func parseStreamTimeout(value string) time.Duration {
+	if strings.ToLower(value) == "unlimited" {
+		return 0
+	}
+
+	t, err := parseTimeout(value)
+	if err != nil {
+		return 0
+	}
+
+	return t
+}
+
+// parseFlushInterval parses a flush interval header value in milliseconds, "0"
+// flushes every chunk. Empty and invalid values get the default.
+func parseFlushInterval(value string) time.Duration {
+	t, err := strconv.Atoi(value)
+	if err != nil || t < 0 {
+		return upstreamFlushInterval
+	}
+
+	return time.Duration(t) * time.Millisecond
+}
+
+// parseChunkSize parses a chunk size header value in bytes, capped at
+// maxChunkSize. Empty, invalid and "0" values get the default.
+func parseChunkSize(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return upstreamChunkSize
+	}
+
+	return min(n, maxChunkSize)
+}
+
+// flushWriter flushes what is written to the caller within interval, right away
+// when it is zero, so slow streams do not sit in the buffers of the server.
+// Writers that cannot be flushed are written to as they are.
+type flushWriter struct {
+	w        io.Writer
+	flusher  fhttp.Flusher
+	interval time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newFlushWriter(w fhttp.ResponseWriter, interval time.Duration) *flushWriter {
+	flusher, _ := w.(fhttp.Flusher)
+	return &flushWriter{w: w, flusher: flusher, interval: interval}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.w.Write(p)
+	if err != nil || f.flusher == nil {
+		return n, err
+	}
+	if f.interval <= 0 {
+		f.flusher.Flush()
+	} else if f.timer == nil {
+		f.timer = time.AfterFunc(f.interval, f.flush)
+	}
+	return n, nil
+}
+
+func (f *flushWriter) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.flusher.Flush()
+		f.timer = nil
+	}
+}
+
+// stop flushes what is left and stops flushing, the writer must not be used
+// after the handler returns
+func (f *flushWriter) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+		f.flusher.Flush()
+	}
+}
+
+// copyStream copies the body to w in reads of up to chunk bytes, closing the
+// body once no data has been received for idle, or once the whole stream took
+// longer than total. A zero duration disables the corresponding timeout.
+func copyStream(w io.Writer, body io.ReadCloser, total, idle time.Duration, chunk int) (int64, error) {
+	var timedOut atomic.Bool
+	abort := func() {
+		timedOut.Store(true)
+		body.Close()
+	}
+
+	if total > 0 {
+		totalTimer := time.AfterFunc(total, abort)
+		defer totalTimer.Stop()
+	}
+
+	var idleTimer *time.Timer
+	if idle > 0 {
+		idleTimer = time.AfterFunc(idle, abort)
+		defer idleTimer.Stop()
+	}
+
+	var written int64
+	buf := make([]byte, chunk)
+	for {
+		n, readErr := body.Read(buf)
+		if idleTimer != nil {
+			idleTimer.Reset(idle)
+		}
+
+		if n > 0 {
+			m, writeErr := w.Write(buf[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+		}
+
+		if readErr != nil {
+			if timedOut.Load() {
+				return written, errStreamTimeout
+			}
+			if readErr == io.EOF {
+				return written, nil
+			}
+			return written, readErr
+		}
+	}
+}
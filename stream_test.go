@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyStreamIdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("data: 1\n\n"))
+		time.Sleep(50 * time.Millisecond)
+		pw.Write([]byte("data: 2\n\n"))
+		// stall without closing the stream
+	}()
+
+	var buf bytes.Buffer
+	n, err := copyStream(&buf, pr, 0, 200*time.Millisecond, 32*1024)
+
+	assert.ErrorIs(t, err, errStreamTimeout)
+	assert.Equal(t, int64(18), n)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", buf.String())
+}
+
+func TestCopyStreamTotalTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			if _, err := pw.Write([]byte("tick\n")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	_, err := copyStream(io.Discard, pr, 100*time.Millisecond, time.Second, 32*1024)
+
+	assert.ErrorIs(t, err, errStreamTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestParseStreamTimeout(t *testing.T) {
+	assert.Equal(t, 5*time.Second, parseStreamTimeout("5"))
+	assert.Equal(t, 1500*time.Millisecond, parseStreamTimeout("1500ms"))
+	assert.Equal(t, time.Duration(0), parseStreamTimeout("unlimited"))
+	assert.Equal(t, time.Duration(0), parseStreamTimeout(""))
+	assert.Equal(t, time.Duration(0), parseStreamTimeout("-1"))
+}
+
+func TestMaxBody(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n0123456789")
+
+	for _, buffer := range []string{"1", "0"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": buffer, "x-tls-max-body": "4"})
+		assert.Equal(t, http.StatusOK, w.statusCode)
+		assert.Equal(t, "0123", w.body.String())
+		assert.Equal(t, "ERR_BODY_LIMIT", w.headers.Get("x-tls-error")+w.headers.Get(http.TrailerPrefix+"x-tls-error"))
+		if buffer == "1" {
+			assert.Equal(t, "4", w.headers.Get("Content-Length"))
+		} else {
+			assert.Empty(t, w.headers.Get("Content-Length"))
+		}
+
+		// A body that fits is left alone
+		w = proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": buffer, "x-tls-max-body": "10"})
+		assert.Equal(t, "0123456789", w.body.String())
+		assert.Empty(t, w.headers.Get("x-tls-error"))
+		assert.Empty(t, w.headers.Get(http.TrailerPrefix+"x-tls-error"))
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	body, err := io.ReadAll(limitBody(io.NopCloser(strings.NewReader("0123456789")), 4))
+	assert.ErrorIs(t, err, errBodyTooLarge)
+	assert.Equal(t, "0123", string(body))
+
+	body, err = io.ReadAll(limitBody(io.NopCloser(strings.NewReader("0123")), 4))
+	assert.NoError(t, err)
+	assert.Equal(t, "0123", string(body))
+}
+
+func TestParseMaxBody(t *testing.T) {
+	n, err := parseMaxBody("1048576")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1048576), n)
+
+	n, err = parseMaxBody("")
+	assert.NoError(t, err)
+	assert.Equal(t, upstreamMaxBody.get(), n)
+
+	_, err = parseMaxBody("-1")
+	assert.Error(t, err)
+	_, err = parseMaxBody("1MB")
+	assert.Error(t, err)
+}
+
+func TestStreamFlushing(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(HandleReq))
+	defer proxy.Close()
+	defer close(release)
+
+	for _, interval := range []string{"0", "50"} {
+		r, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		r.Header.Set("x-tls-url", upstream.URL)
+		r.Header.Set("x-tls-flush-interval", interval)
+
+		// The start of the stream arrives while the upstream is still sending it
+		read := make(chan string, 1)
+		go func() {
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				read <- err.Error()
+				return
+			}
+			defer res.Body.Close()
+			buf := make([]byte, 5)
+			io.ReadFull(res.Body, buf)
+			read <- string(buf)
+		}()
+		select {
+		case first := <-read:
+			assert.Equal(t, "first", first)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("interval %s: stream not flushed", interval)
+		}
+	}
+}
+
+// flushRecorder counts the flushes of what was written
+type flushRecorder struct {
+	http.ResponseWriter
+	mu      sync.Mutex
+	flushes int
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushes++
+}
+
+func (r *flushRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flushes
+}
+
+func TestFlushWriter(t *testing.T) {
+	rec := &flushRecorder{ResponseWriter: httptest.NewRecorder()}
+	f := newFlushWriter(rec, 0)
+	f.Write([]byte("a"))
+	f.Write([]byte("b"))
+	assert.Equal(t, 2, rec.count())
+
+	// Writes within the interval are flushed together
+	rec = &flushRecorder{ResponseWriter: httptest.NewRecorder()}
+	f = newFlushWriter(rec, 50*time.Millisecond)
+	f.Write([]byte("a"))
+	f.Write([]byte("b"))
+	assert.Equal(t, 0, rec.count())
+	assert.Eventually(t, func() bool { return rec.count() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Stopping flushes what is left
+	f.Write([]byte("c"))
+	f.stop()
+	assert.Equal(t, 2, rec.count())
+}
+
+func TestParseFlushInterval(t *testing.T) {
+	assert.Equal(t, 100*time.Millisecond, parseFlushInterval("100"))
+	assert.Equal(t, time.Duration(0), parseFlushInterval("0"))
+	assert.Equal(t, upstreamFlushInterval, parseFlushInterval(""))
+	assert.Equal(t, upstreamFlushInterval, parseFlushInterval("-1"))
+}
+
+func TestParseChunkSize(t *testing.T) {
+	assert.Equal(t, 1024, parseChunkSize("1024"))
+	assert.Equal(t, maxChunkSize, parseChunkSize("1000000000"))
+	assert.Equal(t, upstreamChunkSize, parseChunkSize(""))
+	assert.Equal(t, upstreamChunkSize, parseChunkSize("0"))
+}
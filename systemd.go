@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets from
+const listenFDsStart = 3
+
+// systemdListeners returns the listening sockets systemd passed the process
+// on socket activation, nil when it was not started that way. The variables
+// telling about them are cleared so processes started from this one do not
+// take them for theirs.
+func systemdListeners(certificate bool) ([]listenAddress, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	return inheritListeners(fds, names, listenFDsStart, certificate)
+}
+
+// inheritListeners takes over count sockets starting at the file descriptor
+// first. Sockets named "https" or "http" with FileDescriptorName= in the
+// socket unit serve that, the others HTTPS when a certificate is configured,
+// like addresses without a scheme.
+func inheritListeners(count, names string, first int, certificate bool) ([]listenAddress, error) {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS '%s'", count)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	addrs := make([]listenAddress, 0, n)
+	fail := func(err error) ([]listenAddress, error) {
+		for _, addr := range addrs {
+			addr.inherited.Close()
+		}
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(first+i), name)
+		// The listener works on a duplicate of the descriptor
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fail(fmt.Errorf("socket %d from systemd is not a listening one: %w", first+i, err))
+		}
+		addrs = append(addrs, listenAddress{
+			network:   l.Addr().Network(),
+			address:   l.Addr().String(),
+			tls:       certificate && l.Addr().Network() == "tcp",
+			inherited: l,
+		})
+
+		switch name {
+		case "https":
+			if !certificate {
+				return fail(fmt.Errorf("socket %s from systemd takes --tls-cert or --acme-domains", name))
+			}
+			addrs[i].tls = true
+		case "http":
+			addrs[i].tls = false
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// socketFD returns a descriptor of a socket listening on a free port, the way
+// systemd passes them, and the address it listens on
+func socketFD(t *testing.T) (int, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(f.Fd()), l.Addr().String()
+}
+
+func TestInheritListeners(t *testing.T) {
+	fd, addr := socketFD(t)
+	addrs, err := inheritListeners("1", "", fd, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://"+addr, addrs[0].String())
+	addrs[0].inherited.Close()
+
+	fd, addr = socketFD(t)
+	addrs, err = inheritListeners("1", "http", fd, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "http://"+addr, addrs[0].String())
+
+	// The server takes over the socket
+	server := &http.Server{Handler: http.HandlerFunc(HandleIsAlive)}
+	serve, err := listen(server, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve()
+	defer server.Close()
+	res, err := http.Get("http://" + addr + "/isalive")
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, string(body))
+	}
+
+	fd, _ = socketFD(t)
+	_, err = inheritListeners("1", "https", fd, false)
+	assert.Error(t, err)
+	_, err = inheritListeners("none", "", listenFDsStart, false)
+	assert.Error(t, err)
+
+	// Descriptors of anything but listening sockets are refused
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = inheritListeners("1", "", int(f.Fd()), false)
+	assert.Error(t, err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	// Sockets passed to another process are left alone
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+	addrs, err := systemdListeners(false)
+	assert.NoError(t, err)
+	assert.Nil(t, addrs)
+	assert.Empty(t, os.Getenv("LISTEN_FDS"))
+
+	addrs, err = systemdListeners(false)
+	assert.NoError(t, err)
+	assert.Nil(t, addrs)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	urlBaseHeaderName = getEnv("TLS_URL_BASE", "x-tls-url-base")
+	// upstreamURLBase is the base URL of requests that bring neither a URL nor
+	// a base, see targetURL
+	upstreamURLBase = getEnv("TLS_UPSTREAM_URL_BASE", "")
+)
+
+// targetURL returns the URL the request is sent to: the URL header, or else the
+// path and query of the request appended to the base URL header or the default
+// base, so clients building URLs themselves can be pointed at the server
+func targetURL(r *fhttp.Request) (string, error) {
+	if target := r.Header.Get(urlHeaderName); target != "" {
+		return target, nil
+	}
+
+	base := r.Header.Get(urlBaseHeaderName)
+	if base == "" {
+		base = upstreamURLBase
+	}
+	if base == "" {
+		return "", fmt.Errorf(
+			"no valid request URL supplied via '%s' or '%s'; skipping request", urlHeaderName, urlBaseHeaderName,
+		)
+	}
+	return joinURL(base, r.URL)
+}
+
+// joinURL appends the path and query of the request to the base URL, as they
+// came escaped
+func joinURL(base string, request *url.URL) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid base URL '%s' supplied via '%s'", base, urlBaseHeaderName)
+	}
+
+	path := strings.TrimSuffix(u.EscapedPath(), "/") + request.EscapedPath()
+	var query []string
+	for _, q := range []string{u.RawQuery, request.RawQuery} {
+		if q != "" {
+			query = append(query, q)
+		}
+	}
+
+	u.Path, u.RawPath, u.RawQuery = "", "", ""
+	target := u.String() + path
+	if len(query) > 0 {
+		target += "?" + strings.Join(query, "&")
+	}
+	return target, nil
+}
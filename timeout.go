@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptrace"
+)
+
+var (
+	connectTimeoutHeaderName   = getEnv("TLS_CONNECT_TIMEOUT", "x-tls-connect-timeout")
+	handshakeTimeoutHeaderName = getEnv("TLS_HANDSHAKE_TIMEOUT", "x-tls-handshake-timeout")
+	headerTimeoutHeaderName    = getEnv("TLS_HEADER_TIMEOUT", "x-tls-header-timeout")
+)
+
+// defaultTimeout is the timeout of requests that do not set one
+var defaultTimeout = newSetting(getEnvSeconds("TLS_UPSTREAM_TIMEOUT", 30))
+
+var (
+	errConnectTimeout   = errors.New("connect timeout")
+	errHandshakeTimeout = errors.New("TLS handshake timeout")
+	errHeaderTimeout    = errors.New("response header timeout")
+)
+
+// parseTimeout parses a timeout header value, in seconds when it is a number,
+// fractions included, or a duration with its unit, e.g. "250ms" or "1.5s".
+// Empty values are zero.
+func parseTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if seconds, numErr := strconv.ParseFloat(value, 64); numErr == nil {
+		d, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("'%s' is not a duration", value)
+	}
+	return d, nil
+}
+
+// timeouts bound the phases of a request. total covers the whole request
+// until the response head arrived, redirects included, the others one phase
+// of it: connecting to the upstream or the proxy, the TLS handshake, and
+// waiting for the response head once the request was sent. Zero phases are
+// only bounded by the total.
+type timeouts struct {
+	total, connect, handshake, header time.Duration
+}
+
+// parseTimeouts parses the timeout headers of the request, the total defaults
+// to defaultTimeout
+func parseTimeouts(headers fhttp.Header) (t timeouts, err error) {
+	for _, phase := range []struct {
+		name string
+		d    *time.Duration
+	}{
+		{timeoutHeaderName, &t.total},
+		{connectTimeoutHeaderName, &t.connect},
+		{handshakeTimeoutHeaderName, &t.handshake},
+		{headerTimeoutHeaderName, &t.header},
+	} {
+		if *phase.d, err = parseTimeout(headers.Get(phase.name)); err != nil {
+			return timeouts{}, fmt.Errorf("invalid '%s': %w", phase.name, err)
+		}
+	}
+	if t.total == 0 {
+		t.total = defaultTimeout.get()
+	}
+	return t, nil
+}
+
+type timeoutsKey struct{}
+
+// withTimeouts returns ctx carrying the phase timeouts, for the connections
+// dialed for the request, which is cancelled once the upstream takes longer
+// than the header timeout to answer any of its requests, redirects included
+func withTimeouts(ctx context.Context, t timeouts) context.Context {
+	ctx = context.WithValue(ctx, timeoutsKey{}, t)
+	if t.header <= 0 {
+		return ctx
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	var mu sync.Mutex
+	var timer *time.Timer
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(t.header, func() { cancel(errHeaderTimeout) })
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+				timer = nil
+			}
+		},
+	})
+}
+
+// requestTimeouts returns the timeouts ctx carries, zero when it has none
+func requestTimeouts(ctx context.Context) timeouts {
+	if ctx == nil {
+		return timeouts{}
+	}
+	t, _ := ctx.Value(timeoutsKey{}).(timeouts)
+	return t
+}
+
+// timeoutCause returns the timeout the request failed on when a phase of it
+// timed out, err otherwise. The transports fail with the error of the context.
+func timeoutCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errHeaderTimeout) {
+		return cause
+	}
+	return err
+}
+
+// isPhaseTimeout reports whether a connection the session dialed itself timed
+// out in a phase with its own timeout
+func isPhaseTimeout(err error) bool {
+	return errors.Is(err, errConnectTimeout) || errors.Is(err, errHandshakeTimeout)
+}
+
+// hookTimeouts makes the connections azuretls dials itself use the connect
+// timeout of the request, see dialTLS for the others. azuretls keeps the
+// timeout of a connection once set, it is set for every new one.
+func hookTimeouts(s *azuretls.Session) {
+	preHook := s.PreHookWithContext
+	s.PreHookWithContext = func(ctx *azuretls.Context) error {
+		if u, err := url.Parse(ctx.Request.Url); err == nil {
+			if conn := s.Connections.Get(u); conn.Conn == nil {
+				// Zero gets the timeout of the request
+				conn.TimeOut = requestTimeouts(ctx.Request.Context()).connect
+			}
+		}
+		if preHook != nil {
+			return preHook(ctx)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	start := time.Now()
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-header-timeout": "100ms"})
+	assert.Equal(t, http.StatusGatewayTimeout, w.statusCode)
+	assert.Equal(t, "ERR_TIMEOUT", w.sent.Get("x-tls-error"))
+	assert.Contains(t, w.body.String(), "response header timeout")
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+
+	// The total is as fine-grained
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-timeout": "0.1"})
+	assert.Equal(t, http.StatusGatewayTimeout, w.statusCode)
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-header-timeout": "1s"})
+	assert.Equal(t, http.StatusOK, w.statusCode)
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-header-timeout": "soon"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// Connections are accepted and never answered
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	w := proxyRequest(t, map[string]string{"x-tls-url": "https://" + l.Addr().String(), "x-tls-handshake-timeout": "100ms"})
+	assert.Equal(t, http.StatusGatewayTimeout, w.statusCode)
+	assert.Equal(t, "ERR_TIMEOUT", w.sent.Get("x-tls-error"))
+	assert.Contains(t, w.body.String(), "TLS handshake timeout")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, true},
+		{"30", 30 * time.Second, true},
+		{"0.25", 250 * time.Millisecond, true},
+		{"1500ms", 1500 * time.Millisecond, true},
+		{" 2s ", 2 * time.Second, true},
+		{"-1", 0, false},
+		{"fast", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeout(tt.value)
+		assert.Equal(t, tt.ok, err == nil, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
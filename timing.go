@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptrace"
+	"time"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var timingHeaderName = getEnv("TLS_TIMING", "x-tls-timing")
+
+// requestTiming breaks down where the time of a request went. The dialing
+// phases add up the connections the session opened itself for the request,
+// they stay zero for reused ones. Sessions serve a request at a time, it is
+// reset for every request.
+type requestTiming struct {
+	start time.Time
+	// dns, connect and tls are the time spent resolving the host, connecting to
+	// it or the proxy, tunnel included, and doing the TLS handshake
+	dns, connect, tls time.Duration
+	// ttfb and total are the time until the response head arrived and until the
+	// body was read, from the start of the request
+	ttfb, total time.Duration
+}
+
+// reset starts timing the next request
+func (t *requestTiming) reset() {
+	*t = requestTiming{start: time.Now()}
+}
+
+// dialTrace returns the trace accounting for the DNS lookups of a dial
+func (t *requestTiming) dialTrace() *httptrace.ClientTrace {
+	var lookup time.Time
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { lookup = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.dns += time.Since(lookup) },
+	}
+}
+
+// String formats the durations for the timing response header, in
+// milliseconds. The total is left out until it is known.
+func (t *requestTiming) String() string {
+	s := fmt.Sprintf(
+		"dns=%d;connect=%d;tls=%d;ttfb=%d",
+		t.dns.Milliseconds(), t.connect.Milliseconds(), t.tls.Milliseconds(), t.ttfb.Milliseconds(),
+	)
+	if t.total > 0 {
+		s += fmt.Sprintf(";total=%d", t.total.Milliseconds())
+	}
+	return s
+}
+
+// set sends the timing to the caller, with the total once the body was read,
+// as a header when the status has not been written yet and as a trailer
+// otherwise
+func (t *requestTiming) set(w fhttp.ResponseWriter, done, headerWritten bool) {
+	if done {
+		t.total = time.Since(t.start)
+	}
+	if headerWritten {
+		w.Header().Set(fhttp.TrailerPrefix+timingHeaderName, t.String())
+	} else {
+		w.Header().Set(timingHeaderName, t.String())
+	}
+}
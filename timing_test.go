@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// timingOf parses the durations of a timing header, in milliseconds
+func timingOf(t *testing.T, value string) map[string]int {
+	durations := map[string]int{}
+	for _, part := range strings.Split(value, ";") {
+		name, ms, _ := strings.Cut(part, "=")
+		n, err := strconv.Atoi(ms)
+		if err != nil {
+			t.Fatalf("invalid timing '%s'", value)
+		}
+		durations[name] = n
+	}
+	return durations
+}
+
+func TestTiming(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-timing": "1", "x-tls-buffer": "1"})
+	timing := timingOf(t, w.sent.Get("x-tls-timing"))
+	for _, phase := range []string{"dns", "connect", "tls", "ttfb", "total"} {
+		assert.Contains(t, timing, phase)
+	}
+	assert.GreaterOrEqual(t, timing["ttfb"], 50)
+	assert.GreaterOrEqual(t, timing["total"], timing["ttfb"]+50)
+
+	// streams only know the total once they are done, it comes as a trailer
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-timing": "1"})
+	assert.Equal(t, "ok", w.body.String())
+	timing = timingOf(t, w.sent.Get("x-tls-timing"))
+	assert.NotContains(t, timing, "total")
+	assert.GreaterOrEqual(t, timing["ttfb"], 50)
+	trailer := timingOf(t, w.headers.Get(http.TrailerPrefix+"x-tls-timing"))
+	assert.GreaterOrEqual(t, trailer["total"], timing["ttfb"]+50)
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL})
+	assert.Empty(t, w.sent.Get("x-tls-timing"))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var (
+	// upstreamKeepAlive keeps upstream connections open between requests, off
+	// closes them after every response
+	upstreamKeepAlive = isTrue(getEnv("TLS_UPSTREAM_KEEP_ALIVE", "1"))
+	// Idle upstream connections are closed after this long, 0 keeps them open
+	upstreamIdleConnTimeout = getEnvSeconds("TLS_UPSTREAM_IDLE_CONN_TIMEOUT", 90)
+	// At most this many idle HTTP/1.1 connections are kept per upstream host
+	upstreamMaxIdleConnsPerHost = getEnvInt("TLS_UPSTREAM_MAX_IDLE_CONNS_PER_HOST", fhttp.DefaultMaxIdleConnsPerHost)
+	// Bodies of requests sent with 'Expect: 100-continue' are held back this
+	// long for the upstream to accept or reject them, 0 sends them right away
+	upstreamExpectContinueTimeout = getEnvSeconds("TLS_UPSTREAM_EXPECT_CONTINUE_TIMEOUT", 1)
+)
+
+// tuneTransport applies the upstream connection settings to the transports of
+// the session. azuretls creates them on the first request unless the profile
+// has an HTTP/2 fingerprint, so the HTTP/1.1 one is created here the same way.
+// The heads of the HTTP/1.1 responses are captured in heads.
+func tuneTransport(s *azuretls.Session, heads *rawHeads) {
+	if s.Transport == nil {
+		s.Transport = &fhttp.Transport{
+			TLSHandshakeTimeout:   s.TimeOut,
+			ResponseHeaderTimeout: s.TimeOut,
+		}
+	}
+	// The connections are dialed by the session, see azuretls' initHTTP1. The
+	// dialers of a transport azuretls created for the HTTP/2 fingerprint are
+	// replaced too, so the heads are captured all the same.
+	s.Transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return recordHeads(s.Connections.Get(&url.URL{Host: addr}).TLS, heads), nil
+	}
+	s.Transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return recordHeads(s.Connections.Get(&url.URL{Host: addr}).Conn, heads), nil
+	}
+	s.Transport.DisableKeepAlives = !upstreamKeepAlive
+	s.Transport.IdleConnTimeout = upstreamIdleConnTimeout
+	s.Transport.MaxIdleConnsPerHost = upstreamMaxIdleConnsPerHost
+	// The HTTP/2 transport waits as long. The caller is only asked for the body,
+	// with its own 100 Continue, once the upstream wants it.
+	s.Transport.ExpectContinueTimeout = upstreamExpectContinueTimeout
+	// The transport asks for the proxy of every request right before writing it,
+	// its last chance to learn the length of the body, see withBodyLength.
+	// azuretls dials the proxies itself.
+	s.Transport.Proxy = func(req *fhttp.Request) (*url.URL, error) {
+		if length, ok := req.Context().Value(bodyLengthKey{}).(int64); ok && req.ContentLength == 0 {
+			req.ContentLength = length
+		}
+		return nil, nil
+	}
+
+	tuneHTTP2 := func() {
+		if s.HTTP2Transport != nil {
+			s.HTTP2Transport.IdleConnTimeout = upstreamIdleConnTimeout
+		}
+	}
+	tuneHTTP2()
+
+	// Otherwise the HTTP/2 transport only exists once the first request set it up
+	preHook := s.PreHookWithContext
+	s.PreHookWithContext = func(ctx *azuretls.Context) error {
+		tuneHTTP2()
+		if preHook != nil {
+			return preHook(ctx)
+		}
+		return nil
+	}
+}
+
+type bodyLengthKey struct{}
+
+// withBodyLength returns ctx carrying the length of the request body, azuretls
+// sends bodies it gets as readers without one so they go out chunked. Bodies of
+// unknown length are left that way.
+func withBodyLength(ctx context.Context, length int64) context.Context {
+	if length <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, bodyLengthKey{}, length)
+}
+
+// setDecompression makes the transports of the session decode the bodies of
+// the responses, or pass them on as they came. Sessions serve a request at a
+// time, it is set for every request.
+func setDecompression(s *azuretls.Session, decompress bool) {
+	if s.Transport != nil {
+		s.Transport.DisableCompression = !decompress
+	}
+	if s.HTTP2Transport != nil {
+		s.HTTP2Transport.DisableCompression = !decompress
+	}
+}
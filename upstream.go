@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	fhttp "github.com/Noooste/fhttp"
+)
+
+var upstreamWarningHeaderName = getEnv("TLS_UPSTREAM_WARNING", "x-tls-upstream-warning")
+
+// Warnings of the upstream warning header, stable for callers to match on.
+// What exactly was wrong is logged, and in the body of failed requests.
+const (
+	warningMalformedResponse    = "malformed-response"
+	warningPrematureClose       = "premature-close"
+	warningInvalidHeader        = "invalid-header"
+	warningInvalidContentLength = "invalid-content-length"
+)
+
+// Error messages produced by the transports when the upstream response itself is
+// invalid, as opposed to the connection or the proxy failing
+var malformedResponseErrors = []string{
+	"malformed",
+	"invalid header",
+	"invalid byte in chunk length",
+	"bad chunk",
+	"chunked line",
+	"PROTOCOL_ERROR",
+	"http2: invalid",
+	"server sent GOAWAY",
+}
+
+// upstreamWarning tells how the upstream misbehaved when err was caused by a
+// broken response, or returns an empty string for other errors
+func upstreamWarning(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	msg := err.Error()
+	if errors.Is(err, io.ErrUnexpectedEOF) || strings.Contains(msg, "unexpected EOF") {
+		return warningPrematureClose
+	}
+
+	for _, e := range malformedResponseErrors {
+		if strings.Contains(msg, e) {
+			return warningMalformedResponse
+		}
+	}
+
+	return ""
+}
+
+// setUpstreamWarning annotates the response with the warning for err, as a header
+// when the status has not been written yet, and as a trailer otherwise
+func setUpstreamWarning(w fhttp.ResponseWriter, err error, headerWritten bool) bool {
+	warning := upstreamWarning(err)
+	if warning == "" {
+		return false
+	}
+
+	if headerWritten {
+		w.Header().Set(fhttp.TrailerPrefix+upstreamWarningHeaderName, warning)
+	} else {
+		// Along with the repairs of the head, if any
+		w.Header().Add(upstreamWarningHeaderName, warning)
+	}
+
+	return true
+}
+
+// headRepair is a change made to a response head for the transport to take it
+type headRepair struct {
+	warning string
+	// detail tells what was changed, for the logs
+	detail string
+}
+
+// repairHead leaves out the lines of an HTTP/1.x response head the transport
+// refuses the whole response for: header lines with control bytes or without a
+// colon, and Content-Length headers that are invalid or disagree, the body is
+// then read until the connection closes. Repeated lengths are merged.
+func repairHead(head []byte) ([]byte, []headRepair) {
+	lines := bytes.Split(head, []byte("\n"))
+	kept := [][]byte{lines[0]}
+	var repairs []headRepair
+	var lengths []string
+	at := -1
+	for _, line := range lines[1:] {
+		field := strings.TrimSuffix(string(line), "\r")
+		name, value, ok := strings.Cut(field, ":")
+		folded := field != "" && (field[0] == ' ' || field[0] == '\t')
+		if !folded && (!ok || strings.TrimSpace(name) == "") || hasControlBytes(field) {
+			repairs = append(repairs, headRepair{warningInvalidHeader, fmt.Sprintf("left out header line %q", field)})
+			continue
+		}
+		if !folded && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			// The lengths are put back where the first one was
+			if at < 0 {
+				at = len(kept)
+				kept = append(kept, line)
+			}
+			for _, length := range strings.Split(value, ",") {
+				lengths = append(lengths, strings.TrimSpace(length))
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if at >= 0 {
+		_, err := strconv.ParseUint(lengths[0], 10, 63)
+		valid := err == nil
+		for _, other := range lengths[1:] {
+			valid = valid && other == lengths[0]
+		}
+		switch {
+		case !valid:
+			repairs = append(repairs, headRepair{warningInvalidContentLength, fmt.Sprintf("left out Content-Length %q", lengths)})
+			kept = slices.Delete(kept, at, at+1)
+		case len(lengths) > 1:
+			repairs = append(repairs, headRepair{warningInvalidContentLength, fmt.Sprintf("merged Content-Length %q", lengths)})
+			kept[at] = []byte("Content-Length: " + lengths[0] + "\r")
+		}
+	}
+
+	if repairs == nil {
+		return head, nil
+	}
+	return bytes.Join(kept, []byte("\n")), repairs
+}
+
+// hasControlBytes reports whether the header line has control bytes other
+// than tabs
+func hasControlBytes(line string) bool {
+	return strings.ContainsFunc(line, func(r rune) bool {
+		return r < ' ' && r != '\t' || r == 0x7f
+	})
+}
+
+// warnRepairs annotates the response with the warnings of the repairs made to
+// its head, each once, and logs what was repaired
+func warnRepairs(w fhttp.ResponseWriter, r *fhttp.Request, repairs []headRepair) {
+	var warnings []string
+	for _, repair := range repairs {
+		slog.WarnContext(r.Context(), "Repaired upstream response", "warning", repair.warning, "detail", repair.detail)
+		if !slices.Contains(warnings, repair.warning) {
+			warnings = append(warnings, repair.warning)
+			w.Header().Add(upstreamWarningHeaderName, repair.warning)
+		}
+	}
+}
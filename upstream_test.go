@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// rawServer answers every connection with the given raw bytes and closes it
+func rawServer(t *testing.T, response string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				conn.Write([]byte(response))
+			}()
+		}
+	}()
+
+	return "http://" + l.Addr().String()
+}
+
+func proxyRequest(t *testing.T, headers map[string]string) *mockResponseWriter {
+	r, err := http.NewRequest(http.MethodGet, "/", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+
+	w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+	HandleReq(w, r)
+
+	return w
+}
+
+func TestMalformedUpstreamResponse(t *testing.T) {
+	url := rawServer(t, "this is not http\r\n\r\n")
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url})
+
+	assert.Equal(t, http.StatusBadGateway, w.statusCode)
+	assert.Equal(t, "malformed-response", w.headers.Get("x-tls-upstream-warning"))
+	// What the transport made of it is in the body
+	assert.Contains(t, w.body.String(), "malformed HTTP status code")
+}
+
+func TestPrematureUpstreamClose(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1"})
+
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "premature-close", w.headers.Get("x-tls-upstream-warning"))
+	assert.Empty(t, w.headers.Get("Content-Length"))
+	assert.Equal(t, "partial", w.body.String())
+}
+
+func TestRepairedUpstreamResponse(t *testing.T) {
+	tests := []struct {
+		head, warning, body string
+	}{
+		{"X-Bad\x01: 1\r\nX-Null: a\x00b\r\nno colon\r\nX-Kept: 1\r\nContent-Length: 2\r\n", "invalid-header", "ok"},
+		{"X-Kept: 1\r\nContent-Length: 2x\r\n", "invalid-content-length", "okEXTRA"},
+		{"Content-Length: 2\r\nX-Kept: 1\r\nContent-Length: 7\r\n", "invalid-content-length", "okEXTRA"},
+		{"Content-Length: 2, 2\r\nX-Kept: 1\r\n", "invalid-content-length", "ok"},
+		{"X-Kept: 1\r\nContent-Length: 2\r\n", "", "ok"},
+	}
+	for _, tt := range tests {
+		url := rawServer(t, "HTTP/1.1 200 OK\r\n"+tt.head+"\r\nokEXTRA")
+		for _, buffer := range []string{"0", "1"} {
+			w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": buffer})
+
+			assert.Equal(t, http.StatusOK, w.statusCode, tt.head)
+			assert.Equal(t, tt.warning, w.sent.Get("x-tls-upstream-warning"), tt.head)
+			assert.Equal(t, "1", w.sent.Get("X-Kept"), tt.head)
+			assert.Equal(t, tt.body, w.body.String(), tt.head)
+		}
+	}
+}
+
+func TestMultiValueResponseHeaders(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 200 OK\r\n"+
+		"Set-Cookie: a=1; Path=/\r\nSet-Cookie: b=2; Path=/\r\n"+
+		"Link: </style.css>; rel=preload\r\nLink: </app.js>; rel=preload\r\n"+
+		"Content-Length: 2\r\n\r\nok")
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1"})
+
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Path=/"}, w.sent.Values("Set-Cookie"))
+	assert.Equal(t, []string{"</style.css>; rel=preload", "</app.js>; rel=preload"}, w.sent.Values("Link"))
+}
+
+func TestResponseHeadersAndTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Upstream", "1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+
+	for _, buffer := range []string{"0", "1"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-buffer": buffer})
+
+		assert.Equal(t, http.StatusCreated, w.statusCode)
+		assert.Equal(t, "ok", w.body.String())
+		// headers are set before the status, trailers once the body is through
+		assert.Equal(t, "1", w.sent.Get("X-Upstream"), buffer)
+		assert.Equal(t, "abc", w.headers.Get(http.TrailerPrefix+"X-Checksum"), buffer)
+	}
+}
+
+func TestPreserveResponseHeaders(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"x-lower: 1\r\nX-UPPER: 2\r\nset-cookie: a=1\r\nSet-Cookie: b=2\r\n"+
+		"content-type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"2\r\nok\r\n0\r\n\r\n")
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1", "x-tls-preserve-headers": "1"})
+
+	assert.Equal(t, "ok", w.body.String())
+	assert.Equal(t, []string{"1"}, w.sent["x-lower"])
+	assert.Equal(t, []string{"2"}, w.sent["X-UPPER"])
+	assert.Equal(t, []string{"a=1"}, w.sent["set-cookie"])
+	assert.Equal(t, []string{"b=2"}, w.sent["Set-Cookie"])
+	// The server frames the response with these, they keep their canonical names
+	assert.Equal(t, []string{"text/plain"}, w.sent["Content-Type"])
+	assert.Equal(t, []string{"x-lower", "x-upper", "set-cookie", "content-type"}, w.sent[http.HeaderOrderKey])
+	assert.Equal(t, "x-lower, X-UPPER, set-cookie, content-type", w.sent.Get("x-tls-header-order"))
+
+	w = proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1"})
+
+	assert.Equal(t, []string{"1"}, w.sent["X-Lower"])
+	assert.Empty(t, w.sent.Get("x-tls-header-order"))
+}
+
+func TestParseHead(t *testing.T) {
+	head := "HTTP/1.1 200 OK\r\nX-Folded: a\r\n  b\nx-bare-lf:  c \r\n\r\nbody"
+
+	end, rest := headEnd([]byte(head))
+	assert.Equal(t, "body", head[rest:])
+
+	status, fields := parseHead([]byte(head[:end]))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, []headerField{{"X-Folded", "a b"}, {"x-bare-lf", "c"}}, fields)
+
+	end, _ = headEnd([]byte("HTTP/1.1 200 OK\r\nX-Partial: 1\r\n"))
+	assert.Equal(t, -1, end)
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	url := rawServer(t, "HTTP/1.1 200 OK\r\n"+
+		"Connection: close, X-Hop\r\nX-Hop: 1\r\nKeep-Alive: timeout=5\r\nProxy-Authenticate: Basic\r\n"+
+		"X-End: 1\r\nContent-Length: 2\r\n\r\nok")
+
+	for _, preserve := range []string{"0", "1"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1", "x-tls-preserve-headers": preserve})
+
+		assert.Equal(t, "ok", w.body.String())
+		assert.Equal(t, "1", w.sent.Get("X-End"), preserve)
+		for _, h := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+			assert.Empty(t, w.sent.Get(h), preserve)
+		}
+	}
+
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer upstream.Close()
+
+	proxyRequest(t, map[string]string{
+		"x-tls-url":           upstream.URL,
+		"Connection":          "X-Secret",
+		"X-Secret":            "1",
+		"Keep-Alive":          "timeout=5",
+		"Upgrade":             "websocket",
+		"Proxy-Authorization": "Basic Zm9vOmJhcg==",
+		"X-Kept":              "1",
+	})
+
+	header := <-received
+	assert.Equal(t, "1", header.Get("X-Kept"))
+	for _, h := range []string{"X-Secret", "Keep-Alive", "Upgrade", "Proxy-Authorization"} {
+		assert.Empty(t, header.Get(h), h)
+	}
+}
+
+func TestBufferedContentLength(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(strings.Repeat("decoded ", 100)))
+	gz.Close()
+
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: "+strconv.Itoa(gzipped.Len())+"\r\n\r\n"+gzipped.String())
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1"})
+
+	assert.Equal(t, 800, w.body.Len())
+	assert.Equal(t, []string{"800"}, w.sent.Values("Content-Length"))
+	assert.Empty(t, w.sent.Get("Content-Encoding"))
+}
+
+func TestRawEncoding(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(strings.Repeat("encoded ", 100)))
+	gz.Close()
+
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: "+strconv.Itoa(gzipped.Len())+"\r\n\r\n"+gzipped.String())
+
+	for _, buffer := range []string{"0", "1"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": buffer, "x-tls-raw-encoding": "1"})
+
+		assert.Equal(t, gzipped.Bytes(), w.body.Bytes(), buffer)
+		assert.Equal(t, "gzip", w.sent.Get("Content-Encoding"), buffer)
+		assert.Equal(t, strconv.Itoa(gzipped.Len()), w.sent.Get("Content-Length"), buffer)
+	}
+}
+
+func TestPreserveResponseHeadersKeepAlive(t *testing.T) {
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["x-MiXed"] = []string{"1"}
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	trustServer(t, upstream)
+
+	// The second request goes over the connection the first one left idle
+	for i := 0; i < 2; i++ {
+		w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-alpn": "http/1.1", "x-tls-preserve-headers": "1"})
+
+		assert.Equal(t, "ok", w.body.String())
+		assert.Equal(t, []string{"1"}, w.sent["x-MiXed"], i)
+	}
+	assert.Equal(t, int32(1), conns.Load())
+}
+
+func TestGzipToCaller(t *testing.T) {
+	page := strings.Repeat("<p>decoded</p>", 100)
+	url := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(page))+"\r\n\r\n"+page)
+
+	for _, buffer := range []string{"0", "1"} {
+		w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": buffer, "Accept-Encoding": "br, gzip"})
+
+		assert.Equal(t, "gzip", w.sent.Get("Content-Encoding"), buffer)
+		assert.Equal(t, "Accept-Encoding", w.sent.Get("Vary"), buffer)
+		gz, err := gzip.NewReader(bytes.NewReader(w.body.Bytes()))
+		if assert.NoError(t, err, buffer) {
+			body, _ := io.ReadAll(gz)
+			assert.Equal(t, page, string(body), buffer)
+		}
+		if buffer == "1" {
+			assert.Equal(t, strconv.Itoa(w.body.Len()), w.sent.Get("Content-Length"))
+		} else {
+			assert.Empty(t, w.sent.Get("Content-Length"))
+		}
+	}
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": url, "x-tls-buffer": "1", "Accept-Encoding": "gzip;q=0, br"})
+	assert.Empty(t, w.sent.Get("Content-Encoding"))
+	assert.Equal(t, page, w.body.String())
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	assert.True(t, acceptsGzip("gzip"))
+	assert.True(t, acceptsGzip("deflate, GZIP;q=0.5"))
+	assert.True(t, acceptsGzip("*"))
+	assert.False(t, acceptsGzip(""))
+	assert.False(t, acceptsGzip("br, zstd"))
+	assert.False(t, acceptsGzip("gzip;q=0"))
+}
+
+// uploadBody is a request body recording whether it was read
+type uploadBody struct {
+	body io.Reader
+	read atomic.Bool
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.body.Read(p)
+}
+
+func TestExpectContinue(t *testing.T) {
+	var accept atomic.Bool
+	received := make(chan string, 1)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if !accept.Load() {
+					received <- req.Header.Get("Expect")
+					conn.Write([]byte("HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+				body, _ := io.ReadAll(req.Body)
+				received <- string(body)
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			}()
+		}
+	}()
+
+	upload := func() (*mockResponseWriter, *uploadBody) {
+		body := &uploadBody{body: strings.NewReader("upload")}
+		r, err := http.NewRequest(http.MethodPost, "/", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("x-tls-url", "http://"+l.Addr().String())
+		r.Header.Set("x-tls-buffer", "1")
+		r.Header.Set("Expect", "100-continue")
+
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+		return w, body
+	}
+
+	// A rejected upload is never read from the caller
+	w, body := upload()
+	assert.Equal(t, http.StatusExpectationFailed, w.statusCode)
+	assert.Equal(t, "100-continue", <-received)
+	assert.False(t, body.read.Load())
+
+	accept.Store(true)
+	w, body = upload()
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, "upload", <-received)
+	assert.True(t, body.read.Load())
+}
+
+func TestBodylessResponses(t *testing.T) {
+	tests := []struct {
+		method, response, length string
+	}{
+		{http.MethodHead, "HTTP/1.1 200 OK\r\nContent-Length: 42\r\n\r\n", "42"},
+		{http.MethodHead, "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: 42\r\n\r\n", ""},
+		// The body the caller has is the one the server gzipped
+		{http.MethodGet, "HTTP/1.1 304 Not Modified\r\nContent-Length: 42\r\n\r\n", ""},
+		{http.MethodGet, "HTTP/1.1 204 No Content\r\nContent-Length: 0\r\n\r\n", ""},
+	}
+	for _, tt := range tests {
+		url := rawServer(t, tt.response)
+		for _, buffer := range []string{"0", "1"} {
+			r, err := http.NewRequest(tt.method, "/", http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("x-tls-url", url)
+			r.Header.Set("x-tls-buffer", buffer)
+			r.Header.Set("Accept-Encoding", "gzip")
+
+			w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+			HandleReq(w, r)
+
+			assert.Zero(t, w.body.Len(), tt.response)
+			assert.Equal(t, tt.length, w.sent.Get("Content-Length"), tt.response)
+			assert.Empty(t, w.sent.Get("Content-Encoding"), tt.response)
+		}
+	}
+}
+
+func TestCallerDisconnect(t *testing.T) {
+	for name, response := range map[string]string{
+		"head":   "",
+		"stream": "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial",
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		// The upstream answers with the response if any and stalls until the
+		// connection is closed
+		closed := make(chan struct{})
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			http.ReadRequest(reader)
+			conn.Write([]byte(response))
+			io.Copy(io.Discard, reader)
+			close(closed)
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("x-tls-url", "http://"+l.Addr().String())
+		r.Header.Set("x-tls-timeout", "30")
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		done := make(chan struct{})
+		go func() {
+			HandleReq(NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0), r)
+			close(done)
+		}()
+
+		for what, ch := range map[string]chan struct{}{"request": done, "upstream connection": closed} {
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: %s not cancelled with the caller", name, what)
+			}
+		}
+	}
+}
+
+// zeros is an endless request body of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestStreamedUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads over a gigabyte")
+	}
+	const size = 1<<30 + 1<<20
+
+	type upload struct {
+		length   int64
+		chunked  bool
+		received int64
+	}
+	received := make(chan upload, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		received <- upload{r.ContentLength, chunked, n}
+	}))
+	defer upstream.Close()
+
+	for _, length := range []int64{size, -1} {
+		r, err := http.NewRequest(http.MethodPut, "/", io.LimitReader(zeros{}, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ContentLength = length
+		r.Header.Set("x-tls-url", upstream.URL)
+		r.Header.Set("x-tls-buffer", "1")
+		r.Header.Set("x-tls-timeout", "120")
+
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+
+		runtime.ReadMemStats(&after)
+		assert.Equal(t, http.StatusOK, w.statusCode)
+		got := <-received
+		assert.Equal(t, int64(size), got.received)
+		// Bodies of unknown length go out chunked, the others with their length
+		assert.Equal(t, length, got.length)
+		assert.Equal(t, length < 0, got.chunked)
+		// The body is never held in memory
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(64<<20))
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	// Part headers in an unusual order and case, and a boundary a multipart
+	// writer would not pick
+	const boundary = "----formdata-odd_Boundary'1"
+	body := "--" + boundary + "\r\n" +
+		"content-type: text/plain\r\n" +
+		"Content-Disposition: form-data; name=\"b\"\r\n\r\n" +
+		"second\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"a\"; filename=\"a.bin\"\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: binary\r\n\r\n" +
+		"\x00\x01\r\n\x02\r\n" +
+		"--" + boundary + "--\r\n"
+	contentType := "multipart/form-data; boundary=\"" + boundary + "\""
+
+	type received struct{ contentType, body string }
+	uploads := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		uploads <- received{r.Header.Get("Content-Type"), string(b)}
+	}))
+	defer upstream.Close()
+
+	upload := func(session string) {
+		r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("x-tls-url", upstream.URL)
+		r.Header.Set("x-tls-session-id", session)
+
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+
+		assert.Equal(t, http.StatusOK, w.statusCode)
+		assert.Equal(t, received{contentType, body}, <-uploads, session)
+	}
+	upload("")
+	upload("multipart")
+	defer sessions.terminate("multipart")
+
+	// A session sending JSON by default still forwards the caller's body type
+	w := sessionAPIRequest(t, http.MethodPut, "/api/sessions/multipart/headers", `{"headers": [["content-type", "application/json"]]}`)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	upload("multipart")
+}
+
+func TestCompressBody(t *testing.T) {
+	type received struct {
+		encoding string
+		chunked  bool
+		body     string
+	}
+	uploads := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = gz
+		}
+		b, _ := io.ReadAll(body)
+		uploads <- received{r.Header.Get("Content-Encoding"), r.ContentLength < 0, string(b)}
+	}))
+	defer upstream.Close()
+
+	upload := func(compress, encoding, body string) received {
+		r, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// As the server hands it over
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		r.Header.Set("Content-Encoding", encoding)
+		r.Header.Set("x-tls-url", upstream.URL)
+		r.Header.Set("x-tls-compress-body", compress)
+
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+		assert.Equal(t, http.StatusOK, w.statusCode)
+		return <-uploads
+	}
+
+	payload := strings.Repeat(`{"event":"click"}`, 1000)
+	assert.Equal(t, received{"gzip", true, payload}, upload("1", "", payload))
+	assert.Equal(t, received{"", false, payload}, upload("0", "", payload))
+	// Bodies encoded by the caller are not compressed again
+	assert.Equal(t, received{"br", false, "brotli"}, upload("1", "br", "brotli"))
+}
+
+func TestMethodOverride(t *testing.T) {
+	type received struct{ method, body string }
+	requests := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- received{r.Method, string(b)}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		method, override, body string
+		want                   received
+		response               string
+	}{
+		{http.MethodPost, "PATCH", "patch", received{http.MethodPatch, "patch"}, "ok"},
+		{http.MethodGet, "delete", "", received{http.MethodDelete, ""}, "ok"},
+		{http.MethodPost, "", "post", received{http.MethodPost, "post"}, "ok"},
+		// The upstream answering a HEAD request has no body to forward
+		{http.MethodPost, "HEAD", "", received{http.MethodHead, ""}, ""},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("x-tls-url", upstream.URL)
+		r.Header.Set("x-tls-method", tt.override)
+
+		w := NewMockResponseWriter(make(http.Header), &bytes.Buffer{}, 0)
+		HandleReq(w, r)
+
+		assert.Equal(t, http.StatusOK, w.statusCode, tt.override)
+		assert.Equal(t, tt.want, <-requests, tt.override)
+		assert.Equal(t, tt.response, w.body.String(), tt.override)
+	}
+
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "x-tls-method": "GET /"})
+	assert.Equal(t, http.StatusBadRequest, w.statusCode)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := strings.Repeat("cached", 100)
+	validators := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validators <- r.Header.Get("If-None-Match") + r.Header.Get("If-Modified-Since")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.ServeContent(w, r, "page.txt", modified, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	for _, conditional := range []map[string]string{
+		{"If-None-Match": `"v1"`},
+		{"If-Modified-Since": modified.Format(http.TimeFormat)},
+	} {
+		for _, buffer := range []string{"0", "1"} {
+			headers := map[string]string{"x-tls-url": upstream.URL, "x-tls-buffer": buffer}
+			for k, v := range conditional {
+				headers[k] = v
+			}
+			w := proxyRequest(t, headers)
+
+			assert.Equal(t, http.StatusNotModified, w.statusCode, conditional)
+			assert.NotEmpty(t, <-validators, conditional)
+			assert.Zero(t, w.body.Len(), conditional)
+			assert.Equal(t, `"v1"`, w.sent.Get("ETag"), conditional)
+			assert.Equal(t, "max-age=60", w.sent.Get("Cache-Control"), conditional)
+		}
+	}
+
+	// The body the caller revalidates was gzipped by the server
+	w := proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "If-None-Match": `"v1"`, "Accept-Encoding": "gzip"})
+	<-validators
+	assert.Equal(t, http.StatusNotModified, w.statusCode)
+	assert.Equal(t, "Accept-Encoding", w.sent.Get("Vary"))
+	assert.Empty(t, w.sent.Get("Content-Encoding"))
+
+	// Stale validators get the body
+	w = proxyRequest(t, map[string]string{"x-tls-url": upstream.URL, "If-None-Match": `"v0"`})
+	assert.Equal(t, `"v0"`, <-validators)
+	assert.Equal(t, http.StatusOK, w.statusCode)
+	assert.Equal(t, content, w.body.String())
+	assert.Equal(t, `"v1"`, w.sent.Get("ETag"))
+	assert.Equal(t, modified.Format(http.TimeFormat), w.sent.Get("Last-Modified"))
+}
+
+func TestValidMethod(t *testing.T) {
+	for _, method := range []string{"GET", "patch", "PROPFIND", "M-SEARCH"} {
+		assert.True(t, validMethod(method), method)
+	}
+	for _, method := range []string{"", "GET /", "GET\r\n", "(GET)"} {
+		assert.False(t, validMethod(method), method)
+	}
+}